@@ -0,0 +1,143 @@
+package enproxy
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// TunnelClosedIdle: the tunnel wasn't used for the Proxy's IdleTimeout.
+	// Since clients don't tell the Proxy when they close their Conns, this is
+	// how most tunnels end.
+	TunnelClosedIdle = "idle"
+
+	// TunnelClosedDestination: the destination server closed its connection
+	TunnelClosedDestination = "destination"
+
+	// TunnelClosedError: reading from or writing to the destination server
+	// failed
+	TunnelClosedError = "error"
+
+	// TunnelClosedUnestablished: the tunnel's first request wasn't received
+	// within the Proxy's EstablishTimeout
+	TunnelClosedUnestablished = "unestablished"
+
+	// TunnelClosedClient: the client closed the WebSocket carrying the tunnel
+	// (see Config.WebSocket)
+	TunnelClosedClient = "client"
+
+	// TunnelClosedEvicted: the tunnel was evicted to make room for a new one
+	// (see Proxy.MaxTunnels)
+	TunnelClosedEvicted = "evicted"
+
+	// TunnelClosedRequestTooLarge: a request carried more than the Proxy's
+	// MaxRequestBodyBytes
+	TunnelClosedRequestTooLarge = "request-too-large"
+)
+
+// AccessLogRecord describes a tunnel that a Proxy has closed, for use with
+// Proxy.OnTunnelClosed.
+type AccessLogRecord struct {
+	// Time: when the tunnel was opened
+	Time time.Time
+
+	// ID: the id of the client's Conn
+	ID string
+
+	// ClientAddr: ip address of the client that opened the tunnel
+	ClientAddr string
+
+	// Destination: the host:port of the destination server
+	Destination string
+
+	// BytesUp: number of bytes sent from the client to the destination server
+	BytesUp int64
+
+	// BytesDown: number of bytes sent from the destination server to the
+	// client
+	BytesDown int64
+
+	// Duration: how long the tunnel was open
+	Duration time.Duration
+
+	// CloseReason: why the tunnel was closed, one of TunnelClosedIdle,
+	// TunnelClosedDestination, TunnelClosedError, TunnelClosedUnestablished,
+	// TunnelClosedClient, TunnelClosedEvicted and TunnelClosedRequestTooLarge
+	CloseReason string
+}
+
+// String formats the record as a line in the style of an Apache access log,
+// e.g.
+//
+//	10.0.0.1 - - [02/Jan/2006:15:04:05 -0700] "TUNNEL example.com:443" 1024 65536 12.345s idle
+func (r *AccessLogRecord) String() string {
+	clientAddr := r.ClientAddr
+	if clientAddr == "" {
+		clientAddr = "-"
+	}
+	return fmt.Sprintf("%v - - [%v] \"TUNNEL %v\" %d %d %.3fs %v",
+		clientAddr,
+		r.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Destination,
+		r.BytesUp,
+		r.BytesDown,
+		r.Duration.Seconds(),
+		r.CloseReason)
+}
+
+// addBytesUp and addBytesDown count the bytes passing through the tunnel
+func (l *lazyConn) addBytesUp(n int64) {
+	atomic.AddInt64(&l.bytesUp, n)
+}
+
+func (l *lazyConn) addBytesDown(n int64) {
+	atomic.AddInt64(&l.bytesDown, n)
+}
+
+// setFailed records that the connection to the destination server failed
+func (l *lazyConn) setFailed() {
+	l.mutex.Lock()
+	l.failed = true
+	l.mutex.Unlock()
+}
+
+// tunnelClosed cancels the tunnel's context and calls OnTunnelClosed, if set,
+// once the tunnel has been closed
+func (p *Proxy) tunnelClosed(l *lazyConn) {
+	l.cancel()
+	if p.OnTunnelClosed == nil {
+		return
+	}
+	closeReason := TunnelClosedIdle
+	l.mutex.Lock()
+	if l.closed {
+		l.mutex.Unlock()
+		return
+	}
+	l.closed = true
+	if l.err == errTunnelEvicted {
+		closeReason = TunnelClosedEvicted
+	} else if l.err == errRequestBodyTooLarge {
+		closeReason = TunnelClosedRequestTooLarge
+	} else if !l.established {
+		closeReason = TunnelClosedUnestablished
+	} else if l.failed {
+		closeReason = TunnelClosedError
+	} else if l.hitEOF {
+		closeReason = TunnelClosedDestination
+	} else if l.clientClosed {
+		closeReason = TunnelClosedClient
+	}
+	l.mutex.Unlock()
+	p.OnTunnelClosed(&AccessLogRecord{
+		Time:        l.createdAt,
+		ID:          l.id,
+		ClientAddr:  l.clientAddr,
+		Destination: l.addr,
+		BytesUp:     atomic.LoadInt64(&l.bytesUp),
+		BytesDown:   atomic.LoadInt64(&l.bytesDown),
+		Duration:    time.Now().Sub(l.createdAt),
+		CloseReason: closeReason,
+	})
+}
@@ -0,0 +1,187 @@
+package enproxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+)
+
+const (
+	ENCODING_BASE64 = "base64"
+)
+
+// BodyEncoding determines how tunnel data is encoded in the bodies of requests
+// to the proxy and of the proxy's responses (see Config.BodyEncoding).
+type BodyEncoding int
+
+const (
+	// BodyEncodingRaw: bodies carry the tunnel data as is. This is the
+	// default.
+	BodyEncodingRaw BodyEncoding = iota
+
+	// BodyEncodingBase64: bodies carry the tunnel data encoded with standard
+	// base64, for intermediaries that corrupt or inspect binary bodies. This
+	// makes bodies about 33% bigger (4 bytes for every 3 bytes of data, plus
+	// padding for each piece of streamed data). Data is encoded as it's
+	// written and decoded as it's read, so streaming and flushing work as
+	// they do with raw bodies. If data is compressed (see CompressionDict),
+	// the compressed data is encoded.
+	BodyEncodingBase64
+)
+
+// encodeBase64 reads all of r and returns it encoded with base64
+func encodeBase64(r io.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	encoded := make([]byte, base64.StdEncoding.EncodedLen(buf.Len()))
+	base64.StdEncoding.Encode(encoded, buf.Bytes())
+	return encoded, nil
+}
+
+// base64Encoder is a reader of the base64 encoding of the data from r. Each
+// read from r is encoded (and padded) on its own right away, so that streamed
+// data isn't held back waiting for a complete group of 3 bytes.
+type base64Encoder struct {
+	r   io.Reader
+	buf []byte
+	// out: encoded data that hasn't been read yet
+	out []byte
+}
+
+func newBase64Encoder(r io.Reader) *base64Encoder {
+	return &base64Encoder{r: r}
+}
+
+func (e *base64Encoder) Read(b []byte) (int, error) {
+	if len(e.out) == 0 {
+		// Read as much as fits into b once encoded, but at least one group
+		size := len(b) / 4 * 3
+		if size < 3 {
+			size = 3
+		}
+		if cap(e.buf) < size {
+			e.buf = make([]byte, size)
+		}
+		n, err := e.r.Read(e.buf[:size])
+		if n == 0 {
+			return 0, err
+		}
+		encoded := base64.StdEncoding.EncodedLen(n)
+		if cap(e.out) < encoded {
+			e.out = make([]byte, encoded)
+		}
+		e.out = e.out[:encoded]
+		base64.StdEncoding.Encode(e.out, e.buf[:n])
+	}
+	n := copy(b, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+// base64Writer writes the base64 encoding of what's written to it to w. Like
+// base64Encoder, it encodes each write on its own so that it can be flushed
+// right away.
+type base64Writer struct {
+	w   io.Writer
+	buf []byte
+}
+
+func newBase64Writer(w io.Writer) *base64Writer {
+	return &base64Writer{w: w}
+}
+
+func (e *base64Writer) Write(b []byte) (int, error) {
+	encoded := base64.StdEncoding.EncodedLen(len(b))
+	if cap(e.buf) < encoded {
+		e.buf = make([]byte, encoded)
+	}
+	base64.StdEncoding.Encode(e.buf[:encoded], b)
+	if _, err := e.w.Write(e.buf[:encoded]); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// base64Decoder decodes the base64 data from r written by a base64Encoder or
+// base64Writer, which may have padding after any group of 4 bytes.
+type base64Decoder struct {
+	r io.Reader
+	// in: encoded data that hasn't been decoded yet because it's not a
+	// complete group
+	in  []byte
+	buf []byte
+	// out: decoded data that hasn't been read yet
+	out []byte
+	err error
+}
+
+func newBase64Decoder(r io.Reader) *base64Decoder {
+	return &base64Decoder{r: r}
+}
+
+func (d *base64Decoder) Read(b []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.err != nil {
+			if d.err == io.EOF && len(d.in) > 0 {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return 0, d.err
+		}
+		size := len(b)/3*4 + 4
+		if cap(d.buf) < size {
+			d.buf = make([]byte, size)
+		}
+		n, err := d.r.Read(d.buf[:size])
+		d.err = err
+		d.in = append(d.in, d.buf[:n]...)
+		if err := d.decode(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+// decode decodes the complete groups in in to out
+func (d *base64Decoder) decode() error {
+	complete := len(d.in) / 4 * 4
+	encoded := d.in[:complete]
+	if decodedLen := base64.StdEncoding.DecodedLen(complete); cap(d.out) < decodedLen {
+		d.out = make([]byte, 0, decodedLen)
+	}
+	d.out = d.out[:0]
+	for len(encoded) > 0 {
+		// Decode up to and including the next padded group
+		end := len(encoded)
+		if i := bytes.IndexByte(encoded, '='); i >= 0 {
+			end = (i/4 + 1) * 4
+		}
+		n, err := base64.StdEncoding.Decode(d.out[len(d.out):cap(d.out)], encoded[:end])
+		if err != nil {
+			d.err = err
+			return err
+		}
+		d.out = d.out[:len(d.out)+n]
+		encoded = encoded[end:]
+	}
+	d.in = append(d.in[:0], d.in[complete:]...)
+	return nil
+}
+
+// base64Body is a response body that decodes the wrapped base64 body
+type base64Body struct {
+	*base64Decoder
+	body io.ReadCloser
+}
+
+func newBase64Body(body io.ReadCloser) *base64Body {
+	return &base64Body{newBase64Decoder(body), body}
+}
+
+// Close closes the wrapped body
+func (b *base64Body) Close() error {
+	return b.body.Close()
+}
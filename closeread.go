@@ -0,0 +1,37 @@
+package enproxy
+
+import (
+	"time"
+)
+
+// CloseRead() implements the function from Conn
+func (c *conn) CloseRead() error {
+	c.readCloseOnce.Do(func() {
+		close(c.readClosedCh)
+		// Interrupt the poll that's in flight, if any. processReads sees that
+		// reading was closed and stops polling.
+		c.pollConnMutex.Lock()
+		pollConn := c.pollConn
+		c.pollConnMutex.Unlock()
+		if pollConn != nil {
+			pollConn.markClosed()
+			if err := pollConn.conn.SetReadDeadline(time.Now()); err != nil {
+				c.logger().Debugf("Unable to interrupt poll: %v", err)
+			}
+		}
+	})
+	return nil
+}
+
+// readClosed indicates whether CloseRead has been called
+func (c *conn) readClosed() bool {
+	return isClosed(c.readClosedCh)
+}
+
+// setPollConn records the proxyConn that processReads currently polls on, for
+// CloseRead to interrupt.
+func (c *conn) setPollConn(proxyConn *connInfo) {
+	c.pollConnMutex.Lock()
+	c.pollConn = proxyConn
+	c.pollConnMutex.Unlock()
+}
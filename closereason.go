@@ -0,0 +1,54 @@
+package enproxy
+
+import (
+	"sync/atomic"
+)
+
+// CloseReason indicates why a Conn was closed
+type CloseReason int32
+
+const (
+	// CloseReasonNone: the Conn hasn't been closed
+	CloseReasonNone CloseReason = iota
+
+	// CloseReasonApplication: the application called Close
+	CloseReasonApplication
+
+	// CloseReasonIdle: the Conn was idle for longer than Config.IdleTimeout
+	CloseReasonIdle
+
+	// CloseReasonError: a request to the proxy failed
+	CloseReasonError
+
+	// CloseReasonNoProgress: no data was read or written for longer than
+	// Config.ProgressTimeout
+	CloseReasonNoProgress
+)
+
+func (r CloseReason) String() string {
+	switch r {
+	case CloseReasonNone:
+		return "none"
+	case CloseReasonApplication:
+		return "application"
+	case CloseReasonIdle:
+		return "idle"
+	case CloseReasonError:
+		return "error"
+	case CloseReasonNoProgress:
+		return "no progress"
+	default:
+		return "unknown"
+	}
+}
+
+// CloseReason() implements the function from Conn
+func (c *conn) CloseReason() CloseReason {
+	return CloseReason(atomic.LoadInt32(&c.closeReason))
+}
+
+// setCloseReason records why this conn is being closed, unless a reason was
+// already recorded.
+func (c *conn) setCloseReason(reason CloseReason) {
+	atomic.CompareAndSwapInt32(&c.closeReason, int32(CloseReasonNone), int32(reason))
+}
@@ -0,0 +1,96 @@
+package enproxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+)
+
+// CloseWrite() implements the function from Conn
+func (c *conn) CloseWrite() error {
+	if c.ws != nil || (!c.negotiating() && !c.proxySupports(capCloseWrite)) {
+		return ErrNotSupported
+	}
+	first := false
+	c.writeCloseOnce.Do(func() {
+		close(c.writeClosedCh)
+		first = true
+	})
+	if !first {
+		return nil
+	}
+
+	// processWrites sends EOF after the data that's already been written
+	result := make(chan error, 1)
+	select {
+	case c.closeWriteCh <- result:
+	case <-c.closedCh:
+		return net.ErrClosed
+	}
+	select {
+	case err := <-result:
+		return err
+	case <-c.closedCh:
+		return net.ErrClosed
+	}
+}
+
+// writeClosed indicates whether CloseWrite has been called
+func (c *conn) writeClosed() bool {
+	return isClosed(c.writeClosedCh)
+}
+
+// sendWriteEOF sends an empty write request that tells the proxy that we're
+// done writing, and waits for it to finish.
+func (c *conn) sendWriteEOF() error {
+	success := c.submitRequest(&request{
+		body: &closer{bytes.NewReader(nil)},
+		eof:  true,
+	})
+	if !success {
+		return io.EOF
+	}
+	return <-c.requestFinishedCh
+}
+
+// closeWrite shuts down the writing side of the connection to the destination
+// server once the client is done writing (see Conn.CloseWrite). Reads from the
+// destination server continue.
+func (l *lazyConn) closeWrite() {
+	l.mutex.Lock()
+	l.clientEOF = true
+	upstream := l.upstream
+	l.mutex.Unlock()
+	if upstream == nil {
+		return
+	}
+	log.Debugf("Client of tunnel %v done writing to %v", l.id, l.addr)
+	if err := closeWrite(upstream); err != nil {
+		log.Debugf("Unable to close writing to %v: %v", l.addr, err)
+	}
+}
+
+// closeWrite shuts down the writing side of conn, if it supports that
+func closeWrite(conn net.Conn) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return ErrNotSupported
+}
+
+// CloseWrite flushes any buffered data before shutting down writing on the
+// wrapped conn.
+func (c *coalescingConn) CloseWrite() error {
+	c.mutex.Lock()
+	err := c.flush()
+	c.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return closeWrite(c.Conn)
+}
+
+// CloseWrite shuts down writing on the wrapped conn
+func (c *shapedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
@@ -0,0 +1,96 @@
+package enproxy
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// coalescingConn is a net.Conn that buffers small writes, flushing them to the
+// wrapped conn once size bytes have accumulated or once the oldest buffered
+// data has waited for maxDelay, whichever comes first.
+type coalescingConn struct {
+	net.Conn
+	size     int
+	maxDelay time.Duration
+	buf      []byte
+	timer    *time.Timer
+	err      error
+	mutex    sync.Mutex
+}
+
+func newCoalescingConn(conn net.Conn, size int, maxDelay time.Duration) *coalescingConn {
+	return &coalescingConn{
+		Conn:     conn,
+		size:     size,
+		maxDelay: maxDelay,
+		buf:      make([]byte, 0, size),
+	}
+}
+
+// Write() implements the function from net.Conn. Errors from writing buffered
+// data are returned by the next call to Write.
+func (c *coalescingConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.err != nil {
+		return 0, c.err
+	}
+	if len(c.buf)+len(b) > c.size {
+		if err := c.flush(); err != nil {
+			return 0, err
+		}
+		if len(b) >= c.size {
+			// Too big to buffer, write directly
+			return c.Conn.Write(b)
+		}
+	}
+
+	if len(c.buf) == 0 {
+		c.timer = time.AfterFunc(c.maxDelay, c.flushAfterDelay)
+	}
+	c.buf = append(c.buf, b...)
+	if len(c.buf) == c.size {
+		if err := c.flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (c *coalescingConn) flushAfterDelay() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.flush(); err != nil {
+		log.Debugf("Unable to flush buffered writes: %v", err)
+	}
+}
+
+// flush writes out any buffered data. It must be called with mutex held.
+func (c *coalescingConn) flush() error {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if len(c.buf) == 0 {
+		return c.err
+	}
+	_, err := c.Conn.Write(c.buf)
+	c.buf = c.buf[:0]
+	if err != nil {
+		c.err = err
+	}
+	return err
+}
+
+// Close() implements the function from net.Conn, flushing any buffered data
+// before closing the wrapped conn.
+func (c *coalescingConn) Close() error {
+	c.mutex.Lock()
+	if err := c.flush(); err != nil {
+		log.Debugf("Unable to flush buffered writes on close: %v", err)
+	}
+	c.mutex.Unlock()
+	return c.Conn.Close()
+}
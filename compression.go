@@ -0,0 +1,101 @@
+package enproxy
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+)
+
+const (
+	ENCODING_FLATE = "flate"
+)
+
+// dictID identifies a compression dictionary so that the client and proxy can
+// make sure that they're using the same one.
+func dictID(dict []byte) string {
+	sum := sha256.Sum256(dict)
+	return hex.EncodeToString(sum[:8])
+}
+
+// compressBuffered compresses all of r using the given dictionary.
+func compressBuffered(r io.Reader, dict []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	fw, err := flate.NewWriterDict(&buf, flate.DefaultCompression, dict)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(fw, r); err != nil {
+		return nil, err
+	}
+	if err := fw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// compressStreaming returns a reader of the compressed data from r. Whatever
+// is read from r is flushed to the returned reader right away, so that
+// streamed data isn't held back. Closing the returned reader stops the
+// compression.
+func compressStreaming(r io.Reader, dict []byte) *io.PipeReader {
+	pr, pw := io.Pipe()
+	go func() {
+		fw, err := flate.NewWriterDict(pw, flate.DefaultCompression, dict)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		b := make([]byte, 8192)
+		for {
+			n, err := r.Read(b)
+			if n > 0 {
+				if _, err := fw.Write(b[:n]); err != nil {
+					pw.CloseWithError(err)
+					return
+				}
+				if err := fw.Flush(); err != nil {
+					pw.CloseWithError(err)
+					return
+				}
+			}
+			if err == io.EOF {
+				pw.CloseWithError(fw.Close())
+				return
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+	}()
+	return pr
+}
+
+// decompressingBody is a response body that decompresses the wrapped body
+type decompressingBody struct {
+	io.ReadCloser
+	body io.ReadCloser
+}
+
+func newDecompressingBody(body io.ReadCloser, dict []byte) *decompressingBody {
+	return &decompressingBody{flate.NewReaderDict(body, dict), body}
+}
+
+// Close closes both the decompressor and the wrapped body
+func (db *decompressingBody) Close() error {
+	if err := db.ReadCloser.Close(); err != nil {
+		log.Debugf("Unable to close decompressor: %v", err)
+	}
+	return db.body.Close()
+}
+
+// compressionAccepted indicates whether the client that sent req accepts
+// responses compressed with our CompressionDict.
+func (p *Proxy) compressionAccepted(req *http.Request) bool {
+	return p.CompressionDict != nil &&
+		req.Header.Get(X_ENPROXY_ACCEPT_ENCODING) == ENCODING_FLATE &&
+		req.Header.Get(X_ENPROXY_DICT_ID) == dictID(p.CompressionDict)
+}
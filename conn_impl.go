@@ -2,11 +2,19 @@ package enproxy
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httputil"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"code.google.com/p/go-uuid/uuid"
 	"github.com/getlantern/idletiming"
@@ -19,46 +27,256 @@ import (
 //
 // config: configuration for this Conn
 func Dial(addr string, config *Config) (net.Conn, error) {
+	return dial(context.Background(), addr, config, nil)
+}
+
+// dial implements Dial, optionally using the given Dialer to pool connections
+// to the proxy. Retries of the dial (see Config.DialRetries) stop once ctx is
+// done.
+func dial(ctx context.Context, addr string, config *Config, dialer *Dialer) (net.Conn, error) {
 	c := &conn{
-		id:     uuid.NewRandom().String(),
-		addr:   addr,
-		config: config,
+		id:      uuid.NewRandom().String(),
+		addr:    addr,
+		config:  config,
+		dialer:  dialer,
+		dialCtx: ctx,
 	}
+	return c.start()
+}
 
-	c.initDefaults()
+// start opens a connection to the proxy and starts processing writes and reads
+// on this conn, returning the net.Conn to hand to the caller.
+func (c *conn) start() (net.Conn, error) {
+	// Work with our own copy so that defaults don't change the caller's Config
+	c.config = c.config.Clone()
+	c.config.initDefaults()
+	c.initEstablishment()
 	c.makeChannels()
 	c.initRequestStrategy()
+	if c.config.ReadBufferBytes > 0 {
+		c.readBuf = make([]byte, c.config.ReadBufferBytes)
+	}
+	if c.config.UseCookies {
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to create cookie jar: %s", err)
+		}
+		c.jar = jar
+	}
 
 	// Dial proxy
-	proxyConn, err := c.dialProxy()
+	c.dialStartedAt = time.Now()
+	proxyConn, err := c.dialProxyWithRetries()
 	if err != nil {
-		return nil, fmt.Errorf("Unable to dial proxy to %s: %s", addr, err)
+		err = fmt.Errorf("Unable to dial proxy to %s: %s", c.addr, err)
+		c.markReady(err)
+		return nil, err
+	}
+	c.proxyDialTime = time.Now().Sub(c.dialStartedAt)
+	if c.config.WebSocket {
+		c.ws, err = c.upgradeToWebSocket(proxyConn)
+		if err != nil {
+			c.logger().Debugf("Unable to upgrade to WebSocket, falling back to polling: %v", err)
+			proxyConn, err = c.redialProxyIfNecessary(proxyConn)
+			if err != nil {
+				err = fmt.Errorf("Unable to dial proxy to %s: %s", c.addr, err)
+				c.markReady(err)
+				return nil, err
+			}
+		}
+	}
+	if c.config.WaitForUpstream && c.ws == nil {
+		proxyConn, err = c.connectUpstream(proxyConn)
+		if err != nil {
+			c.markReady(err)
+			return nil, err
+		}
 	}
 
-	go c.processWrites()
-	go c.processReads()
-	go c.processRequests(proxyConn)
+	if c.config.WaitForUpstream || c.ws != nil {
+		c.markReady(nil)
+	}
+
+	if c.ws == nil {
+		go c.processWrites()
+		go c.processReads()
+		go c.processRequests(proxyConn)
+	}
 
 	increment(&open)
 
-	return idletiming.Conn(c, c.config.IdleTimeout, func() {
-		log.Debugf("Proxy connection to %s via %s idle for %v, closing", addr, proxyConn.conn.RemoteAddr(), c.config.IdleTimeout)
-		if err := c.Close(); err != nil {
-			log.Debugf("Unable to close connection: %v", err)
+	ic := &idleTimingConn{
+		conn: c,
+		idleConn: idletiming.Conn(c, c.config.IdleTimeout, func() {
+			c.logger().Debugf("Proxy connection to %s via %s idle for %v, closing", c.addr, proxyConn.conn.RemoteAddr(), c.getConfig().IdleTimeout)
+			if err := c.Close(); err != nil {
+				c.logger().Debugf("Unable to close connection: %v", err)
+			}
+		}),
+	}
+	if c.config.MaxIdleTime > 0 {
+		atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+		go ic.closeWhenIdle()
+	}
+	if c.config.ProgressTimeout > 0 {
+		atomic.StoreInt64(&c.lastProgress, time.Now().UnixNano())
+		go c.closeWithoutProgress()
+	}
+	if c.config.HeartbeatInterval > 0 && c.ws == nil {
+		go c.heartbeat()
+	}
+	return ic, nil
+}
+
+// writeStringBuffers: buffers used by WriteString
+var writeStringBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, bodySize)
+		return &buf
+	},
+}
+
+// idleTimingConn is the Conn returned by Dial. Reads, writes and closes go
+// through an IdleTimingConn so that they count as activity, all other methods
+// are served by the conn directly.
+type idleTimingConn struct {
+	*conn
+	idleConn *idletiming.IdleTimingConn
+}
+
+func (ic *idleTimingConn) Read(b []byte) (int, error) {
+	ic.beginCall()
+	defer ic.endCall()
+	n, err := ic.idleConn.Read(b)
+	ic.progressed(n)
+	return n, err
+}
+
+func (ic *idleTimingConn) Write(b []byte) (int, error) {
+	ic.beginCall()
+	defer ic.endCall()
+	n, err := ic.idleConn.Write(b)
+	ic.progressed(n)
+	return n, err
+}
+
+// beginCall and endCall track the application's Reads and Writes for
+// MaxIdleTime
+func (ic *idleTimingConn) beginCall() {
+	atomic.AddInt32(&ic.activeCalls, 1)
+}
+
+func (ic *idleTimingConn) endCall() {
+	atomic.StoreInt64(&ic.lastActive, time.Now().UnixNano())
+	atomic.AddInt32(&ic.activeCalls, -1)
+}
+
+// closeWhenIdle closes this Conn once the application hasn't used it for
+// MaxIdleTime.
+func (ic *idleTimingConn) closeWhenIdle() {
+	maxIdleTime := ic.getConfig().MaxIdleTime
+	timer := time.NewTimer(maxIdleTime)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ic.closedCh:
+			return
+		case <-timer.C:
+			idle := time.Now().Sub(time.Unix(0, atomic.LoadInt64(&ic.lastActive)))
+			if atomic.LoadInt32(&ic.activeCalls) == 0 && idle >= maxIdleTime {
+				ic.logger().Debugf("Connection to %s unused for %v, closing", ic.addr, idle)
+				ic.setCloseReason(CloseReasonIdle)
+				if err := ic.idleConn.Close(); err != nil {
+					ic.logger().Debugf("Unable to close connection: %v", err)
+				}
+				return
+			}
+			wait := maxIdleTime - idle
+			if wait <= 0 {
+				// Check again once the ongoing Read or Write has had time
+				// to finish
+				wait = maxIdleTime
+			}
+			timer.Reset(wait)
+		}
+	}
+}
+
+// progressed records a Read or Write of n bytes for ProgressTimeout
+func (c *conn) progressed(n int) {
+	if n > 0 && c.getConfig().ProgressTimeout > 0 {
+		atomic.StoreInt64(&c.lastProgress, time.Now().UnixNano())
+	}
+}
+
+// closeWithoutProgress fails this conn with ErrNoProgress once no data has
+// been read or written for ProgressTimeout.
+func (c *conn) closeWithoutProgress() {
+	progressTimeout := c.getConfig().ProgressTimeout
+	timer := time.NewTimer(progressTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-c.closedCh:
+			return
+		case <-timer.C:
+			stalled := time.Now().Sub(time.Unix(0, atomic.LoadInt64(&c.lastProgress)))
+			if stalled >= progressTimeout {
+				c.logger().Debugf("No progress on connection to %s for %v, closing", c.addr, stalled)
+				c.setCloseReason(CloseReasonNoProgress)
+				c.fail(ErrNoProgress)
+				return
+			}
+			timer.Reset(progressTimeout - stalled)
 		}
-		// Close the initial proxyConn just in case
-		if err := proxyConn.conn.Close(); err != nil {
-			log.Debugf("Unable to close proxy connection: %v", err)
+	}
+}
+
+// WriteString() implements the function from io.StringWriter. Rather than
+// converting the whole string to a []byte, it's written in pieces using a
+// pooled buffer. Like Write, it returns the number of bytes written.
+func (ic *idleTimingConn) WriteString(s string) (n int, err error) {
+	bufp := writeStringBuffers.Get().(*[]byte)
+	defer writeStringBuffers.Put(bufp)
+	buf := *bufp
+	for len(s) > 0 {
+		copied := copy(buf, s)
+		written, err := ic.Write(buf[:copied])
+		n += written
+		if err != nil {
+			return n, err
 		}
-	}), nil
+		s = s[copied:]
+	}
+	return n, nil
 }
 
-func (c *conn) initDefaults() {
-	if c.config.FlushTimeout == 0 {
-		c.config.FlushTimeout = defaultWriteFlushTimeout
+func (ic *idleTimingConn) Close() error {
+	ic.setCloseReason(CloseReasonApplication)
+	return ic.idleConn.Close()
+}
+
+func (config *Config) initDefaults() {
+	if config.FlushTimeout == 0 {
+		config.FlushTimeout = defaultWriteFlushTimeout
+	}
+	if config.IdleTimeout == 0 {
+		config.IdleTimeout = defaultIdleTimeoutClient
+	}
+	if config.MaxBufferedWriteBytes == 0 {
+		config.MaxBufferedWriteBytes = bodySize
+	}
+	if config.MaxBufferedReadBytes == 0 {
+		config.MaxBufferedReadBytes = defaultMaxBufferedReadBytes
+	}
+	if config.PollScheduler == nil {
+		config.PollScheduler = &FixedPollScheduler{}
+	}
+	if config.MaxRetryAfter == 0 {
+		config.MaxRetryAfter = defaultMaxRetryAfter
 	}
-	if c.config.IdleTimeout == 0 {
-		c.config.IdleTimeout = defaultIdleTimeoutClient
+	if config.HeartbeatTimeout == 0 {
+		config.HeartbeatTimeout = config.HeartbeatInterval
 	}
 }
 
@@ -81,6 +299,22 @@ func (c *conn) makeChannels() {
 	c.doneWritingCh = make(chan bool, 1)
 	c.doneReadingCh = make(chan bool, 1)
 	c.doneRequestingCh = make(chan bool, 1)
+
+	// Closed (never sent to) when the conn is closed, so that any number of
+	// goroutines can wait for it
+	c.closedCh = make(chan struct{})
+	c.readyCh = make(chan struct{})
+	c.readClosedCh = make(chan struct{})
+	c.writeClosedCh = make(chan struct{})
+	c.closeWriteCh = make(chan chan error)
+	c.uncorkCh = make(chan chan error)
+	c.readDeadline = newDeadline()
+	c.writeDeadline = newDeadline()
+	c.proxyConns = make(map[*connInfo]bool)
+
+	if c.config.MaxInFlightRequests > 0 {
+		c.inFlightSlots = make(chan struct{}, c.config.MaxInFlightRequests)
+	}
 }
 
 func (c *conn) initRequestStrategy() {
@@ -96,44 +330,405 @@ func (c *conn) initRequestStrategy() {
 }
 
 func (c *conn) dialProxy() (*connInfo, error) {
-	conn, err := c.config.DialProxy(c.addr)
+	if c.dialer != nil {
+		if proxyConn := c.dialer.get(); proxyConn != nil {
+			c.trackProxyConn(proxyConn)
+			c.getConfig().Trace.gotProxyConn(true)
+			return proxyConn, nil
+		}
+	}
+	c.getConfig().Trace.dialProxyStart()
+	var conn net.Conn
+	var err error
+	if frontends := c.getConfig().Frontends; frontends != nil {
+		conn, err = c.dialFrontend(frontends)
+	} else {
+		conn, err = c.getConfig().DialProxy(c.addr)
+	}
+	c.getConfig().Trace.dialProxyDone(err)
 	if err != nil {
-		msg := fmt.Errorf("Unable to dial proxy to %s: %s", c.addr, err)
-		log.Debug(msg)
+		msg := fmt.Errorf("Unable to dial proxy to %s: %w", c.addr, err)
+		c.logger().Debug(msg)
 		return nil, msg
 	}
+	c.setSocketBuffers(conn)
 	proxyConn := &connInfo{
-		bufReader: bufio.NewReader(conn),
+		raw:       conn,
+		bufReader: bufio.NewReaderSize(conn, c.getConfig().MaxBufferedReadBytes),
 	}
-	proxyConn.conn = idletiming.Conn(conn, c.config.IdleTimeout, func() {
+	proxyConn.conn = idletiming.Conn(conn, c.getConfig().IdleTimeout, func() {
 		// When the underlying connection times out, mark the connInfo closed
-		proxyConn.closedMutex.Lock()
-		defer proxyConn.closedMutex.Unlock()
-		proxyConn.closed = true
+		proxyConn.markClosed()
 	})
+	c.trackProxyConn(proxyConn)
+	c.getConfig().Trace.gotProxyConn(false)
 	return proxyConn, nil
 }
 
-func (c *conn) redialProxyIfNecessary(proxyConn *connInfo) (*connInfo, error) {
-	proxyConn.closedMutex.Lock()
-	defer proxyConn.closedMutex.Unlock()
-	if proxyConn.closed || proxyConn.conn.TimesOutIn() < oneSecond {
-		if err := proxyConn.conn.Close(); err != nil {
-			log.Debugf("Unable to close proxy connection: %v", err)
+// dialProxyWithRetries dials the proxy, retrying up to DialRetries times with
+// exponential backoff if that fails. It gives up early once dialCtx is done or
+// if the next retry wouldn't start before dialCtx's deadline, returning the
+// error from the last dial.
+func (c *conn) dialProxyWithRetries() (*connInfo, error) {
+	ctx := c.dialCtx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	wait := c.config.DialRetryBackoff
+	if wait <= 0 {
+		wait = defaultReconnectInitial
+	}
+	for retries := 0; ; retries++ {
+		proxyConn, err := c.dialProxy()
+		if err == nil || retries >= c.config.DialRetries {
+			return proxyConn, err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			return nil, err
+		}
+		c.logger().Debugf("Dialing proxy to %s failed, retrying in %v", c.addr, wait)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		}
+		wait *= 2
+		if wait > defaultReconnectMax {
+			wait = defaultReconnectMax
+		}
+	}
+}
+
+// setSocketBuffers applies ProxySocketReadBuffer and ProxySocketWriteBuffer to
+// the given connection to the proxy, if it supports them.
+func (c *conn) setSocketBuffers(conn net.Conn) {
+	if c.getConfig().ProxySocketReadBuffer > 0 {
+		if rb, ok := conn.(interface{ SetReadBuffer(int) error }); ok {
+			if err := rb.SetReadBuffer(c.getConfig().ProxySocketReadBuffer); err != nil {
+				c.logger().Debugf("Unable to set read buffer: %v", err)
+			}
 		}
+	}
+	if c.getConfig().ProxySocketWriteBuffer > 0 {
+		if wb, ok := conn.(interface{ SetWriteBuffer(int) error }); ok {
+			if err := wb.SetWriteBuffer(c.getConfig().ProxySocketWriteBuffer); err != nil {
+				c.logger().Debugf("Unable to set write buffer: %v", err)
+			}
+		}
+	}
+}
+
+func (c *conn) redialProxyIfNecessary(proxyConn *connInfo) (*connInfo, error) {
+	if proxyConn == nil {
+		// Previous dial failed
+		return c.dialProxy()
+	}
+	if !proxyConn.usable() {
+		c.closeProxyConn(proxyConn)
 		return c.dialProxy()
 	} else {
 		return proxyConn, nil
 	}
 }
 
+// connectUpstream has the proxy connect to the destination server, returning
+// an error if the proxy wasn't able to. The proxy responds to OP_CONNECT with a
+// 200 once it has connected, or a 502 if connecting failed.
+func (c *conn) connectUpstream(proxyConn *connInfo) (*connInfo, error) {
+	proxyConn, _, resp, err := c.doRequestFollowingRedirects(proxyConn, "", OP_CONNECT, nil)
+	if err != nil {
+		if proxyConn != nil {
+			c.closeProxyConn(proxyConn)
+		}
+		return nil, fmt.Errorf("Unable to connect to %s via proxy: %w", c.addr, err)
+	}
+	if err := resp.Body.Close(); err != nil {
+		c.logger().Debugf("Unable to close response body: %v", err)
+	}
+	if c.getConfig().ProbeKeepAlives && !c.keepAlivesDisabled() {
+		return c.probeKeepAlives(proxyConn)
+	}
+	return proxyConn, nil
+}
+
+// probeKeepAlives checks that the proxy correctly answers a second request on
+// proxyConn, over which it just answered OP_CONNECT, by connecting again
+// (which the proxy answers right away once connected). If it doesn't, keep
+// alives are disabled for this conn, and a new connection is returned in place
+// of proxyConn.
+func (c *conn) probeKeepAlives(proxyConn *connInfo) (*connInfo, error) {
+	var err error
+	if !proxyConn.usable() {
+		err = fmt.Errorf("Proxy closed the connection")
+	} else if buffered := proxyConn.bufReader.Buffered(); buffered > 0 {
+		err = fmt.Errorf("Proxy sent %d bytes after the response", buffered)
+	} else {
+		var resp *http.Response
+		resp, err = c.doRequest(proxyConn, "", OP_CONNECT, nil)
+		if err == nil {
+			if err := resp.Body.Close(); err != nil {
+				c.logger().Debugf("Unable to close response body: %v", err)
+			}
+			if proxyConn.usable() {
+				return proxyConn, nil
+			}
+			err = fmt.Errorf("Proxy closed the connection after the second response")
+		}
+	}
+	c.logger().Debugf("Proxy for %s can't handle several requests on one connection, disabling keep alives: %v", c.addr, err)
+	atomic.StoreInt32(&c.keepAlivesBroken, 1)
+	c.closeProxyConn(proxyConn)
+	return c.dialProxy()
+}
+
+// keepAlivesDisabled indicates whether each request to the proxy goes on a new
+// connection (see Config.DisableKeepAlives and Config.ProbeKeepAlives).
+func (c *conn) keepAlivesDisabled() bool {
+	return c.getConfig().DisableKeepAlives || atomic.LoadInt32(&c.keepAlivesBroken) == 1
+}
+
+// releaseProxyConn is called once a proxyConn is no longer needed by this
+// conn. If the conn was dialed with a Dialer, proxyConn is returned to the
+// Dialer's idle pool, otherwise it is closed. Only proxyConns that have no
+// outstanding request or response may be released.
+func (c *conn) releaseProxyConn(proxyConn *connInfo) {
+	if c.dialer == nil {
+		c.closeProxyConn(proxyConn)
+		return
+	}
+	c.untrackProxyConn(proxyConn)
+	// Close may have interrupted proxyConn in between requests, which doesn't
+	// keep it from being reused
+	if err := proxyConn.conn.SetDeadline(time.Time{}); err != nil {
+		c.logger().Debugf("Unable to clear deadline: %v", err)
+	}
+	c.dialer.put(proxyConn)
+}
+
+// closeProxyConn closes a proxyConn that's no longer needed by this conn.
+func (c *conn) closeProxyConn(proxyConn *connInfo) {
+	c.untrackProxyConn(proxyConn)
+	proxyConn.close()
+}
+
+// trackProxyConn remembers that this conn holds proxyConn, so that Close can
+// interrupt requests that are blocked on it.
+func (c *conn) trackProxyConn(proxyConn *connInfo) {
+	c.proxyConnsMutex.Lock()
+	c.proxyConns[proxyConn] = true
+	c.proxyConnsMutex.Unlock()
+}
+
+func (c *conn) untrackProxyConn(proxyConn *connInfo) {
+	c.proxyConnsMutex.Lock()
+	delete(c.proxyConns, proxyConn)
+	c.proxyConnsMutex.Unlock()
+}
+
+// UnderlyingConns() implements the function from Conn
+func (c *conn) UnderlyingConns() []net.Conn {
+	c.proxyConnsMutex.Lock()
+	defer c.proxyConnsMutex.Unlock()
+	conns := make([]net.Conn, 0, len(c.proxyConns))
+	for proxyConn := range c.proxyConns {
+		conns = append(conns, proxyConn.raw)
+	}
+	return conns
+}
+
+// interruptProxyConns interrupts any reads and writes that are blocked on proxy
+// connections held by this conn.
+func (c *conn) interruptProxyConns() {
+	c.proxyConnsMutex.Lock()
+	defer c.proxyConnsMutex.Unlock()
+	for proxyConn := range c.proxyConns {
+		if err := proxyConn.conn.SetDeadline(time.Now()); err != nil {
+			c.logger().Debugf("Unable to interrupt proxy connection: %v", err)
+		}
+	}
+}
+
+// closeProxyConns closes the proxyConns that this conn still holds once Close
+// has drained the requests on them.
+func (c *conn) closeProxyConns() {
+	c.proxyConnsMutex.Lock()
+	defer c.proxyConnsMutex.Unlock()
+	for proxyConn := range c.proxyConns {
+		delete(c.proxyConns, proxyConn)
+		proxyConn.close()
+	}
+}
+
+// logError logs err as an error, unless the conn is closed, in which case err
+// most likely comes from Close interrupting a request and is only of interest
+// for debugging.
+func (c *conn) logError(err error) {
+	if isClosed(c.closedCh) {
+		c.logger().Debug(err)
+		return
+	}
+	c.logger().Error(err)
+}
+
+// interruptedErr returns net.ErrClosed in place of err if the Conn has been
+// closed, since err then most likely comes from Close interrupting a request
+// to the proxy.
+func (c *conn) interruptedErr(err error) error {
+	if err != nil && err != io.EOF && isClosed(c.closedCh) {
+		return net.ErrClosed
+	}
+	return err
+}
+
+// usable indicates whether this connInfo can still be used for a new request.
+func (ci *connInfo) usable() bool {
+	ci.closedMutex.Lock()
+	defer ci.closedMutex.Unlock()
+	return !ci.closed && ci.conn.TimesOutIn() >= oneSecond
+}
+
+// markClosed marks this connInfo as no longer usable for new requests.
+func (ci *connInfo) markClosed() {
+	ci.closedMutex.Lock()
+	ci.closed = true
+	ci.closedMutex.Unlock()
+}
+
+// detach stops this connInfo from being used for requests and returns a
+// net.Conn for reading the connection raw. Reads from the returned net.Conn
+// first return whatever bufReader already read from the connection but wasn't
+// consumed yet, then read from the connection directly, so no bytes are lost
+// or reordered. After detaching, bufReader must no longer be used.
+func (ci *connInfo) detach() net.Conn {
+	ci.markClosed()
+	buffered := ci.bufReader.Buffered()
+	if buffered == 0 {
+		return ci.conn
+	}
+	// Peek can't fail for bytes that are already buffered
+	pending, _ := ci.bufReader.Peek(buffered)
+	return &detachedConn{ci.conn, append([]byte(nil), pending...)}
+}
+
+// detachedConn is a connection to the proxy that was read through a
+// bufio.Reader, with the bytes that the bufio.Reader had buffered
+type detachedConn struct {
+	net.Conn
+	pending []byte
+}
+
+func (dc *detachedConn) Read(b []byte) (int, error) {
+	if len(dc.pending) > 0 {
+		n := copy(b, dc.pending)
+		dc.pending = dc.pending[n:]
+		return n, nil
+	}
+	return dc.Conn.Read(b)
+}
+
+// markClosed marks proxyConn, which may be nil, as no longer usable
+func markClosed(proxyConn *connInfo) {
+	if proxyConn != nil {
+		proxyConn.markClosed()
+	}
+}
+
+// close closes the underlying connection to the proxy.
+func (ci *connInfo) close() {
+	ci.markClosed()
+	if err := ci.conn.Close(); err != nil {
+		log.Debugf("Unable to close proxy connection: %v", err)
+	}
+}
+
+// doRequestFollowingRedirects issues a request like doRequest, following up to
+// MaxRedirects redirects from the proxy by reissuing the request to the host
+// named in the redirect's Location. Requests that were rate-limited with a
+// Retry-After of up to MaxRetryAfter are reissued once the wait is over.
+// Requests with streamed bodies can't be reissued, so redirects and rate
+// limits of these are never retried. It returns the proxyConn and host to use
+// for subsequent requests.
+func (c *conn) doRequestFollowingRedirects(proxyConn *connInfo, host string, op string, request *request) (*connInfo, string, *http.Response, error) {
+	redirects := 0
+	for {
+		resp, err := c.doRequest(proxyConn, host, op, request)
+		switch e := err.(type) {
+		case *RedirectError:
+			if redirects >= c.getConfig().MaxRedirects || !request.rewind() {
+				return proxyConn, host, resp, err
+			}
+			redirects++
+			newHost, err := e.host(host)
+			if err != nil {
+				return proxyConn, host, nil, err
+			}
+			c.logger().Debugf("Following redirect from %v to %v", host, newHost)
+			host = newHost
+		case *RateLimitError:
+			if e.RetryAfter > c.getConfig().MaxRetryAfter || !request.rewind() {
+				return proxyConn, host, resp, err
+			}
+			c.logger().Debugf("Rate-limited by proxy, retrying %v request in %v", op, e.RetryAfter)
+		default:
+			return proxyConn, host, resp, err
+		}
+
+		proxyConn, err = c.redialProxyIfNecessary(proxyConn)
+		if err != nil {
+			return nil, host, nil, err
+		}
+	}
+}
+
 func (c *conn) doRequest(proxyConn *connInfo, host string, op string, request *request) (resp *http.Response, err error) {
 	var body io.Reader
+	length := 0
+	compressed := false
 	if request != nil {
 		body = request.body
+		length = request.length
+		if c.getConfig().CompressionDict != nil {
+			if length > 0 {
+				// Buffered, or a single write sent with Content-Length (see
+				// PreferContentLength), whose length is that of the
+				// compressed data
+				b, err := compressBuffered(body, c.getConfig().CompressionDict)
+				if err != nil {
+					return nil, fmt.Errorf("Unable to compress request to %s: %s", c.addr, err)
+				}
+				body = bytes.NewReader(b)
+				length = len(b)
+				compressed = true
+			} else if !c.getConfig().BufferRequests {
+				cr := compressStreaming(body, c.getConfig().CompressionDict)
+				defer func() {
+					// Stop compressing in case the request didn't consume
+					// the whole body
+					if err := cr.Close(); err != nil {
+						c.logger().Debugf("Unable to close compressed body: %v", err)
+					}
+				}()
+				body = cr
+				compressed = true
+			}
+		}
+		if c.getConfig().BodyEncoding == BodyEncodingBase64 {
+			if length > 0 {
+				b, err := encodeBase64(body)
+				if err != nil {
+					return nil, fmt.Errorf("Unable to encode request to %s: %s", c.addr, err)
+				}
+				body = bytes.NewReader(b)
+				length = len(b)
+			} else {
+				body = newBase64Encoder(body)
+			}
+		}
 	}
-	path := c.id + "/" + c.addr + "/" + op
-	req, err := c.config.NewRequest(host, path, "POST", body)
+	path := expandPathTemplate(c.getConfig().PathTemplate, c.id, c.addr, op)
+	req, err := c.newRequestFunc()(host, path, "POST", body)
 	if err != nil {
 		err = fmt.Errorf("Unable to construct request to %s via proxy %s: %s", c.addr, host, err)
 		return
@@ -144,50 +739,281 @@ func (c *conn) doRequest(proxyConn *connInfo, host string, op string, request *r
 	// Always send the address that we're trying to reach
 	//req.Header.Set(X_ENPROXY_DEST_ADDR, c.addr)
 	req.Header.Set("Content-type", "application/octet-stream")
-	if request != nil && request.length > 0 {
+	if c.jar != nil {
+		for _, cookie := range c.jar.Cookies(req.URL) {
+			req.AddCookie(cookie)
+		}
+	}
+	if op == OP_WRITE && request != nil && request.seq > 0 {
+		// Resent requests keep their sequence number, so that the proxy can
+		// discard them if it already has their bodies
+		req.Header.Set(X_ENPROXY_SEQ, strconv.FormatInt(request.seq, 10))
+	}
+	if op == OP_WRITE && request != nil && request.eof {
+		req.Header.Set(X_ENPROXY_EOF, "true")
+	}
+	if op == OP_READ && c.draining {
+		req.Header.Set(X_ENPROXY_NO_WAIT, "true")
+	}
+	if op == OP_HEARTBEAT {
+		req.Header.Set(X_ENPROXY_HEARTBEAT, strconv.FormatInt(atomic.LoadInt64(&c.heartbeats), 10))
+	}
+	if c.negotiating() {
+		// Only requests sent before the first response can be the one that
+		// creates the tunnel on the proxy
+		copyHeaders(req.Header, c.establishment)
+	} else if op != OP_HEARTBEAT && c.getConfig().ReplayEstablishment && proxyConn.tunnelID != c.id {
+		c.reEstablish(req.Header)
+	}
+	if c.resumed {
+		// Tell the proxy not to start a new tunnel if it no longer has ours
+		req.Header.Set(X_ENPROXY_RESUME, "true")
+	}
+	if c.getConfig().CompressionDict != nil {
+		req.Header.Set(X_ENPROXY_ACCEPT_ENCODING, ENCODING_FLATE)
+		req.Header.Set(X_ENPROXY_DICT_ID, dictID(c.getConfig().CompressionDict))
+		if compressed {
+			req.Header.Set(X_ENPROXY_ENCODING, ENCODING_FLATE)
+		}
+	}
+	if c.getConfig().BodyEncoding == BodyEncodingBase64 {
+		req.Header.Set(X_ENPROXY_BODY_ENCODING, ENCODING_BASE64)
+	}
+	if maxResponseBytes := c.maxResponseBytes(); maxResponseBytes > 0 {
+		req.Header.Set(X_ENPROXY_MAX_RESPONSE_BYTES, strconv.Itoa(maxResponseBytes))
+	}
+	if c.getConfig().MaxUpstreamReconnects > 0 {
+		req.Header.Set(X_ENPROXY_MAX_RECONNECTS, strconv.Itoa(c.getConfig().MaxUpstreamReconnects))
+	}
+	if receiveWindow := c.receiveWindow(); receiveWindow > 0 {
+		req.Header.Set(X_ENPROXY_RECEIVE_WINDOW, strconv.Itoa(receiveWindow))
+	}
+	if op == OP_READ {
+		// Tell the proxy what arrived, so that it can send the rest again if
+		// an earlier poll broke (see ReconnectBackoff)
+		req.Header.Set(X_ENPROXY_RECEIVED, strconv.FormatInt(atomic.LoadInt64(&c.bytesRead), 10))
+	}
+	if c.keepAlivesDisabled() {
+		req.Close = true
+	}
+	if length > 0 {
 		// Force identity encoding to appeas CDNs like Fastly that can't
 		// handle chunked encoding on requests
 		req.TransferEncoding = []string{"identity"}
-		req.ContentLength = int64(request.length)
+		req.ContentLength = int64(length)
 	} else {
 		req.ContentLength = 0
 	}
+	if request == nil && c.getConfig().EmptyBodyFraming == FrameEmptyChunked {
+		frameEmptyChunked(req)
+	}
 
+	if c.getConfig().OnRequest != nil {
+		c.getConfig().OnRequest(req)
+	}
+	if c.getConfig().MaxRequestHeaderBytes > 0 {
+		headerBytes := requestHeaderBytes(req)
+		if headerBytes > c.getConfig().MaxRequestHeaderBytes {
+			err = fmt.Errorf("Request headers to %s via proxy %s are %d bytes, more than the maximum of %d", c.addr, host, headerBytes, c.getConfig().MaxRequestHeaderBytes)
+			return
+		}
+	}
+
+	if err = c.waitForRateLimit(); err != nil {
+		return
+	}
+	if err = c.countRequest(op); err != nil {
+		return
+	}
+	if err = c.beginRequest(); err != nil {
+		return
+	}
+	defer c.endRequest()
 	err = req.Write(proxyConn.conn)
+	c.getConfig().Trace.wroteRequest(op, err)
 	if err != nil {
-		err = fmt.Errorf("Error sending request to %s via proxy %s: %s", c.addr, host, err)
+		err = fmt.Errorf("Error sending request to %s via proxy %s: %w", c.addr, host, err)
 		return
 	}
 
+	sentAt := time.Now()
+	if c.getConfig().ResponseHeaderTimeout > 0 {
+		if err := proxyConn.conn.SetReadDeadline(time.Now().Add(c.getConfig().ResponseHeaderTimeout)); err != nil {
+			c.logger().Debugf("Unable to set read deadline: %v", err)
+		}
+	}
+	if c.getConfig().Trace.tracesFirstResponseByte() {
+		if _, err := proxyConn.bufReader.Peek(1); err == nil {
+			c.getConfig().Trace.gotFirstResponseByte(op)
+		}
+	}
 	resp, err = http.ReadResponse(proxyConn.bufReader, req)
 	if err != nil {
-		err = fmt.Errorf("Error reading response from proxy: %s", err)
+		c.getConfig().Trace.gotResponse(op, 0, err)
+		err = fmt.Errorf("Error reading response from proxy: %w", err)
+		return
+	}
+	c.getConfig().Trace.gotResponse(op, resp.StatusCode, nil)
+	if c.getConfig().ValidateResponses && resp.StatusCode >= 200 && resp.StatusCode < 300 && resp.Header.Get(X_ENPROXY_ID) != c.id {
+		// Don't let anything about this response affect the conn, nor reuse
+		// the connection that whoever sent it intercepts
+		proxyConn.markClosed()
+		err = unexpectedResponse(resp)
+		resp = nil
 		return
 	}
+	if c.jar != nil {
+		if cookies := resp.Cookies(); len(cookies) > 0 {
+			c.jar.SetCookies(req.URL, cookies)
+		}
+	}
+	c.recordResponse(op, resp, time.Now().Sub(sentAt))
+	c.recordMaxBodyBytes(resp.Header)
+	if c.getConfig().ResponseHeaderTimeout > 0 {
+		if err := proxyConn.conn.SetReadDeadline(time.Time{}); err != nil {
+			c.logger().Debugf("Unable to clear read deadline: %v", err)
+		}
+	}
+
+	if resp.Close || c.keepAlivesDisabled() {
+		// Proxy will close the connection after this response, don't reuse it
+		proxyConn.markClosed()
+	}
 
 	// Check response status
 	responseOK := resp.StatusCode >= 200 && resp.StatusCode < 300
-	if !responseOK {
+	location := resp.Header.Get("Location")
+	if isRedirect(resp.StatusCode) && location != "" {
+		// Don't treat the body of the redirect (e.g. a maintenance page) as
+		// tunneled data.
+		err = &RedirectError{StatusCode: resp.StatusCode, Location: location}
+		if err := resp.Body.Close(); err != nil {
+			c.logger().Debugf("Unable to close response body: %v", err)
+		}
+		resp = nil
+	} else if retryAfter, ok := retryAfterOf(resp); ok {
+		c.rateLimit(retryAfter)
+		err = &RateLimitError{StatusCode: resp.StatusCode, RetryAfter: retryAfter}
+		if err := resp.Body.Close(); err != nil {
+			c.logger().Debugf("Unable to close response body: %v", err)
+		}
+		resp = nil
+	} else if resp.StatusCode == http.StatusGone {
+		err = fmt.Errorf("%w (%s)", ErrTunnelNotFound, resp.Status)
+		if err := resp.Body.Close(); err != nil {
+			c.logger().Debugf("Unable to close response body: %v", err)
+		}
+		resp = nil
+	} else if !responseOK {
 		// This means we're getting something other than an OK response from the fronting provider
 		// itself, which is odd. Try to log the entire response for easier debugging.
 		full, er := httputil.DumpResponse(resp, true)
 		if er == nil {
 			err = fmt.Errorf("Bad response status for read from fronting provider: %s", string(full))
 		} else {
-			log.Errorf("Could not dump response: %v", er)
+			c.logger().Errorf("Could not dump response: %v", er)
 			err = fmt.Errorf("Bad response status for read from fronting provider: %s", resp.Status)
 		}
 		if err := resp.Body.Close(); err != nil {
-			log.Debugf("Unable to close response body: %v", err)
+			c.logger().Debugf("Unable to close response body: %v", err)
 		}
 		resp = nil
 	} else {
-		log.Debugf("Got OK from fronting provider")
+		c.logger().Debugf("Got OK from fronting provider")
+		c.recordProxyVersion(resp.Header)
+		if op != OP_HEARTBEAT {
+			// The proxy knows our tunnel, requests on this connection don't
+			// have to re-establish it
+			proxyConn.tunnelID = c.id
+		}
+		if resp.ContentLength > 0 {
+			resp.Body = c.newFramedBody(resp.Body, proxyConn, resp.ContentLength)
+		}
+		if timeout := c.getConfig().BodyReadTimeout; timeout > 0 {
+			resp.Body = &timedBody{ReadCloser: resp.Body, proxyConn: proxyConn, timeout: timeout}
+		}
+		if resp.Header.Get(X_ENPROXY_BODY_ENCODING) == ENCODING_BASE64 {
+			resp.Body = newBase64Body(resp.Body)
+		}
+		if resp.Header.Get(X_ENPROXY_ENCODING) == ENCODING_FLATE {
+			resp.Body = newDecompressingBody(resp.Body, c.getConfig().CompressionDict)
+		}
 	}
 
 	return
 }
 
+// unexpectedResponse returns an UnexpectedResponseError for resp, which didn't
+// come from the proxy, and closes its body.
+func unexpectedResponse(resp *http.Response) error {
+	snippet, _ := ioutil.ReadAll(io.LimitReader(resp.Body, int64(unexpectedResponseSnippetBytes)))
+	if err := resp.Body.Close(); err != nil {
+		log.Debugf("Unable to close response body: %v", err)
+	}
+	return &UnexpectedResponseError{
+		StatusCode:  resp.StatusCode,
+		ContentType: resp.Header.Get("Content-Type"),
+		Snippet:     snippet,
+	}
+}
+
+// beginRequest waits until a request may be sent according to
+// MaxInFlightRequests and counts it as in flight. It fails with net.ErrClosed
+// if the conn is closed while waiting.
+func (c *conn) beginRequest() error {
+	if c.inFlightSlots != nil {
+		select {
+		case c.inFlightSlots <- struct{}{}:
+		case <-c.closedCh:
+			return net.ErrClosed
+		}
+	}
+	atomic.AddInt64(&c.inFlightRequests, 1)
+	return nil
+}
+
+// endRequest is called once the response headers to a request started with
+// beginRequest have been received, or the request failed.
+func (c *conn) endRequest() {
+	atomic.AddInt64(&c.inFlightRequests, -1)
+	if c.inFlightSlots != nil {
+		<-c.inFlightSlots
+	}
+}
+
+// InFlightRequests() implements the function from Conn
+func (c *conn) InFlightRequests() int {
+	return int(atomic.LoadInt64(&c.inFlightRequests))
+}
+
+// requestHeaderBytes returns the size of the given request's headers as
+// written by http.Header.Write.
+func requestHeaderBytes(req *http.Request) int {
+	var cw countingWriter
+	if err := req.Header.Write(&cw); err != nil {
+		log.Debugf("Unable to measure request headers: %v", err)
+	}
+	return cw.n
+}
+
+// countingWriter is an io.Writer that just counts the bytes written to it
+type countingWriter struct {
+	n int
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	cw.n += len(b)
+	return len(b), nil
+}
+
+func isRedirect(statusCode int) bool {
+	switch statusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
 type closer struct {
 	io.Reader
 }
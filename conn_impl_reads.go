@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"sync/atomic"
+	"time"
 )
 
 // processReads processes read requests by polling the proxy with GET requests
@@ -14,6 +16,9 @@ func (c *conn) processReads() {
 	var resp *http.Response
 	var proxyConn *connInfo
 	var err error
+	// reusable: whether proxyConn is in a clean state (no failed request and
+	// no partially read response) at the time that processReads() exits
+	reusable := false
 
 	defer func() {
 		increment(&readingFinishing)
@@ -21,15 +26,19 @@ func (c *conn) processReads() {
 		// or it will continuously receives data until hit EOF,
 		// which is a waste of bandwidth.
 		if proxyConn != nil {
-			if err := proxyConn.conn.Close(); err != nil {
-				log.Debugf("Unable to close proxy connection: %v", err)
+			if reusable && resp == nil {
+				c.releaseProxyConn(proxyConn)
+			} else {
+				c.closeProxyConn(proxyConn)
 			}
 		}
 		if resp != nil {
 			if err := resp.Body.Close(); err != nil {
-				log.Debugf("Unable to close response body: %v", err)
+				c.logger().Debugf("Unable to close response body: %v", err)
 			}
 		}
+		c.setPollConn(nil)
+		atomic.StoreInt64(&c.bufferedReadBytes, 0)
 		c.doneReadingCh <- true
 		decrement(&readingFinishing)
 		decrement(&reading)
@@ -45,58 +54,290 @@ func (c *conn) processReads() {
 	proxyHost := initialResponse.proxyHost
 	proxyConn = initialResponse.proxyConn
 	resp = initialResponse.resp
+	c.setPollConn(proxyConn)
+	atomic.StoreInt32(&c.readsStarted, 1)
+	// hitEOFUpstream: whether resp indicates EOF from the destination server.
+	// Looked up once per response since looking up headers allocates.
+	hitEOFUpstream := resp.Header.Get(X_ENPROXY_EOF) == "true"
 
 	mkerror := func(text string, err error) error {
-		return fmt.Errorf("Dest: %s    ProxyHost: %s    %s: %s", c.addr, proxyHost, text, err)
+		return fmt.Errorf("Dest: %s    ProxyHost: %s    %s: %w", c.addr, proxyHost, text, err)
+	}
+
+	// reorderer: puts responses in order. The first response always comes
+	// first, but tells it where the numbering starts.
+	reorderer := &responseReorderer{c: c}
+	if _, err := reorderer.order(resp); err != nil {
+		c.logger().Debugf("Unable to order first response: %v", err)
 	}
 
+	// retrier: retries polls according to ReconnectBackoff. resumable:
+	// whether the proxy would send the rest of resp again if it broke (see
+	// resumeResponse), which it doesn't for the first response since that
+	// one answers a write.
+	retrier := &pollRetrier{backoff: &c.getConfig().ReconnectBackoff}
+	resumable := false
+
+	// Poll scheduling
+	pollStart := time.Now()
+	pollBytes := 0
+	emptyPolls := 0
+	var nextPollAt time.Time
+	// moreWaiting: whether the last response that finished said that the
+	// proxy has more data waiting
+	moreWaiting := false
+	// respArrived: whether resp can be read without waiting for the
+	// destination server, because it was held by reorderer or answers a poll
+	// that asked the proxy not to wait
+	respArrived := false
+
 	for b := range c.readRequestsCh {
-		if resp == nil {
-			// Old response finished
-			proxyConn, err = c.redialProxyIfNecessary(proxyConn)
-			if err != nil {
-				c.readResponsesCh <- rwResponse{0, mkerror("Unable to redial proxy", err)}
-				return
+		if c.readClosed() {
+			// Whatever is left of resp is discarded with proxyConn on exit
+			c.answerClosedReads()
+			return
+		}
+		if len(b) == 0 {
+			c.readResponsesCh <- rwResponse{0, nil}
+			continue
+		}
+
+		// Keep polling until we have data to return, so that Read never
+		// returns (0, nil)
+		polled := false
+		// filled: how much of b has been filled. If a response ends while
+		// the proxy has more data waiting, the next one is polled right away
+		// and read into the rest of b, so that a big Read isn't limited to
+		// a single response.
+		filled := 0
+		// availableOnly: whether this is a ReadAvailable, which only takes
+		// data that it doesn't have to wait for
+		availableOnly := atomic.LoadInt32(&c.readingAvailable) == 1
+		for {
+			if resp == nil {
+				// Responses that arrived ahead of their turn are read before
+				// polling again
+				if resp = reorderer.take(); resp != nil {
+					hitEOFUpstream = resp.Header.Get(X_ENPROXY_EOF) == "true"
+					resumable, err = resumeResponse(resp, atomic.LoadInt64(&c.bytesRead))
+					if err != nil {
+						err = mkerror("Unable to read response", err)
+						c.readFailed(err)
+						c.readResponsesCh <- rwResponse{filled, err}
+						return
+					}
+					respArrived = true
+				}
+			}
+			if resp == nil && availableOnly && !(moreWaiting && c.proxySupports(capNoWait)) {
+				// Nothing is waiting for us
+				c.readResponsesCh <- rwResponse{filled, nil}
+				break
 			}
+			if resp == nil {
+				// Old response finished
+				polled = true
+				if wait := nextPollAt.Sub(time.Now()); wait > 0 {
+					timer := time.NewTimer(wait)
+					select {
+					case <-timer.C:
+					case <-c.closedCh:
+						timer.Stop()
+						c.readResponsesCh <- rwResponse{filled, io.EOF}
+						return
+					case <-c.readClosedCh:
+						timer.Stop()
+						c.answerClosedReads()
+						return
+					}
+				}
+				pollStart = time.Now()
+				pollBytes = 0
 
-			resp, err = c.doRequest(proxyConn, proxyHost, OP_READ, nil)
-			if err != nil {
-				err = mkerror("Unable to issue read request", err)
-				log.Error(err)
-				c.readResponsesCh <- rwResponse{0, err}
-				return
+				proxyConn, err = c.redialProxyIfNecessary(proxyConn)
+				c.setPollConn(proxyConn)
+				if c.readClosed() {
+					// Checked after setPollConn, so that CloseRead either
+					// interrupts the poll or we don't start it
+					c.answerClosedReads()
+					return
+				}
+				if err != nil {
+					if retrier.retry(err, c.closedCh) {
+						continue
+					}
+					err = mkerror("Unable to redial proxy", err)
+					c.readFailed(err)
+					c.readResponsesCh <- rwResponse{filled, err}
+					return
+				}
+
+				c.draining = filled > 0 || availableOnly
+				proxyConn, proxyHost, resp, err = c.doRequestFollowingRedirects(proxyConn, proxyHost, OP_READ, nil)
+				if err == nil {
+					resp, err = reorderer.order(resp)
+				}
+				if c.readClosed() {
+					c.answerClosedReads()
+					return
+				}
+				if err != nil {
+					if retrier.retry(err, c.closedCh) {
+						markClosed(proxyConn)
+						continue
+					}
+					err = mkerror("Unable to issue read request", err)
+					c.logError(err)
+					c.readFailed(err)
+					c.readResponsesCh <- rwResponse{filled, err}
+					return
+				}
+				if resp == nil {
+					// Not its turn, poll for the one that is
+					nextPollAt = time.Time{}
+					continue
+				}
+				hitEOFUpstream = resp.Header.Get(X_ENPROXY_EOF) == "true"
+				resumable, err = resumeResponse(resp, atomic.LoadInt64(&c.bytesRead))
+				if err != nil {
+					err = mkerror("Unable to read response", err)
+					c.readFailed(err)
+					c.readResponsesCh <- rwResponse{filled, err}
+					return
+				}
+				respArrived = c.draining
 			}
-		}
 
-		n, err := resp.Body.Read(b)
+			if availableOnly && !respArrived && proxyConn.bufReader.Buffered() == 0 {
+				// Nothing more of the current response has arrived
+				c.readResponsesCh <- rwResponse{filled, nil}
+				break
+			}
 
-		hitEOFUpstream := resp.Header.Get(X_ENPROXY_EOF) == "true"
-		errToClient := err
-		if err == io.EOF && !hitEOFUpstream {
-			// The current response hit EOF, but we haven't hit EOF upstream
-			// so suppress EOF to reader
-			errToClient = nil
-		}
-		c.readResponsesCh <- rwResponse{n, errToClient}
+			n, err := resp.Body.Read(b[filled:])
+			atomic.AddInt64(&c.bytesRead, int64(n))
+			pollBytes += n
+			filled += n
+			atomic.StoreInt64(&c.bufferedReadBytes, int64(proxyConn.bufReader.Buffered()))
+			if c.readClosed() {
+				c.answerClosedReads()
+				return
+			}
+			if err != nil && err != io.EOF && (pollBytes == 0 || resumable) && retrier.retry(err, c.closedCh) {
+				// The connection to the proxy broke, poll again on a new one.
+				// If some of the response arrived, the rest is lost unless
+				// the proxy sends it again.
+				if err := resp.Body.Close(); err != nil {
+					c.logger().Debugf("Unable to close response body: %v", err)
+				}
+				resp = nil
+				proxyConn.markClosed()
+				err = nil
+			} else if n > 0 || err == io.EOF {
+				if failing := retrier.succeeded(); failing > 0 {
+					c.emit(Event{Type: Reconnected, Latency: failing})
+				}
+			}
 
-		if err != nil {
+			moreAvailable := false
 			if err == io.EOF {
 				// Current response is done
 				if err := resp.Body.Close(); err != nil {
-					log.Debugf("Unable to close response body: %v", err)
+					c.logger().Debugf("Unable to close response body: %v", err)
 				}
+				// Closing reads the rest of the body, including the
+				// trailers
+				moreAvailable = resp.Trailer.Get(X_ENPROXY_MORE) == "true"
+				moreWaiting = moreAvailable
 				resp = nil
-				if hitEOFUpstream {
-					// True EOF, stop reading
-					return
+				if !hitEOFUpstream {
+					if pollBytes == 0 {
+						emptyPolls++
+					} else {
+						emptyPolls = 0
+					}
+					wait := c.getConfig().PollScheduler.NextPoll(PollStats{
+						BytesReceived:         pollBytes,
+						Duration:              time.Now().Sub(pollStart),
+						TimeToFirstByte:       time.Duration(atomic.LoadInt64(&c.readTimeToFirstByte)),
+						RTT:                   c.RTT(),
+						ConsecutiveEmptyPolls: emptyPolls,
+						MoreAvailable:         moreAvailable,
+					})
+					if moreAvailable {
+						// Don't hold up data that's already waiting for us
+						wait = 0
+					}
+					atomic.StoreInt64(&c.pollInterval, int64(wait))
+					nextPollAt = time.Now().Add(wait)
 				}
-				continue
-			} else {
-				log.Errorf("Error reading: %s", err)
+			}
+
+			errToClient := err
+			if err == io.EOF && !hitEOFUpstream {
+				// The current response hit EOF, but we haven't hit EOF upstream
+				// so suppress EOF to reader
+				errToClient = nil
+			} else if err != nil && err != io.EOF {
+				c.readFailed(err)
+			}
+			done := filled > 0 || errToClient != nil
+			if done && errToClient == nil && availableOnly && filled < len(b) {
+				// Take whatever else is available
+				done = false
+			}
+			if done && errToClient == nil && moreAvailable && filled < len(b) && c.proxySupports(capNoWait) && !isClosed(c.readDeadline.wait()) {
+				// Drain the data that's waiting into the rest of b
+				done = false
+			}
+			if done {
+				if polled {
+					atomic.AddInt64(&c.readsRequiringPoll, 1)
+				} else {
+					atomic.AddInt64(&c.readsFromBuffer, 1)
+				}
+				c.readResponsesCh <- rwResponse{filled, errToClient}
+			}
+
+			if err == io.EOF && hitEOFUpstream {
+				// True EOF, we're done with proxyConn. Keep answering reads
+				// with EOF until reads are closed.
+				c.releaseProxyConn(proxyConn)
+				proxyConn = nil
+				for range c.readRequestsCh {
+					c.readResponsesCh <- rwResponse{0, io.EOF}
+				}
+				return
+			}
+			if err != nil && err != io.EOF {
+				c.logError(mkerror("Error reading", err))
 				return
 			}
+			if done {
+				break
+			}
 		}
 	}
+
+	// Reads were closed in between responses
+	reusable = true
+}
+
+// answerClosedReads answers the current read and any that follow with EOF
+// after CloseRead, until reads are closed. Reads that were submitted before
+// CloseRead may have returned already without waiting for their answer, so the
+// answer is dropped if nobody takes it.
+func (c *conn) answerClosedReads() {
+	answer := func() {
+		select {
+		case c.readResponsesCh <- rwResponse{0, io.EOF}:
+		default:
+		}
+	}
+	answer()
+	for range c.readRequestsCh {
+		answer()
+	}
 }
 
 // submitRead submits a read to the processReads goroutine, returning true if
@@ -108,6 +349,7 @@ func (c *conn) submitRead(b []byte) bool {
 		return false
 	} else {
 		increment(&blockedOnRead)
+		atomic.AddInt64(&c.readRoundTrips, 1)
 		c.readRequestsCh <- b
 		return true
 	}
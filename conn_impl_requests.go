@@ -3,6 +3,7 @@ package enproxy
 import (
 	"fmt"
 	"net/http"
+	"sync/atomic"
 )
 
 // processRequests handles writing outbound requests to the proxy.  Note - this
@@ -18,12 +19,18 @@ func (c *conn) processRequests(proxyConn *connInfo) {
 	first := true
 	defer c.finishRequesting(resp, first)
 
+	// reusable: whether proxyConn is in a clean state at the time that
+	// processRequests() exits
+	reusable := false
+
 	defer func() {
 		// If there's a proxyConn at the time that processRequests() exits,
-		// close it.
-		if !first && proxyConn != nil {
-			if err := proxyConn.conn.Close(); err != nil {
-				log.Debugf("Unable to close proxy connection: %v", err)
+		// release it (or close it if it's no longer usable).
+		if proxyConn != nil {
+			if reusable {
+				c.releaseProxyConn(proxyConn)
+			} else {
+				c.closeProxyConn(proxyConn)
 			}
 		}
 	}()
@@ -32,7 +39,7 @@ func (c *conn) processRequests(proxyConn *connInfo) {
 	var proxyHost string
 
 	mkerror := func(text string, err error) error {
-		return fmt.Errorf("Dest: %s    ProxyHost: %s    %s: %s", c.addr, proxyHost, text, err)
+		return fmt.Errorf("Dest: %s    ProxyHost: %s    %s: %w", c.addr, proxyHost, text, err)
 	}
 
 	for request := range c.requestOutCh {
@@ -47,9 +54,9 @@ func (c *conn) processRequests(proxyConn *connInfo) {
 
 		// Then issue new request
 		increment(&writingProcessingRequest)
-		resp, err = c.doRequest(proxyConn, proxyHost, OP_WRITE, request)
+		proxyConn, proxyHost, resp, err = c.doRequestFollowingRedirects(proxyConn, proxyHost, OP_WRITE, request)
 		decrement(&writingProcessingRequest)
-		log.Debugf("Issued write request with result: %v", err)
+		c.logger().Debugf("Issued write request with result: %v", err)
 		increment(&writingProcessingRequestPostingRequestFinished)
 		c.requestFinishedCh <- err
 		decrement(&writingProcessingRequestPostingRequestFinished)
@@ -60,15 +67,21 @@ func (c *conn) processRequests(proxyConn *connInfo) {
 
 		if !first {
 			if err := resp.Body.Close(); err != nil {
-				log.Debugf("Unable to close response body: %v", err)
+				c.logger().Debugf("Unable to close response body: %v", err)
 			}
 		} else {
 			// On our first request, find out what host we're actually
 			// talking to and remember that for future requests.
-			proxyHost = resp.Header.Get(X_ENPROXY_PROXY_HOST)
-			if c.config.OnFirstResponse != nil {
-				c.config.OnFirstResponse(resp)
+			if host := resp.Header.Get(X_ENPROXY_PROXY_HOST); host != "" {
+				proxyHost = host
+				c.setProxyHost(host)
+			}
+			if c.getConfig().OnFirstResponse != nil {
+				c.getConfig().OnFirstResponse(resp)
 			}
+			// The proxy only responds successfully once it's connected to
+			// the destination server
+			c.markReady(nil)
 
 			// Also post it to initialResponseCh so that the processReads()
 			// routine knows which proxyHost to use and gets the initial
@@ -94,6 +107,9 @@ func (c *conn) processRequests(proxyConn *connInfo) {
 			}
 		}
 	}
+
+	// All requests were processed successfully
+	reusable = true
 }
 
 // submitRequest submits a request to the processRequests goroutine, returning
@@ -106,6 +122,7 @@ func (c *conn) submitRequest(request *request) bool {
 		return false
 	} else {
 		increment(&writingRequestPending)
+		request.seq = atomic.AddInt64(&c.writeSeq, 1)
 		c.requestOutCh <- request
 		return true
 	}
@@ -116,14 +133,14 @@ func (c *conn) finishRequesting(resp *http.Response, first bool) {
 	close(c.initialResponseCh)
 	if !first && resp != nil {
 		if err := resp.Body.Close(); err != nil {
-			log.Debugf("Unable to close response body: %v", err)
+			c.logger().Debugf("Unable to close response body: %v", err)
 		}
 	}
 	// Drain requestsOutCh
 	for req := range c.requestOutCh {
 		decrement(&writingRequestPending)
 		if err := req.body.Close(); err != nil {
-			log.Debugf("Unable to close request body: %v", err)
+			c.logger().Debugf("Unable to close request body: %v", err)
 		}
 	}
 	c.doneRequestingCh <- true
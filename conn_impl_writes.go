@@ -1,6 +1,7 @@
 package enproxy
 
 import (
+	"sync/atomic"
 	"time"
 )
 
@@ -23,9 +24,22 @@ func (c *conn) processWrites() {
 
 	firstRequest := true
 	hasWritten := false
+	// bodyBytes: how much data the current request body has carried
+	bodyBytes := 0
+	lastWrite := time.Now()
+	// flushTimer: reused for every wait so that waiting doesn't allocate
+	flushTimer := time.NewTimer(c.getConfig().FlushTimeout)
+	defer flushTimer.Stop()
 
 	for {
+		resetTimer(flushTimer, c.getConfig().FlushTimeout)
 		increment(&writingSelecting)
+		readySince := int64(0)
+		if !firstRequest || hasWritten {
+			// Writes submitted before the first time around weren't held up
+			// by anything
+			readySince = time.Now().UnixNano()
+		}
 		select {
 		case b, more := <-c.writeRequestsCh:
 			decrement(&writingSelecting)
@@ -33,15 +47,43 @@ func (c *conn) processWrites() {
 			if !more {
 				return
 			}
+			c.recordWriteWait(readySince)
 			hasWritten = true
+			bodyBytes += len(b)
+			lastWrite = time.Now()
 			if !c.processWrite(b) {
 				// There was a problem processing a write, stop
 				return
 			}
-		case <-time.After(c.config.FlushTimeout):
+		case result := <-c.closeWriteCh:
+			decrement(&writingSelecting)
+			increment(&writingFinishingBody)
+			result <- c.rs.closeWrite()
+			decrement(&writingFinishingBody)
+			firstRequest = false
+			bodyBytes = 0
+		case result := <-c.uncorkCh:
+			decrement(&writingSelecting)
+			increment(&writingFinishingBody)
+			result <- c.rs.finishBody()
+			decrement(&writingFinishingBody)
+			if hasWritten {
+				firstRequest = false
+			}
+			bodyBytes = 0
+		case <-flushTimer.C:
 			// We waited more than FlushTimeout for a write, finish our request
 			decrement(&writingSelecting)
 
+			if c.keepStreaming(bodyBytes, time.Now().Sub(lastWrite)) {
+				// Large upload that paused only briefly, keep the body open
+				continue
+			}
+			if bodyBytes > 0 && c.heldByCork() {
+				// The application is still building its message
+				continue
+			}
+
 			if firstRequest && !hasWritten {
 				// Write empty data just so that we can get a response and get
 				// on with reading.
@@ -50,22 +92,72 @@ func (c *conn) processWrites() {
 				// server.
 				increment(&writingWritingEmpty)
 				if _, err := c.rs.write(emptyBytes); err != nil {
-					log.Debugf("Unable to write to connection: %v", err)
+					c.logger().Debugf("Unable to write to connection: %v", err)
 				}
 				decrement(&writingWritingEmpty)
+			} else if bodyBytes == 0 && c.keepAliveDue() {
+				// Send an empty request to keep the tunnel from being reaped
+				c.logger().Debugf("No requests to %s for %v, sending keepalive", c.addr, c.getConfig().KeepAliveInterval)
+				if _, err := c.rs.write(emptyBytes); err != nil {
+					c.logger().Debugf("Unable to write keepalive: %v", err)
+				}
 			}
 
 			increment(&writingFinishingBody)
 			if err := c.rs.finishBody(); err != nil {
-				log.Debugf("Unable to write connection finishing body: %v", err)
+				c.logger().Debugf("Unable to write connection finishing body: %v", err)
 			}
 			decrement(&writingFinishingBody)
 
 			firstRequest = false
+			bodyBytes = 0
 		}
 	}
 }
 
+// resetTimer resets timer to fire after d, making sure that a previous expiry
+// that hasn't been received doesn't fire it early.
+func resetTimer(timer *time.Timer, d time.Duration) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(d)
+}
+
+// recordWriteWait records how long the write that was just received had to
+// wait for processWrites, which has been ready for writes since readySince (in
+// Unix nanoseconds).
+func (c *conn) recordWriteWait(readySince int64) {
+	waited := readySince - atomic.LoadInt64(&c.writeSubmittedAt)
+	if waited > 0 {
+		atomic.AddInt64(&c.writesBlocked, 1)
+		atomic.AddInt64(&c.writeBlockedTime, waited)
+	}
+}
+
+// keepAliveDue indicates whether no request has been sent to the proxy for
+// KeepAliveInterval.
+func (c *conn) keepAliveDue() bool {
+	if c.getConfig().KeepAliveInterval <= 0 {
+		return false
+	}
+	lastRequest := time.Unix(0, atomic.LoadInt64(&c.lastRequest))
+	return time.Now().Sub(lastRequest) >= c.getConfig().KeepAliveInterval
+}
+
+// keepStreaming indicates whether the current request body should be kept open
+// despite having been idle for the given amount of time, based on
+// WriteKeepStreamingThreshold.
+func (c *conn) keepStreaming(bodyBytes int, idle time.Duration) bool {
+	return c.getConfig().WriteKeepStreamingThreshold > 0 &&
+		!c.getConfig().BufferRequests &&
+		bodyBytes >= keepStreamingMinBytes &&
+		idle < c.getConfig().WriteKeepStreamingThreshold
+}
+
 // processWrite processes a single write request, encapsulated in the body of a
 // POST request to the proxy. It uses the configured requestStrategy to process
 // the request. It returns true if the write was successful.
@@ -73,6 +165,7 @@ func (c *conn) processWrite(b []byte) bool {
 	increment(&writingWriting)
 	n, err := c.rs.write(b)
 	decrement(&writingWriting)
+	atomic.AddInt64(&c.bytesWritten, int64(n))
 
 	increment(&writingPostingResponse)
 	c.writeResponsesCh <- rwResponse{n, err}
@@ -90,6 +183,7 @@ func (c *conn) submitWrite(b []byte) bool {
 		return false
 	} else {
 		increment(&blockedOnWrite)
+		atomic.StoreInt64(&c.writeSubmittedAt, time.Now().UnixNano())
 		c.writeRequestsCh <- b
 		return true
 	}
@@ -99,7 +193,7 @@ func (c *conn) finishWriting() {
 	increment(&writingFinishing)
 	if c.rs != nil {
 		if err := c.rs.finishBody(); err != nil {
-			log.Debugf("Unable to write connection finishing body: %v", err)
+			c.logger().Debugf("Unable to write connection finishing body: %v", err)
 		}
 	}
 	close(c.requestOutCh)
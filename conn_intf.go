@@ -2,10 +2,13 @@ package enproxy
 
 import (
 	"bufio"
+	"context"
 	"io"
 	"net"
 	"net/http"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/getlantern/golog"
@@ -18,9 +21,39 @@ const (
 	X_ENPROXY_EOF        = "X-Enproxy-EOF"
 	X_ENPROXY_PROXY_HOST = "X-Enproxy-Proxy-Host"
 	X_ENPROXY_OP         = "X-Enproxy-Op"
+	X_ENPROXY_RESUME     = "X-Enproxy-Resume"
 
-	OP_WRITE = "write"
-	OP_READ  = "read"
+	X_ENPROXY_MAX_RESPONSE_BYTES = "X-Enproxy-Max-Response-Bytes"
+	X_ENPROXY_ENCODING           = "X-Enproxy-Encoding"
+	X_ENPROXY_ACCEPT_ENCODING    = "X-Enproxy-Accept-Encoding"
+	X_ENPROXY_DICT_ID            = "X-Enproxy-Dict-Id"
+	X_ENPROXY_RECEIVE_WINDOW     = "X-Enproxy-Receive-Window"
+	X_ENPROXY_MAX_RECONNECTS     = "X-Enproxy-Max-Reconnects"
+	X_ENPROXY_RECEIVED           = "X-Enproxy-Received"
+	X_ENPROXY_OFFSET             = "X-Enproxy-Offset"
+	X_ENPROXY_SEQ                = "X-Enproxy-Seq"
+	X_ENPROXY_MORE               = "X-Enproxy-More"
+	X_ENPROXY_HEARTBEAT          = "X-Enproxy-Heartbeat"
+	X_ENPROXY_NO_WAIT            = "X-Enproxy-No-Wait"
+	X_ENPROXY_VERSION            = "X-Enproxy-Version"
+	X_ENPROXY_CAPABILITIES       = "X-Enproxy-Capabilities"
+	X_ENPROXY_MAX_BODY_BYTES     = "X-Enproxy-Max-Body-Bytes"
+	X_ENPROXY_SNI                = "X-Enproxy-Sni"
+	X_ENPROXY_REESTABLISH        = "X-Enproxy-Reestablish"
+	X_ENPROXY_BODY_ENCODING      = "X-Enproxy-Body-Encoding"
+
+	OP_WRITE     = "write"
+	OP_READ      = "read"
+	OP_CONNECT   = "connect"
+	OP_WEBSOCKET = "websocket"
+	OP_HEARTBEAT = "heartbeat"
+
+	// PROTOCOL_VERSION: the version of the protocol between Conns and the
+	// Proxy, which clients and proxies announce to each other in
+	// X_ENPROXY_VERSION along with the optional features that they support
+	// in X_ENPROXY_CAPABILITIES. Proxies that don't announce a version are
+	// version 0.
+	PROTOCOL_VERSION = 1
 )
 
 var (
@@ -32,18 +65,219 @@ var (
 	defaultReadFlushTimeout  = 35 * time.Millisecond
 	defaultIdleTimeoutClient = 30 * time.Second
 	defaultIdleTimeoutServer = 70 * time.Second
+	defaultWriteFlushDelay   = 5 * time.Millisecond
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultMaxRetryAfter     = 1 * time.Minute
+	defaultMaxReorderBytes   = 1024 * 1024
+	defaultReorderTimeout    = 5 * time.Second
+	defaultMinCompressSize   = 256
+
+	// closeGracePeriod: how long Close waits for in-flight requests to finish
+	// before interrupting them. Requests that finish in time leave their proxy
+	// connections reusable.
+	closeGracePeriod = 250 * time.Millisecond
 
 	// closeChannelDepth: controls depth of channels used for close processing.
 	// Doesn't need to be particularly big, as it's just used to prevent
 	// deadlocks on multiple calls to Close().
 	closeChannelDepth = 20
 
-	bodySize = 65536 // size of buffer used for request bodies
+	bodySize = 65536 // default size of buffer used for request bodies
+
+	// keepStreamingMinBytes: how much data a request body needs to have
+	// carried for WriteKeepStreamingThreshold to apply
+	keepStreamingMinBytes = 65536
+
+	defaultMaxBufferedReadBytes = 4096 // default size of buffer used for reading responses
+
+	// unexpectedResponseSnippetBytes: how much of the body of a response that
+	// doesn't come from the proxy is kept in UnexpectedResponseError
+	unexpectedResponseSnippetBytes = 512
 
 	oneSecond = 1 * time.Second
 )
 
-// Conn is a net.Conn that tunnels its data via an httpconn.Proxy using HTTP
+// Conn is the net.Conn returned by Dial, with some additional enproxy-specific
+// methods.
+//
+// Reads and Writes honor the deadlines set with SetDeadline, SetReadDeadline
+// and SetWriteDeadline, failing with os.ErrDeadlineExceeded once they pass,
+// so a Conn can be used with crypto/tls and other code that relies on
+// deadlines. Data from a Read that timed out is returned by the next Read.
+//
+// A Conn may be read from and written to at the same time, but only by one
+// reader and one writer: a Read that's called while another Read is pending
+// fails with ErrConcurrentRead, and likewise a Write with ErrConcurrentWrite.
+type Conn interface {
+	net.Conn
+	io.StringWriter
+
+	// BufferedBytes returns the number of bytes that were accepted by Write but
+	// haven't yet been sent to the proxy, and the number of bytes that have been
+	// received from the proxy but haven't yet been returned by Read.
+	BufferedBytes() (write int, read int)
+
+	// Buffered returns the number of bytes that this Conn has already read
+	// from the proxy and is holding for the caller (see ReadBufferBytes and
+	// SetReadDeadline), similar to bufio.Reader.Buffered. Unlike the read count
+	// of BufferedBytes, it leaves out data that's still in the response from
+	// the proxy, so it's exact: as long as Buffered is greater than 0, Read
+	// returns some of these bytes, in order and without waiting for the proxy.
+	// That way code that switches protocols can account for data that enproxy
+	// read ahead, or take it by reading until Buffered returns 0. The bytes are
+	// only discarded if the Conn fails or is closed for reading. Buffered
+	// doesn't block, but it's only meaningful while no Read is pending.
+	Buffered() int
+
+	// ReadAvailable returns up to max bytes of the data that this Conn can
+	// get without waiting for the destination server. That's, in order, the
+	// data that it has buffered (see Buffered), the part of the current
+	// response from the proxy that has already arrived and, if the proxy said
+	// that it has more data waiting (see PollStats.MoreAvailable), what it
+	// sends back right away to polls that ask it not to wait. ReadAvailable
+	// only blocks while such polls are being answered or data that has
+	// partly arrived is being read; as soon as getting more would mean
+	// waiting for the destination server, it returns what it has, possibly
+	// nothing with a nil error. Errors and EOF are returned as with Read,
+	// after the data that came before them. Read deadlines don't apply. Over
+	// a WebSocket, or while a Read that timed out is still waiting for data
+	// (see SetReadDeadline), it only returns data that's buffered. Like Read,
+	// it fails with ErrConcurrentRead if a Read is pending.
+	ReadAvailable(max int) ([]byte, error)
+
+	// SessionState returns the state needed to resume this Conn's tunnel with
+	// ResumeConn.
+	SessionState() *SessionState
+
+	// File always fails with ErrNotSupported. Unlike a net.TCPConn, a Conn
+	// isn't backed by a single file descriptor: its tunnel is carried by a
+	// series of HTTP requests on connections that come and go. To hand the
+	// tunnel to another process, marshal its SessionState, Close this Conn
+	// and have the other process continue the tunnel with ResumeConn.
+	File() (*os.File, error)
+
+	// Stats returns statistics about this Conn
+	Stats() Stats
+
+	// RTT returns the moving average of the round-trip times of polls, from
+	// sending a read request until its response headers arrive, or 0 before
+	// the first poll. Since the proxy may briefly wait for data before
+	// responding (see Proxy.FlushTimeout), this is an upper bound on the
+	// network round trip through the proxy's front end, which it approaches
+	// when data is flowing.
+	RTT() time.Duration
+
+	// CurrentPollInterval returns how long this Conn currently waits after a
+	// poll finishes before polling again, i.e. the delay that the
+	// PollScheduler chose after the most recent poll (0 if more data was
+	// waiting at the proxy), as opposed to what was configured. It's 0 before
+	// the first poll has finished and over a WebSocket.
+	CurrentPollInterval() time.Duration
+
+	// CurrentIdleInterval returns how long this Conn currently lets writes
+	// idle before sending them to the proxy, i.e. the FlushTimeout in effect
+	// after defaults and Reconfigure, or 0 over a WebSocket, where writes
+	// aren't held back.
+	CurrentIdleInterval() time.Duration
+
+	// CloseReason returns why this Conn was closed, or CloseReasonNone if it
+	// hasn't been closed.
+	CloseReason() CloseReason
+
+	// InFlightRequests returns the number of this Conn's requests to the
+	// proxy that are currently in flight (see Config.MaxInFlightRequests).
+	InFlightRequests() int
+
+	// UnderlyingConns returns the connections to the proxy (as returned by
+	// Config.DialProxy) that this Conn currently holds, e.g. for setting
+	// socket options like TOS/DSCP through their SyscallConn. A Conn dials
+	// new connections over time, so options that must apply to all of them
+	// are better set in DialProxy. Setting socket options is safe, but reading
+	// from, writing to or closing these connections breaks the tunnel.
+	UnderlyingConns() []net.Conn
+
+	// WaitReady blocks until the proxy has confirmed that it's connected to
+	// the destination server, returning nil, or until the tunnel has failed
+	// or this Conn has been closed, returning why, or until ctx is done,
+	// returning ctx.Err(). Once WaitReady has returned nil, it always does.
+	//
+	// With Config.WaitForUpstream or a WebSocket, the proxy has confirmed the
+	// connection by the time that Dial returns, so WaitReady returns nil right
+	// away. Otherwise, the proxy connects to the destination server when it
+	// receives the first write, so WaitReady only returns once data has been
+	// written. Either way, data that's written before the connection is
+	// confirmed isn't lost: the proxy forwards it once connected.
+	WaitReady(ctx context.Context) error
+
+	// Reconfigure switches this Conn to config without interrupting it, e.g.
+	// for trying out different polling strategies on live connections. Like
+	// with Dial, config is copied and defaults are applied to the copy.
+	//
+	// Only these fields can be changed, taking effect with the next request,
+	// poll or flush: FlushTimeout, WriteKeepStreamingThreshold,
+	// KeepAliveInterval, MaxRequests, HeartbeatTimeout,
+	// ResponseHeaderTimeout, DisableKeepAlives, MaxUpstreamReconnects,
+	// PreferContentLength, ProxySocketReadBuffer, ProxySocketWriteBuffer,
+	// MaxResponseBytes, ReceiveWindow, PollScheduler, OnFirstResponse,
+	// OnRequest, MaxRequestHeaderBytes, Trace, ReconnectBackoff, MaxRedirects,
+	// MaxRetryAfter, ReadErrorsAreFatal, ValidateResponses, Tag,
+	// BodyReadTimeout, ReplayEstablishment, EmptyBodyFraming, MaxCorkDuration,
+	// BodyEncoding, Events, MaxReorderBytes and ReorderTimeout. The other
+	// fields determine how the tunnel was set up. If config changes any of
+	// them, Reconfigure returns a ConfigChangeError and leaves the Conn as it
+	// was. DialProxy and NewRequest count as changed unless they're the Conn's
+	// own function values, e.g. from a Clone of its Config: a closure that does
+	// the same but was created separately is a change.
+	Reconfigure(config *Config) error
+
+	// SetTag changes the tag of this Conn (see Config.Tag), e.g. once it's
+	// reused for another request of the application.
+	SetTag(tag string)
+
+	// CloseRead stops reading from the tunnel while writing continues, for
+	// protocols that only send from some point on. Reads that are pending or
+	// that come later return io.EOF, and data that has already arrived but
+	// hasn't been read is discarded. The Conn stops polling the proxy, so data
+	// that the destination server sends from then on stays with the proxy:
+	// it's held in the proxy's connection to the destination server, whose
+	// buffers eventually fill up, so a destination server that insists on
+	// its data being read may stall. Over a WebSocket, a Read that's already
+	// blocked isn't interrupted.
+	CloseRead() error
+
+	// CloseWrite tells the destination server that we're done writing, like
+	// a TCP connection's CloseWrite, while reading continues. Once the data
+	// from the Writes that returned has been sent, the proxy shuts down its
+	// writing side of the connection to the destination server, which reads
+	// EOF. CloseWrite returns once the proxy has taken note. Writes that come
+	// later fail with ErrWriteClosed.
+	//
+	// EOF works the same way in the other direction: a Read returns io.EOF
+	// once the destination server has shut down writing (X_ENPROXY_EOF on a
+	// response), while Writes continue to reach it. The tunnel is done once
+	// both directions have seen EOF, but the Conn still has to be closed.
+	//
+	// CloseWrite fails with ErrNotSupported over a WebSocket and with proxies
+	// that don't support it.
+	CloseWrite() error
+
+	// Cork holds back the data of subsequent Writes until Uncork, like
+	// TCP_CORK, so that a message that's built from several small Writes goes
+	// to the proxy in a single request body whatever the timing of the Writes.
+	// While corked, the body isn't finished when writes pause for
+	// FlushTimeout, but it's still split at the limits on body sizes (see
+	// MaxBufferedWriteBytes). To keep a Conn from staying corked forever, it
+	// uncorks itself after MaxCorkDuration. Cork and Uncork fail with
+	// ErrNotSupported over a WebSocket, where Writes aren't batched.
+	Cork() error
+
+	// Uncork sends the data held back since Cork as one request body,
+	// returning once the body has been finished. Uncorking a Conn that isn't
+	// corked does nothing.
+	Uncork() error
+}
+
+// conn is a net.Conn that tunnels its data via an httpconn.Proxy using HTTP
 // requests and responses.  It assumes that streaming requests are not supported
 // by the underlying servers/proxies, and so uses a polling technique similar to
 // the one used by meek, but different in that data is not encoded as JSON.
@@ -55,6 +289,13 @@ var (
 // channel handles reading data by making GET requests and grabbing the data
 // encapsulated in the response bodies.
 //
+// Each channel uses its own connection to the proxy, so a large upload on the
+// Write Channel never holds up reads and vice versa. The cost is two proxy
+// connections per Conn for as long as it's in use (a Dialer lets Conns share
+// them one after the other). The Proxy needs no coordination between the
+// channels beyond the connection id, which both channels send with every
+// request and which identifies the destination connection.
+//
 // Write Channel:
 //
 //   1. Accept writes, piping these to the proxy as the body of an http POST
@@ -75,14 +316,133 @@ var (
 //      will happen because the proxy periodically closes responses to make sure
 //      intervening proxies don't time out.
 //   5. If a response is received with a special header indicating a true EOF
-//      from the destination server, return EOF to the reader
+//      from the destination server, return EOF to the reader (and to all
+//      subsequent reads)
+//
+// EOF from the destination server only ends the Read Channel. The Write Channel
+// keeps working, so with destinations that only close their side for writing
+// (half-close), data written after Read returned io.EOF is still delivered.
+// Once the destination has closed completely, the proxy fails such writes.
 //
 type conn struct {
+	// Buffered byte counts, accessed atomically (kept at the top of the struct
+	// for 64-bit alignment)
+	bufferedWriteBytes int64
+	bufferedReadBytes  int64
+	pendingReadBytes   int64
+	deadlineReadBytes  int64
+
+	// Total bytes written and read, accessed atomically
+	bytesWritten int64
+	bytesRead    int64
+
+	// initialBytesWritten and initialBytesRead: the totals carried over by
+	// ResumeConn, which weren't transferred by this Conn's requests
+	initialBytesWritten int64
+	initialBytesRead    int64
+
+	// dialStartedAt: when this Conn started dialing the proxy, and
+	// proxyDialTime: how long it took to get its first connection to the
+	// proxy. Both are set before the Conn is handed out. establishTime: how
+	// long it took to establish the tunnel, accessed atomically. See
+	// Stats.EstablishTime.
+	dialStartedAt time.Time
+	proxyDialTime time.Duration
+	establishTime int64
+
+	// Stats, accessed atomically
+	timeToFirstByte     int64
+	readTimeToFirstByte int64
+	rtt                 int64
+	pollInterval        int64
+	droppedEvents       int64
+	bufferedResponses   int64
+	streamedResponses   int64
+	readsFromBuffer     int64
+	readsRequiringPoll  int64
+	requests            int64
+	writeRequests       int64
+	readRequests        int64
+	writesBlocked       int64
+	writeBlockedTime    int64
+
+	// proxyMaxBodyBytes: the proxy's MaxRequestBodyBytes (see
+	// recordMaxBodyBytes), 0 if it has none, accessed atomically
+	proxyMaxBodyBytes int64
+
+	// writeSubmittedAt: when the most recent write was submitted to
+	// processWrites, in Unix nanoseconds and accessed atomically
+	writeSubmittedAt int64
+
+	// lastRequest: when the most recent request was sent to the proxy, in
+	// Unix nanoseconds and accessed atomically
+	lastRequest int64
+
+	// readRoundTrips: number of reads submitted to the processReads goroutine,
+	// accessed atomically
+	readRoundTrips int64
+
+	// inFlightRequests: number of requests to the proxy awaiting their
+	// response headers, accessed atomically
+	inFlightRequests int64
+
+	// rateLimitedUntil: Unix nanoseconds before which no further requests are
+	// sent, as requested by the proxy's last Retry-After, accessed atomically
+	rateLimitedUntil int64
+
+	// writeSeq: the sequence number of the most recent write request,
+	// accessed atomically (see request.seq)
+	writeSeq int64
+
+	// heartbeats: number of heartbeats sent, accessed atomically
+	heartbeats int64
+
+	// lastProgress: when a Read or Write last transferred data, for
+	// ProgressTimeout, in Unix nanoseconds and accessed atomically
+	lastProgress int64
+
+	// Application activity for MaxIdleTime, accessed atomically. lastActive
+	// is in Unix nanoseconds.
+	lastActive  int64
+	activeCalls int32
+
+	// negotiated: 1 once the proxy's version and capabilities are known, which
+	// are in proxyVersion and proxyCapabilities (see recordProxyVersion), all
+	// accessed atomically
+	negotiated        int32
+	proxyVersion      int32
+	proxyCapabilities uint32
+
+	// keepAlivesBroken: 1 if probing found that the proxy can't handle
+	// several requests on the same connection (see ProbeKeepAlives),
+	// accessed atomically
+	keepAlivesBroken int32
+
+	// reading and writing: 1 while a Read or Write is pending, to detect
+	// concurrent Reads and Writes, accessed atomically
+	reading int32
+	writing int32
+
+	// readingAvailable: 1 while the pending read is a ReadAvailable, which
+	// processReads answers without waiting for data. readsStarted: 1 once
+	// processReads has the first response, before which nothing can be read
+	// without waiting. Both are accessed atomically.
+	readingAvailable int32
+	readsStarted     int32
+
+	bufferingDetected int32
+
+	// closeReason: why this conn was closed, accessed atomically
+	closeReason int32
+
 	// addr: the host:port of the destination server that we're trying to reach
 	addr string
 
-	// config: configuration of this Conn
-	config *Config
+	// config: configuration of this Conn. Once the Conn has started, it's
+	// only read through getConfig, since Reconfigure may replace it. The
+	// Config that it points to is never changed.
+	config      *Config
+	configMutex sync.RWMutex
 
 	// initialResponseCh: Self-reported FQDN of the proxy serving this connection
 	// plus initial response from proxy.
@@ -93,11 +453,69 @@ type conn struct {
 	// robin).
 	initialResponseCh chan hostWithResponse
 
+	// readClosedCh: closed by CloseRead (see readClosed)
+	readClosedCh  chan struct{}
+	readCloseOnce sync.Once
+
+	// writeClosedCh: closed by CloseWrite, which hands processWrites a
+	// channel for the result of sending EOF through closeWriteCh
+	writeClosedCh  chan struct{}
+	writeCloseOnce sync.Once
+	closeWriteCh   chan chan error
+
+	// corkedAt: when Cork was called in Unix nanoseconds, 0 if this conn
+	// isn't corked, accessed atomically. Uncork hands processWrites a
+	// channel for the result of finishing the body through uncorkCh.
+	corkedAt int64
+	uncorkCh chan chan error
+
+	// pollConn: the proxyConn on which processReads currently polls, if any
+	pollConn      *connInfo
+	pollConnMutex sync.Mutex
+
+	// draining: whether processReads is polling for more data to fill the
+	// current Read, which the proxy is asked to return right away rather than
+	// waiting for data. Only accessed by processReads.
+	draining bool
+
+	// proxyHost: the proxy host named by the first response, if any, for
+	// sticky routing of heartbeats
+	proxyHost      string
+	proxyHostMutex sync.RWMutex
+
 	// id: unique identifier for this connection. This is used by the Proxy to
 	// associate requests from this connection to the corresponding outbound
 	// connection on the Proxy side.  It is populated using a type 4 UUID.
 	id string
 
+	// resumed: whether this conn resumes a tunnel that was started by a
+	// different Conn (see ResumeConn)
+	resumed bool
+
+	// establishment: the headers with which this conn's requests establish
+	// its tunnel, replayed by reEstablish (see Config.ReplayEstablishment)
+	establishment http.Header
+
+	// dialer: if this Conn was dialed using a Dialer, the Dialer whose pool of
+	// idle proxy connections this Conn uses
+	dialer *Dialer
+
+	// dialCtx: the context that bounds retries of the first dial to the proxy
+	// (see Config.DialRetries), nil if there's none
+	dialCtx context.Context
+
+	// inFlightSlots: if MaxInFlightRequests is set, holds a value for each
+	// request in flight
+	inFlightSlots chan struct{}
+
+	// jar: if UseCookies is set, the cookies that the proxy (or intermediaries)
+	// set for this Conn
+	jar http.CookieJar
+
+	// ws: if the proxy accepted the upgrade requested by Config.WebSocket, the
+	// WebSocket that carries this conn's data instead of requests
+	ws *webSocket
+
 	/* Write processing */
 	writeRequestsCh  chan []byte     // requests to write
 	writeResponsesCh chan rwResponse // responses for writes
@@ -114,18 +532,52 @@ type conn struct {
 	readResponsesCh chan rwResponse // responses for reads
 	doneReadingCh   chan bool
 
+	/* Read buffering (only used if ReadBufferBytes is set) */
+	readBuf      []byte     // buffer into which small reads are read
+	readPending  []byte     // data read into readBuf but not yet returned
+	readErr      error      // error to return once readPending is empty
+	readBufMutex sync.Mutex // mutex guarding read buffering
+
 	/* Fields for tracking error and closed status */
-	asyncErr      error        // error that occurred during asynchronous processing
-	asyncErrMutex sync.RWMutex // mutex guarding asyncErr
-	asyncErrCh    chan error   // channel used to interrupted any waiting reads/writes with an async error
-	closing       bool         // whether or not this Conn is closing
-	closingMutex  sync.RWMutex // mutex controlling access to the closing flag
+	asyncErr     atomic.Value  // latchedError for the first error that failed the Conn
+	asyncErrCh   chan error    // channel used to interrupted any waiting reads/writes with an async error
+	closing      bool          // whether or not this Conn is closing
+	closingMutex sync.RWMutex  // mutex controlling access to the closing flag
+	closedCh     chan struct{} // closed once this Conn is closing
+	readyCh      chan struct{} // closed once readyErr is set (see WaitReady)
+	readyErr     error         // nil if the tunnel was established
+	readyOnce    sync.Once     // makes sure that readyErr is set only once
+
+	/* Deadlines and the state of reads and writes that outlived them (see
+	   deadline.go) */
+	readDeadline       *deadline
+	writeDeadline      *deadline
+	deadlineReadCh     chan rwResponse // response to a read that outlived its deadline
+	deadlineReadBuf    []byte          // buffer for reads with a deadline
+	deadlineReadLeft   []byte          // data read into deadlineReadBuf but not yet returned
+	deadlineReadErr    error           // error to return once deadlineReadLeft is empty
+	deadlineReadMutex  sync.Mutex
+	deadlineWriteCh    chan rwResponse // response to a write that outlived its deadline
+	deadlineWriteMutex sync.Mutex
+
+	/* Proxy connections held by this Conn, so that Close can interrupt them */
+	proxyConns      map[*connInfo]bool
+	proxyConnsMutex sync.Mutex
+
+	// frontend: 1 + the index of the front-end in Config.Frontends that this
+	// conn uses, 0 until it picks one. Accessed atomically.
+	frontend int32
 
 	/* Track current response */
 	resp *http.Response // the current response being used to read data
 }
 
-// Config configures a Conn
+// Config configures a Conn. A Config may be shared by any number of Conns:
+// every Conn works with its own copy of the Config (see Clone), taken when the
+// Conn is dialed, so changing a Config only affects Conns dialed afterwards and
+// defaults that a Conn fills in don't show up in the shared Config. The
+// functions, PollScheduler, Trace and Events are shared by all copies, so they
+// need to be safe for concurrent use by several Conns.
 type Config struct {
 	// DialProxy: function to open a connection to the proxy
 	DialProxy dialFunc
@@ -133,6 +585,41 @@ type Config struct {
 	// NewRequest: function to create a new request to the proxy
 	NewRequest newRequestFunc
 
+	// Tag: optional string identifying the Conn to the application, e.g. the
+	// id of the application's request that the Conn is for. Messages that
+	// enproxy logs about the Conn start with the tag, and Stats reports it,
+	// so that tunnel activity can be correlated with the application's. The
+	// hooks of a ClientTrace don't get the tag, so to correlate them with a
+	// Conn, give the Conn a Config with a ClientTrace of its own.
+	Tag string
+
+	// Frontends: if set, the Conn reaches the proxy through one of these
+	// front-ends, picked at random by weight, instead of using DialProxy,
+	// and falls back to the others if it fails (see FrontendSet). The
+	// FrontendSet is shared by all copies of the Config.
+	Frontends *FrontendSet
+
+	// DialRetries: how many times to retry dialing the proxy (through any of
+	// the Frontends, if set) when that fails while dialing the Conn, e.g.
+	// because of a hiccup at a CDN edge. Zero, the default, fails the dial
+	// right away. This only covers the first connection to the proxy, later
+	// ones are retried like requests (see ReconnectBackoff). With Open and
+	// Dialer.DialContext, retries stop once the context is done, and a retry
+	// that wouldn't start before the context's deadline isn't made.
+	DialRetries int
+
+	// DialRetryBackoff: how long to wait before the first retry of a failed
+	// dial (see DialRetries), defaults to 100 milliseconds. Waits double after
+	// each retry, up to 5 seconds.
+	DialRetryBackoff time.Duration
+
+	// PathTemplate: template for the path passed to NewRequest, in which
+	// {id}, {addr} and {op} are replaced with the Conn's id, the destination
+	// address and the operation, e.g. "connect/{addr}/{id}/{op}" for proxies
+	// that route requests by a destination at the start of the path. The
+	// Proxy's PathTemplate needs to match. Defaults to "{id}/{addr}/{op}".
+	PathTemplate string
+
 	// OnFirstResponse: optional callback that gets called on the first response
 	// from the proxy.
 	OnFirstResponse func(resp *http.Response)
@@ -141,6 +628,82 @@ type Config struct {
 	// request to the proxy.  Defaults to 15 milliseconds.
 	FlushTimeout time.Duration
 
+	// MaxCorkDuration: how long a Conn stays corked at most (see Conn.Cork),
+	// defaults to 1 second. Since the Conn checks whenever writes have paused
+	// for FlushTimeout, it may stay corked for up to FlushTimeout longer.
+	MaxCorkDuration time.Duration
+
+	// WriteKeepStreamingThreshold: if non-zero, once a streamed request body
+	// has carried a large amount of data (at least 64 KB), idle gaps shorter
+	// than this don't finish the body, so large uploads with occasional pauses
+	// stay in a single request. Smaller writes are still flushed after
+	// FlushTimeout. Has no effect when BufferRequests is true.
+	WriteKeepStreamingThreshold time.Duration
+
+	// MaxIdleTime: if non-zero, a Conn that the application hasn't read from
+	// or written to for this long closes itself, after which Read and Write
+	// fail with net.ErrClosed. Unlike IdleTimeout, this only counts the
+	// application's activity (a Read or Write that's blocked counts as
+	// activity), so it's suitable for evicting abandoned Conns from a cache.
+	MaxIdleTime time.Duration
+
+	// KeepAliveInterval: if non-zero, the Conn sends an empty write request to
+	// the proxy whenever it hasn't sent any request for this long, so that
+	// intermediaries don't reap the path to the proxy while the application is
+	// neither writing nor reading (a Conn only polls while the application is
+	// reading). This should be much longer than the time between polls. Since
+	// keepalives carry no data, they don't keep the Proxy from closing the
+	// tunnel after its IdleTimeout.
+	KeepAliveInterval time.Duration
+
+	// MaxRequests: if non-zero, the most requests (including polls) that the
+	// Conn may send to the proxy, which bounds the cost of a Conn on
+	// infrastructure that bills per request. Once the quota is used up, the
+	// Conn closes itself and pending Reads and Writes fail with
+	// ErrRequestQuotaExceeded.
+	MaxRequests int
+
+	// ProgressTimeout: if non-zero, a Conn on which no Read or Write has
+	// transferred any data for this long closes itself, failing pending Reads
+	// and Writes with ErrNoProgress. Unlike IdleTimeout, which polling keeps
+	// at bay, and MaxIdleTime, for which blocked calls count as activity, this
+	// catches tunnels that are wedged while the application is waiting on
+	// them.
+	ProgressTimeout time.Duration
+
+	// ReadErrorsAreFatal: if true, a Read that fails because polling the
+	// proxy failed (rather than because of a deadline or EOF) fails the
+	// whole Conn, like a failed write request always does. From then on,
+	// Reads and Writes return that error right away, so that a Write doesn't
+	// block or appear to succeed on a tunnel that can no longer be read from.
+	ReadErrorsAreFatal bool
+
+	// ValidateResponses: if true, the Conn makes sure that successful
+	// responses come from the proxy, which echoes the Conn's id in each of
+	// them. Networks with captive portals may answer requests with a login
+	// page (often as a 200 OK), which would otherwise be taken for tunneled
+	// data. Responses without the id fail with an UnexpectedResponseError
+	// (matching ErrUnexpectedResponse), so that the application can have the
+	// user log in to the network. Proxies from before this check was added
+	// only echo the id in responses to polls, so don't use this with them.
+	ValidateResponses bool
+
+	// HeartbeatInterval: if non-zero, how often the Conn checks that the proxy
+	// still has its tunnel, once the tunnel is established. Polls can keep
+	// succeeding against a live intermediary (e.g. a CDN) after the tunnel on
+	// the proxy is gone, for example because the proxy restarted, or after the
+	// proxy's connection to the destination server failed. The proxy answers
+	// a heartbeat only if neither happened. Otherwise, or if the proxy doesn't
+	// answer within HeartbeatTimeout, the Conn closes itself and pending Reads
+	// and Writes fail with ErrHeartbeatFailed. Heartbeats aren't sent over a
+	// WebSocket (see WebSocket), nor to proxies that don't announce support
+	// for them (see PROTOCOL_VERSION).
+	HeartbeatInterval time.Duration
+
+	// HeartbeatTimeout: how long to wait for the proxy to answer a heartbeat,
+	// defaults to HeartbeatInterval
+	HeartbeatTimeout time.Duration
+
 	// IdleTimeout: how long to wait before closing an idle connection, defaults
 	// to 30 seconds on the client and 70 seconds on the server proxy.
 	//
@@ -152,10 +715,256 @@ type Config struct {
 	// middle of processing a request.
 	IdleTimeout time.Duration
 
+	// MaxInFlightRequests: if non-zero, the most requests that a Conn has in
+	// flight to the proxy at once, e.g. to stay within a CDN's limit on
+	// concurrent requests. Further requests wait until one of the requests in
+	// flight completes. A request is in flight from when it starts being sent
+	// (for writes, this includes streaming the body) until its response
+	// headers have been received. Since a Conn's reads and writes each use
+	// one request at a time, a Conn never has more than 2 requests in flight,
+	// and 1 makes reads and writes take turns. The default is no limit rather
+	// than 1, because reads and writes already use separate requests that are
+	// in flight at the same time. Taking turns would make writes wait for polls
+	// to be answered, adding up to the Proxy's FlushTimeout to their latency.
+	MaxInFlightRequests int
+
+	// ResponseHeaderTimeout: if non-zero, how long to wait for the proxy's
+	// response headers after sending a request. If the headers don't arrive in
+	// time, the request fails with a timeout error.
+	ResponseHeaderTimeout time.Duration
+
+	// BodyReadTimeout: if non-zero, how long a response body that has
+	// started arriving may stop arriving, e.g. because a CDN hung in the
+	// middle of relaying it. The proxy ends a response within its
+	// FlushTimeout once data stops, so this can be short, unlike IdleTimeout.
+	// A body that stalls for longer is aborted with ErrBodyReadTimeout along
+	// with its connection to the proxy. Polls that stall are retried on a new
+	// connection like other broken connections if ReconnectBackoff allows it,
+	// otherwise the Read fails. Bodies that haven't started arriving don't
+	// count, since the proxy holds polls open until it has data.
+	BodyReadTimeout time.Duration
+
+	// ReplayEstablishment: if true, the first request on each new connection
+	// to the proxy after the tunnel was established (e.g. after a CDN dropped
+	// the previous connection, or one from a Dialer's pool) replays the
+	// parameters with which the tunnel was established, marked with
+	// X_ENPROXY_REESTABLISH. That way, the tunnel survives the connection
+	// reaching a proxy that doesn't know it, or only knows it by id. A proxy
+	// that still has the tunnel continues it. One that doesn't (e.g. another
+	// instance behind a load balancer, or after the tunnel idled) dials the
+	// destination server again if its RedialLostTunnels allows, otherwise
+	// requests fail with ErrTunnelNotFound rather than silently starting a
+	// new tunnel.
+	ReplayEstablishment bool
+
+	// EmptyBodyFraming: how requests that don't carry any data (polls, as
+	// well as the requests of WaitForUpstream and heartbeats) frame their
+	// empty body, for intermediaries that are picky about it (see
+	// EmptyBodyFraming)
+	EmptyBodyFraming EmptyBodyFraming
+
+	// WaitForUpstream: if true, Dial waits for the proxy to connect to the
+	// destination server and fails if it can't, like net.Dial does. Otherwise,
+	// Dial returns as soon as it has connected to the proxy and a failure to
+	// reach the destination server only shows up on the first Read or Write.
+	WaitForUpstream bool
+
+	// UpstreamServerName: if set, the server name (SNI) that the proxy uses
+	// for its TLS handshake with the destination server, if it connects to
+	// destination servers with TLS (see Proxy.UpstreamTLS). This is for
+	// destinations that are dialed by IP but whose certificates name a host.
+	// By default, the proxy uses the host of the destination address.
+	UpstreamServerName string
+
+	// DisableKeepAlives: if true, the Conn sends each request to the proxy on
+	// a new connection and asks for it to be closed after the response
+	// (Connection: close). Regardless of this, enproxy never pipelines: a
+	// connection to the proxy carries one request at a time, and the next
+	// request is only sent on it once the previous response has been read in
+	// full. Still, some intermediaries (e.g. old HTTP/1.0 proxies) mishandle
+	// several requests on the same connection, corrupting the tunnel.
+	DisableKeepAlives bool
+
+	// ProbeKeepAlives: if true, together with WaitForUpstream, Dial checks
+	// that the proxy correctly answers a second request on the connection
+	// that it connected over and, if it doesn't, the Conn behaves as if
+	// DisableKeepAlives were set. Stats.KeepAlivesDisabled tells whether it
+	// does.
+	ProbeKeepAlives bool
+
+	// WebSocket: if true, Dial first asks the proxy to upgrade the connection
+	// to a WebSocket that carries the tunnel in both directions without
+	// polling, which also connects to the destination server like
+	// WaitForUpstream. If the upgrade fails (e.g. because an intermediary
+	// doesn't allow WebSockets or the proxy doesn't support them), the Conn
+	// falls back to polling. Stats.WebSocket tells which one is used.
+	//
+	// Over a WebSocket, data isn't buffered by enproxy, so BufferedBytes is
+	// always 0, and options that shape requests (e.g. BufferRequests,
+	// MaxResponseBytes or PollScheduler) don't apply.
+	WebSocket bool
+
+	// UseCookies: if true, each Conn keeps the cookies set by responses to its
+	// requests (e.g. session affinity cookies from a load balancer or CDN) and
+	// sends them along with its subsequent requests, so that all requests for
+	// a tunnel reach the same backend. Expired cookies are no longer sent.
+	UseCookies bool
+
+	// MaxUpstreamReconnects: if non-zero, the proxy is asked to redial the
+	// destination server up to this many times when its connection to the
+	// destination fails (e.g. because it was reset), instead of failing the
+	// tunnel. The Conn keeps working without noticing, but data that was in
+	// flight when the connection failed is lost and the destination sees a
+	// new connection, so this only suits protocols that can cope with that.
+	// The proxy caps this with Proxy.MaxUpstreamReconnects.
+	MaxUpstreamReconnects int
+
 	// BufferRequests: if true, requests to the proxy will be buffered and sent
 	// with identity encoding.  If false, they'll be streamed with chunked
 	// encoding.
 	BufferRequests bool
+
+	// PreferContentLength: if true, a streamed request body that turns out to
+	// consist of a single write (e.g. a request that the application sends
+	// in one go before waiting for the response) is sent with a
+	// Content-Length instead of chunked encoding. Bodies with more writes are
+	// still streamed. Content-Length suits CDNs that can't handle chunked
+	// request bodies, like Fastly, while chunked encoding is needed by
+	// intermediaries that stream request bodies to the proxy (see
+	// BufferRequests). Has no effect when BufferRequests is true, since
+	// buffered bodies always have a Content-Length.
+	PreferContentLength bool
+
+	// MaxBufferedWriteBytes: when buffering requests, the maximum number of
+	// bytes to buffer before sending them to the proxy. Writes block while a
+	// full buffer is being sent. Defaults to 65536.
+	MaxBufferedWriteBytes int
+
+	// MaxBufferedReadBytes: size of the buffer used for reading responses from
+	// the proxy. Once it's full, no more data is read from the proxy until the
+	// application reads. Defaults to 4096.
+	MaxBufferedReadBytes int
+
+	// ReadBufferBytes: if non-zero, Reads into buffers smaller than this are
+	// served from an internal buffer of this size, so that a series of small
+	// Reads only hands off to the reading goroutine when the buffer is empty.
+	ReadBufferBytes int
+
+	// ProxySocketReadBuffer and ProxySocketWriteBuffer: if non-zero, the sizes
+	// of the operating system's receive and send buffers for connections to
+	// the proxy, e.g. to allow more data in flight on links with a high
+	// bandwidth-delay product. They're set on connections returned by
+	// DialProxy that support SetReadBuffer and SetWriteBuffer, like
+	// *net.TCPConn and *net.UnixConn, and ignored for other connections (e.g.
+	// *tls.Conn).
+	ProxySocketReadBuffer  int
+	ProxySocketWriteBuffer int
+
+	// MaxResponseBytes: if non-zero, the proxy is asked to finish each
+	// response that carries data once it contains this many bytes, so that
+	// intermediaries that buffer whole responses don't hold back data for too
+	// long. When enproxy detects such buffering (see Stats) and this isn't
+	// set, it uses a limit of 65536 bytes until the buffering stops. The
+	// Proxy may cap responses at fewer bytes (see
+	// Proxy.MaxResponseChunkBytes).
+	MaxResponseBytes int
+
+	// ReceiveWindow: if non-zero, how many bytes this Conn is ready to receive
+	// in response to each request. Every request grants the proxy a window of
+	// ReceiveWindow bytes, less any data that was received but not yet read
+	// by the application, and the proxy sends no more than that in its
+	// response. Since a Conn only polls for more data once the application
+	// has read the previous response, the window is replenished as the
+	// application reads. This bounds the data in flight for slow readers.
+	ReceiveWindow int
+
+	// MaxReorderBytes and ReorderTimeout: the Proxy numbers its responses to
+	// polls, and responses that arrive ahead of their turn are held until the
+	// ones before them have been read, up to MaxReorderBytes (defaults to 1
+	// MiB) and for no longer than ReorderTimeout (defaults to 5 seconds),
+	// which is checked as responses arrive. Since a Conn has one poll in
+	// flight at a time, responses only arrive out of order if one got lost,
+	// e.g. on a connection that broke before its data arrived. Once either
+	// limit is exceeded, the Read fails with ErrResponseLost rather than
+	// returning data with a hole in it.
+	MaxReorderBytes int
+	ReorderTimeout  time.Duration
+
+	// PollScheduler: decides when to poll the proxy for more data, defaults to
+	// a FixedPollScheduler that polls again as soon as the previous poll
+	// finished.
+	PollScheduler PollScheduler
+
+	// CompressionDict: if non-nil, data is compressed in both directions using
+	// flate with this preset dictionary, which should contain byte sequences
+	// that are common in the tunneled protocol. The Proxy must be configured
+	// with the same CompressionDict, otherwise it rejects compressed requests
+	// and doesn't compress responses.
+	CompressionDict []byte
+
+	// BodyEncoding: how tunnel data is encoded in the bodies of requests and
+	// responses, defaults to BodyEncodingRaw. BodyEncodingBase64 is a fallback
+	// for networks whose intermediaries mangle binary bodies, at the cost of
+	// about 33% more bytes on the wire. Each request tells the Proxy how its
+	// body and the body of its response are encoded, so the Proxy doesn't
+	// need to be configured, but it needs to be recent enough to understand
+	// BodyEncoding: older ones would pass encoded data on to the destination
+	// server. Doesn't apply to WebSockets.
+	BodyEncoding BodyEncoding
+
+	// OnRequest: optional callback that gets called with every request to the
+	// proxy, after enproxy has added its headers and right before the request
+	// is sent. This allows auditing exactly which headers are sent.
+	OnRequest func(req *http.Request)
+
+	// MaxRequestHeaderBytes: if non-zero, requests whose headers (as written
+	// by http.Header.Write, so excluding the Host, User-Agent and
+	// Content-Length headers that net/http adds) exceed this many bytes fail
+	// instead of being sent to the proxy.
+	MaxRequestHeaderBytes int
+
+	// Trace: optional hooks that get called at various stages of requests to
+	// the proxy, useful for finding out which phase of a request is slow.
+	Trace *ClientTrace
+
+	// Events: optional channel to which the Conn sends Events about its
+	// tunnel (opened, closed, reconnected and polls), for applications that
+	// would rather aggregate events than set hooks. Sends never block: if the
+	// channel is full, the event is dropped and counted in
+	// Stats.DroppedEvents, so the channel should be buffered and drained
+	// promptly. The channel is shared by all copies of the Config and enproxy
+	// never closes it.
+	Events chan<- Event
+
+	// ReconnectBackoff: if its MaxTotal is set, polls that fail because the
+	// connection to the proxy broke are retried on a new connection instead
+	// of failing the Read (see ReconnectBackoff).
+	ReconnectBackoff ReconnectBackoff
+
+	// MaxRedirects: how many redirects from the proxy to follow for a single
+	// request. Redirects are followed by sending the request to the host in the
+	// redirect's Location. Defaults to 0, meaning that redirects fail with a
+	// RedirectError.
+	MaxRedirects int
+
+	// MaxRetryAfter: the longest Retry-After that the Conn waits out when the
+	// proxy rate-limits it with a 429 or 503, defaults to 1 minute. Requests
+	// are reissued once the wait is over, except for requests with streamed
+	// bodies, which can't be reissued. Responses whose Retry-After is longer
+	// than this, and responses to requests that can't be reissued, fail with a
+	// RateLimitError.
+	MaxRetryAfter time.Duration
+}
+
+// Clone returns a copy of this Config that can be changed without affecting the
+// original. Slices are copied, while functions, PollScheduler, Trace and
+// Events are shared with the original.
+func (config *Config) Clone() *Config {
+	clone := *config
+	if config.CompressionDict != nil {
+		clone.CompressionDict = append([]byte(nil), config.CompressionDict...)
+	}
+	return &clone
 }
 
 // dialFunc is a function that dials an address (e.g. the upstream proxy)
@@ -170,11 +979,29 @@ type rwResponse struct {
 	err error
 }
 
+// connInfo is a connection to the proxy. Responses are read through bufReader,
+// which may read past the end of the current response (e.g. into a response
+// to a pipelined request, or into data that doesn't use HTTP framing at all).
+// Those bytes belong to whoever reads from the connection next, so:
+//
+//   - the connection is only reused for another request once bufReader has
+//     no buffered bytes left over from the previous response (see
+//     Dialer.put and framedBody)
+//   - code that stops reading HTTP responses and reads the connection raw
+//     must do so through detach, which hands off the buffered bytes before
+//     reading from conn
 type connInfo struct {
 	conn        *idletiming.IdleTimingConn
 	bufReader   *bufio.Reader
 	closed      bool
 	closedMutex sync.Mutex
+
+	// raw: the connection returned by DialProxy, which conn wraps
+	raw net.Conn
+
+	// tunnelID: the id of the Conn whose tunnel a request on this connection
+	// last succeeded for (see Config.ReplayEstablishment)
+	tunnelID string
 }
 
 type hostWithResponse struct {
@@ -185,8 +1012,22 @@ type hostWithResponse struct {
 
 // Write() implements the function from net.Conn
 func (c *conn) Write(b []byte) (n int, err error) {
-	err = c.getAsyncErr()
-	if err != nil {
+	if !atomic.CompareAndSwapInt32(&c.writing, 0, 1) {
+		return 0, ErrConcurrentWrite
+	}
+	defer atomic.StoreInt32(&c.writing, 0)
+	if err := c.getAsyncErr(); err != nil {
+		return 0, err
+	}
+	if c.writeClosed() {
+		return 0, ErrWriteClosed
+	}
+	if c.usesWriteDeadline() {
+		return c.writeWithDeadline(b)
+	}
+	if c.ws != nil {
+		n, err = c.ws.Write(b)
+		atomic.AddInt64(&c.bytesWritten, int64(n))
 		return
 	}
 
@@ -198,20 +1039,74 @@ func (c *conn) Write(b []byte) (n int, err error) {
 			if !ok {
 				return 0, io.EOF
 			} else {
-				return res.n, res.err
+				return res.n, c.interruptedErr(res.err)
 			}
 		case err := <-c.asyncErrCh:
 			return 0, err
 		}
 	} else {
-		return 0, io.EOF
+		return 0, net.ErrClosed
 	}
 }
 
-// Read() implements the function from net.Conn
+// Read() implements the function from net.Conn. Unless b is empty, Read
+// blocks until it can return some data or an error, so it never returns
+// (0, nil) even when polls to the proxy come back empty. If the proxy has more
+// data waiting once a response has been read, Read polls for it right away to
+// fill the rest of b, so that a big Read isn't limited to a single response.
 func (c *conn) Read(b []byte) (n int, err error) {
-	err = c.getAsyncErr()
-	if err != nil {
+	if !atomic.CompareAndSwapInt32(&c.reading, 0, 1) {
+		return 0, ErrConcurrentRead
+	}
+	defer atomic.StoreInt32(&c.reading, 0)
+	if err := c.getAsyncErr(); err != nil {
+		return 0, err
+	}
+	if c.readClosed() {
+		return 0, io.EOF
+	}
+	if c.readBuf == nil {
+		return c.doRead(b)
+	}
+
+	c.readBufMutex.Lock()
+	defer c.readBufMutex.Unlock()
+	if c.readClosed() {
+		// Discard what's left over
+		c.readPending = nil
+		c.readErr = nil
+		atomic.StoreInt64(&c.pendingReadBytes, 0)
+		return 0, io.EOF
+	}
+	if len(c.readPending) == 0 && c.readErr == nil {
+		if len(b) >= len(c.readBuf) {
+			// Big enough to read directly
+			return c.doRead(b)
+		}
+		n, c.readErr = c.doRead(c.readBuf)
+		c.readPending = c.readBuf[:n]
+	} else {
+		atomic.AddInt64(&c.readsFromBuffer, 1)
+	}
+
+	n = copy(b, c.readPending)
+	c.readPending = c.readPending[n:]
+	atomic.StoreInt64(&c.pendingReadBytes, int64(len(c.readPending)))
+	if len(c.readPending) == 0 {
+		err = c.readErr
+		c.readErr = nil
+	}
+	return
+}
+
+// doRead reads into b using the processReads goroutine
+func (c *conn) doRead(b []byte) (n int, err error) {
+	if c.usesReadDeadline() {
+		return c.readWithDeadline(b)
+	}
+	if c.ws != nil {
+		n, err = c.ws.Read(b)
+		atomic.AddInt64(&c.bytesRead, int64(n))
 		return
 	}
 
@@ -223,24 +1118,30 @@ func (c *conn) Read(b []byte) (n int, err error) {
 			if !ok {
 				return 0, io.EOF
 			} else {
-				return res.n, res.err
+				return res.n, c.interruptedErr(res.err)
 			}
 		case err := <-c.asyncErrCh:
 			return 0, err
+		case <-c.readClosedCh:
+			return 0, io.EOF
 		}
 	} else {
-		return 0, io.EOF
+		return 0, net.ErrClosed
 	}
 }
 
 func (c *conn) fail(err error) {
-	log.Debugf("Failing on %v", err)
+	c.logger().Debugf("Failing on %v", err)
 
-	c.asyncErrMutex.Lock()
-	if c.asyncErr != nil {
-		c.asyncErr = err
+	if isClosed(c.closedCh) {
+		// Errors that come from closing don't count, and Close takes care
+		// of waking up waiting readers and writers
+		return
 	}
-	c.asyncErrMutex.Unlock()
+	// Only the first error counts
+	c.asyncErr.CompareAndSwap(nil, latchedError{err})
+
+	c.markReady(err)
 
 	// Let any waiting readers or writers know about the error
 	for i := 0; i < 2; i++ {
@@ -252,66 +1153,110 @@ func (c *conn) fail(err error) {
 		}
 	}
 
+	c.setCloseReason(CloseReasonError)
 	go func() {
 		if err := c.Close(); err != nil {
-			log.Debugf("Unable to close connection: %v", err)
+			c.logger().Debugf("Unable to close connection: %v", err)
 		}
 	}()
 }
 
+// latchedError wraps the error in asyncErr, since an atomic.Value only holds
+// values of a single type
+type latchedError struct {
+	err error
+}
+
+// getAsyncErr returns the error that failed the Conn, if any
 func (c *conn) getAsyncErr() error {
-	c.asyncErrMutex.RLock()
-	err := c.asyncErr
-	c.asyncErrMutex.RUnlock()
-	return err
+	if latched, ok := c.asyncErr.Load().(latchedError); ok {
+		return latched.err
+	}
+	return nil
+}
+
+// readFailed fails the Conn on an error from polling the proxy if
+// ReadErrorsAreFatal.
+func (c *conn) readFailed(err error) {
+	if c.getConfig().ReadErrorsAreFatal && !isClosed(c.closedCh) {
+		c.fail(err)
+	}
+}
+
+// BufferedBytes() implements the function from Conn
+func (c *conn) BufferedBytes() (write int, read int) {
+	read = int(atomic.LoadInt64(&c.bufferedReadBytes)) + c.Buffered()
+	return int(atomic.LoadInt64(&c.bufferedWriteBytes)), read
 }
 
-// Close() implements the function from net.Conn
+// Buffered() implements the function from Conn
+func (c *conn) Buffered() int {
+	return int(atomic.LoadInt64(&c.pendingReadBytes) + atomic.LoadInt64(&c.deadlineReadBytes))
+}
+
+// Close() implements the function from net.Conn. It shuts the conn down in a
+// fixed order: new reads and writes are refused, the processing goroutines are
+// told to stop, the requests that are in flight are drained (being interrupted
+// after closeGracePeriod), and only then are the remaining proxyConns closed
+// and the response channels closed, so that nothing can still be using either
+// of them.
 func (c *conn) Close() error {
 	increment(&closing)
 	defer decrement(&closing)
 
+	// Closes by the application and on errors record their reason before
+	// getting here, so otherwise we're being closed by the idle timer.
+	c.setCloseReason(CloseReasonIdle)
+
 	c.closingMutex.Lock()
 	wasClosing := c.closing
 	c.closing = true
 	c.closingMutex.Unlock()
 	if !wasClosing {
 		increment(&blockedOnClosing)
-		close(c.writeRequestsCh)
-		close(c.readRequestsCh)
-		<-c.doneReadingCh
-		<-c.doneWritingCh
-		<-c.doneRequestingCh
+		c.markReady(net.ErrClosed)
+		close(c.closedCh)
+		c.emit(Event{Type: TunnelClosed, Err: c.getAsyncErr(), CloseReason: c.CloseReason()})
+		if c.ws != nil {
+			if err := c.ws.Close(); err != nil {
+				c.logger().Debugf("Unable to close WebSocket: %v", err)
+			}
+			c.proxyConnsMutex.Lock()
+			for proxyConn := range c.proxyConns {
+				delete(c.proxyConns, proxyConn)
+			}
+			c.proxyConnsMutex.Unlock()
+		} else {
+			// Don't wait indefinitely for requests that are blocked on a
+			// slow proxy
+			interrupt := time.AfterFunc(closeGracePeriod, c.interruptProxyConns)
+			close(c.writeRequestsCh)
+			close(c.readRequestsCh)
+			<-c.doneReadingCh
+			<-c.doneWritingCh
+			<-c.doneRequestingCh
+			interrupt.Stop()
+			c.closeProxyConns()
+			// Our goroutines were the only senders, so reads and writes that
+			// are still waiting for a response see EOF
+			close(c.readResponsesCh)
+			close(c.writeResponsesCh)
+		}
 		decrement(&blockedOnClosing)
 		decrement(&open)
 	}
 	return nil
 }
 
-// LocalAddr() is not implemented
+// LocalAddr() implements the function from net.Conn. The local end of a
+// tunnel has no address of its own, like the remote end of one accepted by a
+// Listener.
 func (c *conn) LocalAddr() net.Addr {
-	panic("LocalAddr() not implemented")
+	return tunnelAddr("enproxy")
 }
 
-// RemoteAddr() is not implemented
+// RemoteAddr() implements the function from net.Conn, returning the address
+// of the destination server
 func (c *conn) RemoteAddr() net.Addr {
-	panic("RemoteAddr() not implemented")
-}
-
-// SetDeadline() is currently unimplemented.
-func (c *conn) SetDeadline(t time.Time) error {
-	log.Tracef("SetDeadline not implemented")
-	return nil
-}
-
-// SetReadDeadline() is currently unimplemented.
-func (c *conn) SetReadDeadline(t time.Time) error {
-	log.Tracef("SetReadDeadline not implemented")
-	return nil
-}
-
-// SetWriteDeadline() is currently unimplemented.
-func (c *conn) SetWriteDeadline(t time.Time) error {
-	log.Tracef("SetWriteDeadline not implemented")
-	return nil
+	return tunnelAddr(c.addr)
 }
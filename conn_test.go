@@ -3,15 +3,28 @@ package enproxy
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/getlantern/fdcount"
+	"github.com/getlantern/golog"
+	"github.com/getlantern/idletiming"
 	"github.com/getlantern/keyman"
 	"github.com/getlantern/testify/assert"
 	. "github.com/getlantern/waitforserver"
@@ -89,8 +102,4740 @@ func TestIdle(t *testing.T) {
 	}
 }
 
+func TestBufferedBytes(t *testing.T) {
+	startServers(t, false)
+
+	flushTimeout := 250 * time.Millisecond
+	conn, err := Dial(httpAddr, &Config{
+		DialProxy: func(addr string) (net.Conn, error) {
+			return net.Dial("tcp", proxyAddr)
+		},
+		NewRequest:     newRequest,
+		BufferRequests: true,
+		FlushTimeout:   flushTimeout,
+	})
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	defer func() {
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	}()
+
+	req := makeRequest(conn, t)
+	time.Sleep(flushTimeout / 5)
+	write, _ := conn.(Conn).BufferedBytes()
+	assert.True(t, write > 0, "Request should be buffered before flush")
+
+	readResponse(conn, req, t)
+	var read int
+	for i := 0; i < 10; i++ {
+		// The response can arrive before the write side has finished processing
+		// the request, so wait a bit for the buffer to drain.
+		write, read = conn.(Conn).BufferedBytes()
+		if write == 0 {
+			break
+		}
+		time.Sleep(flushTimeout / 10)
+	}
+	assert.Equal(t, 0, write, "Nothing should be buffered for writing after flush")
+	assert.Equal(t, 0, read, "Nothing should be buffered for reading after reading whole response")
+}
+
+func TestRedirect(t *testing.T) {
+	proxy := &Proxy{}
+	proxy.Start()
+	redirector := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.Host == "old.example" {
+			http.Redirect(resp, req, "http://new.example/maintenance", http.StatusFound)
+			return
+		}
+		proxy.ServeHTTP(resp, req)
+	}))
+	defer redirector.Close()
+	startHttpServer(t)
+
+	dialRedirected := func(maxRedirects int) net.Conn {
+		conn, err := Dial(httpAddr, &Config{
+			DialProxy: func(addr string) (net.Conn, error) {
+				return net.Dial("tcp", redirector.Listener.Addr().String())
+			},
+			NewRequest: func(host, path, method string, body io.Reader) (*http.Request, error) {
+				if host == "" {
+					host = "old.example"
+				}
+				req, err := http.NewRequest(method, "http://"+redirector.Listener.Addr().String()+"/"+path+"/", body)
+				if err == nil {
+					req.Host = host
+				}
+				return req, err
+			},
+			BufferRequests: true,
+			MaxRedirects:   maxRedirects,
+		})
+		if err != nil {
+			t.Fatalf("Unable to dial: %v", err)
+		}
+		return conn
+	}
+
+	conn := dialRedirected(0)
+	_, err := conn.Read(make([]byte, 10))
+	var redirectErr *RedirectError
+	if assert.True(t, errors.As(err, &redirectErr), "Unfollowed redirect should result in RedirectError, not %v", err) {
+		assert.Equal(t, http.StatusFound, redirectErr.StatusCode)
+		assert.Equal(t, "http://new.example/maintenance", redirectErr.Location)
+	}
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+
+	conn = dialRedirected(1)
+	doRequests(conn, t)
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC)
+	wait, ok := parseRetryAfter("120", now)
+	assert.True(t, ok, "Delta-seconds should parse")
+	assert.Equal(t, 2*time.Minute, wait)
+	wait, ok = parseRetryAfter("Wed, 21 Oct 2015 07:28:30 GMT", now)
+	assert.True(t, ok, "HTTP-date should parse")
+	assert.Equal(t, 30*time.Second, wait)
+	wait, ok = parseRetryAfter("Wed, 21 Oct 2015 07:27:00 GMT", now)
+	assert.True(t, ok, "HTTP-date in the past should parse")
+	assert.Equal(t, time.Duration(0), wait)
+	_, ok = parseRetryAfter("soon", now)
+	assert.False(t, ok, "Garbage shouldn't parse")
+
+	proxy := &Proxy{IdleTimeout: 500 * time.Millisecond}
+	proxy.Start()
+	startHttpServer(t)
+
+	dialRateLimited := func(retryAfter func() string, maxRetryAfter time.Duration) (net.Conn, *[]time.Time) {
+		var mutex sync.Mutex
+		var requestTimes []time.Time
+		limiter := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			mutex.Lock()
+			requestTimes = append(requestTimes, time.Now())
+			first := len(requestTimes) == 1
+			mutex.Unlock()
+			if first {
+				resp.Header().Set("Retry-After", retryAfter())
+				resp.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			proxy.ServeHTTP(resp, req)
+		}))
+		t.Cleanup(limiter.Close)
+
+		conn, err := Dial(httpAddr, &Config{
+			DialProxy: func(addr string) (net.Conn, error) {
+				return net.Dial("tcp", limiter.Listener.Addr().String())
+			},
+			NewRequest: func(host, path, method string, body io.Reader) (*http.Request, error) {
+				return http.NewRequest(method, "http://"+limiter.Listener.Addr().String()+"/"+path+"/", body)
+			},
+			BufferRequests: true,
+			MaxRetryAfter:  maxRetryAfter,
+		})
+		if err != nil {
+			t.Fatalf("Unable to dial: %v", err)
+		}
+		return conn, &requestTimes
+	}
+
+	for _, format := range []struct {
+		name       string
+		retryAfter func() string
+	}{
+		{"delta-seconds", func() string { return "1" }},
+		{"HTTP-date", func() string { return time.Now().Add(2 * time.Second).UTC().Format(http.TimeFormat) }},
+	} {
+		conn, requestTimes := dialRateLimited(format.retryAfter, 0)
+		doRequests(conn, t)
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+		if assert.True(t, len(*requestTimes) > 1, "%v: rate-limited request should have been reissued", format.name) {
+			gap := (*requestTimes)[1].Sub((*requestTimes)[0])
+			assert.True(t, gap >= 900*time.Millisecond, "%v: next request should have waited for Retry-After, only waited %v", format.name, gap)
+		}
+	}
+
+	conn, _ := dialRateLimited(func() string { return "60" }, 1*time.Second)
+	_, err := conn.Read(make([]byte, 10))
+	assert.True(t, errors.Is(err, ErrRateLimited), "Retry-After longer than MaxRetryAfter should result in ErrRateLimited, not %v", err)
+	var rateLimitErr *RateLimitError
+	if assert.True(t, errors.As(err, &rateLimitErr), "Error should be a RateLimitError") {
+		assert.Equal(t, http.StatusTooManyRequests, rateLimitErr.StatusCode)
+		assert.Equal(t, 60*time.Second, rateLimitErr.RetryAfter)
+	}
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+}
+
+func TestWaitForUpstream(t *testing.T) {
+	startServers(t, false)
+
+	config := &Config{
+		DialProxy: func(addr string) (net.Conn, error) {
+			return net.Dial("tcp", proxyAddr)
+		},
+		NewRequest:      newRequest,
+		WaitForUpstream: true,
+	}
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	unreachableAddr := l.Addr().String()
+	if err := l.Close(); err != nil {
+		t.Fatalf("Unable to close listener: %v", err)
+	}
+	_, err = Dial(unreachableAddr, config)
+	if assert.Error(t, err, "Dialing unreachable destination should fail") {
+		assert.Contains(t, err.Error(), "502")
+	}
+
+	conn, err := Dial(httpAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	doRequests(conn, t)
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+}
+
+func TestKeepAlives(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	proxy := &Proxy{IdleTimeout: 2 * time.Second}
+	proxy.Start()
+	// Like an intermediary that mishandles reused connections, optionally
+	// drops any request that isn't the first on its connection
+	var mutex sync.Mutex
+	requestsByConn := make(map[string]int)
+	var breakReuse int32
+	var closeRequested int32
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		requestsByConn[req.RemoteAddr]++
+		reused := requestsByConn[req.RemoteAddr] > 1
+		mutex.Unlock()
+		if req.Close {
+			atomic.StoreInt32(&closeRequested, 1)
+		}
+		if reused && atomic.LoadInt32(&breakReuse) == 1 {
+			conn, _, err := resp.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+			return
+		}
+		proxy.ServeHTTP(resp, req)
+	}))
+	defer server.Close()
+	maxRequestsPerConn := func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		max := 0
+		for _, requests := range requestsByConn {
+			if requests > max {
+				max = requests
+			}
+		}
+		requestsByConn = make(map[string]int)
+		return max
+	}
+
+	echo := func(config *Config) Stats {
+		conn, err := Dial(destAddr, config)
+		if err != nil {
+			t.Fatalf("Unable to dial: %v", err)
+		}
+		for i := 0; i < 3; i++ {
+			_, err = conn.Write([]byte("Hello"))
+			assert.NoError(t, err, "Writing should succeed")
+			_, err = io.ReadFull(conn, make([]byte, 5))
+			assert.NoError(t, err, "Reading should succeed")
+		}
+		stats := conn.(Conn).Stats()
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+		return stats
+	}
+
+	// Connections are reused by default
+	config := testConfig(server.Listener.Addr().String())
+	config.WaitForUpstream = true
+	config.ProbeKeepAlives = true
+	stats := echo(config)
+	assert.False(t, stats.KeepAlivesDisabled, "Probe should have found that keep alives work")
+	assert.True(t, maxRequestsPerConn() > 1, "Connections should have been reused")
+	assert.EqualValues(t, 0, atomic.LoadInt32(&closeRequested), "Conn shouldn't have asked for connections to be closed")
+
+	// Each request on its own connection
+	config.DisableKeepAlives = true
+	config.ProbeKeepAlives = false
+	stats = echo(config)
+	assert.True(t, stats.KeepAlivesDisabled)
+	assert.Equal(t, 1, maxRequestsPerConn(), "Connections shouldn't have been reused")
+	assert.EqualValues(t, 1, atomic.LoadInt32(&closeRequested), "Conn should have asked for connections to be closed")
+
+	// Probing detects the broken intermediary
+	atomic.StoreInt32(&breakReuse, 1)
+	config.DisableKeepAlives = false
+	config.ProbeKeepAlives = true
+	stats = echo(config)
+	assert.True(t, stats.KeepAlivesDisabled, "Probe should have disabled keep alives")
+	assert.Equal(t, 2, maxRequestsPerConn(), "Only the probe should have reused a connection")
+}
+
+func TestVersionNegotiation(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	proxy := &Proxy{IdleTimeout: 2 * time.Second}
+	proxy.Start()
+	// legacy: emulate a proxy and client from before versioning, which
+	// neither announce their versions nor understand those of the other side
+	var legacy int32
+	var heartbeats int64
+	var trailersSent int32
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/"+OP_HEARTBEAT+"/") {
+			atomic.AddInt64(&heartbeats, 1)
+		}
+		if atomic.LoadInt32(&legacy) == 1 {
+			req.Header.Del(X_ENPROXY_VERSION)
+			req.Header.Del(X_ENPROXY_CAPABILITIES)
+			resp = &legacyResponseWriter{resp, &trailersSent}
+		}
+		proxy.ServeHTTP(resp, req)
+	}))
+	defer server.Close()
+
+	var announced, requests int64
+	config := testConfig(server.Listener.Addr().String())
+	config.HeartbeatInterval = 50 * time.Millisecond
+	config.OnRequest = func(req *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		if req.Header.Get(X_ENPROXY_VERSION) != "" {
+			atomic.AddInt64(&announced, 1)
+			assert.Equal(t, "more,no-wait,heartbeat,seq,close-write,response-seq", req.Header.Get(X_ENPROXY_CAPABILITIES))
+		}
+	}
+	echo := func() Stats {
+		conn, err := Dial(destAddr, config)
+		if err != nil {
+			t.Fatalf("Unable to dial: %v", err)
+		}
+		for i := 0; i < 3; i++ {
+			_, err = conn.Write([]byte("Hello"))
+			assert.NoError(t, err, "Writing should succeed")
+			_, err = io.ReadFull(conn, make([]byte, 5))
+			assert.NoError(t, err, "Reading should succeed")
+		}
+		// Give heartbeats a chance
+		time.Sleep(150 * time.Millisecond)
+		stats := conn.(Conn).Stats()
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+		return stats
+	}
+
+	stats := echo()
+	assert.Equal(t, PROTOCOL_VERSION, stats.ProxyVersion, "Should have learned the proxy's version")
+	assert.True(t, atomic.LoadInt64(&announced) > 0, "Should have announced our version")
+	assert.True(t, atomic.LoadInt64(&announced) < atomic.LoadInt64(&requests), "Should have stopped announcing our version once the proxy answered")
+	assert.True(t, atomic.LoadInt64(&heartbeats) > 0, "Should have sent heartbeats")
+
+	// Features that the other side doesn't know about aren't used
+	atomic.StoreInt32(&legacy, 1)
+	atomic.StoreInt64(&heartbeats, 0)
+	stats = echo()
+	assert.Equal(t, 0, stats.ProxyVersion, "Proxy without version should be version 0")
+	assert.EqualValues(t, 0, atomic.LoadInt64(&heartbeats), "Shouldn't have sent heartbeats to proxy that doesn't support them")
+	assert.EqualValues(t, 0, atomic.LoadInt32(&trailersSent), "Proxy shouldn't have sent trailers to client that doesn't know them")
+}
+
+// legacyResponseWriter strips the version headers from responses and records
+// whether trailers were declared.
+type legacyResponseWriter struct {
+	http.ResponseWriter
+	trailersSent *int32
+}
+
+func (w *legacyResponseWriter) WriteHeader(status int) {
+	w.Header().Del(X_ENPROXY_VERSION)
+	w.Header().Del(X_ENPROXY_CAPABILITIES)
+	if w.Header().Get("Trailer") != "" {
+		atomic.StoreInt32(w.trailersSent, 1)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *legacyResponseWriter) Flush() {
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+func TestResponseReordering(t *testing.T) {
+	// Responses that arrive ahead of their turn are held
+	reorderer := &responseReorderer{c: &conn{config: &Config{MaxReorderBytes: 10}}}
+	numbered := func(seq int, body string) *http.Response {
+		return &http.Response{
+			Header: http.Header{X_ENPROXY_SEQ: []string{strconv.Itoa(seq)}},
+			Body:   ioutil.NopCloser(strings.NewReader(body)),
+		}
+	}
+	read := func(resp *http.Response) string {
+		if !assert.NotNil(t, resp, "Should have gotten a response") {
+			return ""
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return string(b)
+	}
+	resp, err := reorderer.order(numbered(1, "a"))
+	assert.NoError(t, err)
+	assert.Equal(t, "a", read(resp))
+	resp, err = reorderer.order(numbered(3, "c"))
+	assert.NoError(t, err)
+	assert.Nil(t, resp, "Response ahead of its turn should have been held")
+	assert.Nil(t, reorderer.take(), "Nothing should be ready while response 2 is missing")
+	resp, err = reorderer.order(numbered(2, "b"))
+	assert.NoError(t, err)
+	assert.Equal(t, "b", read(resp))
+	assert.Equal(t, "c", read(reorderer.take()))
+	resp, err = reorderer.order(numbered(2, "b"))
+	assert.NoError(t, err)
+	assert.Nil(t, resp, "Duplicate response should have been discarded")
+	resp, err = reorderer.order(&http.Response{Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader("d"))})
+	assert.NoError(t, err)
+	assert.Equal(t, "d", read(resp), "Responses without numbers should be read right away")
+	_, err = reorderer.order(numbered(6, "0123456789a"))
+	assert.True(t, errors.Is(err, ErrResponseLost), "Exceeding MaxReorderBytes should fail, not %v", err)
+
+	// A response that gets lost fails the Read once ReorderTimeout passes
+	destAddr := startEchoServer(t)
+	proxy := &Proxy{IdleTimeout: 2 * time.Second}
+	proxy.Start()
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		proxy.ServeHTTP(&lostResponseWriter{resp}, req)
+	}))
+	defer server.Close()
+
+	config := testConfig(server.Listener.Addr().String())
+	config.ReorderTimeout = 100 * time.Millisecond
+	conn, err := Dial(destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	defer conn.Close()
+	var received []byte
+	for i := 0; i < 20 && !errors.Is(err, ErrResponseLost); i++ {
+		_, err = conn.Write([]byte("Hello"))
+		assert.NoError(t, err, "Writing should succeed")
+		assert.NoError(t, conn.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+		b := make([]byte, 100)
+		var n int
+		n, err = conn.Read(b)
+		received = append(received, b[:n]...)
+	}
+	assert.True(t, errors.Is(err, ErrResponseLost), "Read should have failed, not with %v", err)
+	assert.Equal(t, strings.Repeat("Hello", len(received)/5), string(received), "Data before the lost response should have been received in order")
+}
+
+// lostResponseWriter renumbers responses to make it look like the third one
+// got lost
+type lostResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w *lostResponseWriter) WriteHeader(status int) {
+	if seq, _ := strconv.Atoi(w.Header().Get(X_ENPROXY_SEQ)); seq >= 3 {
+		w.Header().Set(X_ENPROXY_SEQ, strconv.Itoa(seq+1))
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *lostResponseWriter) Flush() {
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+func TestWaitReady(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	proxy := &Proxy{IdleTimeout: 500 * time.Millisecond}
+	proxy.Start()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+	config := testConfig(server.Listener.Addr().String())
+
+	waitReady := func(conn net.Conn, timeout time.Duration) error {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return conn.(Conn).WaitReady(ctx)
+	}
+
+	conn, err := Dial(destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	assert.Equal(t, context.DeadlineExceeded, waitReady(conn, 50*time.Millisecond), "Tunnel shouldn't be ready before first write")
+	_, err = conn.Write([]byte("Hello"))
+	assert.NoError(t, err, "Writing should succeed")
+	assert.NoError(t, waitReady(conn, 5*time.Second), "Tunnel should be ready after first write")
+	_, err = io.ReadFull(conn, make([]byte, 5))
+	assert.NoError(t, err, "Reading should succeed")
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	assert.NoError(t, waitReady(conn, 50*time.Millisecond), "Tunnel should stay ready after closing")
+
+	conn, err = Dial(destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	assert.Equal(t, net.ErrClosed, waitReady(conn, 5*time.Second), "Closing before ready should fail WaitReady")
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	unreachableAddr := l.Addr().String()
+	if err := l.Close(); err != nil {
+		t.Fatalf("Unable to close listener: %v", err)
+	}
+	conn, err = Dial(unreachableAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	_, err = conn.Write([]byte("Hello"))
+	assert.NoError(t, err, "Writing should succeed")
+	err = waitReady(conn, 5*time.Second)
+	if assert.Error(t, err, "Unreachable destination should fail WaitReady") {
+		assert.Contains(t, err.Error(), "Unable to dial out")
+	}
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+
+	config.WaitForUpstream = true
+	conn, err = Dial(destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	assert.NoError(t, waitReady(conn, 50*time.Millisecond), "Tunnel should be ready when dialed with WaitForUpstream")
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+}
+
+func TestOnRequest(t *testing.T) {
+	startServers(t, false)
+
+	var headers []string
+	var headersMutex sync.Mutex
+	config := &Config{
+		DialProxy: func(addr string) (net.Conn, error) {
+			return net.Dial("tcp", proxyAddr)
+		},
+		NewRequest: newRequest,
+		OnRequest: func(req *http.Request) {
+			headersMutex.Lock()
+			defer headersMutex.Unlock()
+			for key := range req.Header {
+				headers = append(headers, key)
+			}
+		},
+	}
+	conn, err := Dial(httpAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	doRequests(conn, t)
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+
+	headersMutex.Lock()
+	defer headersMutex.Unlock()
+	assert.True(t, len(headers) > 0, "OnRequest should have been called")
+	for _, key := range headers {
+		switch key {
+		case X_ENPROXY_RECEIVED:
+			// Polls say how much of the tunnel's data arrived
+		case X_ENPROXY_SEQ:
+			// Write requests also carry their sequence number
+		case X_ENPROXY_VERSION, X_ENPROXY_CAPABILITIES:
+			// Requests announce our version until the proxy has answered
+		default:
+			assert.Equal(t, "Content-Type", key, "Unexpected request header")
+		}
+	}
+
+	// Content-Type: application/octet-stream\r\n is 40 bytes
+	config.OnRequest = nil
+	config.MaxRequestHeaderBytes = 39
+	conn, err = Dial(httpAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	_, err = conn.Read(make([]byte, 10))
+	if assert.Error(t, err, "Request with too big headers should fail") {
+		assert.Contains(t, err.Error(), "more than the maximum of 39")
+	}
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+}
+
+func TestClientTrace(t *testing.T) {
+	startServers(t, false)
+
+	var events []string
+	var eventsMutex sync.Mutex
+	record := func(event string) {
+		eventsMutex.Lock()
+		defer eventsMutex.Unlock()
+		events = append(events, event)
+	}
+	config := &Config{
+		DialProxy: func(addr string) (net.Conn, error) {
+			return net.Dial("tcp", proxyAddr)
+		},
+		NewRequest: newRequest,
+		Trace: &ClientTrace{
+			DialProxyStart: func() {
+				record("dial start")
+			},
+			DialProxyDone: func(err error) {
+				record(fmt.Sprintf("dial done %v", err))
+			},
+			GotProxyConn: func(reused bool) {
+				record(fmt.Sprintf("got conn %v", reused))
+			},
+			WroteRequest: func(op string, err error) {
+				record(fmt.Sprintf("wrote %v %v", op, err))
+			},
+			GotFirstResponseByte: func(op string) {
+				record(fmt.Sprintf("first byte %v", op))
+			},
+			GotResponse: func(op string, statusCode int, err error) {
+				record(fmt.Sprintf("response %v %d %v", op, statusCode, err))
+			},
+		},
+	}
+	conn, err := Dial(httpAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	doRequests(conn, t)
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+
+	eventsMutex.Lock()
+	defer eventsMutex.Unlock()
+	if assert.True(t, len(events) >= 6, "Not enough events: %v", events) {
+		assert.Equal(t, []string{
+			"dial start",
+			"dial done <nil>",
+			"got conn false",
+			"wrote write <nil>",
+			"first byte write",
+			"response write 200 <nil>",
+		}, events[:6], "Events for first request should be in order")
+	}
+	for _, event := range []string{"wrote read <nil>", "first byte read", "response read 200 <nil>"} {
+		assert.Contains(t, events, event)
+	}
+}
+
+// TestEstablishTime makes sure that the time that it takes to establish a
+// tunnel is reported, along with how much of it went to dialing the proxy.
+func TestEstablishTime(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	// The proxy takes a while to connect to the destination server
+	proxy := &Proxy{IdleTimeout: 500 * time.Millisecond}
+	proxy.Start()
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/"+OP_CONNECT+"/") {
+			time.Sleep(200 * time.Millisecond)
+		}
+		proxy.ServeHTTP(resp, req)
+	}))
+	defer server.Close()
+
+	established := make(chan time.Duration, 2)
+	config := testConfig(server.Listener.Addr().String())
+	dialProxy := config.DialProxy
+	config.DialProxy = func(addr string) (net.Conn, error) {
+		time.Sleep(100 * time.Millisecond)
+		return dialProxy(addr)
+	}
+	config.WaitForUpstream = true
+	config.Trace = &ClientTrace{
+		TunnelEstablished: func(latency time.Duration, err error) {
+			assert.NoError(t, err, "Establishing should succeed")
+			established <- latency
+		},
+	}
+	conn, err := Dial(destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	stats := conn.(Conn).Stats()
+	assert.True(t, stats.ProxyDialTime >= 100*time.Millisecond, "Dialing the proxy should have taken at least 100ms, not %v", stats.ProxyDialTime)
+	assert.True(t, stats.EstablishTime >= stats.ProxyDialTime+200*time.Millisecond, "Establishing should have taken at least 200ms longer than dialing, not %v", stats.EstablishTime)
+	select {
+	case latency := <-established:
+		assert.Equal(t, stats.EstablishTime, latency, "Hook should get the same latency as Stats")
+	default:
+		t.Error("TunnelEstablished should have been called")
+	}
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	assert.Empty(t, established, "TunnelEstablished should be called only once")
+}
+
+// TestEvents makes sure that a Conn sends events about its tunnel to
+// Config.Events, dropping them when the channel is full.
+func TestEvents(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	proxy := &Proxy{IdleTimeout: 500 * time.Millisecond}
+	proxy.Start()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	events := make(chan Event, 100)
+	config := testConfig(server.Listener.Addr().String())
+	config.WaitForUpstream = true
+	config.Tag = "tagged"
+	config.Events = events
+	conn, err := Dial(destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	_, err = conn.Write([]byte(TEXT))
+	assert.NoError(t, err, "Writing should succeed")
+	_, err = io.ReadFull(conn, make([]byte, len(TEXT)))
+	assert.NoError(t, err, "Reading should succeed")
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+
+	var received []Event
+	for len(events) > 0 {
+		received = append(received, <-events)
+	}
+	if !assert.True(t, len(received) >= 3, "Should have received events, got %v", received) {
+		return
+	}
+	opened := received[0]
+	assert.Equal(t, TunnelOpened, opened.Type, "First event should be the tunnel opening")
+	assert.NoError(t, opened.Err)
+	assert.True(t, opened.Latency > 0, "Opening should report its latency")
+	assert.Equal(t, conn.(Conn).SessionState().ID, opened.ID)
+	assert.Equal(t, destAddr, opened.Addr)
+	assert.Equal(t, "tagged", opened.Tag)
+	polls := 0
+	var closed []Event
+	for _, event := range received {
+		assert.False(t, event.Time.IsZero(), "Events should have a time")
+		switch event.Type {
+		case PollIssued:
+			polls++
+		case TunnelClosed:
+			closed = append(closed, event)
+		}
+	}
+	assert.True(t, polls > 0, "Polls should have been reported")
+	if assert.Len(t, closed, 1, "Closing should have been reported once") {
+		assert.Equal(t, CloseReasonApplication, closed[0].CloseReason)
+		assert.NoError(t, closed[0].Err)
+	}
+	assert.EqualValues(t, 0, conn.(Conn).Stats().DroppedEvents, "No events should have been dropped")
+
+	// Events that don't fit are dropped without blocking the Conn
+	config.Events = make(chan Event, 1)
+	conn, err = Dial(destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	_, err = conn.Write([]byte(TEXT))
+	assert.NoError(t, err, "Writing should succeed")
+	_, err = io.ReadFull(conn, make([]byte, len(TEXT)))
+	assert.NoError(t, err, "Reading with a full channel should succeed")
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	assert.True(t, conn.(Conn).Stats().DroppedEvents > 0, "Events should have been dropped")
+}
+func TestUseCookies(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	var cookies []string
+	var cookiesMutex sync.Mutex
+	proxy := &Proxy{IdleTimeout: 500 * time.Millisecond}
+	proxy.Start()
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		cookiesMutex.Lock()
+		cookies = append(cookies, req.Header.Get("Cookie"))
+		cookiesMutex.Unlock()
+		if _, err := req.Cookie("backend"); err != nil {
+			// Pin the client to this backend
+			http.SetCookie(resp, &http.Cookie{Name: "backend", Value: "b1", Path: "/"})
+		}
+		proxy.ServeHTTP(resp, req)
+	}))
+	defer server.Close()
+
+	echo := func(useCookies bool) []string {
+		cookiesMutex.Lock()
+		cookies = nil
+		cookiesMutex.Unlock()
+
+		config := testConfig(server.Listener.Addr().String())
+		config.UseCookies = useCookies
+		conn, err := Dial(destAddr, config)
+		if err != nil {
+			t.Fatalf("Unable to dial: %v", err)
+		}
+		for i := 0; i < 3; i++ {
+			_, err := conn.Write([]byte("Hello"))
+			assert.NoError(t, err, "Writing should succeed")
+			_, err = io.ReadFull(conn, make([]byte, 5))
+			assert.NoError(t, err, "Reading should succeed")
+			// Pause for longer than FlushTimeout so that every write is its
+			// own request
+			time.Sleep(50 * time.Millisecond)
+		}
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+
+		cookiesMutex.Lock()
+		defer cookiesMutex.Unlock()
+		return cookies
+	}
+
+	sent := echo(true)
+	if assert.True(t, len(sent) > 2, "Not enough requests") {
+		assert.Equal(t, "", sent[0], "First request shouldn't have cookies")
+		for _, cookie := range sent[1:] {
+			assert.Equal(t, "backend=b1", cookie, "Subsequent requests should replay cookie")
+		}
+	}
+
+	for _, cookie := range echo(false) {
+		assert.Equal(t, "", cookie, "Cookies shouldn't be sent unless UseCookies is set")
+	}
+}
+
+func TestConfigClone(t *testing.T) {
+	startServers(t, false)
+
+	config := &Config{
+		DialProxy: func(addr string) (net.Conn, error) {
+			return net.Dial("tcp", proxyAddr)
+		},
+		NewRequest:      newRequest,
+		CompressionDict: []byte("dictionary"),
+	}
+	clone := config.Clone()
+	clone.FlushTimeout = 5 * time.Second
+	clone.CompressionDict[0] = 'D'
+	assert.Equal(t, time.Duration(0), config.FlushTimeout, "Changing clone shouldn't change original")
+	assert.Equal(t, "dictionary", string(config.CompressionDict), "Clone should have its own CompressionDict")
+
+	// The test proxy doesn't use compression
+	config.CompressionDict = nil
+	conn, err := Dial(httpAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	doRequests(conn, t)
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	assert.Equal(t, time.Duration(0), config.FlushTimeout, "Dialing shouldn't fill in defaults on shared Config")
+	assert.Nil(t, config.PollScheduler, "Dialing shouldn't fill in defaults on shared Config")
+}
+
+func TestNewConfig(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	proxy := &Proxy{IdleTimeout: 2 * time.Second}
+	proxy.Start()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+	addr := server.Listener.Addr().String()
+	dialProxy := func(string) (net.Conn, error) {
+		return net.Dial("tcp", addr)
+	}
+	newRequest := func(host, path, method string, body io.Reader) (*http.Request, error) {
+		return http.NewRequest(method, "http://"+addr+"/"+path+"/", body)
+	}
+
+	config := NewConfig(dialProxy, newRequest,
+		WithPollInterval(10*time.Millisecond),
+		WithIdleTimeout(5*time.Second),
+		WithWaitForUpstream(),
+		WithBufferedRequests(),
+		With(func(config *Config) {
+			config.MaxRedirects = 2
+		}))
+	assert.NotNil(t, config.DialProxy)
+	assert.NotNil(t, config.NewRequest)
+	assert.Equal(t, &FixedPollScheduler{Interval: 10 * time.Millisecond}, config.PollScheduler)
+	assert.Equal(t, 5*time.Second, config.IdleTimeout)
+	assert.True(t, config.WaitForUpstream)
+	assert.True(t, config.BufferRequests)
+	assert.Equal(t, 2, config.MaxRedirects)
+	assert.Equal(t, time.Duration(0), config.FlushTimeout, "Fields without options should keep their defaults")
+
+	conn, err := Dial(destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(TEXT))
+	assert.NoError(t, err, "Writing should succeed")
+	b := make([]byte, len(TEXT))
+	_, err = io.ReadFull(conn, b)
+	assert.NoError(t, err, "Reading should succeed")
+	assert.Equal(t, TEXT, string(b))
+}
+
+func TestReconfigure(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	proxy := &Proxy{IdleTimeout: 2 * time.Second}
+	proxy.Start()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+	dialVia := func(proxyAddr string) func(string) (net.Conn, error) {
+		return func(string) (net.Conn, error) {
+			return net.Dial("tcp", proxyAddr)
+		}
+	}
+	config := testConfig(server.Listener.Addr().String())
+	config.DialProxy = dialVia(server.Listener.Addr().String())
+
+	conn, err := Dial(destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	echo := func() {
+		_, err := conn.Write([]byte("Hello"))
+		assert.NoError(t, err, "Writing should succeed")
+		_, err = io.ReadFull(conn, make([]byte, 5))
+		assert.NoError(t, err, "Reading should succeed")
+	}
+	echo()
+
+	// Changing hot-swappable fields takes effect with the next requests
+	var requests int64
+	updated := config.Clone()
+	updated.FlushTimeout = 20 * time.Millisecond
+	updated.OnRequest = func(req *http.Request) {
+		atomic.AddInt64(&requests, 1)
+	}
+	assert.NoError(t, conn.(Conn).Reconfigure(updated), "Reconfiguring hot-swappable fields should succeed")
+	echo()
+	assert.True(t, atomic.LoadInt64(&requests) > 0, "New OnRequest should have been called")
+
+	// Changing fields that determine how the tunnel was set up fails
+	incompatible := updated.Clone()
+	incompatible.DialProxy = func(addr string) (net.Conn, error) {
+		return nil, fmt.Errorf("Shouldn't be dialed")
+	}
+	err = conn.(Conn).Reconfigure(incompatible)
+	if assert.IsType(t, &ConfigChangeError{}, err, "Reconfiguring DialProxy should fail") {
+		assert.Equal(t, "DialProxy", err.(*ConfigChangeError).Field)
+	}
+	// Closures of the same function literal share their code, but they're
+	// still different functions
+	for _, proxyAddr := range []string{"127.0.0.1:1", server.Listener.Addr().String()} {
+		incompatible = updated.Clone()
+		incompatible.DialProxy = dialVia(proxyAddr)
+		err = conn.(Conn).Reconfigure(incompatible)
+		if assert.IsType(t, &ConfigChangeError{}, err, "Reconfiguring DialProxy with another closure should fail") {
+			assert.Equal(t, "DialProxy", err.(*ConfigChangeError).Field)
+		}
+	}
+	assert.Error(t, conn.(Conn).Reconfigure(nil), "Reconfiguring with nil Config should fail")
+	incompatible = updated.Clone()
+	incompatible.BufferRequests = true
+	err = conn.(Conn).Reconfigure(incompatible)
+	if assert.IsType(t, &ConfigChangeError{}, err, "Reconfiguring BufferRequests should fail") {
+		assert.Equal(t, "BufferRequests", err.(*ConfigChangeError).Field)
+	}
+
+	// A failed Reconfigure leaves the Conn as it was
+	before := atomic.LoadInt64(&requests)
+	echo()
+	assert.True(t, atomic.LoadInt64(&requests) > before, "OnRequest from successful Reconfigure should still be called")
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+}
+
+func TestWriteString(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	proxy := &Proxy{IdleTimeout: 500 * time.Millisecond}
+	proxy.Start()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	conn, err := Dial(destAddr, testConfig(server.Listener.Addr().String()))
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	defer func() {
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	}()
+
+	// Bigger than the buffer that WriteString uses
+	long := strings.Repeat("0123456789", 10000)
+	for _, s := range []string{"héllo wörld", long} {
+		n, err := conn.(Conn).WriteString(s)
+		assert.NoError(t, err, "Writing string should succeed")
+		assert.Equal(t, len(s), n, "WriteString should return number of bytes written")
+		b := make([]byte, len(s))
+		_, err = io.ReadFull(conn, b)
+		assert.NoError(t, err, "Reading should succeed")
+		assert.Equal(t, s, string(b), "Should have gotten echo")
+	}
+}
+
+// deadConn is a connection to the proxy that accepts writes but whose reads
+// fail right away, like one to a CDN that drops connections after accepting
+// them
+type deadConn struct {
+	closed int32
+}
+
+var errDeadConn = errors.New("connection reset by CDN")
+
+func (c *deadConn) Read(b []byte) (int, error) {
+	return 0, errDeadConn
+}
+
+func (c *deadConn) Write(b []byte) (int, error) {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return 0, net.ErrClosed
+	}
+	return len(b), nil
+}
+
+func (c *deadConn) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
+	return nil
+}
+
+func (c *deadConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (c *deadConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (c *deadConn) SetDeadline(t time.Time) error      { return nil }
+func (c *deadConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *deadConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func TestDeadOnArrivalProxyConn(t *testing.T) {
+	newConfig := func() *Config {
+		return &Config{
+			DialProxy: func(addr string) (net.Conn, error) {
+				return &deadConn{}, nil
+			},
+			NewRequest: newRequest,
+		}
+	}
+
+	// Dialing that waits for the upstream connection fails right away
+	config := newConfig()
+	config.WaitForUpstream = true
+	_, err := Dial("localhost:80", config)
+	if assert.Error(t, err, "Dialing via dead connection should fail") {
+		assert.True(t, errors.Is(err, errDeadConn), "Dialing should fail with the read error, not %v", err)
+	}
+
+	for _, buffered := range []bool{false, true} {
+		config := newConfig()
+		config.BufferRequests = buffered
+		conn, err := Dial("localhost:80", config)
+		if err != nil {
+			t.Fatalf("Unable to dial: %v", err)
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			// The first write is buffered until its request fails
+			_, err := conn.Write([]byte(TEXT))
+			if err == nil {
+				_, err = conn.Read(make([]byte, 10))
+			}
+			if assert.Error(t, err, "Reading or writing via dead connection should fail, buffered: %v", buffered) {
+				assert.True(t, errors.Is(err, errDeadConn), "Reading or writing should fail with the read error, not %v, buffered: %v", err, buffered)
+			}
+			_, err = conn.Write([]byte(TEXT))
+			assert.Error(t, err, "Writing after failure should fail, buffered: %v", buffered)
+			_, err = conn.Read(make([]byte, 10))
+			assert.Error(t, err, "Reading after failure should fail, buffered: %v", buffered)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Conn via dead connection hung, buffered: %v", buffered)
+		}
+		assert.Equal(t, CloseReasonError, conn.(Conn).CloseReason(), "Conn should have been closed because of the error, buffered: %v", buffered)
+		assert.NoError(t, conn.Close(), "Closing failed conn should succeed")
+	}
+}
+
+func TestFrontends(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	proxy := &Proxy{IdleTimeout: 2 * time.Second}
+	proxy.Start()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+	config := testConfig(server.Listener.Addr().String())
+
+	var heavyDials, lightDials, deadDials, lightRequests int32
+	dialCounting := func(dials *int32) func(string) (net.Conn, error) {
+		return func(addr string) (net.Conn, error) {
+			atomic.AddInt32(dials, 1)
+			return config.DialProxy(addr)
+		}
+	}
+	light := Frontend{
+		Name:      "light",
+		DialProxy: dialCounting(&lightDials),
+		NewRequest: func(host, path, method string, body io.Reader) (*http.Request, error) {
+			atomic.AddInt32(&lightRequests, 1)
+			return config.NewRequest(host, path, method, body)
+		},
+		Weight: 1,
+	}
+
+	echo := func(config *Config) {
+		conn, err := Dial(destAddr, config)
+		if err != nil {
+			t.Fatalf("Unable to dial: %v", err)
+		}
+		defer conn.Close()
+		_, err = conn.Write([]byte(TEXT))
+		assert.NoError(t, err, "Writing should succeed")
+		b := make([]byte, len(TEXT))
+		_, err = io.ReadFull(conn, b)
+		assert.NoError(t, err, "Reading should succeed")
+		assert.Equal(t, TEXT, string(b))
+	}
+
+	// Tunnels are spread by weight
+	weighted := config.Clone()
+	weighted.DialProxy = nil
+	weighted.Frontends = &FrontendSet{Frontends: []Frontend{
+		{Name: "heavy", DialProxy: dialCounting(&heavyDials), Weight: 3},
+		light,
+		{Name: "unused", DialProxy: dialCounting(&deadDials), Weight: 0},
+	}}
+	for i := 0; i < 40; i++ {
+		echo(weighted)
+	}
+	heavy, lightCount := atomic.LoadInt32(&heavyDials), atomic.LoadInt32(&lightDials)
+	assert.True(t, lightCount > 0, "Light front-end should have been used")
+	assert.True(t, heavy > lightCount, "Heavy front-end should have been used more, heavy: %d, light: %d", heavy, lightCount)
+	assert.True(t, atomic.LoadInt32(&lightRequests) > 0, "Light front-end's requests should have been built with its NewRequest")
+	assert.Equal(t, int32(0), atomic.LoadInt32(&deadDials), "Front-end without weight shouldn't have been used")
+
+	// A front-end that fails is fallen back from and then left out
+	atomic.StoreInt32(&lightDials, 0)
+	failing := config.Clone()
+	failing.DialProxy = nil
+	failing.Frontends = &FrontendSet{Cooldown: 1 * time.Minute, Frontends: []Frontend{
+		{Name: "dead", DialProxy: func(addr string) (net.Conn, error) {
+			atomic.AddInt32(&deadDials, 1)
+			return nil, errors.New("front-end down")
+		}, Weight: 1000},
+		light,
+	}}
+	for i := 0; i < 5; i++ {
+		echo(failing)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&deadDials), "Failed front-end should have been left out after failing")
+	assert.True(t, atomic.LoadInt32(&lightDials) >= 5, "Conns should have fallen back to working front-end")
+
+	// Once all front-ends have failed, they're tried again rather than not
+	// at all
+	failing.Frontends.Frontends = failing.Frontends.Frontends[:1]
+	_, err := Dial(destAddr, failing)
+	if assert.Error(t, err, "Dialing through dead front-end should fail") {
+		assert.Contains(t, err.Error(), "front-end down")
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&deadDials), "Failed front-end should have been tried again as the last resort")
+}
+
+func TestProxySocketBuffers(t *testing.T) {
+	startServers(t, false)
+
+	var conns []*bufferRecordingConn
+	var connsMutex sync.Mutex
+	config := &Config{
+		DialProxy: func(addr string) (net.Conn, error) {
+			conn, err := net.Dial("tcp", proxyAddr)
+			if err != nil {
+				return nil, err
+			}
+			rc := &bufferRecordingConn{TCPConn: conn.(*net.TCPConn)}
+			connsMutex.Lock()
+			conns = append(conns, rc)
+			connsMutex.Unlock()
+			return rc, nil
+		},
+		NewRequest:             newRequest,
+		ProxySocketReadBuffer:  256 * 1024,
+		ProxySocketWriteBuffer: 128 * 1024,
+	}
+	conn, err := Dial(httpAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	doRequests(conn, t)
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+
+	connsMutex.Lock()
+	defer connsMutex.Unlock()
+	if assert.True(t, len(conns) > 0, "Proxy should have been dialed") {
+		for _, rc := range conns {
+			assert.Equal(t, 256*1024, rc.readBuffer, "Read buffer should have been set")
+			assert.Equal(t, 128*1024, rc.writeBuffer, "Write buffer should have been set")
+		}
+	}
+}
+
+// bufferRecordingConn is a TCP connection that records the socket buffer sizes
+// set on it
+type bufferRecordingConn struct {
+	*net.TCPConn
+	readBuffer  int
+	writeBuffer int
+}
+
+func (c *bufferRecordingConn) SetReadBuffer(bytes int) error {
+	c.readBuffer = bytes
+	return c.TCPConn.SetReadBuffer(bytes)
+}
+
+func (c *bufferRecordingConn) SetWriteBuffer(bytes int) error {
+	c.writeBuffer = bytes
+	return c.TCPConn.SetWriteBuffer(bytes)
+}
+
+func TestCloseReason(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	failWrites := int32(0)
+	proxy := &Proxy{IdleTimeout: 500 * time.Millisecond}
+	proxy.Start()
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&failWrites) == 1 && strings.HasSuffix(req.URL.Path, "/"+OP_WRITE+"/") {
+			resp.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		proxy.ServeHTTP(resp, req)
+	}))
+	defer server.Close()
+	config := testConfig(server.Listener.Addr().String())
+
+	waitForReason := func(conn net.Conn, expected CloseReason) {
+		deadline := time.Now().Add(2 * time.Second)
+		for conn.(Conn).CloseReason() != expected && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(t, expected, conn.(Conn).CloseReason())
+	}
+
+	conn, err := Dial(destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	assert.Equal(t, CloseReasonNone, conn.(Conn).CloseReason(), "Open conn shouldn't have close reason")
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	assert.Equal(t, CloseReasonApplication, conn.(Conn).CloseReason())
+	assert.Equal(t, "application", conn.(Conn).CloseReason().String())
+
+	idleConfig := *config
+	idleConfig.IdleTimeout = 250 * time.Millisecond
+	conn, err = Dial(destAddr, &idleConfig)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	waitForReason(conn, CloseReasonIdle)
+	// Closing again doesn't change the reason
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	assert.Equal(t, CloseReasonIdle, conn.(Conn).CloseReason())
+
+	atomic.StoreInt32(&failWrites, 1)
+	conn, err = Dial(destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	waitForReason(conn, CloseReasonError)
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+}
+
+func TestMaxIdleTime(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	proxy := &Proxy{IdleTimeout: 500 * time.Millisecond}
+	proxy.Start()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+	config := testConfig(server.Listener.Addr().String())
+	config.MaxIdleTime = 250 * time.Millisecond
+
+	conn, err := Dial(destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	_, err = conn.Write([]byte("Hello"))
+	assert.NoError(t, err, "Writing should succeed")
+	_, err = io.ReadFull(conn, make([]byte, 5))
+	assert.NoError(t, err, "Reading should succeed")
+
+	// A blocked Read counts as activity
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 5))
+		readErr <- err
+	}()
+	time.Sleep(500 * time.Millisecond)
+	assert.Equal(t, CloseReasonNone, conn.(Conn).CloseReason(), "Conn with blocked Read shouldn't have been closed")
+	_, err = conn.Write([]byte("Hello"))
+	assert.NoError(t, err, "Writing should succeed")
+	assert.NoError(t, <-readErr, "Reading should succeed")
+
+	time.Sleep(500 * time.Millisecond)
+	assert.Equal(t, CloseReasonIdle, conn.(Conn).CloseReason(), "Unused conn should have been closed")
+	_, err = conn.Write([]byte("Hello"))
+	assert.True(t, errors.Is(err, net.ErrClosed), "Write on closed conn should fail with net.ErrClosed, not %v", err)
+	_, err = conn.Read(make([]byte, 5))
+	assert.True(t, errors.Is(err, net.ErrClosed), "Read on closed conn should fail with net.ErrClosed, not %v", err)
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+}
+
+func TestHeartbeat(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	proxy := &Proxy{IdleTimeout: 2 * time.Second}
+	proxy.Start()
+	// A proxy that doesn't have our tunnels, like one behind the same CDN
+	// after ours went away
+	otherProxy := &Proxy{IdleTimeout: 2 * time.Second}
+	otherProxy.Start()
+	var heartbeatsElsewhere int32
+	var heartbeatDelay int64
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/"+OP_HEARTBEAT+"/") {
+			time.Sleep(time.Duration(atomic.LoadInt64(&heartbeatDelay)))
+			if atomic.LoadInt32(&heartbeatsElsewhere) == 1 {
+				otherProxy.ServeHTTP(resp, req)
+				return
+			}
+		}
+		proxy.ServeHTTP(resp, req)
+	}))
+	defer server.Close()
+	config := testConfig(server.Listener.Addr().String())
+	config.HeartbeatInterval = 100 * time.Millisecond
+
+	dial := func() net.Conn {
+		conn, err := Dial(destAddr, config)
+		if err != nil {
+			t.Fatalf("Unable to dial: %v", err)
+		}
+		_, err = conn.Write([]byte("Hello"))
+		assert.NoError(t, err, "Writing should succeed")
+		_, err = io.ReadFull(conn, make([]byte, 5))
+		assert.NoError(t, err, "Reading should succeed")
+		return conn
+	}
+	expectFailure := func(conn net.Conn) {
+		readErr := make(chan error, 1)
+		go func() {
+			_, err := conn.Read(make([]byte, 5))
+			readErr <- err
+		}()
+		select {
+		case err := <-readErr:
+			assert.True(t, errors.Is(err, ErrHeartbeatFailed), "Read should fail with ErrHeartbeatFailed, not %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Conn should have failed")
+		}
+		assert.Equal(t, CloseReasonError, conn.(Conn).CloseReason())
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	}
+
+	conn := dial()
+	time.Sleep(350 * time.Millisecond)
+	assert.Equal(t, CloseReasonNone, conn.(Conn).CloseReason(), "Heartbeats should have been answered")
+	// Polls keep succeeding, but heartbeats reach a proxy without the tunnel
+	atomic.StoreInt32(&heartbeatsElsewhere, 1)
+	expectFailure(conn)
+
+	// Unanswered heartbeats
+	atomic.StoreInt32(&heartbeatsElsewhere, 0)
+	conn = dial()
+	atomic.StoreInt64(&heartbeatDelay, int64(time.Second))
+	expectFailure(conn)
+}
+
+func TestProgressTimeout(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	proxy := &Proxy{IdleTimeout: 2 * time.Second}
+	proxy.Start()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+	config := testConfig(server.Listener.Addr().String())
+	config.ProgressTimeout = 500 * time.Millisecond
+
+	conn, err := Dial(destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+
+	// Keep making progress for longer than the ProgressTimeout
+	for i := 0; i < 4; i++ {
+		_, err = conn.Write([]byte("Hello"))
+		assert.NoError(t, err, "Writing should succeed")
+		_, err = io.ReadFull(conn, make([]byte, 5))
+		assert.NoError(t, err, "Reading should succeed")
+		time.Sleep(200 * time.Millisecond)
+	}
+	assert.Equal(t, CloseReasonNone, conn.(Conn).CloseReason(), "Conn making progress shouldn't have been closed")
+
+	// A Read that's blocked because nothing arrives doesn't count as progress,
+	// even though the Conn keeps polling the proxy
+	start := time.Now()
+	_, err = conn.Read(make([]byte, 5))
+	assert.True(t, errors.Is(err, ErrNoProgress), "Read on stalled conn should fail with ErrNoProgress, not %v", err)
+	assert.WithinDuration(t, start.Add(300*time.Millisecond), time.Now(), 250*time.Millisecond, "Read should have failed once ProgressTimeout passed")
+	assert.Equal(t, CloseReasonNoProgress, conn.(Conn).CloseReason(), "Stalled conn should have been closed")
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	// Proxy that accepts requests but never responds
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	defer func() {
+		if err := l.Close(); err != nil {
+			log.Debugf("Unable to close listener: %v", err)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				if _, err := io.Copy(ioutil.Discard, conn); err != nil {
+					log.Debugf("Unable to read: %v", err)
+				}
+				if err := conn.Close(); err != nil {
+					log.Debugf("Unable to close connection: %v", err)
+				}
+			}()
+		}
+	}()
+
+	config := testConfig(l.Addr().String())
+	config.ResponseHeaderTimeout = 250 * time.Millisecond
+	conn, err := Dial("localhost:1", config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	defer func() {
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	}()
+
+	start := time.Now()
+	_, err = conn.Read(make([]byte, 10))
+	var netErr net.Error
+	if assert.True(t, errors.As(err, &netErr), "Read should fail with net.Error, not %v", err) {
+		assert.True(t, netErr.Timeout(), "Read should fail with timeout")
+	}
+	assert.True(t, time.Now().Sub(start) < 5*config.ResponseHeaderTimeout, "Read should fail soon after ResponseHeaderTimeout")
+}
+
+// TestContentLengthMismatch makes sure that responses whose bodies don't match
+// their Content-Length result in a FramingError instead of hanging or
+// misframing the next response.
+func TestContentLengthMismatch(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+	// Proxy that answers the first write with the given raw response and
+	// subsequent reads with "World" followed by EOF
+	startProxy := func(initialResponse string) string {
+		server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			if _, err := io.Copy(ioutil.Discard, req.Body); err != nil {
+				log.Debugf("Unable to read request body: %v", err)
+			}
+			if strings.HasSuffix(req.URL.Path, "/"+OP_READ+"/") {
+				resp.Header().Set(X_ENPROXY_EOF, "true")
+				if _, err := resp.Write([]byte("World")); err != nil {
+					log.Debugf("Unable to write response: %v", err)
+				}
+				return
+			}
+			conn, _, err := resp.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Errorf("Unable to hijack: %v", err)
+				return
+			}
+			if _, err := conn.Write([]byte(initialResponse)); err != nil {
+				log.Debugf("Unable to write response: %v", err)
+			}
+			<-done
+			if err := conn.Close(); err != nil {
+				log.Debugf("Unable to close connection: %v", err)
+			}
+		}))
+		go func() {
+			<-done
+			server.Close()
+		}()
+		return server.Listener.Addr().String()
+	}
+
+	// Body shorter than declared
+	config := testConfig(startProxy("HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\nHello"))
+	config.ResponseHeaderTimeout = 250 * time.Millisecond
+	conn, err := Dial("localhost:1", config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	_, err = conn.Write([]byte("Hello"))
+	assert.NoError(t, err, "Writing should succeed")
+	b := make([]byte, 10)
+	n, err := conn.Read(b)
+	assert.NoError(t, err, "Reading data that did arrive should succeed")
+	assert.Equal(t, "Hello", string(b[:n]))
+	start := time.Now()
+	_, err = conn.Read(b)
+	var framingErr *FramingError
+	if assert.True(t, errors.As(err, &framingErr), "Read should fail with FramingError, not %v", err) {
+		assert.EqualValues(t, 100, framingErr.Declared)
+		assert.EqualValues(t, 5, framingErr.Received)
+	}
+	assert.True(t, time.Now().Sub(start) < 5*config.ResponseHeaderTimeout, "Read should fail soon after body stopped arriving")
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+
+	// Body longer than declared
+	conn, err = Dial("localhost:1", testConfig(startProxy("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nHelloGarbage")))
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	defer func() {
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	}()
+	_, err = conn.Write([]byte("Hello"))
+	assert.NoError(t, err, "Writing should succeed")
+	all, err := ioutil.ReadAll(conn)
+	assert.NoError(t, err, "Reading should succeed")
+	assert.Equal(t, "HelloWorld", string(all), "Data beyond Content-Length should have been dropped")
+}
+
+// TestDetachProxyConn makes sure that detach hands off the bytes that the
+// bufio.Reader read past the end of a response, ahead of the rest of the raw
+// connection.
+func TestDetachProxyConn(t *testing.T) {
+	clientSide, proxySide := net.Pipe()
+	defer proxySide.Close()
+	proxyConn := &connInfo{
+		conn:      idletiming.Conn(clientSide, 5*time.Second, nil),
+		bufReader: bufio.NewReader(clientSide),
+	}
+	defer proxyConn.close()
+
+	// The response and the raw data that follows it arrive in one piece, so
+	// the bufio.Reader reads past the end of the response
+	go func() {
+		if _, err := proxySide.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nHelloRaw data")); err != nil {
+			t.Errorf("Unable to write response: %v", err)
+			return
+		}
+		if _, err := proxySide.Write([]byte(" and more")); err != nil {
+			t.Errorf("Unable to write more data: %v", err)
+		}
+	}()
+	resp, err := http.ReadResponse(proxyConn.bufReader, nil)
+	if !assert.NoError(t, err, "Reading response should succeed") {
+		return
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err, "Reading body should succeed")
+	assert.Equal(t, "Hello", string(body))
+	assert.Equal(t, len("Raw data"), proxyConn.bufReader.Buffered(), "Raw data should have been buffered")
+
+	raw := proxyConn.detach()
+	assert.False(t, proxyConn.usable(), "Detached proxyConn shouldn't be usable")
+	data := make([]byte, len("Raw data and more"))
+	_, err = io.ReadFull(raw, data)
+	assert.NoError(t, err, "Reading raw should succeed")
+	assert.Equal(t, "Raw data and more", string(data), "Buffered bytes should come before the rest of the raw data")
+}
+
+// TestReconnectBackoff makes sure that polls that fail because the connection
+// to the proxy broke are retried on a new connection.
+func TestReconnectBackoff(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	proxy := &Proxy{IdleTimeout: 500 * time.Millisecond}
+	proxy.Start()
+	// Drop the connections of the first 2 polls after the initial response
+	var drops int32
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/"+OP_READ+"/") && atomic.AddInt32(&drops, 1) <= 2 {
+			conn, _, err := resp.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Errorf("Unable to hijack: %v", err)
+				return
+			}
+			if err := conn.Close(); err != nil {
+				log.Debugf("Unable to close connection: %v", err)
+			}
+			return
+		}
+		proxy.ServeHTTP(resp, req)
+	}))
+	defer server.Close()
+
+	echo := func(conn net.Conn, msg string) error {
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			return err
+		}
+		b := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return err
+		}
+		if string(b) != msg {
+			return fmt.Errorf("Unexpected echo: %v", string(b))
+		}
+		return nil
+	}
+
+	events := make(chan Event, 100)
+	config := testConfig(server.Listener.Addr().String())
+	config.ReconnectBackoff = ReconnectBackoff{MaxTotal: 2 * time.Second, Initial: 50 * time.Millisecond}
+	config.Events = events
+	conn, err := Dial(destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	assert.NoError(t, echo(conn, "Hello"), "Echo in initial response should succeed")
+	assert.NoError(t, echo(conn, "World"), "Echo should survive dropped polls")
+	assert.EqualValues(t, 3, atomic.LoadInt32(&drops), "Should have retried both dropped polls")
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	reconnected := 0
+	for len(events) > 0 {
+		if event := <-events; event.Type == Reconnected {
+			reconnected++
+			assert.True(t, event.Latency >= 50*time.Millisecond, "Reconnected should tell how long polls were failing")
+		}
+	}
+	assert.Equal(t, 1, reconnected, "Recovering from the dropped polls should have been reported once")
+
+	// Without ReconnectBackoff, the Read fails
+	atomic.StoreInt32(&drops, 0)
+	conn, err = Dial(destAddr, testConfig(server.Listener.Addr().String()))
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	assert.NoError(t, echo(conn, "Hello"), "Echo in initial response should succeed")
+	assert.Error(t, echo(conn, "World"), "Echo should fail on dropped poll")
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+}
+
+// TestReconnectMidBody makes sure that when the connection to the proxy breaks
+// while it's sending a response, the retried poll picks up exactly where the
+// broken response stopped, and that the Read fails instead of losing data if
+// the proxy doesn't resend.
+func TestReconnectMidBody(t *testing.T) {
+	data := patternedData(200000)
+	// The destination only sends data once the client said go, which it does
+	// after the initial response, so that the data arrives in polls
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	defer func() {
+		if err := l.Close(); err != nil {
+			log.Debugf("Unable to close listener: %v", err)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() {
+					if err := conn.Close(); err != nil {
+						log.Debugf("Unable to close connection: %v", err)
+					}
+				}()
+				b := make([]byte, 2)
+				if _, err := io.ReadFull(conn, b); err != nil {
+					log.Debugf("Unable to read go: %v", err)
+					return
+				}
+				if _, err := conn.Write(data); err != nil {
+					log.Debugf("Unable to write data: %v", err)
+				}
+				if _, err := io.Copy(ioutil.Discard, conn); err != nil {
+					log.Debugf("Unable to read from connection: %v", err)
+				}
+			}()
+		}
+	}()
+
+	proxy := &Proxy{IdleTimeout: 500 * time.Millisecond}
+	proxy.Start()
+	// Break the first 2 polls that carry data after 10000 bytes of it
+	var drops int32
+	// With oldProxy, the client's polls and the proxy's responses lose the
+	// headers that the proxy needs to keep the data that it sent
+	var oldProxy int32
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		old := atomic.LoadInt32(&oldProxy) == 1
+		if old {
+			req.Header.Del(X_ENPROXY_RECEIVED)
+		}
+		if strings.HasSuffix(req.URL.Path, "/"+OP_READ+"/") && atomic.LoadInt32(&drops) < 2 {
+			resp = &breakingResponseWriter{ResponseWriter: resp, remaining: 10000, onBreak: func() {
+				atomic.AddInt32(&drops, 1)
+			}, stripOffset: old}
+		}
+		proxy.ServeHTTP(resp, req)
+	}))
+	defer server.Close()
+
+	config := testConfig(server.Listener.Addr().String())
+	config.ReconnectBackoff = ReconnectBackoff{MaxTotal: 2 * time.Second, Initial: 50 * time.Millisecond}
+	conn, err := Dial(l.Addr().String(), config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	sayGo(t, conn)
+	b := make([]byte, len(data))
+	_, err = io.ReadFull(conn, b)
+	assert.NoError(t, err, "Reading should survive broken responses")
+	assert.Equal(t, data, b, "Data should have arrived intact")
+	assert.EqualValues(t, 2, atomic.LoadInt32(&drops), "Should have broken 2 responses")
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+
+	// A proxy that doesn't resend data loses what was in flight, so the Read
+	// must fail
+	atomic.StoreInt32(&drops, 0)
+	atomic.StoreInt32(&oldProxy, 1)
+	conn, err = Dial(l.Addr().String(), config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	sayGo(t, conn)
+	n, err := io.ReadFull(conn, b)
+	assert.Error(t, err, "Reading should fail on broken response")
+	assert.Equal(t, data[:n], b[:n], "Data that arrived should be intact")
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+}
+
+func sayGo(t *testing.T, conn net.Conn) {
+	_, err := conn.Write([]byte("g"))
+	assert.NoError(t, err, "Writing should succeed")
+	time.Sleep(250 * time.Millisecond)
+	_, err = conn.Write([]byte("o"))
+	assert.NoError(t, err, "Writing should succeed")
+}
+
+// breakingResponseWriter is an http.ResponseWriter that lets remaining bytes
+// of the response body through and then breaks the connection, calling
+// onBreak. With stripOffset, it hides X_ENPROXY_OFFSET from the client.
+type breakingResponseWriter struct {
+	http.ResponseWriter
+	remaining   int
+	onBreak     func()
+	stripOffset bool
+	broken      bool
+}
+
+func (w *breakingResponseWriter) WriteHeader(status int) {
+	if w.stripOffset {
+		w.Header().Del(X_ENPROXY_OFFSET)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *breakingResponseWriter) Write(b []byte) (int, error) {
+	if w.broken {
+		return 0, io.ErrClosedPipe
+	}
+	if w.stripOffset {
+		w.Header().Del(X_ENPROXY_OFFSET)
+	}
+	if len(b) <= w.remaining {
+		n, err := w.ResponseWriter.Write(b)
+		w.remaining -= n
+		return n, err
+	}
+	n, err := w.ResponseWriter.Write(b[:w.remaining])
+	if err != nil {
+		return n, err
+	}
+	w.ResponseWriter.(http.Flusher).Flush()
+	w.broken = true
+	conn, _, err := w.ResponseWriter.(http.Hijacker).Hijack()
+	if err != nil {
+		return n, err
+	}
+	if err := conn.Close(); err != nil {
+		log.Debugf("Unable to close connection: %v", err)
+	}
+	w.onBreak()
+	return n, io.ErrClosedPipe
+}
+
+func (w *breakingResponseWriter) Flush() {
+	if !w.broken {
+		w.ResponseWriter.(http.Flusher).Flush()
+	}
+}
+
+// TestBodyReadTimeout makes sure that a poll whose response stops arriving
+// midway is aborted after BodyReadTimeout and retried, picking up where the
+// stalled response stopped, instead of hanging.
+func TestBodyReadTimeout(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	proxy := &Proxy{IdleTimeout: 500 * time.Millisecond}
+	proxy.Start()
+	// Once hang is set, the next poll sends 3 bytes of data and then hangs
+	// until the client goes away
+	var hang int32
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/"+OP_READ+"/") && atomic.CompareAndSwapInt32(&hang, 1, 0) {
+			resp = &stallingResponseWriter{ResponseWriter: resp, remaining: 3, done: req.Context().Done()}
+		}
+		proxy.ServeHTTP(resp, req)
+	}))
+	defer server.Close()
+
+	for _, retry := range []bool{true, false} {
+		config := testConfig(server.Listener.Addr().String())
+		config.BodyReadTimeout = 250 * time.Millisecond
+		if retry {
+			config.ReconnectBackoff = ReconnectBackoff{MaxTotal: 2 * time.Second, Initial: 50 * time.Millisecond}
+		}
+		conn, err := Dial(destAddr, config)
+		if err != nil {
+			t.Fatalf("Unable to dial: %v", err)
+		}
+		_, err = conn.Write([]byte("Hello"))
+		assert.NoError(t, err, "Writing should succeed")
+		b := make([]byte, 5)
+		_, err = io.ReadFull(conn, b)
+		assert.NoError(t, err, "Reading initial response should succeed")
+
+		atomic.StoreInt32(&hang, 1)
+		_, err = conn.Write([]byte("World"))
+		assert.NoError(t, err, "Writing should succeed")
+		_, err = io.ReadFull(conn, b[:3])
+		assert.NoError(t, err, "Reading the bytes that did arrive should succeed")
+		assert.Equal(t, "Wor", string(b[:3]))
+		start := time.Now()
+		if retry {
+			_, err = io.ReadFull(conn, b[:2])
+			assert.NoError(t, err, "Reading should succeed once the stalled poll is retried")
+			assert.Equal(t, "ld", string(b[:2]))
+		} else {
+			_, err = conn.Read(b)
+			assert.True(t, errors.Is(err, ErrBodyReadTimeout), "Read should fail with ErrBodyReadTimeout, not %v", err)
+		}
+		assert.True(t, time.Now().Sub(start) < 5*config.BodyReadTimeout, "Stalled body should be aborted soon after BodyReadTimeout")
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	}
+}
+
+// stallingResponseWriter is an http.ResponseWriter that lets remaining bytes
+// of the response body through and then hangs until done is closed.
+type stallingResponseWriter struct {
+	http.ResponseWriter
+	remaining int
+	done      <-chan struct{}
+}
+
+func (w *stallingResponseWriter) Write(b []byte) (int, error) {
+	if len(b) <= w.remaining {
+		n, err := w.ResponseWriter.Write(b)
+		w.remaining -= n
+		return n, err
+	}
+	n, err := w.ResponseWriter.Write(b[:w.remaining])
+	w.remaining -= n
+	if err != nil {
+		return n, err
+	}
+	w.ResponseWriter.(http.Flusher).Flush()
+	<-w.done
+	return n, io.ErrClosedPipe
+}
+
+func (w *stallingResponseWriter) Flush() {
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+// TestCloseWhileReading makes sure that Close returns promptly while a read is
+// blocked on a slow proxy.
+func TestCloseWhileReading(t *testing.T) {
+	destAddr := startDataServer(t, nil)
+
+	// Short IdleTimeout so that the proxy closes its connection to the
+	// destination once we're done
+	proxy := &Proxy{IdleTimeout: 500 * time.Millisecond}
+	proxy.Start()
+	// Read requests stall until the client goes away
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/"+OP_READ+"/") {
+			<-req.Context().Done()
+			return
+		}
+		proxy.ServeHTTP(resp, req)
+	}))
+	defer server.Close()
+
+	conn, err := Dial(destAddr, testConfig(server.Listener.Addr().String()))
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 10))
+		readErr <- err
+	}()
+	// Give the read time to block on the proxy
+	time.Sleep(250 * time.Millisecond)
+
+	start := time.Now()
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	elapsed := time.Now().Sub(start)
+	assert.True(t, elapsed < 1*time.Second, "Close should return promptly, took %v", elapsed)
+	select {
+	case err := <-readErr:
+		assert.Error(t, err, "Blocked read should fail once conn is closed")
+	case <-time.After(1 * time.Second):
+		t.Error("Blocked read should have returned once conn was closed")
+	}
+}
+
+func TestCloseRead(t *testing.T) {
+	// The destination echoes what it receives and reports it in received
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Destination unable to listen: %v", err)
+	}
+	defer l.Close()
+	received := make(chan string, 10)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		b := make([]byte, 100)
+		for {
+			n, err := conn.Read(b)
+			if err != nil {
+				return
+			}
+			received <- string(b[:n])
+			if _, err := conn.Write(b[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	proxy := &Proxy{IdleTimeout: 2 * time.Second}
+	proxy.Start()
+	readRequests := int32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/"+OP_READ+"/") {
+			atomic.AddInt32(&readRequests, 1)
+		}
+		proxy.ServeHTTP(resp, req)
+	}))
+	defer server.Close()
+
+	conn, err := Dial(l.Addr().String(), testConfig(server.Listener.Addr().String()))
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("before"))
+	assert.NoError(t, err, "Writing should succeed")
+	assert.Equal(t, "before", <-received)
+	b := make([]byte, 6)
+	_, err = io.ReadFull(conn, b)
+	assert.NoError(t, err, "Reading should succeed")
+	assert.Equal(t, "before", string(b))
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(b)
+		readErr <- err
+	}()
+	// Give the read time to block on the proxy
+	time.Sleep(250 * time.Millisecond)
+	assert.NoError(t, conn.(Conn).CloseRead(), "Closing read side should succeed")
+	select {
+	case err := <-readErr:
+		assert.Equal(t, io.EOF, err, "Blocked read should return EOF once read side is closed")
+	case <-time.After(1 * time.Second):
+		t.Error("Blocked read should have returned once read side was closed")
+	}
+
+	_, err = conn.Write([]byte("after"))
+	assert.NoError(t, err, "Writing should still succeed")
+	select {
+	case data := <-received:
+		assert.Equal(t, "after", data)
+	case <-time.After(2 * time.Second):
+		t.Error("Destination should have received data written after CloseRead")
+	}
+	_, err = conn.Read(b)
+	assert.Equal(t, io.EOF, err, "Reading after CloseRead should return EOF")
+
+	// The proxy isn't polled anymore
+	polls := atomic.LoadInt32(&readRequests)
+	time.Sleep(500 * time.Millisecond)
+	assert.Equal(t, polls, atomic.LoadInt32(&readRequests), "Conn shouldn't poll after CloseRead")
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+}
+
+// errorRecordingLogger records what's logged as an error, so that tests can
+// check that nothing was
+type errorRecordingLogger struct {
+	golog.Logger
+	mutex  sync.Mutex
+	errors []string
+}
+
+// testLog replaces log for the duration of the tests, which happens before any
+// goroutines that might log are started
+var testLog = &errorRecordingLogger{Logger: log}
+
+func init() {
+	log = testLog
+}
+
+func (l *errorRecordingLogger) Error(arg interface{}) {
+	l.record(fmt.Sprint(arg))
+	l.Logger.Error(arg)
+}
+
+func (l *errorRecordingLogger) Errorf(msg string, args ...interface{}) {
+	l.record(fmt.Sprintf(msg, args...))
+	l.Logger.Errorf(msg, args...)
+}
+
+func (l *errorRecordingLogger) record(msg string) {
+	l.mutex.Lock()
+	l.errors = append(l.errors, msg)
+	l.mutex.Unlock()
+}
+
+// errorsMentioning returns the errors logged so far that contain s
+func (l *errorRecordingLogger) errorsMentioning(s string) []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	var errors []string
+	for _, err := range l.errors {
+		if strings.Contains(err, s) {
+			errors = append(errors, err)
+		}
+	}
+	return errors
+}
+
+// TestCloseWrite makes sure that each direction of a tunnel can reach EOF on its
+// own, with the other direction continuing until it reaches EOF too, whichever
+// side closes first.
+func TestCloseWrite(t *testing.T) {
+	proxy := &Proxy{IdleTimeout: 2 * time.Second}
+	proxy.Start()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	for _, buffered := range []bool{false, true} {
+		for _, clientFirst := range []bool{true, false} {
+			// If the client closes first, the destination reads until EOF and
+			// then answers. Otherwise, it sends first, shuts down writing and
+			// then reads until EOF.
+			l, err := net.Listen("tcp", "localhost:0")
+			if err != nil {
+				t.Fatalf("Destination unable to listen: %v", err)
+			}
+			received := make(chan string, 1)
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				if !clientFirst {
+					if _, err := conn.Write([]byte("Hi")); err != nil {
+						log.Debugf("Unable to write: %v", err)
+					}
+					if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+						log.Debugf("Unable to close write: %v", err)
+					}
+				}
+				data, err := ioutil.ReadAll(conn)
+				if err != nil {
+					log.Debugf("Unable to read: %v", err)
+				}
+				received <- string(data)
+				if clientFirst {
+					if _, err := conn.Write([]byte("Got " + string(data))); err != nil {
+						log.Debugf("Unable to write: %v", err)
+					}
+				}
+			}()
+
+			config := testConfig(server.Listener.Addr().String())
+			config.BufferRequests = buffered
+			conn, err := Dial(l.Addr().String(), config)
+			if err != nil {
+				t.Fatalf("Unable to dial: %v", err)
+			}
+			assert.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+			if clientFirst {
+				_, err = conn.Write([]byte("Hello"))
+				assert.NoError(t, err, "Writing should succeed")
+				assert.NoError(t, conn.(Conn).CloseWrite(), "Closing write side should succeed")
+				_, err = conn.Write([]byte("Hello"))
+				assert.Equal(t, ErrWriteClosed, err, "Writing after CloseWrite should fail")
+				data, err := ioutil.ReadAll(conn)
+				assert.NoError(t, err, "Reading after CloseWrite should succeed until EOF")
+				assert.Equal(t, "Got Hello", string(data))
+			} else {
+				data, err := ioutil.ReadAll(conn)
+				assert.NoError(t, err, "Reading should succeed until EOF")
+				assert.Equal(t, "Hi", string(data))
+				_, err = conn.Write([]byte("Hello"))
+				assert.NoError(t, err, "Writing after EOF from destination should succeed")
+				assert.NoError(t, conn.(Conn).CloseWrite(), "Closing write side should succeed")
+			}
+			select {
+			case data := <-received:
+				assert.Equal(t, "Hello", data, "Destination should have read everything up to EOF")
+			case <-time.After(5 * time.Second):
+				t.Errorf("Destination should have read EOF (buffered: %v, client first: %v)", buffered, clientFirst)
+			}
+			assert.NoError(t, conn.Close(), "Closing conn should succeed")
+			assert.NoError(t, l.Close())
+		}
+	}
+}
+
+func TestCloseUnderTraffic(t *testing.T) {
+	for _, buffered := range []bool{false, true} {
+		destAddr := startEchoServer(t)
+
+		proxy := &Proxy{IdleTimeout: 2 * time.Second}
+		proxy.Start()
+		server := httptest.NewServer(proxy)
+
+		config := testConfig(server.Listener.Addr().String())
+		config.BufferRequests = buffered
+		conn, err := Dial(destAddr, config)
+		if err != nil {
+			t.Fatalf("Unable to dial: %v", err)
+		}
+
+		// Keep reads and writes in flight while closing
+		var wg sync.WaitGroup
+		errs := make(chan error, 2)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			b := make([]byte, 8192)
+			for {
+				if _, err := conn.Read(b); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			b := bytes.Repeat([]byte("x"), 8192)
+			for {
+				if _, err := conn.Write(b); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+		time.Sleep(250 * time.Millisecond)
+		assert.NoError(t, conn.Close(), "Closing under traffic should succeed")
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			assert.True(t, err == io.EOF || errors.Is(err, net.ErrClosed), "Reads and writes interrupted by Close should see EOF or ErrClosed, not %v", err)
+		}
+		assert.Empty(t, conn.(Conn).UnderlyingConns(), "Close should have closed all proxy connections")
+		assert.Empty(t, testLog.errorsMentioning(destAddr), "Close shouldn't log errors")
+
+		server.Close()
+	}
+}
+
+func TestReadErrorsAreFatal(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	proxy := &Proxy{IdleTimeout: 500 * time.Millisecond}
+	proxy.Start()
+	failReads := int32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/"+OP_READ+"/") && atomic.LoadInt32(&failReads) == 1 {
+			resp.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		proxy.ServeHTTP(resp, req)
+	}))
+	defer server.Close()
+
+	for _, fatal := range []bool{false, true} {
+		atomic.StoreInt32(&failReads, 0)
+		config := testConfig(server.Listener.Addr().String())
+		config.ReadErrorsAreFatal = fatal
+		conn, err := Dial(destAddr, config)
+		if err != nil {
+			t.Fatalf("Unable to dial: %v", err)
+		}
+		_, err = conn.Write([]byte("Hello"))
+		assert.NoError(t, err, "Writing should succeed")
+		_, err = io.ReadFull(conn, make([]byte, 5))
+		assert.NoError(t, err, "Reading should succeed")
+
+		atomic.StoreInt32(&failReads, 1)
+		_, readErr := conn.Read(make([]byte, 5))
+		assert.Error(t, readErr, "Reading should fail once polls fail")
+		_, err = conn.Write([]byte("Hello"))
+		if fatal {
+			assert.Equal(t, readErr, err, "Writing should fail with the read error")
+			_, err = conn.Read(make([]byte, 5))
+			assert.Equal(t, readErr, err, "Reading again should fail with the same error")
+		} else {
+			assert.NoError(t, err, "Writing should still succeed if read errors aren't fatal")
+		}
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	}
+}
+
+// TestSmallReadBuffer makes sure that reading with a buffer smaller than the
+// data in a response doesn't lose data and doesn't require a new request for
+// every Read.
+func TestSmallReadBuffer(t *testing.T) {
+	data := patternedData(64 * 1024)
+	destAddr := startDataServer(t, data)
+
+	readRequests := int32(0)
+	proxy := &Proxy{}
+	proxy.Start()
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/"+OP_READ+"/") {
+			atomic.AddInt32(&readRequests, 1)
+		}
+		proxy.ServeHTTP(resp, req)
+	}))
+	defer server.Close()
+
+	conn, err := Dial(destAddr, testConfig(server.Listener.Addr().String()))
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	defer func() {
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	}()
+
+	received := make([]byte, 0, len(data))
+	b := make([]byte, 1)
+	reads := int64(0)
+	for len(received) < len(data) {
+		n, err := conn.Read(b)
+		if err != nil {
+			t.Fatalf("Unable to read after %d bytes: %v", len(received), err)
+		}
+		reads++
+		assert.True(t, n <= len(b), "Read should never return more than len(b)")
+		received = append(received, b[:n]...)
+	}
+	assert.True(t, bytes.Equal(data, received), "Received data didn't match sent data")
+	assert.True(t, int(atomic.LoadInt32(&readRequests)) < len(data)/1000, "Reads should have been served from existing responses, but saw %d read requests", readRequests)
+
+	stats := conn.(Conn).Stats()
+	assert.Equal(t, reads, stats.ReadsFromBuffer+stats.ReadsRequiringPoll, "Every Read should have been counted")
+	assert.True(t, stats.ReadsRequiringPoll <= int64(atomic.LoadInt32(&readRequests)), "Reads requiring poll should match read requests")
+	assert.True(t, stats.ReadsFromBuffer > stats.ReadsRequiringPoll, "Most Reads should have been served from open responses")
+}
+
+// TestReadBuffer makes sure that with ReadBufferBytes set, small Reads are
+// served from the internal read buffer instead of each one going to the
+// processReads goroutine.
+func TestReadBuffer(t *testing.T) {
+	data := patternedData(64 * 1024)
+	destAddr := startDataServer(t, data)
+
+	proxy := &Proxy{}
+	proxy.Start()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	config := testConfig(server.Listener.Addr().String())
+	config.ReadBufferBytes = 4096
+	conn, err := Dial(destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	defer func() {
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	}()
+
+	received := make([]byte, 0, len(data))
+	b := make([]byte, 10)
+	for len(received) < len(data) {
+		n, err := conn.Read(b)
+		if err != nil {
+			t.Fatalf("Unable to read after %d bytes: %v", len(received), err)
+		}
+		received = append(received, b[:n]...)
+	}
+	assert.True(t, bytes.Equal(data, received), "Received data didn't match sent data")
+	roundTrips := atomic.LoadInt64(&conn.(*idleTimingConn).readRoundTrips)
+	assert.True(t, roundTrips <= int64(len(data)/len(b)/10), "Reads should have been served from the read buffer, but saw %d round trips", roundTrips)
+}
+
+// TestBuffered makes sure that Buffered reports the data held in the read
+// buffer and that Read returns exactly that data before going to the proxy
+// again.
+func TestBuffered(t *testing.T) {
+	data := patternedData(64 * 1024)
+	destAddr := startDataServer(t, data)
+
+	proxy := &Proxy{}
+	proxy.Start()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	config := testConfig(server.Listener.Addr().String())
+	config.ReadBufferBytes = 4096
+	conn, err := Dial(destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	defer func() {
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	}()
+	c := conn.(Conn)
+	assert.Equal(t, 0, c.Buffered(), "Nothing should be buffered before reading")
+
+	received := make([]byte, 0, len(data))
+	b := make([]byte, 10)
+	n, err := conn.Read(b)
+	if err != nil {
+		t.Fatalf("Unable to read: %v", err)
+	}
+	received = append(received, b[:n]...)
+	buffered := c.Buffered()
+	if !assert.True(t, buffered > 0, "Small read should have left data in the read buffer") {
+		return
+	}
+	_, unread := c.BufferedBytes()
+	assert.True(t, unread >= buffered, "BufferedBytes should include the buffered data")
+
+	roundTrips := atomic.LoadInt64(&conn.(*idleTimingConn).readRoundTrips)
+	rest := make([]byte, buffered)
+	for len(rest) > 0 {
+		n, err := conn.Read(rest)
+		if err != nil {
+			t.Fatalf("Unable to read buffered data: %v", err)
+		}
+		received = append(received, rest[:n]...)
+		rest = rest[n:]
+	}
+	assert.Equal(t, 0, c.Buffered(), "Reading the buffered data should have emptied the read buffer")
+	assert.Equal(t, roundTrips, atomic.LoadInt64(&conn.(*idleTimingConn).readRoundTrips), "Buffered data should have been returned without going to the proxy")
+
+	for len(received) < len(data) {
+		n, err := conn.Read(b)
+		if err != nil {
+			t.Fatalf("Unable to read after %d bytes: %v", len(received), err)
+		}
+		received = append(received, b[:n]...)
+	}
+	assert.True(t, bytes.Equal(data, received), "Received data didn't match sent data")
+}
+
+func TestReadAvailable(t *testing.T) {
+	data := patternedData(64 * 1024)
+	destAddr := startDataServer(t, data)
+
+	proxy := &Proxy{}
+	proxy.Start()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	config := testConfig(server.Listener.Addr().String())
+	// Small responses, so that the proxy has more waiting after each
+	config.MaxResponseBytes = 4096
+	conn, err := Dial(destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	defer func() {
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	}()
+	c := conn.(Conn)
+
+	received := make([]byte, 0, len(data))
+	deadline := time.Now().Add(5 * time.Second)
+	for len(received) < len(data) && time.Now().Before(deadline) {
+		b, err := c.ReadAvailable(len(data))
+		if err != nil {
+			t.Fatalf("Unable to read available data after %d bytes: %v", len(received), err)
+		}
+		received = append(received, b...)
+		if len(b) == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	assert.True(t, bytes.Equal(data, received), "Received data didn't match sent data")
+
+	// Nothing more is coming, which ReadAvailable doesn't wait for
+	start := time.Now()
+	b, err := c.ReadAvailable(100)
+	assert.NoError(t, err)
+	assert.Empty(t, b, "Nothing should have been available")
+	assert.True(t, time.Now().Sub(start) < 1*time.Second, "ReadAvailable shouldn't have waited for data")
+
+	// Data that Read buffered comes first
+	config.ReadBufferBytes = 4096
+	echo, err := Dial(startEchoServer(t), config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	defer func() {
+		assert.NoError(t, echo.Close(), "Closing conn should succeed")
+	}()
+	_, err = echo.Write([]byte("Hello"))
+	assert.NoError(t, err, "Writing should succeed")
+	_, err = io.ReadFull(echo, make([]byte, 1))
+	assert.NoError(t, err, "Reading should succeed")
+	b, err = echo.(Conn).ReadAvailable(100)
+	assert.NoError(t, err)
+	assert.Equal(t, "ello", string(b), "Should have gotten the rest of the data")
+}
+
+func BenchmarkSmallReads(b *testing.B) {
+	benchmarkSmallReads(b, 0)
+}
+
+func BenchmarkSmallReadsBuffered(b *testing.B) {
+	benchmarkSmallReads(b, 4096)
+}
+
+// benchmarkSmallReads reads b.N bytes one byte at a time, reporting the number
+// of round trips to the processReads goroutine per Read.
+func benchmarkSmallReads(b *testing.B, readBufferBytes int) {
+	destAddr := startDataServer(b, patternedData(b.N))
+
+	proxy := &Proxy{}
+	proxy.Start()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	config := testConfig(server.Listener.Addr().String())
+	config.ReadBufferBytes = readBufferBytes
+	conn, err := Dial(destAddr, config)
+	if err != nil {
+		b.Fatalf("Unable to dial: %v", err)
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			b.Errorf("Unable to close conn: %v", err)
+		}
+	}()
+
+	buf := make([]byte, 1)
+	b.ResetTimer()
+	for read := 0; read < b.N; {
+		n, err := conn.Read(buf)
+		if err != nil {
+			b.Fatalf("Unable to read after %d bytes: %v", read, err)
+		}
+		read += n
+	}
+	b.StopTimer()
+	roundTrips := atomic.LoadInt64(&conn.(*idleTimingConn).readRoundTrips)
+	b.ReportMetric(float64(roundTrips)/float64(b.N), "roundtrips/op")
+}
+
+func BenchmarkWrite(b *testing.B) {
+	conn, accepted := dialInMemory(b)
+	go func() {
+		if _, err := io.Copy(ioutil.Discard, accepted); err != nil {
+			log.Debugf("Unable to read: %v", err)
+		}
+	}()
+
+	msg := patternedData(32 * 1024)
+	b.SetBytes(int64(len(msg)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.Write(msg); err != nil {
+			b.Fatalf("Unable to write: %v", err)
+		}
+	}
+}
+
+func BenchmarkRead(b *testing.B) {
+	conn, accepted := dialInMemory(b)
+	msg := patternedData(32 * 1024)
+	go func() {
+		for {
+			if _, err := accepted.Write(msg); err != nil {
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, len(msg))
+	b.SetBytes(int64(len(msg)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			b.Fatalf("Unable to read: %v", err)
+		}
+	}
+}
+
+func BenchmarkRoundTrip(b *testing.B) {
+	conn, accepted := dialInMemory(b)
+	go func() {
+		if _, err := io.Copy(accepted, accepted); err != nil {
+			log.Debugf("Unable to echo: %v", err)
+		}
+	}()
+
+	msg := []byte("ping")
+	buf := make([]byte, len(msg))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.Write(msg); err != nil {
+			b.Fatalf("Unable to write: %v", err)
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			b.Fatalf("Unable to read: %v", err)
+		}
+	}
+}
+
+// dialInMemory dials a Conn through a Proxy without using the network: the
+// client reaches the proxy through pipes, and the Proxy hands the tunnel to a
+// Listener. It returns the Conn and the accepted end of the tunnel, both of
+// which are closed when the test or benchmark finishes.
+func dialInMemory(b testing.TB) (net.Conn, net.Conn) {
+	proxy := &Proxy{}
+	tunnels := NewListener(proxy)
+	proxyListener := newPipeListener()
+	go func() {
+		if err := proxy.Serve(proxyListener); err != nil {
+			log.Debugf("Proxy stopped serving: %v", err)
+		}
+	}()
+
+	config := &Config{
+		DialProxy: func(addr string) (net.Conn, error) {
+			return proxyListener.dial()
+		},
+		NewRequest: func(host, path, method string, body io.Reader) (*http.Request, error) {
+			return http.NewRequest(method, "http://proxy/"+path+"/", body)
+		},
+	}
+	conn, err := Dial("service:1", config)
+	if err != nil {
+		b.Fatalf("Unable to dial: %v", err)
+	}
+	// The tunnel is only handed to the Listener once data arrives
+	if _, err := conn.Write([]byte{0}); err != nil {
+		b.Fatalf("Unable to write: %v", err)
+	}
+	accepted, err := tunnels.Accept()
+	if err != nil {
+		b.Fatalf("Unable to accept: %v", err)
+	}
+	if _, err := io.ReadFull(accepted, make([]byte, 1)); err != nil {
+		b.Fatalf("Unable to read: %v", err)
+	}
+	b.Cleanup(func() {
+		for _, c := range []io.Closer{conn, accepted, tunnels, proxyListener} {
+			if err := c.Close(); err != nil {
+				log.Debugf("Unable to close: %v", err)
+			}
+		}
+	})
+	return conn, accepted
+}
+
+// pipeListener is a net.Listener whose connections are net.Pipes created by
+// dial
+type pipeListener struct {
+	connsCh   chan net.Conn
+	closedCh  chan struct{}
+	closeOnce sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{
+		connsCh:  make(chan net.Conn),
+		closedCh: make(chan struct{}),
+	}
+}
+
+func (l *pipeListener) dial() (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.connsCh <- server:
+		return client, nil
+	case <-l.closedCh:
+		return nil, ErrListenerClosed
+	}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.connsCh:
+		return conn, nil
+	case <-l.closedCh:
+		return nil, ErrListenerClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closedCh)
+	})
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return tunnelAddr("pipe")
+}
+
+func TestTLSOverTunnel(t *testing.T) {
+	// For its certificate
+	startHttpsServer(t)
+	keypair, err := tls.X509KeyPair(cert.PEMEncoded(), pk.PEMEncoded())
+	if err != nil {
+		t.Fatalf("Unable to generate x509 key pair: %s", err)
+	}
+	clientConfig := &tls.Config{
+		ServerName: "localhost",
+		RootCAs:    cert.PoolContainingCert(),
+	}
+
+	conn, accepted := dialInMemory(t)
+	go func() {
+		server := tls.Server(accepted, &tls.Config{Certificates: []tls.Certificate{keypair}})
+		if _, err := io.Copy(server, server); err != nil {
+			log.Debugf("Unable to echo: %v", err)
+		}
+		if err := server.Close(); err != nil {
+			log.Debugf("Unable to close: %v", err)
+		}
+	}()
+
+	client := tls.Client(conn, clientConfig)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.HandshakeContext(ctx); err != nil {
+		t.Fatalf("Unable to handshake: %v", err)
+	}
+	assert.Equal(t, "service:1", client.RemoteAddr().String(), "Remote address should be the destination")
+	assert.Equal(t, "service:1", accepted.LocalAddr().String(), "Accepted tunnel should have the destination as its local address")
+	assert.Equal(t, accepted.RemoteAddr(), client.LocalAddr(), "Local address should match the accepted tunnel's remote address")
+	echo := func(msg []byte) {
+		// Write concurrently, since the tunnel doesn't buffer much
+		writeErr := make(chan error, 1)
+		go func() {
+			_, err := client.Write(msg)
+			writeErr <- err
+		}()
+		b := make([]byte, len(msg))
+		_, err := io.ReadFull(client, b)
+		assert.NoError(t, err, "Reading should succeed")
+		assert.NoError(t, <-writeErr, "Writing should succeed")
+		assert.True(t, bytes.Equal(msg, b), "Should have gotten echo of %d bytes", len(msg))
+	}
+	for _, size := range []int{1, 100, 64 * 1024} {
+		echo(patternedData(size))
+	}
+
+	// A Read that times out leaves the TLS connection usable
+	assert.NoError(t, client.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	_, err = client.Read(make([]byte, 10))
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded), "Read should have timed out, not %v", err)
+	assert.NoError(t, client.SetReadDeadline(time.Time{}))
+	echo([]byte("Hello after timeout"))
+
+	// Handshakes give up when their context is done, which interrupts the
+	// handshake using a deadline in the past
+	conn, accepted = dialInMemory(t)
+	go func() {
+		if _, err := io.Copy(ioutil.Discard, accepted); err != nil {
+			log.Debugf("Unable to read: %v", err)
+		}
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = tls.Client(conn, clientConfig).HandshakeContext(ctx)
+	assert.Error(t, err, "Handshake with unresponsive server should fail")
+	assert.True(t, time.Now().Sub(start) < 2*time.Second, "Handshake should have given up on time")
+}
+
+func TestDeadlines(t *testing.T) {
+	conn, accepted := dialInMemory(t)
+
+	assert.NoError(t, conn.SetWriteDeadline(time.Now().Add(-1*time.Second)))
+	_, err := conn.Write([]byte("Hello"))
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded), "Write past deadline should fail, not %v", err)
+	netErr, ok := err.(net.Error)
+	assert.True(t, ok && netErr.Timeout(), "Timeout should be a net.Error")
+	assert.NoError(t, conn.SetWriteDeadline(time.Time{}))
+
+	b := make([]byte, 5)
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	start := time.Now()
+	_, err = conn.Read(b)
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded), "Read past deadline should fail, not %v", err)
+	elapsed := time.Now().Sub(start)
+	assert.True(t, elapsed >= 100*time.Millisecond && elapsed < time.Second, "Read should have timed out at deadline, not after %v", elapsed)
+
+	// Data that arrives for the timed out read is returned by the next Read,
+	// even one with a smaller buffer
+	_, err = accepted.Write([]byte("Hello"))
+	assert.NoError(t, err, "Writing to tunnel should succeed")
+	assert.NoError(t, conn.SetReadDeadline(time.Time{}))
+	small := make([]byte, 2)
+	n, err := conn.Read(small)
+	assert.NoError(t, err, "Reading should succeed")
+	assert.Equal(t, "He", string(small[:n]))
+	_, err = io.ReadFull(conn, b[:3])
+	assert.NoError(t, err, "Reading should succeed")
+	assert.Equal(t, "llo", string(b[:3]))
+
+	// Extending a deadline keeps blocked Reads waiting
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		assert.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		time.Sleep(100 * time.Millisecond)
+		if _, err := accepted.Write([]byte("World")); err != nil {
+			log.Debugf("Unable to write: %v", err)
+		}
+	}()
+	_, err = io.ReadFull(conn, b)
+	assert.NoError(t, err, "Reading before extended deadline should succeed")
+	assert.Equal(t, "World", string(b))
+}
+
+// TestReadReturnsAvailableData makes sure that Read returns as soon as some
+// data is available rather than waiting to fill the buffer.
+func TestReadReturnsAvailableData(t *testing.T) {
+	chunk := []byte("0123456789")
+	pause := 2 * time.Second
+
+	destAddr := startTricklingServer(t, chunk, pause)
+
+	proxy := &Proxy{IdleTimeout: 500 * time.Millisecond}
+	proxy.Start()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	for _, readBufferBytes := range []int{0, 8192} {
+		config := testConfig(server.Listener.Addr().String())
+		config.ReadBufferBytes = readBufferBytes
+		conn, err := Dial(destAddr, config)
+		if err != nil {
+			t.Fatalf("Unable to dial: %v", err)
+		}
+
+		start := time.Now()
+		n, err := conn.Read(make([]byte, 4096))
+		elapsed := time.Now().Sub(start)
+		assert.NoError(t, err, "Read should succeed")
+		assert.Equal(t, len(chunk), n, "Read should return the available data")
+		assert.True(t, elapsed < pause/2, "Read shouldn't wait for more data, took %v", elapsed)
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	}
+}
+
+func TestMaxInFlightRequests(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	proxy := &Proxy{IdleTimeout: 500 * time.Millisecond}
+	proxy.Start()
+	// Count requests from their arrival until their response headers are sent
+	var inFlight, maxInFlight int64
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt64(&inFlight, 1)
+		for {
+			max := atomic.LoadInt64(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt64(&maxInFlight, max, n) {
+				break
+			}
+		}
+		w := &headerNotifyingWriter{ResponseWriter: resp, onHeader: func() {
+			atomic.AddInt64(&inFlight, -1)
+		}}
+		proxy.ServeHTTP(w, req)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	config := testConfig(server.Listener.Addr().String())
+	config.MaxInFlightRequests = 1
+
+	conn, err := Dial(destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	defer func() {
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	}()
+
+	msg := []byte("Hello")
+	count := 10
+	readErr := make(chan error, 1)
+	go func() {
+		b := make([]byte, len(msg)*count)
+		_, err := io.ReadFull(conn, b)
+		if err == nil && string(b) != strings.Repeat(string(msg), count) {
+			err = fmt.Errorf("Unexpected data: %v", string(b))
+		}
+		readErr <- err
+	}()
+	for i := 0; i < count; i++ {
+		_, err := conn.Write(msg)
+		assert.NoError(t, err, "Writing should succeed")
+		assert.True(t, conn.(Conn).InFlightRequests() <= 1, "Conn shouldn't have more than 1 request in flight")
+		// Long enough for each write to get its own request, while reads keep
+		// polling
+		time.Sleep(50 * time.Millisecond)
+	}
+	select {
+	case err := <-readErr:
+		assert.NoError(t, err, "Reading echo should succeed")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Reading echo timed out")
+	}
+	assert.EqualValues(t, 1, atomic.LoadInt64(&maxInFlight), "Proxy shouldn't have seen concurrent requests")
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, conn.(Conn).InFlightRequests(), "Idle conn shouldn't have requests in flight")
+
+	// A request that's waiting for a slot gives up once the Conn is closed
+	c := conn.(*idleTimingConn)
+	c.inFlightSlots <- struct{}{}
+	began := make(chan error, 1)
+	go func() {
+		began <- c.beginRequest()
+	}()
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	select {
+	case err := <-began:
+		assert.Equal(t, net.ErrClosed, err, "Waiting request should have failed")
+	case <-time.After(closeGracePeriod):
+		t.Fatal("Waiting request didn't notice Close")
+	}
+}
+
+// headerNotifyingWriter is an http.ResponseWriter that calls onHeader once the
+// response headers are written
+type headerNotifyingWriter struct {
+	http.ResponseWriter
+	onHeader func()
+	once     sync.Once
+}
+
+func (w *headerNotifyingWriter) WriteHeader(status int) {
+	w.once.Do(func() {
+		w.ResponseWriter.WriteHeader(status)
+		w.onHeader()
+	})
+}
+
+func (w *headerNotifyingWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *headerNotifyingWriter) Flush() {
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+// TestReadNeverReturnsNothing makes sure that Read keeps polling through empty
+// responses instead of returning (0, nil).
+func TestReadNeverReturnsNothing(t *testing.T) {
+	data := []byte("0123456789")
+	destAddr := startDataServer(t, data)
+
+	emptyResponses := int32(0)
+	proxy := &Proxy{IdleTimeout: 500 * time.Millisecond}
+	proxy.Start()
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/"+OP_READ+"/") && atomic.AddInt32(&emptyResponses, -1) >= 0 {
+			// Finish poll without data, like the proxy does after a while
+			resp.WriteHeader(http.StatusOK)
+			return
+		}
+		proxy.ServeHTTP(resp, req)
+	}))
+	defer server.Close()
+
+	for _, readBufferBytes := range []int{0, 8192} {
+		atomic.StoreInt32(&emptyResponses, 3)
+		config := testConfig(server.Listener.Addr().String())
+		config.ReadBufferBytes = readBufferBytes
+		// Don't get data in response to the first write
+		config.WaitForUpstream = true
+		conn, err := Dial(destAddr, config)
+		if err != nil {
+			t.Fatalf("Unable to dial: %v", err)
+		}
+
+		received := 0
+		for received < len(data) {
+			n, err := conn.Read(make([]byte, 4096))
+			if !assert.NoError(t, err, "Read should succeed") {
+				break
+			}
+			if !assert.True(t, n > 0, "Read shouldn't return (0, nil)") {
+				break
+			}
+			received += n
+		}
+		assert.True(t, atomic.LoadInt32(&emptyResponses) < 0, "Polls should have come back empty")
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	}
+}
+
+// TestBufferingDetection makes sure that responses that were buffered by an
+// intermediary are detected and that the client then asks for smaller
+// responses.
+func TestBufferingDetection(t *testing.T) {
+	chunk := []byte("0123456789")
+	destAddr := startTricklingServer(t, chunk, 2*bufferingThreshold)
+
+	var maxResponseBytesHeader atomic.Value
+	maxResponseBytesHeader.Store("")
+	proxy := &Proxy{IdleTimeout: 2 * time.Second}
+	proxy.Start()
+	// Intermediary that buffers whole responses
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if h := req.Header.Get(X_ENPROXY_MAX_RESPONSE_BYTES); h != "" {
+			maxResponseBytesHeader.Store(h)
+		}
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, req)
+		for key, values := range rec.Header() {
+			resp.Header()[key] = values
+		}
+		resp.Header().Set("Content-Length", strconv.Itoa(rec.Body.Len()))
+		resp.WriteHeader(rec.Code)
+		if _, err := resp.Write(rec.Body.Bytes()); err != nil {
+			log.Debugf("Unable to write response: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	conn, err := Dial(destAddr, testConfig(server.Listener.Addr().String()))
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	defer func() {
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	}()
+
+	b := make([]byte, 100)
+	for i := 0; i < 4; i++ {
+		_, err := io.ReadFull(conn, b[:len(chunk)])
+		if err != nil {
+			t.Fatalf("Unable to read: %v", err)
+		}
+	}
+	stats := conn.(Conn).Stats()
+	assert.True(t, stats.TimeToFirstByte > 0, "Should have recorded time to first byte")
+	assert.True(t, stats.BufferedResponses > 0, "Should have detected buffered responses")
+	assert.True(t, stats.BufferingDetected, "Should have detected buffering")
+	assert.Equal(t, strconv.Itoa(defaultBufferedMaxResponseBytes), maxResponseBytesHeader.Load(), "Should have asked for smaller responses")
+}
+
+func TestKeepAliveInterval(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	var requests int32
+	proxy := &Proxy{IdleTimeout: 2 * time.Second}
+	proxy.Start()
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		proxy.ServeHTTP(resp, req)
+	}))
+	defer server.Close()
+
+	for _, keepAliveInterval := range []time.Duration{0, 100 * time.Millisecond} {
+		config := testConfig(server.Listener.Addr().String())
+		config.KeepAliveInterval = keepAliveInterval
+		conn, err := Dial(destAddr, config)
+		if err != nil {
+			t.Fatalf("Unable to dial: %v", err)
+		}
+		_, err = conn.Write([]byte("Hello"))
+		assert.NoError(t, err, "Writing should succeed")
+		_, err = io.ReadFull(conn, make([]byte, 5))
+		assert.NoError(t, err, "Reading should succeed")
+
+		// Leave the conn alone, so that it doesn't poll
+		time.Sleep(100 * time.Millisecond)
+		atomic.StoreInt32(&requests, 0)
+		requestsBefore := conn.(Conn).Stats().Requests
+		time.Sleep(550 * time.Millisecond)
+		keepAlives := conn.(Conn).Stats().Requests - requestsBefore
+		if keepAliveInterval == 0 {
+			assert.EqualValues(t, 0, keepAlives, "Idle conn without KeepAliveInterval shouldn't send requests")
+		} else {
+			assert.True(t, keepAlives >= 4, "Idle conn should have sent keepalives, only sent %d", keepAlives)
+			received := atomic.LoadInt32(&requests)
+			assert.True(t, received >= 4, "Keepalives should have reached the proxy, only %d did", received)
+		}
+
+		// The tunnel still works
+		_, err = conn.Write([]byte("Hello"))
+		assert.NoError(t, err, "Writing after idling should succeed")
+		_, err = io.ReadFull(conn, make([]byte, 5))
+		assert.NoError(t, err, "Reading after idling should succeed")
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	// Example from RFC 6455
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", websocketAccept("dGhlIHNhbXBsZSBub25jZQ=="))
+
+	destAddr := startEchoServer(t)
+
+	closeReasons := make(chan string, 10)
+	proxy := &Proxy{
+		IdleTimeout: 500 * time.Millisecond,
+		OnTunnelClosed: func(record *AccessLogRecord) {
+			closeReasons <- record.CloseReason
+		},
+	}
+	proxy.Start()
+	var rejectUpgrades int32
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&rejectUpgrades) == 1 && req.Header.Get("Upgrade") != "" {
+			// Intermediary that doesn't allow WebSockets
+			resp.WriteHeader(http.StatusForbidden)
+			return
+		}
+		proxy.ServeHTTP(resp, req)
+	}))
+	defer server.Close()
+
+	data := patternedData(200000)
+	for _, reject := range []int32{0, 1} {
+		atomic.StoreInt32(&rejectUpgrades, reject)
+		config := testConfig(server.Listener.Addr().String())
+		config.WebSocket = true
+		conn, err := Dial(destAddr, config)
+		if err != nil {
+			t.Fatalf("Unable to dial: %v", err)
+		}
+		assert.Equal(t, reject == 0, conn.(Conn).Stats().WebSocket, "Should only use WebSocket if the upgrade was allowed")
+
+		for i := 0; i < 3; i++ {
+			_, err = conn.Write([]byte("Hello"))
+			assert.NoError(t, err, "Writing should succeed")
+			b := make([]byte, 5)
+			_, err = io.ReadFull(conn, b)
+			assert.NoError(t, err, "Reading should succeed")
+			assert.Equal(t, "Hello", string(b))
+		}
+		go func() {
+			if _, err := conn.Write(data); err != nil {
+				t.Errorf("Unable to write data: %v", err)
+			}
+		}()
+		received := make([]byte, len(data))
+		_, err = io.ReadFull(conn, received)
+		assert.NoError(t, err, "Reading data should succeed")
+		assert.True(t, bytes.Equal(data, received), "Echoed data should match")
+
+		if reject == 0 {
+			assert.EqualValues(t, 1, conn.(Conn).Stats().Requests, "WebSocket should carry data without further requests")
+			assert.NoError(t, conn.Close(), "Closing conn should succeed")
+			select {
+			case reason := <-closeReasons:
+				assert.Equal(t, TunnelClosedClient, reason, "Closing conn should close tunnel")
+			case <-time.After(time.Second):
+				t.Error("Tunnel wasn't closed along with WebSocket")
+			}
+			_, err = conn.Write([]byte("Hello"))
+			assert.True(t, errors.Is(err, net.ErrClosed), "Write on closed conn should fail with net.ErrClosed, not %v", err)
+			assert.Empty(t, conn.(Conn).UnderlyingConns(), "Closed conn shouldn't hold connections")
+		} else {
+			assert.True(t, conn.(Conn).Stats().Requests > 1, "Conn should have fallen back to polling")
+			assert.NoError(t, conn.Close(), "Closing conn should succeed")
+		}
+	}
+}
+
+func TestUnderlyingConns(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	proxy := &Proxy{IdleTimeout: 500 * time.Millisecond}
+	proxy.Start()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	var mutex sync.Mutex
+	dialed := make(map[net.Conn]bool)
+	config := testConfig(server.Listener.Addr().String())
+	config.DialProxy = func(addr string) (net.Conn, error) {
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		if err == nil {
+			mutex.Lock()
+			dialed[conn] = true
+			mutex.Unlock()
+		}
+		return conn, err
+	}
+	conn, err := Dial(destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	_, err = conn.Write([]byte("Hello"))
+	assert.NoError(t, err, "Writing should succeed")
+	_, err = io.ReadFull(conn, make([]byte, 5))
+	assert.NoError(t, err, "Reading should succeed")
+
+	underlying := conn.(Conn).UnderlyingConns()
+	assert.NotEmpty(t, underlying, "Conn should hold connections to the proxy")
+	for _, uc := range underlying {
+		mutex.Lock()
+		assert.True(t, dialed[uc], "Underlying conns should be the ones returned by DialProxy")
+		mutex.Unlock()
+		rawConn, err := uc.(*net.TCPConn).SyscallConn()
+		if assert.NoError(t, err, "Getting SyscallConn should succeed") {
+			assert.NoError(t, rawConn.Control(func(fd uintptr) {}), "Controlling socket should succeed")
+		}
+	}
+
+	// Setting socket options doesn't break the tunnel
+	_, err = conn.Write([]byte("Hello"))
+	assert.NoError(t, err, "Writing should succeed")
+	_, err = io.ReadFull(conn, make([]byte, 5))
+	assert.NoError(t, err, "Reading should succeed")
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	assert.Empty(t, conn.(Conn).UnderlyingConns(), "Closed conn shouldn't hold connections")
+}
+
+func TestWritesBlocked(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	proxy := &Proxy{IdleTimeout: 2 * time.Second}
+	proxy.Start()
+	// Slow proxy
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		proxy.ServeHTTP(resp, req)
+	}))
+	defer server.Close()
+	config := testConfig(server.Listener.Addr().String())
+	config.BufferRequests = true
+
+	conn, err := Dial(destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	_, err = conn.Write([]byte("Hello"))
+	assert.NoError(t, err, "Writing should succeed")
+	stats := conn.(Conn).Stats()
+	assert.EqualValues(t, 0, stats.WritesBlocked, "First write shouldn't have been blocked")
+
+	// Give the Conn time to start sending the first write to the proxy
+	time.Sleep(100 * time.Millisecond)
+	_, err = conn.Write([]byte("Hello"))
+	assert.NoError(t, err, "Writing should succeed")
+	stats = conn.(Conn).Stats()
+	assert.EqualValues(t, 1, stats.WritesBlocked, "Write while sending to slow proxy should have been blocked, stats: %+v", stats)
+	assert.True(t, stats.WriteBlockedTime >= 50*time.Millisecond, "Should have recorded blocked time, only got %v", stats.WriteBlockedTime)
+
+	_, err = io.ReadFull(conn, make([]byte, 10))
+	assert.NoError(t, err, "Reading should succeed")
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+}
+
+func TestConcurrentUse(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	proxy := &Proxy{IdleTimeout: 2 * time.Second}
+	proxy.Start()
+	// Write requests stall until released
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/"+OP_WRITE+"/") {
+			<-release
+		}
+		proxy.ServeHTTP(resp, req)
+	}))
+	defer server.Close()
+	config := testConfig(server.Listener.Addr().String())
+	config.BufferRequests = true
+
+	conn, err := Dial(destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+
+	readResult := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(conn, make([]byte, 10))
+		readResult <- err
+	}()
+	_, err = conn.Write([]byte("Hello"))
+	assert.NoError(t, err, "Writing should succeed")
+	// Give the Conn time to start sending the first write to the proxy, so
+	// that the next Write blocks
+	time.Sleep(100 * time.Millisecond)
+	writeResult := make(chan error, 1)
+	go func() {
+		_, err := conn.Write([]byte("Hello"))
+		writeResult <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	_, err = conn.Read(make([]byte, 10))
+	assert.Equal(t, ErrConcurrentRead, err, "Read while another Read is pending should fail")
+	_, err = conn.Write([]byte("Hello"))
+	assert.Equal(t, ErrConcurrentWrite, err, "Write while another Write is pending should fail")
+
+	close(release)
+	assert.NoError(t, <-writeResult, "Pending Write should succeed")
+	assert.NoError(t, <-readResult, "Pending Read should succeed")
+	assert.Equal(t, CloseReasonNone, conn.(Conn).CloseReason(), "Concurrent use shouldn't close the Conn")
+
+	// Now that nothing is pending, Reads and Writes work again
+	_, err = conn.Write([]byte("Hello"))
+	assert.NoError(t, err, "Writing should succeed")
+	_, err = io.ReadFull(conn, make([]byte, 5))
+	assert.NoError(t, err, "Reading should succeed")
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+}
+
+func TestPollEfficiency(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	proxy := &Proxy{IdleTimeout: 2 * time.Second}
+	proxy.Start()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	conn, err := Dial(destAddr, testConfig(server.Listener.Addr().String()))
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	stats := conn.(Conn).Stats()
+	assert.EqualValues(t, 0, stats.BytesPerWriteRequest, "Ratio should be 0 before the first write request")
+
+	data := make([]byte, 1000)
+	for i := 0; i < 3; i++ {
+		_, err = conn.Write(data)
+		assert.NoError(t, err, "Writing should succeed")
+		_, err = io.ReadFull(conn, data)
+		assert.NoError(t, err, "Reading should succeed")
+	}
+	stats = conn.(Conn).Stats()
+	assert.True(t, stats.WriteRequests > 0, "Should have counted write requests")
+	assert.True(t, stats.ReadRequests > 0, "Should have counted read requests")
+	assert.True(t, stats.WriteRequests+stats.ReadRequests <= stats.Requests, "Write and read requests should be part of all requests")
+	assert.InDelta(t, 3000/float64(stats.WriteRequests), stats.BytesPerWriteRequest, 0.001)
+	assert.InDelta(t, 3000/float64(stats.ReadRequests), stats.BytesPerReadRequest, 0.001)
+	assert.InDelta(t, 6000/float64(stats.Requests), stats.BytesPerRequest, 0.001)
+
+	// Polling while there's nothing to read lowers the ratio
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(250*time.Millisecond)))
+	_, err = conn.Read(data)
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded), "Read should have timed out, not %v", err)
+	idleStats := conn.(Conn).Stats()
+	assert.True(t, idleStats.BytesPerReadRequest < stats.BytesPerReadRequest, "Empty polls should have lowered the ratio from %v to less, got %v", stats.BytesPerReadRequest, idleStats.BytesPerReadRequest)
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+}
+
+func TestMaxRequests(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	var requests int64
+	proxy := &Proxy{IdleTimeout: 500 * time.Millisecond}
+	proxy.Start()
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		proxy.ServeHTTP(resp, req)
+	}))
+	defer server.Close()
+	config := testConfig(server.Listener.Addr().String())
+	config.MaxRequests = 6
+
+	conn, err := Dial(destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	for i := 0; i < 20 && err == nil; i++ {
+		_, err = conn.Write([]byte("Hello"))
+		if err == nil {
+			_, err = io.ReadFull(conn, make([]byte, 5))
+		}
+	}
+	assert.True(t, errors.Is(err, ErrRequestQuotaExceeded), "Exceeding MaxRequests should result in ErrRequestQuotaExceeded, not %v", err)
+	assert.EqualValues(t, 6, conn.(Conn).Stats().Requests, "Stats should count the requests that were sent")
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	// Requests that were in flight when the conn closed may have been cut off
+	assert.True(t, atomic.LoadInt64(&requests) <= 6, "Proxy shouldn't have received more than MaxRequests requests")
+}
+
+// TestMaxResponseBytes makes sure that the proxy honors the client's
+// MaxResponseBytes.
+func TestMaxResponseBytes(t *testing.T) {
+	data := patternedData(64 * 1024)
+	destAddr := startDataServer(t, data)
+
+	readRequests := int32(0)
+	proxy := &Proxy{}
+	proxy.Start()
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/"+OP_READ+"/") {
+			atomic.AddInt32(&readRequests, 1)
+		}
+		proxy.ServeHTTP(resp, req)
+	}))
+	defer server.Close()
+
+	config := testConfig(server.Listener.Addr().String())
+	config.MaxResponseBytes = 1000
+	conn, err := Dial(destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	defer func() {
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	}()
+
+	received := make([]byte, len(data))
+	_, err = io.ReadFull(conn, received)
+	assert.NoError(t, err, "Reading should succeed")
+	assert.True(t, bytes.Equal(data, received), "Received data didn't match sent data")
+	assert.True(t, int(atomic.LoadInt32(&readRequests)) >= len(data)/config.MaxResponseBytes-1, "Responses should have been limited to MaxResponseBytes, but saw only %d read requests", readRequests)
+}
+
+func TestReceiveWindow(t *testing.T) {
+	data := patternedData(64 * 1024)
+	destAddr := startDataServer(t, data)
+
+	var windows []string
+	largestResponse := int64(0)
+	var mutex sync.Mutex
+	proxy := &Proxy{}
+	proxy.Start()
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		windows = append(windows, req.Header.Get(X_ENPROXY_RECEIVE_WINDOW))
+		mutex.Unlock()
+		n := int64(0)
+		proxy.ServeHTTP(&countingResponseWriter{resp, &n}, req)
+		mutex.Lock()
+		if n > largestResponse {
+			largestResponse = n
+		}
+		mutex.Unlock()
+	}))
+	defer server.Close()
+
+	config := testConfig(server.Listener.Addr().String())
+	config.ReceiveWindow = 4096
+	conn, err := Dial(destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	defer func() {
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	}()
+
+	received := make([]byte, len(data))
+	_, err = io.ReadFull(conn, received)
+	assert.NoError(t, err, "Reading should succeed")
+	assert.True(t, bytes.Equal(data, received), "Received data didn't match sent data")
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, window := range windows {
+		assert.Equal(t, "4096", window, "Every request should advertise the window")
+	}
+	assert.True(t, largestResponse <= 4096, "Responses should have been limited to the window, but one had %d bytes", largestResponse)
+}
+
+func TestPollScheduler(t *testing.T) {
+	chunk := []byte("0123456789")
+	destAddr := startTricklingServer(t, chunk, 100*time.Millisecond)
+
+	var pollTimes []time.Time
+	var pollTimesMutex sync.Mutex
+	proxy := &Proxy{IdleTimeout: 500 * time.Millisecond}
+	proxy.Start()
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/"+OP_READ+"/") {
+			pollTimesMutex.Lock()
+			pollTimes = append(pollTimes, time.Now())
+			pollTimesMutex.Unlock()
+		}
+		proxy.ServeHTTP(resp, req)
+	}))
+	defer server.Close()
+
+	scheduler := &recordingPollScheduler{interval: 200 * time.Millisecond}
+	config := testConfig(server.Listener.Addr().String())
+	config.PollScheduler = scheduler
+	conn, err := Dial(destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	defer func() {
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	}()
+
+	b := make([]byte, 100)
+	for i := 0; i < 4; i++ {
+		if _, err := conn.Read(b); err != nil {
+			t.Fatalf("Unable to read: %v", err)
+		}
+	}
+
+	pollTimesMutex.Lock()
+	defer pollTimesMutex.Unlock()
+	if assert.True(t, len(pollTimes) >= 2, "Should have polled at least twice") {
+		for i := 1; i < len(pollTimes); i++ {
+			gap := pollTimes[i].Sub(pollTimes[i-1])
+			assert.True(t, gap >= scheduler.interval, "Polls should have been at least %v apart, but were %v apart", scheduler.interval, gap)
+		}
+	}
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	if assert.True(t, len(scheduler.stats) > 0, "NextPoll should have been called") {
+		for _, stats := range scheduler.stats {
+			assert.True(t, stats.BytesReceived > 0, "Polls should have received data")
+			assert.True(t, stats.Duration > 0, "Polls should have a duration")
+			assert.Equal(t, 0, stats.ConsecutiveEmptyPolls)
+		}
+	}
+}
+
+// TestCurrentIntervals makes sure that a Conn reports the poll interval that
+// its PollScheduler chose and the flush timeout in effect.
+func TestCurrentIntervals(t *testing.T) {
+	chunk := []byte("0123456789")
+	destAddr := startTricklingServer(t, chunk, 100*time.Millisecond)
+
+	proxy := &Proxy{IdleTimeout: 500 * time.Millisecond}
+	proxy.Start()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	scheduler := &recordingPollScheduler{interval: 50 * time.Millisecond}
+	config := testConfig(server.Listener.Addr().String())
+	config.PollScheduler = scheduler
+	conn, err := Dial(destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	defer func() {
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	}()
+	c := conn.(Conn)
+	assert.Equal(t, time.Duration(0), c.CurrentPollInterval(), "Poll interval should be 0 before polling")
+	assert.Equal(t, defaultWriteFlushTimeout, c.CurrentIdleInterval(), "Idle interval should default to the default FlushTimeout")
+
+	b := make([]byte, 100)
+	for i := 0; i < 3; i++ {
+		if _, err := conn.Read(b); err != nil {
+			t.Fatalf("Unable to read: %v", err)
+		}
+	}
+	assert.Equal(t, scheduler.interval, c.CurrentPollInterval(), "Poll interval should be what the PollScheduler chose")
+	assert.Equal(t, scheduler.interval, c.Stats().PollInterval, "Stats should report the poll interval")
+
+	updated := config.Clone()
+	updated.FlushTimeout = 50 * time.Millisecond
+	assert.NoError(t, c.Reconfigure(updated), "Reconfiguring should succeed")
+	assert.Equal(t, updated.FlushTimeout, c.CurrentIdleInterval(), "Idle interval should follow Reconfigure")
+	assert.Equal(t, updated.FlushTimeout, c.Stats().IdleInterval, "Stats should report the idle interval")
+}
+
+func TestMoreAvailable(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	proxy := &Proxy{IdleTimeout: 2 * time.Second}
+	proxy.Start()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	scheduler := &recordingPollScheduler{interval: 500 * time.Millisecond}
+	config := testConfig(server.Listener.Addr().String())
+	config.PollScheduler = scheduler
+	config.MaxResponseBytes = 10
+	conn, err := Dial(destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	defer func() {
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	}()
+
+	msg := bytes.Repeat([]byte("0123456789"), 5)
+	_, err = conn.Write(msg)
+	assert.NoError(t, err, "Writing should succeed")
+	// Give the echo some time to reach the proxy
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	b := make([]byte, len(msg))
+	_, err = io.ReadFull(conn, b)
+	assert.NoError(t, err, "Reading should succeed")
+	assert.Equal(t, string(msg), string(b))
+	assert.True(t, time.Now().Sub(start) < 4*scheduler.interval, "Polls for available data shouldn't wait for the PollScheduler")
+
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	moreAvailable := 0
+	for _, stats := range scheduler.stats {
+		if stats.MoreAvailable {
+			assert.Equal(t, 10, stats.BytesReceived, "Only full responses should indicate more data")
+			moreAvailable++
+		}
+	}
+	assert.True(t, moreAvailable >= 3, "Most polls should have indicated more data, only %d did", moreAvailable)
+}
+
+// TestReadDrainsQueuedResponses makes sure that a big Read isn't limited to a
+// single response when the proxy has more data waiting.
+func TestReadDrainsQueuedResponses(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	proxy := &Proxy{IdleTimeout: 2 * time.Second}
+	proxy.Start()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	config := testConfig(server.Listener.Addr().String())
+	config.MaxResponseBytes = 10
+	conn, err := Dial(destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+
+	msg := bytes.Repeat([]byte("0123456789"), 5)
+	_, err = conn.Write(msg)
+	assert.NoError(t, err, "Writing should succeed")
+	// Give the echo some time to reach the proxy
+	time.Sleep(100 * time.Millisecond)
+	b := make([]byte, 100)
+	n, err := conn.Read(b)
+	assert.NoError(t, err, "Reading should succeed")
+	assert.Equal(t, string(msg), string(b[:n]), "A single Read should have drained all waiting responses")
+
+	// Draining stops once b is full
+	_, err = conn.Write(msg)
+	assert.NoError(t, err, "Writing should succeed")
+	time.Sleep(100 * time.Millisecond)
+	n, err = conn.Read(b[:25])
+	assert.NoError(t, err, "Reading should succeed")
+	assert.Equal(t, string(msg[:25]), string(b[:n]))
+	_, err = io.ReadFull(conn, b[:25])
+	assert.NoError(t, err, "Reading should succeed")
+	assert.Equal(t, string(msg[25:]), string(b[:25]))
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+}
+
+func TestRTT(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	// Polls take at least delay to be answered
+	delay := 100 * time.Millisecond
+	proxy := &Proxy{IdleTimeout: 500 * time.Millisecond}
+	proxy.Start()
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/"+OP_READ+"/") {
+			time.Sleep(delay)
+		}
+		proxy.ServeHTTP(resp, req)
+	}))
+	defer server.Close()
+
+	scheduler := &recordingPollScheduler{}
+	config := testConfig(server.Listener.Addr().String())
+	config.PollScheduler = scheduler
+	conn, err := Dial(destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	defer func() {
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	}()
+	assert.EqualValues(t, 0, conn.(Conn).RTT(), "RTT should be 0 before the first poll")
+
+	b := make([]byte, 5)
+	for i := 0; i < 5; i++ {
+		_, err = conn.Write([]byte("Hello"))
+		assert.NoError(t, err, "Writing should succeed")
+		if _, err := io.ReadFull(conn, b); err != nil {
+			t.Fatalf("Unable to read: %v", err)
+		}
+	}
+	rtt := conn.(Conn).RTT()
+	assert.True(t, rtt >= delay, "RTT should include the delay of polls, got %v", rtt)
+	assert.True(t, rtt < 5*delay, "RTT should be close to the delay of polls, got %v", rtt)
+
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	if assert.NotEmpty(t, scheduler.stats, "Scheduler should have been consulted") {
+		assert.True(t, scheduler.stats[len(scheduler.stats)-1].RTT >= delay, "Scheduler should learn the RTT")
+	}
+}
+
+// recordingPollScheduler is a PollScheduler that records the stats passed to
+// it and always waits interval.
+type recordingPollScheduler struct {
+	interval time.Duration
+	stats    []PollStats
+	mutex    sync.Mutex
+}
+
+func (s *recordingPollScheduler) NextPoll(stats PollStats) time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stats = append(s.stats, stats)
+	return s.interval
+}
+
+func TestWriteKeepStreaming(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	writeRequests := int32(0)
+	proxy := &Proxy{}
+	proxy.Start()
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/"+OP_WRITE+"/") {
+			atomic.AddInt32(&writeRequests, 1)
+		}
+		proxy.ServeHTTP(resp, req)
+	}))
+	defer server.Close()
+
+	data := patternedData(512 * 1024)
+	upload := func(threshold time.Duration) int32 {
+		atomic.StoreInt32(&writeRequests, 0)
+		config := testConfig(server.Listener.Addr().String())
+		config.WriteKeepStreamingThreshold = threshold
+		conn, err := Dial(destAddr, config)
+		if err != nil {
+			t.Fatalf("Unable to dial: %v", err)
+		}
+		defer func() {
+			assert.NoError(t, conn.Close(), "Closing conn should succeed")
+		}()
+
+		echoed := make(chan []byte)
+		go func() {
+			b := make([]byte, len(data))
+			n, err := io.ReadFull(conn, b)
+			assert.NoError(t, err, "Reading echo should succeed")
+			echoed <- b[:n]
+		}()
+
+		// Write in small pieces, pausing for longer than FlushTimeout after
+		// every 64 KB
+		for i := 0; i < len(data); i += 16 * 1024 {
+			_, err := conn.Write(data[i : i+16*1024])
+			assert.NoError(t, err, "Writing should succeed")
+			if (i+16*1024)%(64*1024) == 0 {
+				time.Sleep(60 * time.Millisecond)
+			}
+		}
+		assert.True(t, bytes.Equal(data, <-echoed), "Echoed data should match written data")
+		return atomic.LoadInt32(&writeRequests)
+	}
+
+	withoutThreshold := upload(0)
+	withThreshold := upload(500 * time.Millisecond)
+	assert.True(t, withoutThreshold >= 8, "Each pause should have finished the request body, but only %d write requests were made", withoutThreshold)
+	assert.True(t, withThreshold <= 2, "Pauses shouldn't have finished the request body, but %d write requests were made", withThreshold)
+}
+
+// TestCork makes sure that the Writes made while a Conn is corked go to the
+// proxy in a single request body, and that a Conn doesn't stay corked for
+// longer than MaxCorkDuration.
+func TestCork(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	var bodies []string
+	var bodiesMutex sync.Mutex
+	proxy := &Proxy{IdleTimeout: 2 * time.Second}
+	proxy.Start()
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/"+OP_WRITE+"/") {
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				resp.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if len(body) > 0 {
+				bodiesMutex.Lock()
+				bodies = append(bodies, string(body))
+				bodiesMutex.Unlock()
+			}
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		proxy.ServeHTTP(resp, req)
+	}))
+	defer server.Close()
+
+	pieces := []string{"one", "two", "three", "four"}
+	message := strings.Join(pieces, "")
+	for _, buffered := range []bool{true, false} {
+		bodiesMutex.Lock()
+		bodies = nil
+		bodiesMutex.Unlock()
+
+		config := testConfig(server.Listener.Addr().String())
+		config.BufferRequests = buffered
+		config.WaitForUpstream = true
+		conn, err := Dial(destAddr, config)
+		if err != nil {
+			t.Fatalf("Unable to dial: %v", err)
+		}
+		c := conn.(Conn)
+
+		assert.NoError(t, c.Cork(), "Corking should succeed")
+		for _, piece := range pieces {
+			_, err := conn.Write([]byte(piece))
+			assert.NoError(t, err, "Writing should succeed")
+			// Pause for longer than FlushTimeout
+			time.Sleep(2 * defaultWriteFlushTimeout)
+		}
+		assert.NoError(t, c.Uncork(), "Uncorking should succeed")
+		b := make([]byte, len(message))
+		_, err = io.ReadFull(conn, b)
+		assert.NoError(t, err, "Reading echo should succeed")
+		assert.Equal(t, message, string(b))
+		bodiesMutex.Lock()
+		assert.Equal(t, []string{message}, bodies, "Corked writes should have been sent in one body (buffered: %v)", buffered)
+		bodiesMutex.Unlock()
+		assert.NoError(t, c.Uncork(), "Uncorking again should do nothing")
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	}
+
+	// Staying corked for too long
+	config := testConfig(server.Listener.Addr().String())
+	config.MaxCorkDuration = 100 * time.Millisecond
+	conn, err := Dial(destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	defer func() {
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	}()
+	assert.NoError(t, conn.(Conn).Cork(), "Corking should succeed")
+	_, err = conn.Write([]byte(TEXT))
+	assert.NoError(t, err, "Writing should succeed")
+	read := make(chan error, 1)
+	go func() {
+		b := make([]byte, len(TEXT))
+		_, err := io.ReadFull(conn, b)
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		assert.NoError(t, err, "Reading echo should succeed")
+	case <-time.After(2 * time.Second):
+		t.Fatal("Conn should have uncorked itself after MaxCorkDuration")
+	}
+}
+
+func TestPreferContentLength(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	var lengths []int64
+	var lengthsMutex sync.Mutex
+	dict := []byte("Hello World")
+	proxy := &Proxy{IdleTimeout: 500 * time.Millisecond, CompressionDict: dict}
+	proxy.Start()
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/"+OP_WRITE+"/") {
+			lengthsMutex.Lock()
+			lengths = append(lengths, req.ContentLength)
+			lengthsMutex.Unlock()
+		}
+		proxy.ServeHTTP(resp, req)
+	}))
+	defer server.Close()
+
+	config := testConfig(server.Listener.Addr().String())
+	config.PreferContentLength = true
+	conn, err := Dial(destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	defer func() {
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	}()
+
+	echo := func(conn net.Conn, writes ...string) {
+		lengthsMutex.Lock()
+		lengths = nil
+		lengthsMutex.Unlock()
+		expected := ""
+		for _, msg := range writes {
+			_, err := conn.Write([]byte(msg))
+			assert.NoError(t, err, "Writing should succeed")
+			expected += msg
+		}
+		b := make([]byte, len(expected))
+		_, err := io.ReadFull(conn, b)
+		assert.NoError(t, err, "Reading should succeed")
+		assert.Equal(t, expected, string(b), "Should have gotten echo")
+		// Wait for the request to finish
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	echo(conn, "Hello")
+	lengthsMutex.Lock()
+	assert.Equal(t, []int64{5}, lengths, "Single write should have been sent with Content-Length")
+	lengthsMutex.Unlock()
+
+	echo(conn, "Hello", " ", "World")
+	lengthsMutex.Lock()
+	assert.Equal(t, []int64{-1}, lengths, "Multiple writes should have been streamed")
+	lengthsMutex.Unlock()
+
+	// With compression, Content-Length is that of the compressed body
+	config.CompressionDict = dict
+	compressing, err := Dial(destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	defer func() {
+		assert.NoError(t, compressing.Close(), "Closing conn should succeed")
+	}()
+	echo(compressing, strings.Repeat("Hello World ", 100))
+	lengthsMutex.Lock()
+	if assert.Len(t, lengths, 1, "Single write should have been sent in one request") {
+		assert.True(t, lengths[0] > 0 && lengths[0] < 1200, "Request should have had the compressed length, not %d", lengths[0])
+	}
+	lengthsMutex.Unlock()
+}
+
+func TestEmptyBodyFraming(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	// framings: how polls were framed, as their Content-Length and
+	// Transfer-Encoding
+	var framings []string
+	var framingsMutex sync.Mutex
+	proxy := &Proxy{IdleTimeout: 500 * time.Millisecond}
+	proxy.Start()
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/"+OP_READ+"/") {
+			framingsMutex.Lock()
+			framings = append(framings, fmt.Sprintf("%d %v", req.ContentLength, req.TransferEncoding))
+			framingsMutex.Unlock()
+		}
+		proxy.ServeHTTP(resp, req)
+	}))
+	defer server.Close()
+
+	for framing, expected := range map[EmptyBodyFraming]string{
+		FrameEmptyContentLength: "0 []",
+		FrameEmptyChunked:       "-1 [chunked]",
+	} {
+		framingsMutex.Lock()
+		framings = nil
+		framingsMutex.Unlock()
+		config := testConfig(server.Listener.Addr().String())
+		config.EmptyBodyFraming = framing
+		conn, err := Dial(destAddr, config)
+		if err != nil {
+			t.Fatalf("Unable to dial: %v", err)
+		}
+		for _, msg := range []string{"Hello", "World"} {
+			_, err = conn.Write([]byte(msg))
+			assert.NoError(t, err, "Writing should succeed")
+			b := make([]byte, len(msg))
+			_, err = io.ReadFull(conn, b)
+			assert.NoError(t, err, "Reading should succeed")
+			assert.Equal(t, msg, string(b), "Should have gotten echo")
+		}
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+
+		framingsMutex.Lock()
+		if assert.NotEmpty(t, framings, "Should have polled") {
+			for _, f := range framings {
+				assert.Equal(t, expected, f, "Polls should be framed according to EmptyBodyFraming %d", framing)
+			}
+		}
+		framingsMutex.Unlock()
+	}
+}
+
+func TestCompression(t *testing.T) {
+	dict := []byte("GET /index.html HTTP/1.1\r\nHost: www.example.com\r\nAccept: */*\r\n\r\n")
+	msg := bytes.Repeat(dict, 20)
+	destAddr := startEchoServer(t)
+
+	bytesUp := int64(0)
+	bytesDown := int64(0)
+	proxy := &Proxy{CompressionDict: dict}
+	proxy.Start()
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		req.Body = &countingReadCloser{req.Body, &bytesUp}
+		proxy.ServeHTTP(&countingResponseWriter{resp, &bytesDown}, req)
+	}))
+	defer server.Close()
+
+	for _, buffered := range []bool{true, false} {
+		atomic.StoreInt64(&bytesUp, 0)
+		atomic.StoreInt64(&bytesDown, 0)
+		config := testConfig(server.Listener.Addr().String())
+		config.CompressionDict = dict
+		config.BufferRequests = buffered
+		conn, err := Dial(destAddr, config)
+		if err != nil {
+			t.Fatalf("Unable to dial: %v", err)
+		}
+		_, err = conn.Write(msg)
+		assert.NoError(t, err, "Writing should succeed")
+		received := make([]byte, len(msg))
+		_, err = io.ReadFull(conn, received)
+		assert.NoError(t, err, "Reading should succeed")
+		assert.True(t, bytes.Equal(msg, received), "Received data didn't match sent data")
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+
+		assert.True(t, atomic.LoadInt64(&bytesUp) < int64(len(msg)/10), "Data sent to proxy should have been compressed, buffered: %v, bytes: %d", buffered, bytesUp)
+		assert.True(t, atomic.LoadInt64(&bytesDown) < int64(len(msg)/10), "Data received from proxy should have been compressed, buffered: %v, bytes: %d", buffered, bytesDown)
+	}
+
+	// Proxy rejects data compressed with a different dictionary
+	config := testConfig(server.Listener.Addr().String())
+	config.CompressionDict = []byte("something else")
+	config.BufferRequests = true
+	conn, err := Dial(destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	_, err = conn.Write(msg)
+	assert.NoError(t, err, "Buffered write should succeed")
+	_, err = conn.Read(make([]byte, 10))
+	if assert.Error(t, err, "Reading with unknown dictionary should fail") {
+		assert.Contains(t, err.Error(), "unknown dictionary")
+	}
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+}
+
+func TestMinCompressSize(t *testing.T) {
+	dict := []byte("GET /index.html HTTP/1.1\r\nHost: www.example.com\r\nAccept: */*\r\n\r\n")
+	destAddr := startEchoServer(t)
+
+	proxy := &Proxy{CompressionDict: dict, MinCompressSize: 100}
+	proxy.Start()
+	var encodingsMutex sync.Mutex
+	var encodings []string
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		// Record the encoding of responses that carry data
+		proxy.ServeHTTP(&encodingRecordingWriter{ResponseWriter: resp, record: func(encoding string) {
+			encodingsMutex.Lock()
+			encodings = append(encodings, encoding)
+			encodingsMutex.Unlock()
+		}}, req)
+	}))
+	defer server.Close()
+
+	config := testConfig(server.Listener.Addr().String())
+	config.CompressionDict = dict
+	conn, err := Dial(destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	defer conn.Close()
+
+	// Small and big responses alternate within the same tunnel
+	for _, msg := range [][]byte{[]byte("small"), bytes.Repeat(dict, 20), []byte("small again")} {
+		encodingsMutex.Lock()
+		encodings = nil
+		encodingsMutex.Unlock()
+		_, err = conn.Write(msg)
+		assert.NoError(t, err, "Writing should succeed")
+		received := make([]byte, len(msg))
+		_, err = io.ReadFull(conn, received)
+		assert.NoError(t, err, "Reading should succeed")
+		assert.True(t, bytes.Equal(msg, received), "Received data didn't match sent data")
+
+		encodingsMutex.Lock()
+		if assert.NotEmpty(t, encodings, "Data should have been received") {
+			if len(msg) < proxy.MinCompressSize {
+				assert.Equal(t, "", encodings[0], "Response of %d bytes shouldn't have been compressed", len(msg))
+			} else {
+				assert.Equal(t, ENCODING_FLATE, encodings[0], "Response of %d bytes should have been compressed", len(msg))
+			}
+		}
+		encodingsMutex.Unlock()
+	}
+}
+
+// encodingRecordingWriter is an http.ResponseWriter that records the
+// X_ENPROXY_ENCODING of the response once data is written to it
+type encodingRecordingWriter struct {
+	http.ResponseWriter
+	record   func(encoding string)
+	recorded bool
+}
+
+func (w *encodingRecordingWriter) Write(b []byte) (int, error) {
+	if len(b) > 0 && !w.recorded {
+		w.recorded = true
+		w.record(w.Header().Get(X_ENPROXY_ENCODING))
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *encodingRecordingWriter) Flush() {
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+// countingReadCloser is an io.ReadCloser that counts the bytes read from it
+type countingReadCloser struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (r *countingReadCloser) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	atomic.AddInt64(r.n, int64(n))
+	return n, err
+}
+
+// countingResponseWriter is an http.ResponseWriter that counts the bytes
+// written to it
+type countingResponseWriter struct {
+	http.ResponseWriter
+	n *int64
+}
+
+func (w *countingResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	atomic.AddInt64(w.n, int64(n))
+	return n, err
+}
+
+func (w *countingResponseWriter) Flush() {
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+// TestBodyEncoding makes sure that with BodyEncodingBase64, only base64 text
+// goes over the wire in either direction, with and without compression.
+func TestBodyEncoding(t *testing.T) {
+	dict := []byte("GET /index.html HTTP/1.1\r\nHost: www.example.com\r\nAccept: */*\r\n\r\n")
+	msg := make([]byte, 10000)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	destAddr := startEchoServer(t)
+
+	bytesUp := int64(0)
+	binarySeen := int32(0)
+	proxy := &Proxy{CompressionDict: dict}
+	proxy.Start()
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		req.Body = &base64CheckingReadCloser{&countingReadCloser{req.Body, &bytesUp}, &binarySeen}
+		proxy.ServeHTTP(&base64CheckingResponseWriter{resp, &binarySeen}, req)
+	}))
+	defer server.Close()
+
+	for _, compressed := range []bool{false, true} {
+		for _, buffered := range []bool{true, false} {
+			atomic.StoreInt64(&bytesUp, 0)
+			config := testConfig(server.Listener.Addr().String())
+			config.BodyEncoding = BodyEncodingBase64
+			config.BufferRequests = buffered
+			if compressed {
+				config.CompressionDict = dict
+			}
+			conn, err := Dial(destAddr, config)
+			if err != nil {
+				t.Fatalf("Unable to dial: %v", err)
+			}
+			// Write in pieces that don't line up with groups of 3 bytes
+			for i := 0; i < len(msg); i += 1000 {
+				_, err = conn.Write(msg[i : i+1000])
+				assert.NoError(t, err, "Writing should succeed")
+			}
+			received := make([]byte, len(msg))
+			_, err = io.ReadFull(conn, received)
+			assert.NoError(t, err, "Reading should succeed")
+			assert.True(t, bytes.Equal(msg, received), "Received data didn't match sent data, compressed: %v, buffered: %v", compressed, buffered)
+			assert.NoError(t, conn.Close(), "Closing conn should succeed")
+
+			assert.EqualValues(t, 0, atomic.LoadInt32(&binarySeen), "Only base64 should have gone over the wire, compressed: %v, buffered: %v", compressed, buffered)
+			if !compressed {
+				assert.True(t, atomic.LoadInt64(&bytesUp) >= int64(len(msg)*4/3), "Encoded data should be bigger, buffered: %v, bytes: %d", buffered, bytesUp)
+			}
+		}
+	}
+}
+
+// isBase64Text indicates whether b only contains characters of the standard
+// base64 alphabet
+func isBase64Text(b []byte) bool {
+	for _, c := range b {
+		if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '+' || c == '/' || c == '=') {
+			return false
+		}
+	}
+	return true
+}
+
+// base64CheckingReadCloser and base64CheckingResponseWriter set binarySeen if
+// data read or written isn't base64 text
+type base64CheckingReadCloser struct {
+	io.ReadCloser
+	binarySeen *int32
+}
+
+func (r *base64CheckingReadCloser) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	if !isBase64Text(b[:n]) {
+		atomic.StoreInt32(r.binarySeen, 1)
+	}
+	return n, err
+}
+
+type base64CheckingResponseWriter struct {
+	http.ResponseWriter
+	binarySeen *int32
+}
+
+func (w *base64CheckingResponseWriter) Write(b []byte) (int, error) {
+	if !isBase64Text(b) {
+		atomic.StoreInt32(w.binarySeen, 1)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *base64CheckingResponseWriter) Flush() {
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+// TestUpstreamEOF makes sure that when the destination server closes its side
+// after sending some data, the client reads exactly that data followed by
+// io.EOF, and can still write to a destination that only half-closed.
+func TestUpstreamEOF(t *testing.T) {
+	data := patternedData(10000)
+	afterEOF := []byte("after EOF")
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	defer func() {
+		if err := l.Close(); err != nil {
+			log.Debugf("Unable to close listener: %v", err)
+		}
+	}()
+	receivedCh := make(chan []byte, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Errorf("Unable to accept: %v", err)
+			return
+		}
+		defer func() {
+			if err := conn.Close(); err != nil {
+				log.Debugf("Unable to close connection: %v", err)
+			}
+		}()
+		if _, err := conn.Write(data); err != nil {
+			t.Errorf("Unable to write data: %v", err)
+			return
+		}
+		if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+			t.Errorf("Unable to close for writing: %v", err)
+			return
+		}
+		received := make([]byte, len(afterEOF))
+		if _, err := io.ReadFull(conn, received); err != nil {
+			t.Errorf("Unable to read after EOF: %v", err)
+		}
+		receivedCh <- received
+	}()
+
+	// Short IdleTimeout so that the proxy closes its connection to the
+	// destination soon after the test is done
+	proxy := &Proxy{IdleTimeout: 500 * time.Millisecond}
+	proxy.Start()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	conn, err := Dial(l.Addr().String(), testConfig(server.Listener.Addr().String()))
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	defer func() {
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	}()
+
+	received, err := ioutil.ReadAll(conn)
+	assert.NoError(t, err, "Reading until EOF should succeed")
+	assert.True(t, bytes.Equal(data, received), "Should have received exactly %d bytes, got %d", len(data), len(received))
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 10))
+		readErr <- err
+	}()
+	select {
+	case err := <-readErr:
+		assert.Equal(t, io.EOF, err, "Reads after EOF should keep returning EOF")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Read after EOF blocked")
+	}
+
+	_, err = conn.Write(afterEOF)
+	assert.NoError(t, err, "Writing after EOF should succeed")
+	select {
+	case received := <-receivedCh:
+		assert.Equal(t, string(afterEOF), string(received), "Destination should have received data written after EOF")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Destination didn't receive data written after EOF")
+	}
+}
+
+func TestOpen(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	proxy := &Proxy{IdleTimeout: 2 * time.Second}
+	proxy.Start()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+	config := testConfig(server.Listener.Addr().String())
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := Open(canceled, destAddr, config)
+	assert.Equal(t, context.Canceled, err, "Opening with a done context should fail")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn, err := Open(ctx, destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to open: %v", err)
+	}
+	assert.False(t, config.WaitForUpstream, "Open shouldn't modify the caller's Config")
+	assert.NoError(t, conn.(Conn).WaitReady(context.Background()), "Opened conn should already be connected")
+	_, err = conn.Write([]byte(TEXT))
+	assert.NoError(t, err, "Writing should succeed")
+	b := make([]byte, len(TEXT))
+	_, err = io.ReadFull(conn, b)
+	assert.NoError(t, err, "Reading should succeed")
+	assert.Equal(t, TEXT, string(b))
+
+	// Canceling the context closes the conn
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(b)
+		readErr <- err
+	}()
+	cancel()
+	select {
+	case err := <-readErr:
+		assert.Error(t, err, "Read should fail once the context is done")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Read should have returned once the context was done")
+	}
+	assert.Equal(t, CloseReasonApplication, conn.(Conn).CloseReason())
+	_, err = conn.Write([]byte(TEXT))
+	assert.Error(t, err, "Writing should fail once the context is done")
+
+	// Closing the conn stops watching the context
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	conn, err = Open(ctx, destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to open: %v", err)
+	}
+	assert.NoError(t, conn.Close(), "Closing should succeed")
+	ic := conn.(*idleTimingConn)
+	done := make(chan struct{})
+	go func() {
+		ic.closeWhenDone(ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(1 * time.Second):
+		t.Error("Watching the context of a closed conn should stop right away")
+	}
+}
+
+// TestDialRetries makes sure that a Conn retries dialing the proxy
+// DialRetries times and that retries stop at the context's deadline.
+func TestDialRetries(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	proxy := &Proxy{IdleTimeout: 2 * time.Second}
+	proxy.Start()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	var dials int32
+	config := testConfig(server.Listener.Addr().String())
+	dialProxy := config.DialProxy
+	config.DialProxy = func(addr string) (net.Conn, error) {
+		if atomic.AddInt32(&dials, 1) <= 2 {
+			return nil, fmt.Errorf("Edge hiccup")
+		}
+		return dialProxy(addr)
+	}
+	config.DialRetryBackoff = 10 * time.Millisecond
+
+	config.DialRetries = 1
+	_, err := Dial(destAddr, config)
+	assert.Error(t, err, "Dialing should fail once retries are used up")
+	assert.EqualValues(t, 2, atomic.LoadInt32(&dials), "Dial should have been retried once")
+
+	atomic.StoreInt32(&dials, 0)
+	config.DialRetries = 2
+	conn, err := Dial(destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial with retries: %v", err)
+	}
+	assert.EqualValues(t, 3, atomic.LoadInt32(&dials), "Dial should have succeeded on the second retry")
+	_, err = conn.Write([]byte(TEXT))
+	assert.NoError(t, err, "Writing should succeed")
+	b := make([]byte, len(TEXT))
+	_, err = io.ReadFull(conn, b)
+	assert.NoError(t, err, "Reading should succeed")
+	assert.Equal(t, TEXT, string(b))
+	assert.NoError(t, conn.Close(), "Closing should succeed")
+
+	// A retry that wouldn't start before the deadline isn't made
+	atomic.StoreInt32(&dials, 0)
+	config.DialRetries = 10
+	config.DialRetryBackoff = 1 * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = Open(ctx, destAddr, config)
+	assert.Error(t, err, "Opening should fail")
+	assert.True(t, time.Now().Sub(start) < 1*time.Second, "Opening shouldn't have waited for a retry past the deadline")
+	time.Sleep(200 * time.Millisecond)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&dials), "Dial shouldn't have been retried past the deadline")
+}
+
+func TestValidateResponses(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	// The real proxy passes validation
+	proxy := &Proxy{IdleTimeout: 2 * time.Second}
+	proxy.Start()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+	config := testConfig(server.Listener.Addr().String())
+	config.ValidateResponses = true
+	for _, waitForUpstream := range []bool{false, true} {
+		config.WaitForUpstream = waitForUpstream
+		conn, err := Dial(destAddr, config)
+		if err != nil {
+			t.Fatalf("Unable to dial: %v", err)
+		}
+		_, err = conn.Write([]byte(TEXT))
+		assert.NoError(t, err, "Writing should succeed")
+		b := make([]byte, len(TEXT))
+		_, err = io.ReadFull(conn, b)
+		assert.NoError(t, err, "Reading should succeed")
+		assert.Equal(t, TEXT, string(b))
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	}
+
+	// A captive portal answers everything with its login page
+	loginPage := "<html><body>Please log in to use this network</body></html>"
+	portal := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write([]byte(loginPage))
+	}))
+	defer portal.Close()
+	config = testConfig(portal.Listener.Addr().String())
+	config.ValidateResponses = true
+
+	checkErr := func(err error, msg string) {
+		if assert.True(t, errors.Is(err, ErrUnexpectedResponse), "%s should fail with ErrUnexpectedResponse, not %v", msg, err) {
+			var unexpected *UnexpectedResponseError
+			if assert.True(t, errors.As(err, &unexpected)) {
+				assert.Equal(t, http.StatusOK, unexpected.StatusCode)
+				assert.Equal(t, "text/html", unexpected.ContentType)
+				assert.Equal(t, loginPage, string(unexpected.Snippet))
+			}
+		}
+	}
+
+	config.WaitForUpstream = true
+	_, err := Dial(destAddr, config)
+	checkErr(err, "Dialing")
+
+	config.WaitForUpstream = false
+	conn, err := Dial(destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(TEXT))
+	assert.NoError(t, err, "Write is buffered before the response is checked")
+	_, err = conn.Read(make([]byte, 100))
+	checkErr(err, "Reading")
+}
+
+func TestTag(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	// Once polls fail, that's logged
+	proxy := &Proxy{IdleTimeout: 500 * time.Millisecond}
+	proxy.Start()
+	failReads := int32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/"+OP_READ+"/") && atomic.LoadInt32(&failReads) == 1 {
+			resp.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		proxy.ServeHTTP(resp, req)
+	}))
+	defer server.Close()
+	config := testConfig(server.Listener.Addr().String())
+	config.Tag = "request-42"
+
+	conn, err := Dial(destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	defer conn.Close()
+	assert.Equal(t, "request-42", conn.(Conn).Stats().Tag)
+	_, err = conn.Write([]byte(TEXT))
+	assert.NoError(t, err, "Writing should succeed")
+	b := make([]byte, len(TEXT))
+	_, err = io.ReadFull(conn, b)
+	assert.NoError(t, err, "Reading should succeed")
+
+	atomic.StoreInt32(&failReads, 1)
+	_, err = conn.Read(b)
+	assert.Error(t, err, "Reading should fail once polls fail")
+	assert.NotEmpty(t, testLog.errorsMentioning("[request-42] "), "Errors about the conn should be logged with its tag")
+
+	conn.(Conn).SetTag("request-43")
+	assert.Equal(t, "request-43", conn.(Conn).Stats().Tag)
+	assert.Equal(t, "request-42", config.Tag, "Setting the tag shouldn't change the caller's Config")
+}
+
+// TestReplayEstablishment makes sure that a Conn whose connections to the proxy
+// reach a proxy that doesn't have its tunnel (e.g. another instance behind a
+// CDN) re-establishes the tunnel, or fails if the proxy doesn't allow that.
+func TestReplayEstablishment(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	// Requests go to first until switched to second
+	first := &Proxy{IdleTimeout: 2 * time.Second}
+	first.Start()
+	var second atomic.Value
+	var reestablished int32
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.Header.Get(X_ENPROXY_REESTABLISH) == "true" {
+			atomic.AddInt32(&reestablished, 1)
+		}
+		if p, _ := second.Load().(*Proxy); p != nil {
+			p.ServeHTTP(resp, req)
+			return
+		}
+		first.ServeHTTP(resp, req)
+	}))
+	defer server.Close()
+
+	echo := func(conn net.Conn, msg string) error {
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			return err
+		}
+		b := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return err
+		}
+		if string(b) != msg {
+			return fmt.Errorf("Unexpected echo: %v", string(b))
+		}
+		return nil
+	}
+
+	for _, redial := range []bool{false, true} {
+		second.Store((*Proxy)(nil))
+		atomic.StoreInt32(&reestablished, 0)
+		config := testConfig(server.Listener.Addr().String())
+		// Each request on its own connection, all of which re-establish
+		// once the tunnel is established
+		config.DisableKeepAlives = true
+		config.ReplayEstablishment = true
+		conn, err := Dial(destAddr, config)
+		if err != nil {
+			t.Fatalf("Unable to dial: %v", err)
+		}
+		assert.NoError(t, echo(conn, "Hello"), "Echo should succeed")
+		assert.NoError(t, echo(conn, "World"), "Echo on re-established tunnel should succeed")
+		assert.True(t, atomic.LoadInt32(&reestablished) > 0, "Requests on new connections should re-establish the tunnel")
+
+		other := &Proxy{IdleTimeout: 2 * time.Second, RedialLostTunnels: redial}
+		other.Start()
+		second.Store(other)
+		if redial {
+			assert.NoError(t, echo(conn, "Again"), "Echo should succeed once the other proxy redials")
+		} else {
+			err := echo(conn, "Again")
+			assert.True(t, errors.Is(err, ErrTunnelNotFound), "Echo should fail with ErrTunnelNotFound, not %v", err)
+		}
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	}
+}
+
+func TestResumeConn(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	proxy := &Proxy{}
+	proxy.Start()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+	config := testConfig(server.Listener.Addr().String())
+
+	echo := func(conn net.Conn, msg string) {
+		_, err := conn.Write([]byte(msg))
+		assert.NoError(t, err, "Writing should succeed")
+		b := make([]byte, len(msg))
+		_, err = io.ReadFull(conn, b)
+		assert.NoError(t, err, "Reading should succeed")
+		assert.Equal(t, msg, string(b), "Should have gotten echo")
+	}
+
+	conn, err := Dial(destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	echo(conn, "Hello")
+	_, err = conn.(Conn).File()
+	assert.Equal(t, ErrNotSupported, err, "Conn can't be passed on as a file")
+	data, err := conn.(Conn).SessionState().MarshalBinary()
+	assert.NoError(t, err, "Marshaling session state should succeed")
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	// Give the proxy a moment to notice that the old conn's requests are gone
+	time.Sleep(100 * time.Millisecond)
+
+	state := &SessionState{}
+	if !assert.NoError(t, state.UnmarshalBinary(data), "Unmarshaling session state should succeed") {
+		return
+	}
+	assert.Equal(t, destAddr, state.Addr)
+	assert.Equal(t, int64(5), state.BytesWritten)
+	assert.Equal(t, int64(5), state.BytesRead)
+	assert.True(t, state.WriteSeq > 0, "Session state should include write sequence number")
+
+	conn, err = ResumeConn(state, config)
+	if err != nil {
+		t.Fatalf("Unable to resume: %v", err)
+	}
+	echo(conn, "Hello again")
+	resumedState := conn.(Conn).SessionState()
+	assert.Equal(t, state.ID, resumedState.ID, "Resumed conn should use same id")
+	assert.Equal(t, int64(16), resumedState.BytesWritten, "Resumed conn should keep counting bytes")
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+
+	// Resuming an unknown tunnel fails instead of starting a new tunnel
+	state.ID = "unknown"
+	conn, err = ResumeConn(state, config)
+	if err != nil {
+		t.Fatalf("Unable to resume: %v", err)
+	}
+	_, err = conn.Read(make([]byte, 10))
+	if assert.Error(t, err, "Resuming unknown tunnel should fail") {
+		assert.Contains(t, err.Error(), "410")
+	}
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+}
+
 // This test stimulates a connection leak as seen in
 // https://github.com/getlantern/lantern/issues/2174.
+func TestHTTPConnectProxy(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	proxy := &Proxy{IdleTimeout: 2 * time.Second}
+	proxy.Start()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+	proxyAddr := server.Listener.Addr().String()
+	var connects int64
+	connectProxyAddr := startHTTPConnectProxy(t, "Basic "+base64.StdEncoding.EncodeToString([]byte("user:secret")), &connects)
+
+	config := testConfig(proxyAddr)
+	connectProxy := &HTTPConnectProxy{
+		Addr:     connectProxyAddr,
+		Username: "user",
+		Password: "secret",
+		Timeout:  time.Second,
+	}
+	config.DialProxy = connectProxy.DialProxy(proxyAddr)
+	conn, err := Dial(destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	_, err = conn.Write([]byte("Hello"))
+	assert.NoError(t, err, "Writing should succeed")
+	_, err = io.ReadFull(conn, make([]byte, 5))
+	assert.NoError(t, err, "Reading should succeed")
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	assert.True(t, atomic.LoadInt64(&connects) > 0, "Should have gone through the HTTP proxy")
+
+	connectProxy.Password = "wrong"
+	_, err = connectProxy.DialProxy(proxyAddr)(destAddr)
+	if assert.Error(t, err, "Dialing with wrong credentials should fail") {
+		assert.Contains(t, err.Error(), "407")
+	}
+
+	// A connection that came with data after the CONNECT response still
+	// allows setting socket options
+	raw, err := net.Dial("tcp", connectProxyAddr)
+	if err != nil {
+		t.Fatalf("Unable to dial HTTP proxy: %v", err)
+	}
+	defer raw.Close()
+	var buffered net.Conn = &bufferedConn{Conn: raw, tcp: raw.(*net.TCPConn), reader: bufio.NewReader(io.MultiReader(strings.NewReader("left over"), raw))}
+	b := make([]byte, 9)
+	_, err = io.ReadFull(buffered, b)
+	assert.NoError(t, err, "Reading buffered data should succeed")
+	assert.Equal(t, "left over", string(b))
+	if rb, ok := buffered.(interface{ SetReadBuffer(int) error }); assert.True(t, ok, "Should support SetReadBuffer") {
+		assert.NoError(t, rb.SetReadBuffer(65536))
+	}
+	if sc, ok := buffered.(syscall.Conn); assert.True(t, ok, "Should support SyscallConn") {
+		_, err := sc.SyscallConn()
+		assert.NoError(t, err)
+	}
+}
+
+// TestLoopbackIntegration runs a Conn end to end through a Proxy served by its
+// own http.Server (via Serve) on a loopback port to a destination server that
+// echoes a fixed amount of data and then hangs up, all over real sockets.
+func TestLoopbackIntegration(t *testing.T) {
+	data := patternedData(1024 * 1024)
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Destination unable to listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				if _, err := io.CopyN(conn, conn, int64(len(data))); err != nil {
+					log.Debugf("Unable to echo: %v", err)
+				}
+				if err := conn.Close(); err != nil {
+					log.Debugf("Unable to close connection: %v", err)
+				}
+			}()
+		}
+	}()
+
+	pl, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Proxy unable to listen: %v", err)
+	}
+	defer pl.Close()
+	records := make(chan *AccessLogRecord, 2)
+	proxy := &Proxy{
+		IdleTimeout: 500 * time.Millisecond,
+		OnTunnelClosed: func(record *AccessLogRecord) {
+			records <- record
+		},
+	}
+	go func() {
+		if err := proxy.Serve(pl); err != nil {
+			log.Debugf("Proxy stopped serving: %v", err)
+		}
+	}()
+
+	for _, buffered := range []bool{false, true} {
+		config := testConfig(pl.Addr().String())
+		config.BufferRequests = buffered
+		conn, err := Dial(l.Addr().String(), config)
+		if err != nil {
+			t.Fatalf("Unable to dial: %v", err)
+		}
+
+		writeErr := make(chan error, 1)
+		go func() {
+			// Write in pieces of varying size, concurrently with reading
+			rest := data
+			for i := 1; len(rest) > 0; i++ {
+				n := i * 997 % 65536
+				if n > len(rest) {
+					n = len(rest)
+				}
+				if _, err := conn.Write(rest[:n]); err != nil {
+					writeErr <- err
+					return
+				}
+				rest = rest[n:]
+			}
+			writeErr <- nil
+		}()
+		received, err := ioutil.ReadAll(conn)
+		assert.NoError(t, err, "Reading up to EOF should succeed (buffered: %v)", buffered)
+		assert.NoError(t, <-writeErr, "Writing should succeed (buffered: %v)", buffered)
+		assert.True(t, bytes.Equal(data, received), "Should have received all data back in order (buffered: %v), got %d of %d bytes", buffered, len(received), len(data))
+		_, err = conn.Read(make([]byte, 1))
+		assert.Equal(t, io.EOF, err, "Reads after EOF should keep returning EOF (buffered: %v)", buffered)
+
+		assert.NoError(t, conn.Close(), "Closing conn should succeed (buffered: %v)", buffered)
+		_, err = conn.Write([]byte("x"))
+		assert.Error(t, err, "Writing to closed conn should fail (buffered: %v)", buffered)
+		select {
+		case record := <-records:
+			assert.EqualValues(t, len(data), record.BytesUp, "Proxy should have sent all data upstream (buffered: %v)", buffered)
+			assert.EqualValues(t, len(data), record.BytesDown, "Proxy should have sent all data downstream (buffered: %v)", buffered)
+			assert.Equal(t, TunnelClosedDestination, record.CloseReason)
+		case <-time.After(2 * time.Second):
+			t.Errorf("Proxy should have closed the tunnel (buffered: %v)", buffered)
+		}
+	}
+}
+
 func TestHTTPRedirect(t *testing.T) {
 	startProxy(t, false)
 
@@ -238,6 +4983,18 @@ func prepareConn(addr string, buffered bool, fail bool, t *testing.T, onResponse
 		})
 }
 
+// testConfig returns a Config for dialing the proxy at the given address.
+func testConfig(addr string) *Config {
+	return &Config{
+		DialProxy: func(string) (net.Conn, error) {
+			return net.Dial("tcp", addr)
+		},
+		NewRequest: func(host, path, method string, body io.Reader) (*http.Request, error) {
+			return http.NewRequest(method, "http://"+addr+"/"+path+"/", body)
+		},
+	}
+}
+
 func newRequest(host, path, method string, body io.Reader) (req *http.Request, err error) {
 	return http.NewRequest(method, "http://"+proxyAddr+"/"+path+"/", body)
 }
@@ -398,6 +5155,152 @@ func startHttpsServer(t *testing.T) {
 	doStartServer(t, l)
 }
 
+// startDataServer starts a TCP server that writes data to every connection
+// that it accepts and then leaves the connection open until the client closes
+// it.
+func startDataServer(t testing.TB, data []byte) string {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Data server unable to listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() {
+					if err := conn.Close(); err != nil {
+						log.Debugf("Unable to close connection: %v", err)
+					}
+				}()
+				if _, err := conn.Write(data); err != nil {
+					log.Debugf("Unable to write data: %v", err)
+				}
+				if _, err := io.Copy(ioutil.Discard, conn); err != nil {
+					log.Debugf("Unable to read from connection: %v", err)
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// startTricklingServer starts a TCP server that writes chunk to every
+// connection that it accepts, pausing in between, until the client hangs up.
+func startTricklingServer(t testing.TB, chunk []byte, pause time.Duration) string {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Trickling server unable to listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				for {
+					if _, err := conn.Write(chunk); err != nil {
+						break
+					}
+					time.Sleep(pause)
+				}
+				if err := conn.Close(); err != nil {
+					log.Debugf("Unable to close connection: %v", err)
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// startEchoServer starts a TCP server that echoes back whatever it receives
+func startEchoServer(t testing.TB) string {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Echo server unable to listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				if _, err := io.Copy(conn, conn); err != nil {
+					log.Debugf("Unable to echo: %v", err)
+				}
+				if err := conn.Close(); err != nil {
+					log.Debugf("Unable to close connection: %v", err)
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// startHTTPConnectProxy starts an HTTP proxy that only supports CONNECT and
+// requires the given Proxy-Authorization, counting successful CONNECTs in
+// connects.
+func startHTTPConnectProxy(t testing.TB, authorization string, connects *int64) string {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("HTTP proxy unable to listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				if req.Method != http.MethodConnect || req.Header.Get("Proxy-Authorization") != authorization {
+					if _, err := conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n")); err != nil {
+						log.Debugf("Unable to respond: %v", err)
+					}
+					return
+				}
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					return
+				}
+				defer target.Close()
+				atomic.AddInt64(connects, 1)
+				if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+					return
+				}
+				go func() {
+					if _, err := io.Copy(target, conn); err != nil {
+						log.Debugf("Unable to copy to target: %v", err)
+					}
+					target.Close()
+				}()
+				if _, err := io.Copy(conn, target); err != nil {
+					log.Debugf("Unable to copy from target: %v", err)
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// patternedData returns n bytes of data following a pattern that doesn't line
+// up with typical buffer sizes.
+func patternedData(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	return data
+}
+
 func doStartServer(t *testing.T, l net.Listener) {
 	go func() {
 		httpServer := &http.Server{
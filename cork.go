@@ -0,0 +1,72 @@
+package enproxy
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultMaxCorkDuration: how long a Conn stays corked at most by default
+	// (see Config.MaxCorkDuration)
+	defaultMaxCorkDuration = 1 * time.Second
+)
+
+// Cork() implements the function from Conn
+func (c *conn) Cork() error {
+	if c.ws != nil {
+		return ErrNotSupported
+	}
+	if isClosed(c.closedCh) {
+		return net.ErrClosed
+	}
+	atomic.CompareAndSwapInt64(&c.corkedAt, 0, time.Now().UnixNano())
+	return nil
+}
+
+// Uncork() implements the function from Conn
+func (c *conn) Uncork() error {
+	if c.ws != nil {
+		return ErrNotSupported
+	}
+	if atomic.SwapInt64(&c.corkedAt, 0) == 0 {
+		// Not corked
+		return nil
+	}
+
+	// processWrites finishes the body with the data that's already been
+	// written
+	result := make(chan error, 1)
+	select {
+	case c.uncorkCh <- result:
+	case <-c.closedCh:
+		return net.ErrClosed
+	}
+	select {
+	case err := <-result:
+		return err
+	case <-c.closedCh:
+		return net.ErrClosed
+	}
+}
+
+// heldByCork indicates whether the current request body should be kept open
+// despite having been idle because this conn is corked. Once the conn has been
+// corked for MaxCorkDuration, it's uncorked so that the body goes out.
+func (c *conn) heldByCork() bool {
+	corkedAt := atomic.LoadInt64(&c.corkedAt)
+	if corkedAt == 0 {
+		return false
+	}
+	max := c.getConfig().MaxCorkDuration
+	if max <= 0 {
+		max = defaultMaxCorkDuration
+	}
+	if time.Now().Sub(time.Unix(0, corkedAt)) < max {
+		return true
+	}
+	if atomic.CompareAndSwapInt64(&c.corkedAt, corkedAt, 0) {
+		c.logger().Debugf("Connection to %s corked for more than %v, uncorking", c.addr, max)
+	}
+	return false
+}
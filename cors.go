@@ -0,0 +1,107 @@
+package enproxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// enproxyHeaders: the headers that enproxy's requests and responses carry,
+// which browsers have to be allowed to send and read (see CORS)
+var enproxyHeaders = []string{
+	X_ENPROXY_ID,
+	X_ENPROXY_DEST_ADDR,
+	X_ENPROXY_EOF,
+	X_ENPROXY_PROXY_HOST,
+	X_ENPROXY_OP,
+	X_ENPROXY_RESUME,
+	X_ENPROXY_MAX_RESPONSE_BYTES,
+	X_ENPROXY_ENCODING,
+	X_ENPROXY_ACCEPT_ENCODING,
+	X_ENPROXY_DICT_ID,
+	X_ENPROXY_RECEIVE_WINDOW,
+	X_ENPROXY_MAX_RECONNECTS,
+	X_ENPROXY_RECEIVED,
+	X_ENPROXY_OFFSET,
+	X_ENPROXY_SEQ,
+	X_ENPROXY_MORE,
+	X_ENPROXY_HEARTBEAT,
+	X_ENPROXY_NO_WAIT,
+	X_ENPROXY_VERSION,
+	X_ENPROXY_CAPABILITIES,
+	X_ENPROXY_MAX_BODY_BYTES,
+	X_ENPROXY_SNI,
+	X_ENPROXY_REESTABLISH,
+	X_ENPROXY_BODY_ENCODING,
+}
+
+// CORS configures how a Proxy answers requests from browsers (see
+// Proxy.CORS). Preflight requests, i.e. OPTIONS requests with an
+// Access-Control-Request-Method header and without an X-Enproxy-Id header, are
+// answered with a 204 and the Access-Control-* headers instead of being
+// treated as tunnel requests. Tunnel requests from allowed origins get an
+// Access-Control-Allow-Origin header, and the enproxy headers of their
+// responses are exposed to the browser.
+type CORS struct {
+	// AllowedOrigins: the origins (e.g. "https://app.example.com") that may
+	// use the Proxy, "*" allows any origin. Preflight requests from other
+	// origins are refused with a 403.
+	AllowedOrigins []string
+
+	// AllowedHeaders: headers that browsers may send besides the enproxy
+	// headers, which are always allowed, e.g. headers that a front-end
+	// expects.
+	AllowedHeaders []string
+
+	// MaxAge: how long browsers may cache the answer to a preflight request.
+	// If zero, browsers use their default.
+	MaxAge time.Duration
+}
+
+// allowsOrigin indicates whether origin may use the Proxy
+func (cors *CORS) allowsOrigin(origin string) bool {
+	for _, allowed := range cors.AllowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// handle sets the CORS headers on resp for requests that come from a browser
+// and answers preflight requests. It returns true if req was a preflight
+// request, which needs no further handling.
+func (cors *CORS) handle(resp http.ResponseWriter, req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		// Not from a browser
+		return false
+	}
+	preflight := req.Method == http.MethodOptions &&
+		req.Header.Get("Access-Control-Request-Method") != "" &&
+		req.Header.Get(X_ENPROXY_ID) == ""
+	header := resp.Header()
+	header.Add("Vary", "Origin")
+	if !cors.allowsOrigin(origin) {
+		if preflight {
+			log.Debugf("Refusing preflight request from origin %v", origin)
+			resp.WriteHeader(http.StatusForbidden)
+		}
+		return preflight
+	}
+	header.Set("Access-Control-Allow-Origin", origin)
+	if !preflight {
+		header.Set("Access-Control-Expose-Headers", strings.Join(enproxyHeaders, ", "))
+		return false
+	}
+
+	header.Set("Access-Control-Allow-Methods", "GET, POST, HEAD")
+	allowedHeaders := append(append([]string{"Content-Type"}, enproxyHeaders...), cors.AllowedHeaders...)
+	header.Set("Access-Control-Allow-Headers", strings.Join(allowedHeaders, ", "))
+	if cors.MaxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(int(cors.MaxAge.Seconds())))
+	}
+	resp.WriteHeader(http.StatusNoContent)
+	return true
+}
@@ -0,0 +1,265 @@
+package enproxy
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// deadline is a read or write deadline that blocked calls can wait for, like
+// the deadlines of net.Pipe.
+type deadline struct {
+	mutex  sync.Mutex
+	timer  *time.Timer
+	t      time.Time
+	passed chan struct{} // closed once the deadline has passed
+}
+
+func newDeadline() *deadline {
+	return &deadline{passed: make(chan struct{})}
+}
+
+// set sets the deadline to t, the zero value meaning no deadline
+func (d *deadline) set(t time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		// Wait for the timer to close passed
+		<-d.passed
+	}
+	d.timer = nil
+	d.t = t
+	passed := isClosed(d.passed)
+	if t.IsZero() {
+		if passed {
+			d.passed = make(chan struct{})
+		}
+		return
+	}
+	if wait := time.Until(t); wait > 0 {
+		if passed {
+			d.passed = make(chan struct{})
+		}
+		d.timer = time.AfterFunc(wait, func() {
+			close(d.passed)
+		})
+		return
+	}
+	if !passed {
+		close(d.passed)
+	}
+}
+
+// isSet indicates whether there is a deadline
+func (d *deadline) isSet() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return !d.t.IsZero()
+}
+
+// wait returns a channel that's closed once the deadline has passed
+func (d *deadline) wait() chan struct{} {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.passed
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// SetDeadline() implements the function from net.Conn
+func (c *conn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// SetReadDeadline() implements the function from net.Conn
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline() implements the function from net.Conn
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// usesReadDeadline indicates whether a Read has to go through
+// readWithDeadline, because there is a read deadline or a read that outlived
+// its deadline hasn't been returned yet.
+func (c *conn) usesReadDeadline() bool {
+	if c.readDeadline.isSet() {
+		return true
+	}
+	c.deadlineReadMutex.Lock()
+	defer c.deadlineReadMutex.Unlock()
+	return c.deadlineReadCh != nil || len(c.deadlineReadLeft) > 0 || c.deadlineReadErr != nil
+}
+
+// readWithDeadline reads into b unless the read deadline passes first, in
+// which case it fails with os.ErrDeadlineExceeded. The data of a read that
+// outlives its deadline isn't lost, it's returned by a subsequent Read. To keep
+// such reads from writing into b after we've returned, they read into a
+// buffer owned by the conn.
+func (c *conn) readWithDeadline(b []byte) (int, error) {
+	c.deadlineReadMutex.Lock()
+	defer c.deadlineReadMutex.Unlock()
+
+	if c.readClosed() {
+		c.deadlineReadLeft = nil
+		c.deadlineReadErr = nil
+		atomic.StoreInt64(&c.deadlineReadBytes, 0)
+		return 0, io.EOF
+	}
+	if len(c.deadlineReadLeft) > 0 {
+		n := copy(b, c.deadlineReadLeft)
+		c.deadlineReadLeft = c.deadlineReadLeft[n:]
+		atomic.StoreInt64(&c.deadlineReadBytes, int64(len(c.deadlineReadLeft)))
+		return n, nil
+	}
+	if c.deadlineReadErr != nil {
+		err := c.deadlineReadErr
+		c.deadlineReadErr = nil
+		return 0, err
+	}
+
+	if c.deadlineReadCh == nil {
+		if isClosed(c.readDeadline.wait()) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		if cap(c.deadlineReadBuf) < len(b) {
+			c.deadlineReadBuf = make([]byte, len(b))
+		}
+		buf := c.deadlineReadBuf[:len(b)]
+		if c.ws != nil {
+			ch := make(chan rwResponse, 1)
+			go func() {
+				n, err := c.ws.Read(buf)
+				atomic.AddInt64(&c.bytesRead, int64(n))
+				ch <- rwResponse{n, err}
+			}()
+			c.deadlineReadCh = ch
+		} else {
+			if err := c.getAsyncErr(); err != nil {
+				return 0, err
+			}
+			if !c.submitRead(buf) {
+				return 0, net.ErrClosed
+			}
+			defer decrement(&blockedOnRead)
+			c.deadlineReadCh = c.readResponsesCh
+		}
+	}
+
+	select {
+	case res, ok := <-c.deadlineReadCh:
+		c.deadlineReadCh = nil
+		if !ok {
+			return 0, io.EOF
+		}
+		n := copy(b, c.deadlineReadBuf[:res.n])
+		if n < res.n {
+			// The read was for a bigger b, return the rest with the
+			// following Reads
+			c.deadlineReadLeft = c.deadlineReadBuf[n:res.n]
+			atomic.StoreInt64(&c.deadlineReadBytes, int64(len(c.deadlineReadLeft)))
+			c.deadlineReadErr = res.err
+			return n, nil
+		}
+		return n, c.interruptedErr(res.err)
+	case err := <-c.asyncErrCh:
+		return 0, err
+	case <-c.readClosedCh:
+		c.deadlineReadCh = nil
+		return 0, io.EOF
+	case <-c.readDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+// usesWriteDeadline indicates whether a Write has to go through
+// writeWithDeadline, because there is a write deadline or a write that
+// outlived its deadline hasn't finished yet.
+func (c *conn) usesWriteDeadline() bool {
+	if c.writeDeadline.isSet() {
+		return true
+	}
+	c.deadlineWriteMutex.Lock()
+	defer c.deadlineWriteMutex.Unlock()
+	return c.deadlineWriteCh != nil
+}
+
+// writeWithDeadline writes b unless the write deadline passes first, in which
+// case it fails with os.ErrDeadlineExceeded. Like with other net.Conns, data
+// from a Write that timed out may still be sent. A Write that follows such a
+// Write waits for it to finish first, so that data is sent in order. Since the
+// write can finish after we've returned, it writes a copy of b.
+func (c *conn) writeWithDeadline(b []byte) (int, error) {
+	c.deadlineWriteMutex.Lock()
+	defer c.deadlineWriteMutex.Unlock()
+
+	if c.deadlineWriteCh != nil {
+		select {
+		case res, ok := <-c.deadlineWriteCh:
+			c.deadlineWriteCh = nil
+			if !ok {
+				return 0, io.EOF
+			}
+			if res.err != nil {
+				return 0, c.interruptedErr(res.err)
+			}
+		case err := <-c.asyncErrCh:
+			return 0, err
+		case <-c.writeDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+
+	if isClosed(c.writeDeadline.wait()) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	buf := make([]byte, len(b))
+	copy(buf, b)
+	var ch chan rwResponse
+	if c.ws != nil {
+		ch = make(chan rwResponse, 1)
+		go func() {
+			n, err := c.ws.Write(buf)
+			atomic.AddInt64(&c.bytesWritten, int64(n))
+			ch <- rwResponse{n, err}
+		}()
+	} else {
+		if err := c.getAsyncErr(); err != nil {
+			return 0, err
+		}
+		if !c.submitWrite(buf) {
+			return 0, net.ErrClosed
+		}
+		defer decrement(&blockedOnWrite)
+		ch = c.writeResponsesCh
+	}
+
+	select {
+	case res, ok := <-ch:
+		if !ok {
+			return 0, io.EOF
+		}
+		return res.n, c.interruptedErr(res.err)
+	case err := <-c.asyncErrCh:
+		return 0, err
+	case <-c.writeDeadline.wait():
+		c.deadlineWriteCh = ch
+		return 0, os.ErrDeadlineExceeded
+	}
+}
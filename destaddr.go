@@ -0,0 +1,74 @@
+package enproxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxHostLength: the longest domain name allowed by DNS
+	maxHostLength = 253
+
+	// maxLabelLength: the longest label of a domain name allowed by DNS
+	maxLabelLength = 63
+)
+
+// normalizeDestAddr checks that addr, the destination address requested by a
+// client, is a well-formed host:port and returns it in canonical form: host
+// names lowercased, IP addresses in their standard notation and the port
+// without leading zeros. This keeps malformed input from reaching Dial and
+// makes sure that DestinationLimits, Resolver and the access log see a single
+// form of each address.
+func normalizeDestAddr(addr string) (string, error) {
+	for _, c := range addr {
+		if c <= ' ' || c == 0x7F {
+			return "", fmt.Errorf("Destination address %q contains whitespace or control characters", addr)
+		}
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("Destination address %q is not a host:port: %v", addr, err)
+	}
+
+	portNum, err := strconv.Atoi(port)
+	if err != nil || port[0] < '0' || port[0] > '9' || portNum < 1 || portNum > 65535 {
+		return "", fmt.Errorf("Destination address %q has invalid port %q", addr, port)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	} else {
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		if !validHostname(host) {
+			return "", fmt.Errorf("Destination address %q has invalid host %q", addr, host)
+		}
+	}
+	return net.JoinHostPort(host, strconv.Itoa(portNum)), nil
+}
+
+// validHostname indicates whether host is a syntactically valid (lowercase)
+// host name. Underscores are allowed since they show up in real-world names.
+// Names whose last label is numeric are rejected, since resolvers may take
+// them for IP addresses in nonstandard notation (e.g. 127.000.0.1 or
+// 0x7f.1).
+func validHostname(host string) bool {
+	if host == "" || len(host) > maxHostLength {
+		return false
+	}
+	labels := strings.Split(host, ".")
+	for _, label := range labels {
+		if label == "" || len(label) > maxLabelLength || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	last := labels[len(labels)-1]
+	return strings.Trim(last, "0123456789") != "" && !strings.HasPrefix(last, "0x")
+}
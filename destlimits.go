@@ -0,0 +1,43 @@
+package enproxy
+
+import (
+	"path"
+)
+
+// DestinationLimit limits the number of concurrent tunnels that a Proxy opens
+// to each destination matching a pattern.
+type DestinationLimit struct {
+	// Pattern: pattern for destination addresses (host:port) to which this
+	// limit applies, using the syntax of path.Match, e.g. "*.example.com:443"
+	// or "*:25".
+	Pattern string
+
+	// MaxTunnels: maximum number of concurrent tunnels to each matching
+	// destination address. Each address is counted separately.
+	MaxTunnels int
+}
+
+// destinationLimit returns the maximum number of tunnels to addr according to
+// the first matching DestinationLimit, or 0 if there's no limit.
+func (p *Proxy) destinationLimit(addr string) int {
+	for _, limit := range p.DestinationLimits {
+		if matched, err := path.Match(limit.Pattern, addr); err != nil {
+			log.Debugf("Invalid destination pattern %v: %v", limit.Pattern, err)
+		} else if matched {
+			return limit.MaxTunnels
+		}
+	}
+	return 0
+}
+
+// DestinationCounts returns the number of tunnels that this Proxy currently has
+// open to each destination address.
+func (p *Proxy) DestinationCounts() map[string]int {
+	p.connMapMutex.RLock()
+	defer p.connMapMutex.RUnlock()
+	counts := make(map[string]int, len(p.destCounts))
+	for addr, count := range p.destCounts {
+		counts[addr] = count
+	}
+	return counts
+}
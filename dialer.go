@@ -0,0 +1,204 @@
+package enproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DEFAULT_MAX_IDLE_CONNS = 10
+)
+
+var (
+	// ErrDialerClosed is returned by Dialer.Dial once the Dialer has been
+	// closed.
+	ErrDialerClosed = errors.New("enproxy: Dialer closed")
+
+	defaultMaxIdleTime = 5 * time.Second
+)
+
+// Dialer dials Conns that all share the same Config. Whenever a Conn is done
+// with one of its connections to the proxy and that connection is still in a
+// clean state, the connection is kept in an idle pool from which subsequent
+// Conns can take it instead of dialing the proxy again.
+//
+// Pooled connections are shared without regard to the destination address, so
+// a Dialer should only be used with a DialProxy that always reaches the same
+// proxy.
+//
+// This is how many Conns (e.g. a browser's connections to different sites)
+// share a few connections to the proxy: every request carries its Conn's id,
+// which the Proxy uses to find the right destination connection, so a proxy
+// connection can serve requests for any number of Conns one after the other.
+// A proxy connection is only ever used by one request at a time though, since
+// HTTP/1.1 has no way to interleave responses and read requests hold their
+// connection for as long as the proxy is waiting for data.
+//
+// A Dialer must not be copied after first use.
+type Dialer struct {
+	// Config: configuration used for all Conns dialed by this Dialer
+	Config *Config
+
+	// MaxIdleConns: how many idle proxy connections to keep in the pool,
+	// defaults to 10.
+	MaxIdleConns int
+
+	// MaxIdleTime: how long a proxy connection may sit in the pool before it is
+	// closed, defaults to 5 seconds. This should be lower than the amount of
+	// time for which the proxy keeps idle connections open.
+	MaxIdleTime time.Duration
+
+	// MaxConcurrentDials: if non-zero, how many Conns this Dialer establishes
+	// at once, to spread out the load on the proxy when many Conns are dialed
+	// in a burst (e.g. by a browser loading a page). A Conn counts from when
+	// it's dialed until its tunnel is established or fails, further Dials
+	// wait in a queue in the meantime (see QueuedDials).
+	MaxConcurrentDials int
+
+	idle   []*idleConn
+	closed bool
+	mutex  sync.Mutex
+
+	// dialSlots: semaphore for MaxConcurrentDials, created on first use
+	dialSlots chan struct{}
+	// queuedDials: how many Dials are waiting for a slot, accessed atomically
+	queuedDials int32
+}
+
+// idleConn is a proxy connection sitting in a Dialer's idle pool
+type idleConn struct {
+	proxyConn *connInfo
+	idleSince time.Time
+}
+
+// Dial dials a new Conn to the given addr, reusing idle connections to the
+// proxy where possible.
+func (d *Dialer) Dial(addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), addr)
+}
+
+// DialContext is like Dial, but returns ctx.Err() if ctx is done before the
+// Conn is dialed, including while waiting for MaxConcurrentDials. Once
+// dialed, the Conn doesn't depend on ctx.
+func (d *Dialer) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	d.mutex.Lock()
+	closed := d.closed
+	d.mutex.Unlock()
+	if closed {
+		return nil, ErrDialerClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if d.MaxConcurrentDials <= 0 {
+		return dialContext(ctx, func() (net.Conn, error) {
+			return dial(ctx, addr, d.Config, d)
+		})
+	}
+
+	slots := d.getDialSlots()
+	atomic.AddInt32(&d.queuedDials, 1)
+	select {
+	case slots <- struct{}{}:
+		atomic.AddInt32(&d.queuedDials, -1)
+	case <-ctx.Done():
+		atomic.AddInt32(&d.queuedDials, -1)
+		return nil, ctx.Err()
+	}
+	return dialContext(ctx, func() (net.Conn, error) {
+		conn, err := dial(ctx, addr, d.Config, d)
+		if err != nil {
+			<-slots
+			return nil, err
+		}
+		// Hold on to the slot until the tunnel is established
+		go func() {
+			<-conn.(*idleTimingConn).readyCh
+			<-slots
+		}()
+		return conn, nil
+	})
+}
+
+// QueuedDials returns how many Dials are currently waiting because of
+// MaxConcurrentDials.
+func (d *Dialer) QueuedDials() int {
+	return int(atomic.LoadInt32(&d.queuedDials))
+}
+
+// getDialSlots returns the semaphore for MaxConcurrentDials
+func (d *Dialer) getDialSlots() chan struct{} {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.dialSlots == nil {
+		d.dialSlots = make(chan struct{}, d.MaxConcurrentDials)
+	}
+	return d.dialSlots
+}
+
+// Close closes all idle connections in the pool and stops this Dialer from
+// dialing new Conns. Conns that were already dialed keep working (dialing the
+// proxy directly when they need a new connection), but their proxy
+// connections are closed instead of being pooled once they're done.
+func (d *Dialer) Close() error {
+	d.mutex.Lock()
+	idle := d.idle
+	d.idle = nil
+	d.closed = true
+	d.mutex.Unlock()
+
+	for _, ic := range idle {
+		ic.proxyConn.close()
+	}
+	return nil
+}
+
+// get takes a usable connection from the idle pool, returning nil if none is
+// available.
+func (d *Dialer) get() *connInfo {
+	maxIdleTime := d.MaxIdleTime
+	if maxIdleTime == 0 {
+		maxIdleTime = defaultMaxIdleTime
+	}
+
+	for {
+		d.mutex.Lock()
+		if len(d.idle) == 0 {
+			d.mutex.Unlock()
+			return nil
+		}
+		// Take the most recently pooled connection
+		ic := d.idle[len(d.idle)-1]
+		d.idle = d.idle[:len(d.idle)-1]
+		d.mutex.Unlock()
+
+		if time.Now().Sub(ic.idleSince) < maxIdleTime && ic.proxyConn.usable() {
+			return ic.proxyConn
+		}
+		ic.proxyConn.close()
+	}
+}
+
+// put returns a connection to the idle pool, closing it instead if it's no
+// longer usable, the pool is full or the Dialer is closed.
+func (d *Dialer) put(proxyConn *connInfo) {
+	maxIdleConns := d.MaxIdleConns
+	if maxIdleConns == 0 {
+		maxIdleConns = DEFAULT_MAX_IDLE_CONNS
+	}
+
+	if proxyConn.usable() && proxyConn.bufReader.Buffered() == 0 {
+		d.mutex.Lock()
+		if !d.closed && len(d.idle) < maxIdleConns {
+			d.idle = append(d.idle, &idleConn{proxyConn, time.Now()})
+			d.mutex.Unlock()
+			return
+		}
+		d.mutex.Unlock()
+	}
+	proxyConn.close()
+}
@@ -0,0 +1,156 @@
+package enproxy
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/fdcount"
+	"github.com/getlantern/testify/assert"
+)
+
+func TestDialerClose(t *testing.T) {
+	startServers(t, false)
+
+	err := fdcount.WaitUntilNoneMatch("CLOSE_WAIT", 5*time.Second)
+	if err != nil {
+		t.Fatalf("Unable to wait until no more connections are in CLOSE_WAIT: %v", err)
+	}
+
+	_, counter, err := fdcount.Matching("TCP")
+	if err != nil {
+		t.Fatalf("Unable to get fdcount: %v", err)
+	}
+	goroutinesBefore := runtime.NumGoroutine()
+
+	dialer := &Dialer{
+		Config: &Config{
+			DialProxy: func(addr string) (net.Conn, error) {
+				return net.Dial("tcp", proxyAddr)
+			},
+			NewRequest: newRequest,
+		},
+	}
+
+	conn, err := dialer.Dial(httpAddr)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	doRequests(conn, t)
+
+	// Closing the Dialer refuses new Conns but leaves existing ones alone
+	assert.NoError(t, dialer.Close(), "Closing dialer should succeed")
+	_, err = dialer.Dial(httpAddr)
+	assert.Equal(t, ErrDialerClosed, err, "Dialing on a closed Dialer should fail")
+	doRequests(conn, t)
+
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	dialer.mutex.Lock()
+	idle := len(dialer.idle)
+	dialer.mutex.Unlock()
+	assert.Equal(t, 0, idle, "Closed Dialer shouldn't pool connections")
+
+	if !assert.NoError(t, counter.AssertDelta(2), "All file descriptors except the connection from proxy to destination site should have been closed") {
+		DumpConnTrace()
+	}
+
+	// The only goroutines left behind should be the ones on the proxy and
+	// destination server that serve the upstream connection.
+	var goroutinesAfter int
+	for i := 0; i < 20; i++ {
+		goroutinesAfter = runtime.NumGoroutine()
+		if goroutinesAfter <= goroutinesBefore+2 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.True(t, goroutinesAfter <= goroutinesBefore+2, "Goroutines leaked: %d before, %d after", goroutinesBefore, goroutinesAfter)
+}
+
+func TestDialerReusesIdleConns(t *testing.T) {
+	startServers(t, false)
+
+	dials := int32(0)
+	dialer := &Dialer{
+		Config: &Config{
+			DialProxy: func(addr string) (net.Conn, error) {
+				atomic.AddInt32(&dials, 1)
+				return net.Dial("tcp", proxyAddr)
+			},
+			NewRequest: newRequest,
+		},
+	}
+	defer func() {
+		assert.NoError(t, dialer.Close(), "Closing dialer should succeed")
+	}()
+
+	for i := 0; i < 2; i++ {
+		conn, err := dialer.Dial(httpAddr)
+		if err != nil {
+			t.Fatalf("Unable to dial: %v", err)
+		}
+		doRequests(conn, t)
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&dials), "Second conn should have reused the first conn's proxy connections")
+}
+
+func TestDialerMaxConcurrentDials(t *testing.T) {
+	startServers(t, false)
+
+	// Dialing the proxy blocks until released
+	release := make(chan struct{})
+	dialer := &Dialer{
+		Config: &Config{
+			DialProxy: func(addr string) (net.Conn, error) {
+				<-release
+				return net.Dial("tcp", proxyAddr)
+			},
+			NewRequest: newRequest,
+		},
+		MaxConcurrentDials: 1,
+	}
+	defer func() {
+		assert.NoError(t, dialer.Close(), "Closing dialer should succeed")
+	}()
+
+	dialed := make(chan net.Conn, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			conn, err := dialer.Dial(httpAddr)
+			if err != nil {
+				t.Errorf("Unable to dial: %v", err)
+			}
+			dialed <- conn
+		}()
+	}
+	waitForQueuedDials := func(n int) bool {
+		for i := 0; i < 100; i++ {
+			if dialer.QueuedDials() == n {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+	assert.True(t, waitForQueuedDials(1), "One dial should be queued while the other is in progress")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := dialer.DialContext(ctx, httpAddr)
+	assert.Equal(t, context.DeadlineExceeded, err, "Queued dial should give up once its context is done")
+	assert.Equal(t, 1, dialer.QueuedDials(), "Dial that gave up shouldn't be queued anymore")
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		conn := <-dialed
+		if conn != nil {
+			doRequests(conn, t)
+			assert.NoError(t, conn.Close(), "Closing conn should succeed")
+		}
+	}
+	assert.Equal(t, 0, dialer.QueuedDials(), "No dials should be queued once all are done")
+}
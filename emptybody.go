@@ -0,0 +1,47 @@
+package enproxy
+
+import (
+	"io"
+	"net/http"
+)
+
+// EmptyBodyFraming determines how requests to the proxy that don't carry any
+// data are framed (see Config.EmptyBodyFraming). These requests are POSTs, so
+// they can't go without any framing: Go's HTTP client always announces the
+// length of their body.
+type EmptyBodyFraming int
+
+const (
+	// FrameEmptyContentLength: send Content-Length: 0. This is the default
+	// and works with most intermediaries, including CDNs that don't accept
+	// chunked request bodies (like Fastly, see BufferRequests).
+	FrameEmptyContentLength EmptyBodyFraming = iota
+
+	// FrameEmptyChunked: send Transfer-Encoding: chunked with just the last
+	// chunk, i.e. a zero-length chunked body. This is for intermediaries that
+	// mishandle POSTs with Content-Length: 0, e.g. by dropping them or by
+	// holding on to them waiting for a body, but which pass on the chunked
+	// bodies of streamed write requests. It doesn't work with intermediaries
+	// that reject chunked requests (e.g. with 411 Length Required).
+	FrameEmptyChunked
+)
+
+// emptyBody is a request body without any data whose length isn't known up
+// front, which makes the request use chunked encoding
+type emptyBody struct{}
+
+func (emptyBody) Read(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (emptyBody) Close() error {
+	return nil
+}
+
+// frameEmptyChunked makes req, which doesn't carry any data, send a zero-length
+// chunked body (see FrameEmptyChunked)
+func frameEmptyChunked(req *http.Request) {
+	req.Body = emptyBody{}
+	req.ContentLength = -1
+	req.TransferEncoding = []string{"chunked"}
+}
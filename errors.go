@@ -0,0 +1,169 @@
+package enproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// ErrRateLimited matches (using errors.Is) the RateLimitErrors returned when
+// the proxy rate-limits a Conn.
+var ErrRateLimited = errors.New("enproxy: rate-limited by proxy")
+
+// ErrNoProgress is returned by pending Reads and Writes when a Conn closes
+// itself because of Config.ProgressTimeout.
+var ErrNoProgress = errors.New("enproxy: no progress within ProgressTimeout")
+
+// ErrRequestQuotaExceeded is returned by pending Reads and Writes when a Conn
+// closes itself because it has sent Config.MaxRequests requests.
+var ErrRequestQuotaExceeded = errors.New("enproxy: request quota exceeded")
+
+// ErrHeartbeatFailed is returned (wrapped) by pending Reads and Writes when a
+// Conn closes itself because the proxy didn't answer a heartbeat (see
+// Config.HeartbeatInterval).
+var ErrHeartbeatFailed = errors.New("enproxy: heartbeat failed")
+
+// ErrTunnelNotFound is returned (wrapped) by Reads and Writes when the proxy
+// no longer has the Conn's tunnel, for example because it evicted the tunnel to
+// make room for others (see Proxy.MaxTunnels). Data may have been lost with the
+// tunnel, so the Conn can't continue; the application has to dial a new Conn
+// if it can start over.
+var ErrTunnelNotFound = errors.New("enproxy: tunnel not found by proxy")
+
+// ErrUnexpectedResponse matches (using errors.Is) the UnexpectedResponseErrors
+// returned when Config.ValidateResponses finds a response that doesn't come
+// from the proxy.
+var ErrUnexpectedResponse = errors.New("enproxy: unexpected response, not from proxy")
+
+// ErrBodyReadTimeout is returned (wrapped) when a response body from the proxy
+// stops arriving for longer than Config.BodyReadTimeout.
+var ErrBodyReadTimeout = errors.New("enproxy: response body stopped arriving within BodyReadTimeout")
+
+// ErrResponseLost is returned (wrapped) by a Read when a response from the
+// proxy went missing, so that the data that follows it can't be returned (see
+// Config.MaxReorderBytes).
+var ErrResponseLost = errors.New("enproxy: response from proxy lost")
+
+// ErrNotSupported is returned by Conn.File, since a Conn's tunnel can't be
+// passed to another process as a file descriptor (use SessionState and
+// ResumeConn instead).
+var ErrNotSupported = errors.New("enproxy: not supported by Conn, which has no single underlying file descriptor")
+
+// ErrWriteClosed is returned by Writes on a Conn after CloseWrite.
+var ErrWriteClosed = errors.New("enproxy: write after CloseWrite")
+
+// ErrConcurrentRead is returned by a Read on a Conn that's called while
+// another Read is pending. A Conn supports a single reader at a time.
+var ErrConcurrentRead = errors.New("enproxy: concurrent Reads on Conn")
+
+// ErrConcurrentWrite is returned by a Write on a Conn that's called while
+// another Write is pending. A Conn supports a single writer at a time.
+var ErrConcurrentWrite = errors.New("enproxy: concurrent Writes on Conn")
+
+// RedirectError is returned when the proxy responds to a request with a
+// redirect that isn't followed, either because Config.MaxRedirects has been
+// reached or because the request can't be reissued.
+type RedirectError struct {
+	// StatusCode: the status code of the redirect (e.g. 302)
+	StatusCode int
+
+	// Location: the value of the redirect's Location header
+	Location string
+}
+
+func (e *RedirectError) Error() string {
+	return fmt.Sprintf("Proxy responded with redirect %d to %v", e.StatusCode, e.Location)
+}
+
+// host returns the host to which this redirect points. Only the host of the
+// Location is used, since enproxy determines the path of its requests itself.
+// Relative redirects resolve to the current host.
+func (e *RedirectError) host(currentHost string) (string, error) {
+	u, err := url.Parse(e.Location)
+	if err != nil {
+		return "", fmt.Errorf("Unable to parse redirect location %v: %v", e.Location, err)
+	}
+	if u.Host == "" {
+		return currentHost, nil
+	}
+	return u.Host, nil
+}
+
+// FramingError is returned when a response from the proxy ends before the
+// length declared by its Content-Length, or stops arriving for longer than the
+// Conn's ResponseHeaderTimeout (or IdleTimeout, if that's not set) before
+// reaching that length. This indicates that an intermediary mangled the
+// response.
+type FramingError struct {
+	// Declared: the response's Content-Length
+	Declared int64
+
+	// Received: the number of bytes of the body that were received
+	Received int64
+
+	// Err: the error that ended the body
+	Err error
+}
+
+func (e *FramingError) Error() string {
+	return fmt.Sprintf("Response from proxy ended after %d of the %d bytes declared by its Content-Length: %v", e.Received, e.Declared, e.Err)
+}
+
+func (e *FramingError) Unwrap() error {
+	return e.Err
+}
+
+// ConfigChangeError is returned by Conn.Reconfigure when the new Config changes
+// a field that can't be changed on a running Conn.
+type ConfigChangeError struct {
+	// Field: the name of the Config field that can't be changed
+	Field string
+}
+
+func (e *ConfigChangeError) Error() string {
+	return fmt.Sprintf("Config.%s can't be changed on a running Conn", e.Field)
+}
+
+// RateLimitError is returned when the proxy responds to a request with a 429 or
+// 503 carrying a Retry-After that isn't waited out, either because it's longer
+// than Config.MaxRetryAfter or because the request can't be reissued.
+type RateLimitError struct {
+	// StatusCode: the status code of the response (429 or 503)
+	StatusCode int
+
+	// RetryAfter: how long the proxy asked the Conn to wait before sending
+	// further requests
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("Proxy responded with %d, retry after %v", e.StatusCode, e.RetryAfter)
+}
+
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+// UnexpectedResponseError is returned when Config.ValidateResponses finds that
+// a successful response doesn't come from the proxy, for example because a
+// captive portal answered the request with its login page.
+type UnexpectedResponseError struct {
+	// StatusCode: the status code of the response
+	StatusCode int
+
+	// ContentType: the response's Content-Type (e.g. text/html)
+	ContentType string
+
+	// Snippet: the start of the response's body, up to
+	// unexpectedResponseSnippetBytes
+	Snippet []byte
+}
+
+func (e *UnexpectedResponseError) Error() string {
+	return fmt.Sprintf("Response %d (%s) didn't come from proxy: %q", e.StatusCode, e.ContentType, e.Snippet)
+}
+
+func (e *UnexpectedResponseError) Is(target error) bool {
+	return target == ErrUnexpectedResponse
+}
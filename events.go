@@ -0,0 +1,88 @@
+package enproxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// EventType identifies what happened in an Event
+type EventType int
+
+const (
+	// TunnelOpened: the Conn's tunnel was established, i.e. the proxy
+	// connected to the destination server, or establishing it failed (see
+	// Event.Err). Sent once per Conn.
+	TunnelOpened EventType = iota
+
+	// TunnelClosed: the Conn was closed (see Event.CloseReason). Sent once
+	// per Conn.
+	TunnelClosed
+
+	// Reconnected: a poll succeeded after polls had failed because the
+	// connection to the proxy broke and were retried (see ReconnectBackoff)
+	Reconnected
+
+	// PollIssued: the Conn sent a read request to the proxy
+	PollIssued
+)
+
+func (t EventType) String() string {
+	switch t {
+	case TunnelOpened:
+		return "tunnel opened"
+	case TunnelClosed:
+		return "tunnel closed"
+	case Reconnected:
+		return "reconnected"
+	case PollIssued:
+		return "poll issued"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is something that happened to a Conn, sent to Config.Events
+type Event struct {
+	// Type: what happened
+	Type EventType
+
+	// Time: when it happened
+	Time time.Time
+
+	// ID, Addr and Tag: the Conn's tunnel id, destination address and tag
+	// (see Config.Tag)
+	ID   string
+	Addr string
+	Tag  string
+
+	// Err: for TunnelOpened, the error if establishing the tunnel failed
+	// (including because the Conn was closed first), and for TunnelClosed,
+	// the error that failed the Conn, if any
+	Err error
+
+	// Latency: for TunnelOpened, how long establishing the tunnel took (see
+	// Stats.EstablishTime), and for Reconnected, how long the polls had been
+	// failing
+	Latency time.Duration
+
+	// CloseReason: for TunnelClosed, why the Conn was closed
+	CloseReason CloseReason
+}
+
+// emit sends an event of the given type to Config.Events without blocking,
+// dropping it if the channel is full.
+func (c *conn) emit(event Event) {
+	events := c.getConfig().Events
+	if events == nil {
+		return
+	}
+	event.Time = time.Now()
+	event.ID = c.id
+	event.Addr = c.addr
+	event.Tag = c.getConfig().Tag
+	select {
+	case events <- event:
+	default:
+		atomic.AddInt64(&c.droppedEvents, 1)
+	}
+}
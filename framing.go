@@ -0,0 +1,94 @@
+package enproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errBodyStalled = errors.New("body stopped arriving")
+)
+
+// framedBody is the body of a response with a Content-Length. It turns a body
+// that ends early or stops arriving into a FramingError, and keeps the proxy
+// connection from being reused if the proxy sent more data than it declared,
+// which would otherwise be taken for the start of the next response.
+type framedBody struct {
+	io.ReadCloser
+	proxyConn *connInfo
+	timeout   time.Duration
+	declared  int64
+	received  int64
+	stalled   int32
+}
+
+func (c *conn) newFramedBody(resp io.ReadCloser, proxyConn *connInfo, declared int64) *framedBody {
+	timeout := c.getConfig().ResponseHeaderTimeout
+	if timeout == 0 {
+		timeout = c.getConfig().IdleTimeout
+	}
+	return &framedBody{
+		ReadCloser: resp,
+		proxyConn:  proxyConn,
+		timeout:    timeout,
+		declared:   declared,
+	}
+}
+
+func (b *framedBody) Read(p []byte) (int, error) {
+	// Rather than using a read deadline, which could replace the deadline
+	// with which Close interrupts reads, close the proxy connection if the
+	// body stalls.
+	stallTimer := time.AfterFunc(b.timeout, func() {
+		atomic.StoreInt32(&b.stalled, 1)
+		b.proxyConn.close()
+	})
+	n, err := b.ReadCloser.Read(p)
+	stallTimer.Stop()
+	b.received += int64(n)
+	if err == io.EOF {
+		if b.proxyConn.bufReader.Buffered() > 0 {
+			log.Errorf("Proxy sent more than the %d bytes declared by Content-Length, not reusing connection", b.declared)
+			b.proxyConn.markClosed()
+		}
+	} else if err != nil {
+		b.proxyConn.markClosed()
+		if atomic.LoadInt32(&b.stalled) == 1 {
+			err = errBodyStalled
+		}
+		err = &FramingError{Declared: b.declared, Received: b.received, Err: err}
+	}
+	return n, err
+}
+
+// timedBody aborts a response body that stops arriving for longer than
+// Config.BodyReadTimeout once it has started, by closing the proxy connection
+// like framedBody does.
+type timedBody struct {
+	io.ReadCloser
+	proxyConn *connInfo
+	timeout   time.Duration
+	started   bool
+	stalled   int32
+}
+
+func (b *timedBody) Read(p []byte) (int, error) {
+	if !b.started {
+		n, err := b.ReadCloser.Read(p)
+		b.started = n > 0
+		return n, err
+	}
+	stallTimer := time.AfterFunc(b.timeout, func() {
+		atomic.StoreInt32(&b.stalled, 1)
+		b.proxyConn.close()
+	})
+	n, err := b.ReadCloser.Read(p)
+	stallTimer.Stop()
+	if err != nil && err != io.EOF && atomic.LoadInt32(&b.stalled) == 1 {
+		err = fmt.Errorf("%w after %v: %v", ErrBodyReadTimeout, b.timeout, err)
+	}
+	return n, err
+}
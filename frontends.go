@@ -0,0 +1,166 @@
+package enproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// defaultFrontendCooldown: how long a front-end that failed is left out
+	// by default (see FrontendSet.Cooldown)
+	defaultFrontendCooldown = 30 * time.Second
+
+	errNoFrontends = errors.New("No front-end with a positive weight")
+)
+
+// Frontend is one way of reaching the proxy, e.g. through a particular CDN.
+type Frontend struct {
+	// Name: identifies the front-end in errors and logs
+	Name string
+
+	// DialProxy: function to open a connection to the proxy through this
+	// front-end
+	DialProxy func(addr string) (net.Conn, error)
+
+	// NewRequest: optional function to create requests sent through this
+	// front-end (e.g. with the Host that it expects), defaults to the
+	// Config's NewRequest
+	NewRequest func(host, path, method string, body io.Reader) (*http.Request, error)
+
+	// Weight: how many tunnels this front-end gets relative to the others.
+	// Front-ends with a weight of 0 or less are never used.
+	Weight int
+}
+
+// FrontendSet spreads tunnels across several front-ends in proportion to
+// their weights (see Config.Frontends). A Conn picks one of the front-ends at
+// random when it first dials the proxy and sticks with it. If dialing through
+// it fails, the Conn falls back to another front-end, picked the same way
+// among those that it hasn't tried, and continues with the first one that
+// works. All front-ends must therefore lead to the same Proxy.
+//
+// A front-end that fails is left out for Cooldown by all Conns that share the
+// FrontendSet, so that they don't keep picking a dead front-end, unless all
+// the front-ends that they could pick failed. A FrontendSet is safe for
+// concurrent use and must not be copied once used.
+type FrontendSet struct {
+	// Frontends: the front-ends to choose from
+	Frontends []Frontend
+
+	// Cooldown: how long a front-end that failed is left out, defaults to 30
+	// seconds
+	Cooldown time.Duration
+
+	mutex       sync.Mutex
+	failedUntil map[int]time.Time
+}
+
+// pick picks the index of a front-end at random by weight, leaving out those
+// in tried and, if possible, those that recently failed. It returns -1 if
+// there are no front-ends left.
+func (s *FrontendSet) pick(tried map[int]bool) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	var healthy, all []int
+	for i, frontend := range s.Frontends {
+		if frontend.Weight <= 0 || tried[i] {
+			continue
+		}
+		all = append(all, i)
+		if now.After(s.failedUntil[i]) {
+			healthy = append(healthy, i)
+		}
+	}
+	candidates := healthy
+	if len(candidates) == 0 {
+		candidates = all
+	}
+	total := 0
+	for _, i := range candidates {
+		total += s.Frontends[i].Weight
+	}
+	if total == 0 {
+		return -1
+	}
+	n := rand.Intn(total)
+	for _, i := range candidates {
+		n -= s.Frontends[i].Weight
+		if n < 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// failed leaves the front-end at index i out for Cooldown
+func (s *FrontendSet) failed(i int) {
+	cooldown := s.Cooldown
+	if cooldown <= 0 {
+		cooldown = defaultFrontendCooldown
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.failedUntil == nil {
+		s.failedUntil = make(map[int]time.Time)
+	}
+	s.failedUntil[i] = time.Now().Add(cooldown)
+}
+
+// currentFrontend returns the index of the front-end that this conn uses, or
+// -1 if it hasn't picked one yet.
+func (c *conn) currentFrontend() int {
+	return int(atomic.LoadInt32(&c.frontend)) - 1
+}
+
+// dialFrontend dials the proxy through the front-end that this conn uses,
+// falling back to others if that fails.
+func (c *conn) dialFrontend(frontends *FrontendSet) (net.Conn, error) {
+	tried := make(map[int]bool)
+	i := c.currentFrontend()
+	var lastErr error
+	for {
+		if i < 0 || tried[i] {
+			i = frontends.pick(tried)
+		}
+		if i < 0 {
+			if lastErr == nil {
+				lastErr = errNoFrontends
+			}
+			return nil, lastErr
+		}
+		tried[i] = true
+		frontend := &frontends.Frontends[i]
+		conn, err := frontend.DialProxy(c.addr)
+		if err == nil {
+			if previous := c.currentFrontend(); previous != i {
+				if previous >= 0 {
+					c.logger().Debugf("Connection to %s falling back from front-end %s to %s", c.addr, frontends.Frontends[previous].Name, frontend.Name)
+				}
+				atomic.StoreInt32(&c.frontend, int32(i+1))
+			}
+			return conn, nil
+		}
+		frontends.failed(i)
+		lastErr = fmt.Errorf("Unable to dial front-end %s: %w", frontend.Name, err)
+		c.logger().Debug(lastErr)
+	}
+}
+
+// newRequestFunc returns the function that builds requests through the
+// front-end that this conn uses.
+func (c *conn) newRequestFunc() newRequestFunc {
+	if frontends := c.getConfig().Frontends; frontends != nil {
+		if i := c.currentFrontend(); i >= 0 && frontends.Frontends[i].NewRequest != nil {
+			return frontends.Frontends[i].NewRequest
+		}
+	}
+	return c.getConfig().NewRequest
+}
@@ -0,0 +1,42 @@
+package enproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Health is the status reported by a Proxy at its HealthPath
+type Health struct {
+	// ActiveTunnels: number of tunnels that the Proxy currently has open
+	ActiveTunnels int `json:"activeTunnels"`
+
+	// Uptime: how long ago the Proxy was started, in seconds
+	Uptime float64 `json:"uptimeSeconds"`
+
+	// EvictedTunnels: number of tunnels that the Proxy has evicted to make
+	// room for new ones (see MaxTunnels)
+	EvictedTunnels int64 `json:"evictedTunnels"`
+}
+
+// Health returns the current health of this Proxy
+func (p *Proxy) Health() *Health {
+	p.connMapMutex.RLock()
+	activeTunnels := len(p.connMap)
+	p.connMapMutex.RUnlock()
+	return &Health{
+		ActiveTunnels:  activeTunnels,
+		Uptime:         time.Now().Sub(p.startedAt).Seconds(),
+		EvictedTunnels: p.Evictions(),
+	}
+}
+
+// handleHealth responds to requests to HealthPath with the Proxy's Health as
+// JSON.
+func (p *Proxy) handleHealth(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Header().Set("Cache-Control", "no-cache")
+	if err := json.NewEncoder(resp).Encode(p.Health()); err != nil {
+		log.Debugf("Unable to write health: %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+package enproxy
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// heartbeat periodically checks with the proxy that it still has this conn's
+// tunnel (see Config.HeartbeatInterval), failing the conn if it doesn't or if
+// the proxy doesn't answer in time.
+func (c *conn) heartbeat() {
+	select {
+	case <-c.readyCh:
+		if c.readyErr != nil {
+			return
+		}
+	case <-c.closedCh:
+		return
+	}
+	if !c.proxySupports(capHeartbeat) {
+		c.logger().Debugf("Proxy for %s doesn't support heartbeats, not sending any", c.addr)
+		return
+	}
+
+	ticker := time.NewTicker(c.getConfig().HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closedCh:
+			return
+		case <-ticker.C:
+		}
+		if err := c.sendHeartbeat(); err != nil {
+			select {
+			case <-c.closedCh:
+				// Failed because we're closing
+				return
+			default:
+			}
+			c.logger().Debugf("Heartbeat for %s failed, closing: %v", c.addr, err)
+			c.fail(fmt.Errorf("%w: %v", ErrHeartbeatFailed, err))
+			return
+		}
+	}
+}
+
+// sendHeartbeat sends a heartbeat to the proxy on a connection of its own and
+// waits up to HeartbeatTimeout for the proxy to echo it.
+func (c *conn) sendHeartbeat() error {
+	proxyConn, err := c.dialProxy()
+	if err != nil {
+		return err
+	}
+	timer := time.AfterFunc(c.getConfig().HeartbeatTimeout, proxyConn.close)
+	defer timer.Stop()
+
+	nonce := strconv.FormatInt(atomic.AddInt64(&c.heartbeats, 1), 10)
+	proxyConn, _, resp, err := c.doRequestFollowingRedirects(proxyConn, c.getProxyHost(), OP_HEARTBEAT, nil)
+	if err != nil {
+		if proxyConn != nil {
+			c.closeProxyConn(proxyConn)
+		}
+		if !timer.Stop() {
+			return fmt.Errorf("No echo within %v", c.getConfig().HeartbeatTimeout)
+		}
+		return err
+	}
+	if err := resp.Body.Close(); err != nil {
+		c.logger().Debugf("Unable to close response body: %v", err)
+	}
+	c.releaseProxyConn(proxyConn)
+	if echoed := resp.Header.Get(X_ENPROXY_HEARTBEAT); echoed != nonce {
+		return fmt.Errorf("Proxy echoed heartbeat %q instead of %q", echoed, nonce)
+	}
+	return nil
+}
+
+// setProxyHost and getProxyHost remember the proxy host learned from the first
+// response, so that heartbeats reach the same proxy as the tunnel's requests.
+func (c *conn) setProxyHost(host string) {
+	c.proxyHostMutex.Lock()
+	c.proxyHost = host
+	c.proxyHostMutex.Unlock()
+}
+
+func (c *conn) getProxyHost() string {
+	c.proxyHostMutex.RLock()
+	defer c.proxyHostMutex.RUnlock()
+	return c.proxyHost
+}
+
+// handleHeartbeat echoes a client's heartbeat if we still have its tunnel and
+// the tunnel's connection to the destination server hasn't failed. Unlike other
+// requests, heartbeats never start a tunnel.
+func (p *Proxy) handleHeartbeat(resp http.ResponseWriter, req *http.Request, id string) {
+	p.connMapMutex.RLock()
+	lc := p.connMap[id]
+	p.connMapMutex.RUnlock()
+	if lc == nil {
+		respond(http.StatusGone, resp, fmt.Sprintf("No tunnel with id %v", id))
+		return
+	}
+	lc.mutex.Lock()
+	failed := lc.failed || lc.err != nil
+	lc.mutex.Unlock()
+	if failed {
+		respond(http.StatusBadGateway, resp, fmt.Sprintf("Connection to %v failed", lc.addr))
+		return
+	}
+	resp.Header().Set(X_ENPROXY_HEARTBEAT, req.Header.Get(X_ENPROXY_HEARTBEAT))
+	resp.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,127 @@
+package enproxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// HTTPConnectProxy is an HTTP proxy, like those found in corporate networks,
+// through which the enproxy proxy can only be reached with CONNECT. Its
+// DialProxy method provides a Config.DialProxy that goes through it.
+type HTTPConnectProxy struct {
+	// Addr: host:port of the HTTP proxy
+	Addr string
+
+	// Username and Password: if Username is set, the credentials sent to the
+	// HTTP proxy in a Basic Proxy-Authorization header
+	Username string
+	Password string
+
+	// Header: optional additional headers to send with the CONNECT request
+	// (e.g. a User-Agent that the HTTP proxy expects)
+	Header http.Header
+
+	// Timeout: how long to wait for connecting to the HTTP proxy and for its
+	// response to the CONNECT, unlimited if 0
+	Timeout time.Duration
+}
+
+// DialProxy returns a function for Config.DialProxy that connects to the
+// enproxy proxy at proxyAddr (a host:port) by sending CONNECT to the HTTP
+// proxy. Dialing fails if the HTTP proxy doesn't respond to the CONNECT with a
+// 2xx, for example with a 407 if it doesn't accept the credentials.
+func (p *HTTPConnectProxy) DialProxy(proxyAddr string) func(addr string) (net.Conn, error) {
+	return func(addr string) (net.Conn, error) {
+		return p.dial(proxyAddr)
+	}
+}
+
+func (p *HTTPConnectProxy) dial(proxyAddr string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", p.Addr, p.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to dial HTTP proxy %s: %w", p.Addr, err)
+	}
+	fail := func(err error) (net.Conn, error) {
+		if err := conn.Close(); err != nil {
+			log.Debugf("Unable to close connection to HTTP proxy: %v", err)
+		}
+		return nil, err
+	}
+	if p.Timeout > 0 {
+		if err := conn.SetDeadline(time.Now().Add(p.Timeout)); err != nil {
+			log.Debugf("Unable to set deadline: %v", err)
+		}
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: proxyAddr},
+		Host:   proxyAddr,
+		Header: make(http.Header),
+	}
+	for key, values := range p.Header {
+		req.Header[key] = values
+	}
+	if p.Username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(p.Username + ":" + p.Password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		return fail(fmt.Errorf("Unable to send CONNECT to HTTP proxy %s: %w", p.Addr, err))
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return fail(fmt.Errorf("Unable to read response to CONNECT from HTTP proxy %s: %w", p.Addr, err))
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		if err := resp.Body.Close(); err != nil {
+			log.Debugf("Unable to close response body: %v", err)
+		}
+		return fail(fmt.Errorf("HTTP proxy %s refused CONNECT to %s: %s", p.Addr, proxyAddr, resp.Status))
+	}
+
+	if p.Timeout > 0 {
+		if err := conn.SetDeadline(time.Time{}); err != nil {
+			log.Debugf("Unable to clear deadline: %v", err)
+		}
+	}
+	if reader.Buffered() > 0 {
+		// The HTTP proxy already passed on data from the enproxy proxy, which
+		// must be read before anything else
+		return &bufferedConn{Conn: conn, tcp: conn.(*net.TCPConn), reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a net.Conn from which data that was already read into reader
+// is read first. It forwards the methods for socket options to tcp, the
+// connection to the HTTP proxy, so that they still apply (see
+// Config.ProxySocketReadBuffer and Conn.UnderlyingConns).
+type bufferedConn struct {
+	net.Conn
+	tcp    *net.TCPConn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *bufferedConn) SetReadBuffer(bytes int) error {
+	return c.tcp.SetReadBuffer(bytes)
+}
+
+func (c *bufferedConn) SetWriteBuffer(bytes int) error {
+	return c.tcp.SetWriteBuffer(bytes)
+}
+
+func (c *bufferedConn) SyscallConn() (syscall.RawConn, error) {
+	return c.tcp.SyscallConn()
+}
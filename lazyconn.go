@@ -1,13 +1,23 @@
 package enproxy
 
 import (
+	"container/list"
+	"context"
+	"errors"
 	"fmt"
 	"net"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/getlantern/idletiming"
 )
 
+var (
+	errTunnelNotEstablished = errors.New("Tunnel not established in time")
+	errRequestBodyTooLarge  = errors.New("Request body too large")
+)
+
 // lazyConn is a lazily initializing conn that makes sure it is only initialized
 // once.  Using these allows us to ensure that we only create one connection per
 // connection id, but to still support doing the Dial calls concurrently.
@@ -19,41 +29,312 @@ type lazyConn struct {
 	connOut net.Conn
 	err     error
 	mutex   sync.Mutex
+
+	// dialAddr: the address that's dialed for addr (see Proxy.Resolver)
+	dialAddr string
+
+	// upstreamBucket and downstreamBucket: limits for the tunnel from
+	// Proxy.TunnelRateLimits, nil if unlimited
+	upstreamBucket   *tokenBucket
+	downstreamBucket *tokenBucket
+
+	// serverName: the server name that the client asked for when dialing
+	// the destination server with TLS (see Proxy.UpstreamTLS), if any
+	serverName string
+
+	// clientSource: the client's address for the PROXY protocol header, nil
+	// if unknown
+	clientSource *net.TCPAddr
+
+	// maxReconnects: how many times to redial the destination server after
+	// the connection to it fails (see Config.MaxUpstreamReconnects)
+	maxReconnects int
+	reconnects    int
+
+	// For OnTunnelClosed. bytesUp and bytesDown are accessed atomically.
+	bytesUp    int64
+	bytesDown  int64
+	createdAt  time.Time
+	clientAddr string
+	failed     bool
+	closed     bool
+	// clientClosed: whether the client closed the tunnel's WebSocket
+	clientClosed bool
+
+	// lruElement: this tunnel's element in the Proxy's lru, guarded by the
+	// Proxy's connMapMutex
+	lruElement *list.Element
+
+	// establishTimer: drops the tunnel if it isn't established within the
+	// Proxy's EstablishTimeout
+	establishTimer *time.Timer
+	established    bool
+
+	// For sending data again that may not have reached the client (see
+	// acknowledge). sentDown is how many bytes of data were sent in
+	// responses, the last len(unacked) of which the client hasn't confirmed
+	// yet. readMutex guards them and keeps responses from reading connOut at
+	// the same time, so that the order of their numbers is the order of their
+	// data (see responseReorderer). responseSeq is the number of the last
+	// one, also guarded by readMutex.
+	readMutex   sync.Mutex
+	sentDown    int64
+	unacked     []byte
+	responseSeq int64
+
+	// For writing sequenced write requests in order (see copyInOrder).
+	// nextSeq is 0 until the first one arrives. seqMutex also serializes
+	// their writes to connOut.
+	seqMutex      sync.Mutex
+	nextSeq       int64
+	pendingBodies map[int64][]byte
+	pendingBytes  int
+
+	// clientCapabilities: the capabilities announced by the client, accessed
+	// atomically (see recordClientCapabilities)
+	clientCapabilities uint32
+
+	// upstream: the connection that connOut wraps, for shutting down writing
+	// to it once the client is done writing (clientEOF, see closeWrite).
+	// eofSeq is the sequence number of the write request that said so, if it
+	// arrived before its turn, guarded by seqMutex.
+	upstream  net.Conn
+	clientEOF bool
+	eofSeq    int64
+
+	// ctx: canceled once the tunnel is closed, which cancels dials of the
+	// destination server that are still going on (see Proxy.DialUpstream)
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 func (p *Proxy) newLazyConn(id string, addr string) *lazyConn {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &lazyConn{
-		p:    p,
-		id:   id,
-		addr: addr,
+		p:         p,
+		id:        id,
+		addr:      addr,
+		dialAddr:  addr,
+		createdAt: time.Now(),
+		ctx:       ctx,
+		cancel:    cancel,
 	}
 }
 
-func (l *lazyConn) get() (conn net.Conn, err error) {
+// get returns the connection to the destination server, dialing it if
+// necessary. A dial is canceled once ctx is done or the tunnel is closed.
+func (l *lazyConn) get(ctx context.Context) (conn net.Conn, err error) {
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
 	if l.err != nil {
-		// If dial already resulted in an error, return that
-		return nil, err
+		// If dial already resulted in an error, or the tunnel was dropped,
+		// return that
+		return nil, l.err
 	}
 	if l.connOut == nil {
 		// Lazily dial out
-		conn, err := l.p.Dial(l.addr)
-		if err != nil {
+		dialCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		stop := context.AfterFunc(l.ctx, cancel)
+		defer stop()
+		if err := l.dial(dialCtx); err != nil {
+			if ctx.Err() != nil && l.ctx.Err() == nil {
+				// The client went away while we were dialing, let its next
+				// request dial again
+				l.err = nil
+			}
+			return nil, err
+		}
+	}
+
+	return l.connOut, l.err
+}
+
+// dial dials the destination server, canceling the dial once ctx is done. It
+// must be called with mutex held.
+func (l *lazyConn) dial(ctx context.Context) error {
+	conn, err := l.p.DialUpstream(ctx, l.dialAddr)
+	if err != nil {
+		if l.dialAddr != l.addr {
+			// Don't tell the client the resolved address
+			log.Errorf("Unable to dial out to %s at %s: %s", l.addr, l.dialAddr, err)
+			l.err = fmt.Errorf("Unable to dial out to %s", l.addr)
+		} else {
 			l.err = fmt.Errorf("Unable to dial out to %s: %s", l.addr, err)
-			return nil, l.err
 		}
+		return l.err
+	}
 
-		// Wrap the connection in an idle timing one
-		l.connOut = idletiming.Conn(conn, l.p.IdleTimeout, func() {
-			l.p.connMapMutex.Lock()
-			defer l.p.connMapMutex.Unlock()
-			delete(l.p.connMap, l.id)
+	if l.p.ProxyProtocol != 0 {
+		if err := l.sendProxyProtocolHeader(conn); err != nil {
 			if err := conn.Close(); err != nil {
 				log.Debugf("Unable to close connection: %v", err)
 			}
-		})
+			l.err = fmt.Errorf("Unable to send PROXY protocol header to %s: %s", l.addr, err)
+			return l.err
+		}
+	}
+	if l.p.UpstreamTLS != nil {
+		tlsConn, err := l.handshakeTLS(conn)
+		if err != nil {
+			if err := conn.Close(); err != nil {
+				log.Debugf("Unable to close connection: %v", err)
+			}
+			l.err = fmt.Errorf("Unable to establish TLS with %s: %s", l.addr, err)
+			return l.err
+		}
+		conn = tlsConn
 	}
 
-	return l.connOut, l.err
+	if l.upstreamBucket != nil || l.downstreamBucket != nil {
+		conn = &shapedConn{conn, l.upstreamBucket, l.downstreamBucket}
+	}
+	if l.p.WriteBufferSize > 0 {
+		conn = newCoalescingConn(conn, l.p.WriteBufferSize, l.p.WriteFlushDelay)
+	}
+
+	// Wrap the connection in an idle timing one
+	l.upstream = conn
+	l.connOut = idletiming.Conn(conn, l.p.IdleTimeout, func() {
+		l.p.connMapMutex.Lock()
+		l.p.removeLazyConn(l)
+		l.p.connMapMutex.Unlock()
+		if err := conn.Close(); err != nil {
+			log.Debugf("Unable to close connection: %v", err)
+		}
+		l.p.tunnelClosed(l)
+	})
+	return nil
+}
+
+// establish marks the tunnel as established once its first request has been
+// fully received, so that it's no longer subject to EstablishTimeout.
+func (l *lazyConn) establish() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.established = true
+	if l.establishTimer != nil {
+		l.establishTimer.Stop()
+	}
+}
+
+// dropIfUnestablished drops the tunnel if it hasn't been established, closing
+// the connection to the destination server if there is one.
+func (l *lazyConn) dropIfUnestablished() {
+	l.mutex.Lock()
+	if l.established {
+		l.mutex.Unlock()
+		return
+	}
+	log.Debugf("Tunnel %v to %v not established within %v, dropping", l.id, l.addr, l.p.EstablishTimeout)
+	if l.err == nil {
+		// Fail any requests that are still to come
+		l.err = errTunnelNotEstablished
+	}
+	connOut := l.connOut
+	l.mutex.Unlock()
+
+	l.p.connMapMutex.Lock()
+	l.p.removeLazyConn(l)
+	l.p.connMapMutex.Unlock()
+	if connOut != nil {
+		if err := connOut.Close(); err != nil {
+			log.Debugf("Unable to close connection: %v", err)
+		}
+	}
+	l.p.tunnelClosed(l)
+}
+
+// drop closes the tunnel for the given reason, which requests that are still to
+// come for it fail with.
+func (l *lazyConn) drop(reason error) {
+	// Cancel a dial that's going on before waiting for it
+	l.cancel()
+	l.mutex.Lock()
+	if l.err == nil {
+		l.err = reason
+	}
+	connOut := l.connOut
+	l.mutex.Unlock()
+
+	l.p.connMapMutex.Lock()
+	l.p.removeLazyConn(l)
+	l.p.connMapMutex.Unlock()
+	if connOut != nil {
+		if err := connOut.Close(); err != nil {
+			log.Debugf("Unable to close connection: %v", err)
+		}
+	}
+	l.p.tunnelClosed(l)
+}
+
+// reconnect replaces the given failed connection to the destination server
+// with a new one, if the client asked for reconnects and hasn't used them up.
+// Otherwise, it returns cause. Data that was in flight on the failed
+// connection is lost.
+func (l *lazyConn) reconnect(failed net.Conn, cause error) (net.Conn, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.connOut != failed {
+		// Another request already reconnected
+		return l.connOut, nil
+	}
+	if l.reconnects >= l.maxReconnects || l.clientEOF {
+		// A new connection wouldn't know that the client is done writing
+		return nil, cause
+	}
+	l.reconnects++
+	log.Debugf("Connection to %s failed with %v, reconnecting (%d of %d)", l.addr, cause, l.reconnects, l.maxReconnects)
+	if err := failed.Close(); err != nil {
+		log.Debugf("Unable to close failed connection: %v", err)
+	}
+	l.connOut = nil
+	if err := l.dial(l.ctx); err != nil {
+		return nil, err
+	}
+	return l.connOut, nil
+}
+
+// maxUnackedBytes: how much data the Proxy keeps for sending again (see
+// acknowledge). A response ends once that much is waiting for the client to
+// confirm it, which the client's next poll does.
+const maxUnackedBytes = 1024 * 1024
+
+// acknowledge takes note of how much of the tunnel's data the client has
+// received according to received, the X_ENPROXY_RECEIVED of its poll, and
+// returns the data that it's missing, which is to be sent again. Clients that
+// don't say don't get anything sent again. Must be called with readMutex held.
+func (l *lazyConn) acknowledge(received string) ([]byte, error) {
+	if received == "" {
+		l.unacked = nil
+		return nil, nil
+	}
+	n, err := strconv.ParseInt(received, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s: %q", X_ENPROXY_RECEIVED, received)
+	}
+	kept := l.sentDown - int64(len(l.unacked))
+	if n < kept || n > l.sentDown {
+		// The tunnel started over on this lazyConn, e.g. because the proxy
+		// lost track of it while the client kept going, so count from where
+		// the client is
+		l.sentDown = n
+		l.unacked = nil
+		return nil, nil
+	}
+	l.unacked = l.unacked[n-kept:]
+	if len(l.unacked) == 0 {
+		l.unacked = nil
+	}
+	return l.unacked, nil
+}
+
+// sent takes note of b having been sent to the client in a response, keeping
+// it until the client confirms that it arrived if the client keeps track (see
+// acknowledge). Must be called with readMutex held.
+func (l *lazyConn) sent(b []byte, keep bool) {
+	l.sentDown += int64(len(b))
+	if keep {
+		l.unacked = append(l.unacked, b...)
+	}
 }
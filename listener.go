@@ -0,0 +1,105 @@
+package enproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+var (
+	// ErrListenerClosed is returned by Listener.Accept once the Listener has
+	// been closed.
+	ErrListenerClosed = errors.New("enproxy: Listener closed")
+)
+
+// Listener is a net.Listener that accepts the tunnels served by a Proxy.
+// Instead of dialing the destination server for each new tunnel, the Proxy
+// hands the server side of the tunnel to Accept as a net.Conn, which allows
+// arbitrary TCP services to be served over enproxy.
+type Listener struct {
+	connsCh   chan net.Conn
+	closedCh  chan struct{}
+	closeOnce sync.Once
+}
+
+// NewListener creates a Listener for the given Proxy. This sets the Proxy's
+// DialUpstream, which takes precedence over its Dial, so tunnels served by the
+// Proxy are only ever handed to the Listener. NewListener must be called before
+// the Proxy starts serving.
+func NewListener(p *Proxy) *Listener {
+	l := &Listener{
+		connsCh:  make(chan net.Conn),
+		closedCh: make(chan struct{}),
+	}
+	p.DialUpstream = l.dial
+	return l
+}
+
+// dial is used as the Proxy's DialUpstream, handing one end of a pipe to
+// Accept and returning the other end to the Proxy.
+func (l *Listener) dial(ctx context.Context, addr string) (net.Conn, error) {
+	proxyEnd, serverEnd := net.Pipe()
+	select {
+	case l.connsCh <- &listenerConn{serverEnd, addr}:
+		return proxyEnd, nil
+	case <-l.closedCh:
+		return nil, ErrListenerClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Accept() implements the function from net.Listener, waiting for and
+// returning the next tunnel.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.connsCh:
+		return conn, nil
+	case <-l.closedCh:
+		return nil, ErrListenerClosed
+	}
+}
+
+// Close() implements the function from net.Listener. Tunnels that were already
+// accepted are not closed.
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closedCh)
+	})
+	return nil
+}
+
+// Addr() implements the function from net.Listener
+func (l *Listener) Addr() net.Addr {
+	return tunnelAddr("enproxy")
+}
+
+// listenerConn is a tunnel accepted by a Listener. Its LocalAddr is the
+// destination address requested by the client.
+type listenerConn struct {
+	net.Conn
+	addr string
+}
+
+// LocalAddr() implements the function from net.Conn
+func (c *listenerConn) LocalAddr() net.Addr {
+	return tunnelAddr(c.addr)
+}
+
+// RemoteAddr() implements the function from net.Conn
+func (c *listenerConn) RemoteAddr() net.Addr {
+	return tunnelAddr("enproxy")
+}
+
+// tunnelAddr is a net.Addr for the ends of tunnels, both those accepted by a
+// Listener and Conns
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string {
+	return "enproxy"
+}
+
+func (a tunnelAddr) String() string {
+	return string(a)
+}
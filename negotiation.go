@@ -0,0 +1,129 @@
+package enproxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// capability is a protocol feature that a client or proxy may support, as a
+// bit in a set of capabilities
+type capability uint32
+
+const (
+	// capMore: the proxy tells clients in an X_ENPROXY_MORE trailer whether
+	// more data is waiting, and the client polls again right away if so
+	capMore capability = 1 << iota
+
+	// capNoWait: the proxy answers read requests with X_ENPROXY_NO_WAIT
+	// right away, rather than waiting for data
+	capNoWait
+
+	// capHeartbeat: the proxy answers OP_HEARTBEAT
+	capHeartbeat
+
+	// capSeq: the proxy writes write requests with X_ENPROXY_SEQ in order
+	capSeq
+
+	// capCloseWrite: the proxy shuts down writing to the destination server
+	// once it has written a write request with X_ENPROXY_EOF (see
+	// Conn.CloseWrite)
+	capCloseWrite
+
+	// capResponseSeq: the client puts read responses with X_ENPROXY_SEQ in
+	// order (see responseReorderer)
+	capResponseSeq
+)
+
+// capabilityNames: the names of capabilities in X_ENPROXY_CAPABILITIES
+var capabilityNames = map[capability]string{
+	capMore:        "more",
+	capNoWait:      "no-wait",
+	capHeartbeat:   "heartbeat",
+	capSeq:         "seq",
+	capCloseWrite:  "close-write",
+	capResponseSeq: "response-seq",
+}
+
+// supportedCapabilities: the capabilities of this version of enproxy, which
+// are the same for clients and proxies
+var supportedCapabilities = capMore | capNoWait | capHeartbeat | capSeq | capCloseWrite | capResponseSeq
+
+// String returns the value of X_ENPROXY_CAPABILITIES for these capabilities,
+// a comma-separated list of their names.
+func (caps capability) String() string {
+	names := make([]string, 0, len(capabilityNames))
+	for c := capability(1); c <= caps; c <<= 1 {
+		if caps&c != 0 {
+			names = append(names, capabilityNames[c])
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// parseCapabilities parses the value of X_ENPROXY_CAPABILITIES, ignoring names
+// that it doesn't know, which may be capabilities of newer versions.
+func parseCapabilities(header string) capability {
+	var caps capability
+	for _, name := range strings.Split(header, ",") {
+		name = strings.TrimSpace(name)
+		for c, known := range capabilityNames {
+			if name == known {
+				caps |= c
+			}
+		}
+	}
+	return caps
+}
+
+// setVersionHeaders announces our protocol version and capabilities in
+// header.
+func setVersionHeaders(header http.Header) {
+	header.Set(X_ENPROXY_VERSION, strconv.Itoa(PROTOCOL_VERSION))
+	header.Set(X_ENPROXY_CAPABILITIES, supportedCapabilities.String())
+}
+
+// negotiating indicates whether this conn still has to learn the proxy's
+// version and capabilities, in which case its requests announce ours.
+func (c *conn) negotiating() bool {
+	return atomic.LoadInt32(&c.negotiated) == 0
+}
+
+// recordProxyVersion records the proxy's version and capabilities from the
+// first successful response. A proxy that doesn't announce them is taken to be
+// one from before versioning (version 0) without any of the capabilities, so
+// features that need them aren't used.
+func (c *conn) recordProxyVersion(header http.Header) {
+	if !c.negotiating() {
+		return
+	}
+	version, _ := strconv.Atoi(header.Get(X_ENPROXY_VERSION))
+	if version < 0 {
+		version = 0
+	}
+	caps := parseCapabilities(header.Get(X_ENPROXY_CAPABILITIES))
+	atomic.StoreInt32(&c.proxyVersion, int32(version))
+	atomic.StoreUint32(&c.proxyCapabilities, uint32(caps))
+	if atomic.CompareAndSwapInt32(&c.negotiated, 0, 1) && version != PROTOCOL_VERSION {
+		c.logger().Debugf("Proxy for %s speaks protocol version %d with capabilities %q, we speak %d", c.addr, version, caps, PROTOCOL_VERSION)
+	}
+}
+
+// proxySupports indicates whether the proxy is known to support feature
+func (c *conn) proxySupports(feature capability) bool {
+	return capability(atomic.LoadUint32(&c.proxyCapabilities))&feature != 0
+}
+
+// recordClientCapabilities remembers the capabilities of this tunnel's client,
+// if the request announces them.
+func (l *lazyConn) recordClientCapabilities(req *http.Request) {
+	if req.Header.Get(X_ENPROXY_VERSION) != "" {
+		atomic.StoreUint32(&l.clientCapabilities, uint32(parseCapabilities(req.Header.Get(X_ENPROXY_CAPABILITIES))))
+	}
+}
+
+// clientSupports indicates whether the client of this tunnel announced feature
+func (l *lazyConn) clientSupports(feature capability) bool {
+	return capability(atomic.LoadUint32(&l.clientCapabilities))&feature != 0
+}
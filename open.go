@@ -0,0 +1,73 @@
+package enproxy
+
+import (
+	"context"
+	"net"
+)
+
+// Open is like Dial, but returns a Conn that's already connected to the
+// destination server and whose lifetime is bound to ctx: once ctx is done, the
+// Conn is closed (with CloseReasonApplication). If ctx is done before the
+// connection is established, Open returns ctx.Err().
+//
+// Open always waits for the proxy to connect to the destination server, as if
+// config.WaitForUpstream were set. config itself isn't modified.
+func Open(ctx context.Context, addr string, config *Config) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	config = config.Clone()
+	config.WaitForUpstream = true
+
+	conn, err := dialContext(ctx, func() (net.Conn, error) {
+		return dial(ctx, addr, config, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ic := conn.(*idleTimingConn)
+	go ic.closeWhenDone(ctx)
+	return ic, nil
+}
+
+// dialContext calls dial, returning ctx.Err() if ctx is done first.
+func dialContext(ctx context.Context, dial func() (net.Conn, error)) (net.Conn, error) {
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	dialed := make(chan dialResult, 1)
+	go func() {
+		conn, err := dial()
+		dialed <- dialResult{conn, err}
+	}()
+
+	select {
+	case res := <-dialed:
+		return res.conn, res.err
+	case <-ctx.Done():
+		// Dialing can't be interrupted, so close the conn once it's there
+		go func() {
+			if res := <-dialed; res.err == nil {
+				if err := res.conn.Close(); err != nil {
+					log.Debugf("Unable to close connection: %v", err)
+				}
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// closeWhenDone closes this Conn once ctx is done. It returns as soon as the
+// Conn closes for any other reason, so that it doesn't outlive the Conn.
+func (ic *idleTimingConn) closeWhenDone(ctx context.Context) {
+	select {
+	case <-ic.closedCh:
+	case <-ctx.Done():
+		ic.logger().Debugf("Context of connection to %s done, closing: %v", ic.addr, ctx.Err())
+		if err := ic.Close(); err != nil {
+			ic.logger().Debugf("Unable to close connection: %v", err)
+		}
+	}
+}
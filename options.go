@@ -0,0 +1,140 @@
+package enproxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Option sets optional fields of a Config built by NewConfig. The options
+// cover the commonly used fields, With sets any other.
+type Option func(config *Config)
+
+// NewConfig builds a Config that dials the proxy with dialProxy and builds
+// requests to it with newRequest (see Config.DialProxy and Config.NewRequest),
+// applying opts in order. Fields that no option sets keep their defaults, as
+// with a Config literal.
+func NewConfig(dialProxy func(addr string) (net.Conn, error), newRequest func(host, path, method string, body io.Reader) (*http.Request, error), opts ...Option) *Config {
+	config := &Config{
+		DialProxy:  dialProxy,
+		NewRequest: newRequest,
+	}
+	for _, opt := range opts {
+		opt(config)
+	}
+	return config
+}
+
+// With returns an Option that calls set with the Config, for fields that don't
+// have an Option of their own.
+func With(set func(config *Config)) Option {
+	return set
+}
+
+// WithPollInterval sets Config.PollScheduler to a FixedPollScheduler that
+// waits interval between polls.
+func WithPollInterval(interval time.Duration) Option {
+	return func(config *Config) {
+		config.PollScheduler = &FixedPollScheduler{Interval: interval}
+	}
+}
+
+// WithPollScheduler sets Config.PollScheduler
+func WithPollScheduler(scheduler PollScheduler) Option {
+	return func(config *Config) {
+		config.PollScheduler = scheduler
+	}
+}
+
+// WithFlushTimeout sets Config.FlushTimeout
+func WithFlushTimeout(timeout time.Duration) Option {
+	return func(config *Config) {
+		config.FlushTimeout = timeout
+	}
+}
+
+// WithIdleTimeout sets Config.IdleTimeout
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(config *Config) {
+		config.IdleTimeout = timeout
+	}
+}
+
+// WithResponseHeaderTimeout sets Config.ResponseHeaderTimeout
+func WithResponseHeaderTimeout(timeout time.Duration) Option {
+	return func(config *Config) {
+		config.ResponseHeaderTimeout = timeout
+	}
+}
+
+// WithHeartbeat sets Config.HeartbeatInterval and Config.HeartbeatTimeout
+func WithHeartbeat(interval time.Duration, timeout time.Duration) Option {
+	return func(config *Config) {
+		config.HeartbeatInterval = interval
+		config.HeartbeatTimeout = timeout
+	}
+}
+
+// WithReconnectBackoff sets Config.ReconnectBackoff
+func WithReconnectBackoff(backoff ReconnectBackoff) Option {
+	return func(config *Config) {
+		config.ReconnectBackoff = backoff
+	}
+}
+
+// WithWaitForUpstream sets Config.WaitForUpstream
+func WithWaitForUpstream() Option {
+	return func(config *Config) {
+		config.WaitForUpstream = true
+	}
+}
+
+// WithWebSocket sets Config.WebSocket
+func WithWebSocket() Option {
+	return func(config *Config) {
+		config.WebSocket = true
+	}
+}
+
+// WithBufferedRequests sets Config.BufferRequests
+func WithBufferedRequests() Option {
+	return func(config *Config) {
+		config.BufferRequests = true
+	}
+}
+
+// WithCompression sets Config.CompressionDict
+func WithCompression(dict []byte) Option {
+	return func(config *Config) {
+		config.CompressionDict = dict
+	}
+}
+
+// WithMaxInFlightRequests sets Config.MaxInFlightRequests
+func WithMaxInFlightRequests(max int) Option {
+	return func(config *Config) {
+		config.MaxInFlightRequests = max
+	}
+}
+
+// WithPathTemplate sets Config.PathTemplate
+func WithPathTemplate(template string) Option {
+	return func(config *Config) {
+		config.PathTemplate = template
+	}
+}
+
+// WithOnRequest sets Config.OnRequest
+func WithOnRequest(onRequest func(req *http.Request)) Option {
+	return func(config *Config) {
+		config.OnRequest = onRequest
+	}
+}
+
+// WithTrace sets Config.Trace
+func WithTrace(trace *ClientTrace) Option {
+	return func(config *Config) {
+		config.Trace = trace
+	}
+}
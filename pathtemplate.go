@@ -0,0 +1,73 @@
+package enproxy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// defaultPathTemplate: the request path used when Config.PathTemplate
+	// isn't set
+	defaultPathTemplate = "{id}/{addr}/{op}"
+)
+
+// expandPathTemplate builds a request path from the given template (see
+// Config.PathTemplate).
+func expandPathTemplate(template string, id string, addr string, op string) string {
+	if template == "" {
+		template = defaultPathTemplate
+	}
+	return strings.NewReplacer("{id}", id, "{addr}", addr, "{op}", op).Replace(template)
+}
+
+// pathTemplate is a compiled Proxy.PathTemplate
+type pathTemplate struct {
+	re *regexp.Regexp
+	// indexes of the id, addr and op submatches
+	id, addr, op int
+}
+
+// compilePathTemplate compiles the given template into a regular expression
+// that matches request paths built from it, optionally preceded by a prefix
+// (e.g. one used for routing by a reverse proxy) and followed by a slash.
+func compilePathTemplate(template string) (*pathTemplate, error) {
+	pt := &pathTemplate{}
+	expr := ""
+	group := 0
+	for _, part := range regexp.MustCompile(`\{(id|addr|op)\}|[^{]+|\{`).FindAllString(template, -1) {
+		switch part {
+		case "{id}", "{addr}", "{op}":
+			group++
+			expr += "([^/]+)"
+			switch part {
+			case "{id}":
+				pt.id = group
+			case "{addr}":
+				pt.addr = group
+			case "{op}":
+				pt.op = group
+			}
+		default:
+			expr += regexp.QuoteMeta(part)
+		}
+	}
+	if pt.id == 0 || pt.addr == 0 || pt.op == 0 {
+		return nil, fmt.Errorf("Path template %v needs to contain {id}, {addr} and {op}", template)
+	}
+	re, err := regexp.Compile("/" + strings.TrimPrefix(expr, "/") + "/?$")
+	if err != nil {
+		return nil, fmt.Errorf("Unable to compile path template %v: %v", template, err)
+	}
+	pt.re = re
+	return pt, nil
+}
+
+// parse extracts the id, addr and op from the given request path
+func (pt *pathTemplate) parse(path string) (string, string, string, error) {
+	strs := pt.re.FindStringSubmatch(path)
+	if strs == nil {
+		return "", "", "", fmt.Errorf("Unexpected request path: %q", path)
+	}
+	return strs[pt.id], strs[pt.addr], strs[pt.op], nil
+}
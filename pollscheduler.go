@@ -0,0 +1,57 @@
+package enproxy
+
+import (
+	"time"
+)
+
+// PollScheduler decides when a Conn polls the proxy for more data. A Conn only
+// polls while the application is reading, so the delay returned by NextPoll is
+// the minimum time between the end of one poll and the start of the next.
+type PollScheduler interface {
+	// NextPoll is called after each poll (read request) finishes with
+	// statistics about recent polls, returning how long to wait before polling
+	// again.
+	NextPoll(stats PollStats) time.Duration
+}
+
+// PollStats are statistics about recent polls of a Conn, passed to
+// PollScheduler.NextPoll.
+type PollStats struct {
+	// BytesReceived: number of bytes received by the poll that just finished
+	BytesReceived int
+
+	// Duration: how long the poll that just finished took, from sending the
+	// request until the end of the response
+	Duration time.Duration
+
+	// TimeToFirstByte: how long it took to receive the response headers for the
+	// poll that just finished
+	TimeToFirstByte time.Duration
+
+	// RTT: the moving average of the round-trip times of polls (see
+	// Conn.RTT), including the one that just finished
+	RTT time.Duration
+
+	// ConsecutiveEmptyPolls: number of polls in a row, including the one that
+	// just finished, that didn't receive any data
+	ConsecutiveEmptyPolls int
+
+	// MoreAvailable: whether the proxy indicated that the poll that just
+	// finished stopped while the destination server may have had more data,
+	// e.g. because the response reached MaxResponseBytes. A Conn always polls
+	// again right away in that case, whatever NextPoll returns. If false, the
+	// proxy didn't have any data left or didn't say (e.g. because an
+	// intermediary dropped the HTTP trailer in which it does so).
+	MoreAvailable bool
+}
+
+// FixedPollScheduler is a PollScheduler that always waits the same Interval
+// between polls. The zero value polls again right away, and is the default.
+type FixedPollScheduler struct {
+	Interval time.Duration
+}
+
+// NextPoll() implements the function from PollScheduler
+func (s *FixedPollScheduler) NextPoll(stats PollStats) time.Duration {
+	return s.Interval
+}
@@ -1,11 +1,17 @@
 package enproxy
 
 import (
+	"compress/flate"
+	"container/list"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -25,10 +31,20 @@ var (
 // provides a convenience ListenAndServe() function for quickly starting up
 // a dedicated HTTP server using this Proxy as its handler.
 type Proxy struct {
-	// Dial: function used to dial the destination server.  If nil, a default
-	// TCP dialer is used.
+	// Dial: (Deprecated; use DialUpstream instead) function used to dial the
+	// destination server, used if DialUpstream isn't set.
 	Dial dialFunc
 
+	// DialUpstream: function used to dial the destination server. The dial
+	// is canceled through ctx if the client goes away while waiting for it
+	// (i.e. the request that triggered the dial is done) or if the tunnel is
+	// closed, so that a slow dial doesn't tie up resources after its tunnel
+	// is gone. ctx only covers the dial, not the connection that it returns.
+	// Redials of a tunnel (see Config.MaxUpstreamReconnects) are only
+	// canceled when the tunnel is closed. Defaults to dialing TCP with a
+	// net.Dialer.
+	DialUpstream func(ctx context.Context, addr string) (net.Conn, error)
+
 	// Host: (Deprecated; use HostFn instead) FQDN of this particular proxy.
 	// Either this or HostFn is required if this server was originally reached
 	// by DNS round robin.
@@ -50,12 +66,80 @@ type Proxy struct {
 	BytesBeforeFlush int
 
 	// IdleTimeout: how long to wait before closing an idle connection, defaults
-	// to 70 seconds
+	// to 70 seconds. This is also how long clients have to resume a tunnel
+	// using ResumeConn.
 	IdleTimeout time.Duration
 
+	// ReadHeaderTimeout: how long Serve and ListenAndServe allow clients for
+	// sending the headers of each request, defaults to 10 seconds. When using
+	// the Proxy as the handler of your own http.Server, set its
+	// ReadHeaderTimeout instead.
+	ReadHeaderTimeout time.Duration
+
+	// EstablishTimeout: if non-zero, how long a new tunnel's first request
+	// (including its body) may take to be received. Tunnels that aren't
+	// established in time are dropped, which keeps clients that open tunnels
+	// and then dribble data (slowloris) from tying up resources. Since a
+	// client's first write may keep streaming for as long as the application
+	// keeps writing, this should allow for the largest expected initial
+	// upload.
+	EstablishTimeout time.Duration
+
 	// ReadBufferSize: size of read buffer in bytes
 	ReadBufferSize int
 
+	// WriteBufferSize: if non-zero, writes to the destination server are
+	// buffered up to this many bytes so that small writes from the client are
+	// coalesced into fewer packets upstream.
+	WriteBufferSize int
+
+	// WriteFlushDelay: when buffering writes, the maximum amount of time that
+	// buffered data waits before being flushed to the destination server.
+	// Defaults to 5 milliseconds.
+	WriteFlushDelay time.Duration
+
+	// MaxResponseChunkBytes: if non-zero, the most bytes that the Proxy sends
+	// in response to a single poll before finishing the response, after which
+	// the client polls again right away. Smaller responses get data through
+	// intermediaries that buffer whole responses sooner, larger ones need fewer
+	// requests for bulk transfers. Clients can ask for smaller responses with
+	// Config.MaxResponseBytes and Config.ReceiveWindow, the smallest of the
+	// limits applies.
+	MaxResponseChunkBytes int
+
+	// MaxReorderBytes: the most bytes of write requests that arrived ahead of
+	// their turn, because earlier requests were delayed or lost on the way,
+	// that the Proxy buffers for each tunnel.
+	// Requests beyond that are rejected with a 503 and have to be resent.
+	// Defaults to 1 MB.
+	MaxReorderBytes int
+
+	// MaxRequestBodyBytes: if non-zero, the most bytes that the body of a
+	// single write request may carry, so that a client can't tie up the
+	// Proxy with one endless request. The Proxy announces the limit in its
+	// responses and Conns finish their request bodies before reaching it, but
+	// a Conn only learns the limit with its first response (with
+	// Config.WaitForUpstream, before sending any data), so its first request
+	// isn't limited. A request that goes beyond the limit is answered with a
+	// 413 and its tunnel is closed, since the part of the body that was
+	// already written to the destination server can't be taken back.
+	MaxRequestBodyBytes int64
+
+	// CompressionDict: preset dictionary for compressing data to and from
+	// clients whose Config has the same CompressionDict. If nil, data isn't
+	// compressed.
+	CompressionDict []byte
+
+	// MinCompressSize: how much data a response has to start with for it to
+	// be compressed, since compressing less costs more than it saves.
+	// Responses are streamed, so this is decided by the data that's available
+	// when the response starts: a response is compressed if the first read
+	// from the destination server yields at least MinCompressSize bytes.
+	// Clients decompress every response on its own, so one tunnel can mix
+	// compressed and uncompressed responses. Defaults to 256 bytes, a negative
+	// value compresses every response.
+	MinCompressSize int
+
 	// OnBytesReceived is an optional callback for learning about bytes received
 	// from a client
 	OnBytesReceived statCallback
@@ -69,10 +153,120 @@ type Proxy struct {
 	// return the HTTP error code and an error.
 	Allow func(req *http.Request, destAddr string) (int, error)
 
+	// OnTunnelClosed: optional callback that's called with a record of each
+	// tunnel once the Proxy closes it, e.g. for writing access logs. See
+	// AccessLogRecord.String for a standard text format.
+	OnTunnelClosed func(record *AccessLogRecord)
+
+	// Resolver: optional function that maps the destination address
+	// requested by a client (e.g. a logical name like "internal-db") to the
+	// address that's actually dialed, so that clients never learn the real
+	// addresses. Tunnels to destinations for which it returns an error are
+	// rejected with a 404, which also allows restricting clients to known
+	// names. Allow, DestinationLimits and OnTunnelClosed all see the address
+	// requested by the client.
+	Resolver func(dest string) (string, error)
+
+	// ProxyProtocol: if set to ProxyProtocolV1 or ProxyProtocolV2, each new
+	// connection to a destination server starts with a PROXY protocol header
+	// of that version carrying the address of the client (from
+	// X-Forwarded-For if set, otherwise from the request's RemoteAddr), so
+	// that destination servers that support the protocol see the real client.
+	ProxyProtocol int
+
+	// UpstreamTLS: if set, connections to destination servers use TLS with
+	// (a copy of) this configuration, e.g. so that the Proxy terminates TLS
+	// from clients and re-originates it on the way out. The server name for
+	// the handshake is the one that the client asks for (see
+	// Config.UpstreamServerName), otherwise UpstreamTLS.ServerName if set,
+	// otherwise the host of the destination address requested by the client.
+	// Tunnels whose handshake fails are rejected like those whose destination
+	// server can't be dialed.
+	UpstreamTLS *tls.Config
+
+	// TunnelRateLimits: optional function that returns the bandwidth limits
+	// for a new tunnel to destAddr, given the request that opened it (e.g. to
+	// apply limits according to the client's plan as identified by its
+	// headers). Limits apply to the tunnel's connection to the destination
+	// server in each direction. By default, tunnels aren't limited.
+	TunnelRateLimits func(req *http.Request, destAddr string) RateLimits
+
+	// HealthPath: if set (e.g. "/healthz"), requests for exactly this path are
+	// answered with the Proxy's Health as JSON instead of being treated as
+	// tunnel requests, for use with load balancer health checks. It should not
+	// look like a tunnel path (/id/addr/op/).
+	HealthPath string
+
+	// CORS: if set, the Proxy answers CORS preflight requests from browsers
+	// and allows the configured origins to use it, so that clients running in
+	// a browser can reach it (see CORS).
+	CORS *CORS
+
+	// DestinationLimits: optional limits on the number of concurrent tunnels
+	// to destinations, to keep the Proxy from being used to overwhelm them.
+	// The first limit whose Pattern matches a destination applies. Tunnels
+	// beyond the limit are rejected with a 503.
+	DestinationLimits []DestinationLimit
+
+	// MaxTunnels: if non-zero, the most tunnels that the Proxy keeps open at
+	// once, which bounds the memory that clients can make it use by opening
+	// tunnels (e.g. many clients that never close theirs, or an attacker).
+	// What happens to new tunnels beyond that depends on TunnelEviction.
+	MaxTunnels int
+
+	// TunnelEviction: what to do with a new tunnel when there are MaxTunnels
+	// tunnels open already, defaults to EvictLeastRecentlyActive. Requests for
+	// an evicted tunnel are answered with a 410, which clients report as
+	// ErrTunnelNotFound.
+	TunnelEviction TunnelEvictionPolicy
+
+	// MaxUpstreamReconnects: the most reconnects to the destination server
+	// that clients may ask for with Config.MaxUpstreamReconnects. Defaults to
+	// 0, meaning that clients can't ask for reconnects.
+	MaxUpstreamReconnects int
+
+	// RedialLostTunnels: if true, a client that re-establishes a tunnel that
+	// we don't have (see Config.ReplayEstablishment) gets a new connection to
+	// the destination server under the same id. The destination server sees a
+	// new connection and data that was in flight on the old one is lost, so
+	// this is only for destinations that can cope. Otherwise, such requests
+	// are answered with a 410, which clients report as ErrTunnelNotFound.
+	RedialLostTunnels bool
+
+	// PathTemplate: if set, the template for request paths, which must match
+	// the Config.PathTemplate used by clients. Requests may have additional
+	// path segments before the templated part (e.g. a prefix used for routing
+	// by a reverse proxy). If not set, request paths have the form
+	// /id/addr/op/.
+	PathTemplate string
+
+	// pathTemplate: the compiled PathTemplate
+	pathTemplate    *pathTemplate
+	pathTemplateErr error
+
+	// startedAt: when this Proxy was started
+	startedAt time.Time
+
 	// connMap: map of outbound connections by their id
 	connMap map[string]*lazyConn
 
-	// connMapMutex: synchronizes access to connMap
+	// destCounts: number of entries in connMap by destination address
+	destCounts map[string]int
+
+	// lru: the entries of connMap from the most to the least recently active
+	// one, if MaxTunnels is set
+	lru *list.List
+
+	// evictedIDs: the ids of recently evicted tunnels, in the order in which
+	// they were evicted in evictedOrder
+	evictedIDs   map[string]bool
+	evictedOrder []string
+
+	// evictions: number of tunnels evicted, accessed atomically
+	evictions int64
+
+	// connMapMutex: synchronizes access to connMap, destCounts, lru and
+	// evictedIDs
 	connMapMutex sync.RWMutex
 }
 
@@ -91,9 +285,16 @@ type statCallback func(
 
 // Start() starts this proxy
 func (p *Proxy) Start() {
-	if p.Dial == nil {
-		p.Dial = func(addr string) (net.Conn, error) {
-			return net.Dial("tcp", addr)
+	if p.DialUpstream == nil {
+		if dial := p.Dial; dial != nil {
+			p.DialUpstream = func(ctx context.Context, addr string) (net.Conn, error) {
+				return dial(addr)
+			}
+		} else {
+			dialer := &net.Dialer{}
+			p.DialUpstream = func(ctx context.Context, addr string) (net.Conn, error) {
+				return dialer.DialContext(ctx, "tcp", addr)
+			}
 		}
 	}
 	if p.FlushTimeout == 0 {
@@ -108,7 +309,29 @@ func (p *Proxy) Start() {
 	if p.BytesBeforeFlush == 0 {
 		p.BytesBeforeFlush = DEFAULT_BYTES_BEFORE_FLUSH
 	}
+	if p.ReadHeaderTimeout == 0 {
+		p.ReadHeaderTimeout = defaultReadHeaderTimeout
+	}
+	if p.WriteFlushDelay == 0 {
+		p.WriteFlushDelay = defaultWriteFlushDelay
+	}
+	if p.MaxReorderBytes == 0 {
+		p.MaxReorderBytes = defaultMaxReorderBytes
+	}
+	if p.MinCompressSize == 0 {
+		p.MinCompressSize = defaultMinCompressSize
+	}
 	p.connMap = make(map[string]*lazyConn)
+	p.destCounts = make(map[string]int)
+	p.lru = list.New()
+	p.evictedIDs = make(map[string]bool)
+	if p.PathTemplate != "" {
+		p.pathTemplate, p.pathTemplateErr = compilePathTemplate(p.PathTemplate)
+		if p.pathTemplateErr != nil {
+			log.Error(p.pathTemplateErr)
+		}
+	}
+	p.startedAt = time.Now()
 }
 
 // ListenAndServe: convenience function for quickly starting up a dedicated HTTP
@@ -126,18 +349,25 @@ func (p *Proxy) ListenAndServe(addr string) error {
 func (p *Proxy) Serve(l net.Listener) error {
 	p.Start()
 	httpServer := &http.Server{
-		Handler:      p,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
+		Handler:           p,
+		ReadHeaderTimeout: p.ReadHeaderTimeout,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      10 * time.Second,
 	}
 	return httpServer.Serve(l)
 }
 
 func (p *Proxy) parseRequestPath(path string) (string, string, string, error) {
-	log.Debugf("Path is %v", path)
+	log.Debugf("Path is %q", path)
+	if p.pathTemplateErr != nil {
+		return "", "", "", p.pathTemplateErr
+	}
+	if p.pathTemplate != nil {
+		return p.pathTemplate.parse(path)
+	}
 	strs := r.FindStringSubmatch(path)
 	if len(strs) < 4 {
-		return "", "", "", fmt.Errorf("Unexpected request path: %v", path)
+		return "", "", "", fmt.Errorf("Unexpected request path: %q", path)
 	}
 	return strs[1], strs[2], strs[3], nil
 }
@@ -168,35 +398,90 @@ func (p *Proxy) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 	resp.Header().Set("Lantern-IP", req.Header.Get("X-Forwarded-For"))
 	resp.Header().Set("Lantern-Country", req.Header.Get("Cf-Ipcountry"))
 
+	if p.CORS != nil && p.CORS.handle(resp, req) {
+		// Preflight request, already answered
+		return
+	}
+
 	if req.Method == "HEAD" {
 		// Just respond OK to HEAD requests (used for health checks)
 		resp.WriteHeader(200)
 		return
 	}
 
+	if p.HealthPath != "" && req.URL.Path == p.HealthPath {
+		p.handleHealth(resp, req)
+		return
+	}
+
+	if req.Header.Get(X_ENPROXY_VERSION) != "" {
+		// Tell clients that announce their version which one we speak
+		setVersionHeaders(resp.Header())
+	}
+	if p.MaxRequestBodyBytes > 0 {
+		resp.Header().Set(X_ENPROXY_MAX_BODY_BYTES, strconv.FormatInt(p.MaxRequestBodyBytes, 10))
+	}
+
 	id, addr, op, er := p.parseRequestProps(req)
 	if er != nil {
 		respond(http.StatusBadRequest, resp, er.Error())
 		log.Errorf("Could not parse enproxy data: %v", er)
 		return
 	}
+	addr, er = normalizeDestAddr(addr)
+	if er != nil {
+		respond(http.StatusBadRequest, resp, er.Error())
+		return
+	}
 	log.Debugf("Parsed enproxy data id: %v, addr: %v, op: %v", id, addr, op)
+	// Echo back connection id, which tells clients that the response comes
+	// from us rather than e.g. a captive portal (see Config.ValidateResponses)
+	resp.Header().Set(X_ENPROXY_ID, id)
+	if op == OP_HEARTBEAT {
+		p.handleHeartbeat(resp, req, id)
+		return
+	}
 
 	lc, isNew, err := p.getLazyConn(id, addr, req, resp)
 	if err != nil {
 		// Close the connection?
 		return
 	}
-	connOut, err := lc.get()
+	lc.recordClientCapabilities(req)
+	p.touch(lc)
+	if isNew && p.EstablishTimeout > 0 {
+		// Don't let the client dribble the first request's body. If the
+		// tunnel isn't established, the deadline stays in place so that the
+		// server gives up on the client connection.
+		setReadDeadline(resp, lc.createdAt.Add(p.EstablishTimeout))
+	}
+	connOut, err := lc.get(req.Context())
 	if err != nil {
-		respond(http.StatusInternalServerError, resp, fmt.Sprintf("Unable to get outoing connection to destination server: %v", err))
+		if err == errTunnelEvicted {
+			respondEvicted(resp, id)
+			return
+		}
+		status := http.StatusInternalServerError
+		if op == OP_CONNECT {
+			status = http.StatusBadGateway
+		}
+		respond(status, resp, fmt.Sprintf("Unable to get outoing connection to destination server: %v", err))
 		return
 	}
 
-	if op == OP_WRITE {
+	if op == OP_CONNECT {
+		// We've connected to the destination server, that's all that the
+		// client wanted to know
+		p.establish(resp, lc)
+		resp.WriteHeader(http.StatusOK)
+	} else if op == OP_WRITE {
 		p.handleWrite(resp, req, lc, connOut, isNew)
 	} else if op == OP_READ {
-		p.handleRead(resp, req, lc, connOut, true)
+		// Clients that are only looking for data that's already waiting
+		// don't want us to wait for more
+		p.handleRead(resp, req, lc, connOut, req.Header.Get(X_ENPROXY_NO_WAIT) != "true")
+	} else if op == OP_WEBSOCKET {
+		p.handleWebSocket(resp, req, lc, connOut)
 	} else {
 		respond(http.StatusInternalServerError, resp, fmt.Sprintf("Operation not supported: %v", op))
 	}
@@ -204,18 +489,83 @@ func (p *Proxy) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 
 // handleWrite forwards the data from a POST to the outbound connection
 func (p *Proxy) handleWrite(resp http.ResponseWriter, req *http.Request, lc *lazyConn, connOut net.Conn, first bool) {
-	// Pipe request
-	n, err := io.Copy(connOut, req.Body)
+	decoded := io.ReadCloser(req.Body)
+	if req.Header.Get(X_ENPROXY_BODY_ENCODING) == ENCODING_BASE64 {
+		decoded = newBase64Body(req.Body)
+	}
+	body := io.Reader(decoded)
+	if p.MaxRequestBodyBytes > 0 {
+		// The limit is on the data that the client wrote, not on its encoding
+		// (see Config.BodyEncoding)
+		body = http.MaxBytesReader(resp, decoded, p.MaxRequestBodyBytes)
+	}
+	if req.Header.Get(X_ENPROXY_ENCODING) == ENCODING_FLATE {
+		if p.CompressionDict == nil || req.Header.Get(X_ENPROXY_DICT_ID) != dictID(p.CompressionDict) {
+			respond(http.StatusBadRequest, resp, "Request compressed with unknown dictionary")
+			return
+		}
+		fr := flate.NewReaderDict(body, p.CompressionDict)
+		defer func() {
+			if err := fr.Close(); err != nil {
+				log.Debugf("Unable to close decompressor: %v", err)
+			}
+		}()
+		body = fr
+	}
+
+	seq, sequenced, err := seqOf(req)
+	if err != nil {
+		respond(http.StatusBadRequest, resp, err.Error())
+		return
+	}
+
+	// Pipe request. With X_ENPROXY_EOF, the client is done writing once its
+	// body has been written (see Conn.CloseWrite).
+	eof := req.Header.Get(X_ENPROXY_EOF) == "true"
+	var n int64
+	if sequenced {
+		n, connOut, err = p.copyInOrder(lc, connOut, seq, body, eof)
+	} else {
+		n, connOut, err = p.copyToUpstream(lc, connOut, body)
+		if eof && (err == nil || err == io.EOF) {
+			lc.closeWrite()
+		}
+	}
+	lc.addBytesUp(n)
 	if p.OnBytesReceived != nil && n > 0 {
 		clientIp := clientIpFor(req)
 		if clientIp != "" {
 			p.OnBytesReceived(clientIp, lc.addr, req, n)
 		}
 	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		// The destination server got part of the body, the tunnel can't go on
+		respond(http.StatusRequestEntityTooLarge, resp, fmt.Sprintf("Request body bigger than %d bytes", tooLarge.Limit))
+		lc.drop(errRequestBodyTooLarge)
+		return
+	}
+	if err == errReorderBufferFull {
+		resp.Header().Set("Retry-After", "1")
+		respond(http.StatusServiceUnavailable, resp, err.Error())
+		return
+	}
 	if err != nil && err != io.EOF {
-		respond(http.StatusInternalServerError, resp, fmt.Sprintf("Unable to write to connOut: %s", err))
+		lc.setFailed()
+		msg := fmt.Sprintf("Unable to write to connOut: %s", err)
+		if errors.Is(err, net.ErrClosed) {
+			// We closed the tunnel ourselves, e.g. because its client went
+			// away while polling, so this isn't an error of its own
+			log.Debug(msg)
+			writeResponse(http.StatusInternalServerError, resp, msg)
+			return
+		}
+		respond(http.StatusInternalServerError, resp, msg)
 		return
 	}
+	if first {
+		p.establish(resp, lc)
+	}
 	host := ""
 	if p.HostFn != nil {
 		host = p.HostFn(req)
@@ -240,7 +590,29 @@ func (p *Proxy) handleWrite(resp http.ResponseWriter, req *http.Request, lc *laz
 // a response body.  If no data is read for more than FlushTimeout, then the
 // response is finished and client needs to make a new GET request.
 func (p *Proxy) handleRead(resp http.ResponseWriter, req *http.Request, lc *lazyConn, connOut net.Conn, waitForData bool) {
-	if lc.hitEOF {
+	lc.readMutex.Lock()
+	defer lc.readMutex.Unlock()
+	lc.responseSeq++
+	if lc.clientSupports(capResponseSeq) {
+		// Number the response so that the client can tell if it arrives out
+		// of order
+		resp.Header().Set(X_ENPROXY_SEQ, strconv.FormatInt(lc.responseSeq, 10))
+	}
+
+	// Start with what the client didn't get of earlier responses, if it
+	// keeps track
+	received := req.Header.Get(X_ENPROXY_RECEIVED)
+	tracked := received != ""
+	resend, err := lc.acknowledge(received)
+	if err != nil {
+		respond(http.StatusBadRequest, resp, err.Error())
+		return
+	}
+	if tracked {
+		resp.Header().Set(X_ENPROXY_OFFSET, strconv.FormatInt(lc.sentDown-int64(len(resend)), 10))
+	}
+
+	if lc.hitEOF && len(resend) == 0 {
 		// We hit EOF on the server while processing a previous request,
 		// immediately return EOF to the client
 		resp.Header().Set(X_ENPROXY_EOF, "true")
@@ -253,43 +625,131 @@ func (p *Proxy) handleRead(resp http.ResponseWriter, req *http.Request, lc *lazy
 	// Get clientIp for reporting stats
 	clientIp := clientIpFor(req)
 
+	// Client may ask us to keep responses small
+	maxResponseBytes, _ := strconv.Atoi(req.Header.Get(X_ENPROXY_MAX_RESPONSE_BYTES))
+	// and never sends more than the client is ready to receive
+	if window, _ := strconv.Atoi(req.Header.Get(X_ENPROXY_RECEIVE_WINDOW)); window > 0 && (maxResponseBytes <= 0 || window < maxResponseBytes) {
+		maxResponseBytes = window
+	}
+	// and we may want them smaller still
+	if p.MaxResponseChunkBytes > 0 && (maxResponseBytes <= 0 || p.MaxResponseChunkBytes < maxResponseBytes) {
+		maxResponseBytes = p.MaxResponseChunkBytes
+	}
+	bytesInResponse := 0
+
+	// Compress response if possible, once we know whether it starts with
+	// enough data for that to be worthwhile (see MinCompressSize)
+	var out io.Writer = resp
+	if req.Header.Get(X_ENPROXY_BODY_ENCODING) == ENCODING_BASE64 {
+		// Encode what we write, compressed or not (see Config.BodyEncoding)
+		resp.Header().Set(X_ENPROXY_BODY_ENCODING, ENCODING_BASE64)
+		out = newBase64Writer(resp)
+	}
+	var fw *flate.Writer
+	compress := p.compressionAccepted(req)
+	defer func() {
+		if fw != nil {
+			if err := fw.Close(); err != nil {
+				log.Debugf("Unable to finish compressed response: %v", err)
+			}
+		}
+	}()
+
 	b := make([]byte, p.ReadBufferSize)
 	first := true
 	haveRead := false
 	bytesInBatch := 0
 	lastReadTime := time.Now()
+
+	// Tell the client in a trailer whether we stopped while the destination
+	// server may have more data for it, in which case it should poll again
+	// right away (see PollStats.MoreAvailable), if it understands them
+	sendMore := lc.clientSupports(capMore)
+	moreAvailable := false
+	defer func() {
+		if !first && sendMore {
+			resp.Header().Set(X_ENPROXY_MORE, strconv.FormatBool(moreAvailable))
+		}
+	}()
 	for {
+		select {
+		case <-req.Context().Done():
+			// Client went away, leave remaining data for its next request
+			return
+		default:
+		}
+
 		readDeadline := time.Now().Add(p.FlushTimeout)
 		if err := connOut.SetReadDeadline(readDeadline); err != nil {
 			log.Debugf("Unable to set read deadline: %v", err)
 		}
 
 		// Read
-		n, readErr := connOut.Read(b)
+		readBuf := b
+		if remaining := maxResponseBytes - bytesInResponse; maxResponseBytes > 0 && remaining < len(readBuf) {
+			readBuf = b[:remaining]
+		}
+		var n int
+		var readErr error
+		resent := len(resend) > 0
+		if resent {
+			n = copy(readBuf, resend)
+			resend = resend[n:]
+		} else {
+			n, readErr = connOut.Read(readBuf)
+		}
 		if first {
+			if compress && n >= p.MinCompressSize {
+				var err error
+				fw, err = flate.NewWriterDict(out, flate.DefaultCompression, p.CompressionDict)
+				if err != nil {
+					respond(http.StatusInternalServerError, resp, fmt.Sprintf("Unable to compress response: %v", err))
+					return
+				}
+				resp.Header().Set(X_ENPROXY_ENCODING, ENCODING_FLATE)
+				out = fw
+			}
 			if readErr == io.EOF {
 				// Reached EOF, tell client using a special header
 				resp.Header().Set(X_ENPROXY_EOF, "true")
 			}
-			// Echo back connection id (for debugging purposes)
-			resp.Header().Set(X_ENPROXY_ID, lc.id)
+			if sendMore {
+				resp.Header().Set("Trailer", X_ENPROXY_MORE)
+			}
 			// Always respond 200 OK
 			resp.WriteHeader(200)
+			// Send headers right away so that the client can tell whether
+			// intermediaries buffer our responses (see Stats)
+			resp.(http.Flusher).Flush()
 			first = false
 		}
 
 		// Write if necessary
 		if n > 0 {
-			if clientIp != "" && p.OnBytesSent != nil && n > 0 {
-				p.OnBytesSent(clientIp, lc.addr, req, int64(n))
+			if !resent {
+				if clientIp != "" && p.OnBytesSent != nil && n > 0 {
+					p.OnBytesSent(clientIp, lc.addr, req, int64(n))
+				}
+				lc.addBytesDown(int64(n))
+				lc.sent(b[:n], tracked)
 			}
-
 			haveRead = true
 			lastReadTime = time.Now()
 			bytesInBatch = bytesInBatch + n
-			_, writeErr := resp.Write(b[:n])
+			bytesInResponse = bytesInResponse + n
+			_, writeErr := out.Write(b[:n])
+			if writeErr == nil && fw != nil {
+				// Don't hold back data in the compressor
+				writeErr = fw.Flush()
+			}
 			if writeErr != nil {
-				log.Errorf("Error writing to response: %s", writeErr)
+				// The client went away, most likely because it closed its Conn
+				// while polling
+				log.Debugf("Error writing to response for %s: %s", lc.addr, writeErr)
+				if tracked {
+					// It can poll for what didn't arrive again
+					return
+				}
 				if err := connOut.Close(); err != nil {
 					log.Debugf("Unable to close out connection: %v", err)
 				}
@@ -297,6 +757,14 @@ func (p *Proxy) handleRead(resp http.ResponseWriter, req *http.Request, lc *lazy
 			}
 		}
 
+		if readErr != nil && readErr != io.EOF && !isTimeout(readErr) {
+			// Connection to destination failed, reconnect if possible
+			if newConnOut, err := lc.reconnect(connOut, readErr); err == nil {
+				connOut = newConnOut
+				continue
+			}
+		}
+
 		// Inspect readErr to decide whether or not to continue reading
 		if readErr != nil {
 			switch e := readErr.(type) {
@@ -317,12 +785,16 @@ func (p *Proxy) handleRead(resp http.ResponseWriter, req *http.Request, lc *lazy
 						}
 					}
 				} else {
+					lc.setFailed()
 					return
 				}
 			default:
 				if readErr == io.EOF {
+					lc.mutex.Lock()
 					lc.hitEOF = true
+					lc.mutex.Unlock()
 				} else {
+					lc.setFailed()
 					log.Errorf("Unexpected error reading from upstream: %s", readErr)
 					// TODO: probably want to close connOut right away
 				}
@@ -330,6 +802,18 @@ func (p *Proxy) handleRead(resp http.ResponseWriter, req *http.Request, lc *lazy
 			}
 		}
 
+		if maxResponseBytes > 0 && bytesInResponse >= maxResponseBytes {
+			// Response is as big as the client wants it, let it poll again
+			moreAvailable = true
+			return
+		}
+
+		if len(lc.unacked) >= maxUnackedBytes {
+			// Let the client confirm what it received before sending more
+			moreAvailable = true
+			return
+		}
+
 		if time.Now().Sub(lastReadTime) > 10*time.Second {
 			// We've spent more than 10 seconds without reading, return so that
 			// CloudFlare doesn't time us out
@@ -346,13 +830,106 @@ func (p *Proxy) handleRead(resp http.ResponseWriter, req *http.Request, lc *lazy
 	}
 }
 
+// establish marks the tunnel lc as established once its first request, for
+// which resp is the response, has been received.
+func (p *Proxy) establish(resp http.ResponseWriter, lc *lazyConn) {
+	lc.establish()
+	if p.EstablishTimeout > 0 {
+		// Let the server keep watching for the client going away
+		setReadDeadline(resp, time.Time{})
+	}
+}
+
+// setReadDeadline sets the deadline for reading from the client connection
+// through which resp is being sent
+func setReadDeadline(resp http.ResponseWriter, deadline time.Time) {
+	if err := http.NewResponseController(resp).SetReadDeadline(deadline); err != nil {
+		log.Debugf("Unable to set read deadline: %v", err)
+	}
+}
+
+// copyToUpstream copies body to connOut. If writing to connOut fails and the
+// client asked for reconnects, this reconnects to the destination server and
+// copies the rest of body to the new connection, which it returns.
+func (p *Proxy) copyToUpstream(lc *lazyConn, connOut net.Conn, body io.Reader) (int64, net.Conn, error) {
+	total := int64(0)
+	for {
+		w := &errorRecordingWriter{w: connOut}
+		n, err := io.Copy(w, body)
+		total += n
+		if err == nil || w.err == nil {
+			// Done, or failed reading the body
+			return total, connOut, err
+		}
+		newConnOut, reconnectErr := lc.reconnect(connOut, err)
+		if reconnectErr != nil {
+			return total, connOut, err
+		}
+		connOut = newConnOut
+	}
+}
+
+// errorRecordingWriter is an io.Writer that remembers the error from writing to
+// the wrapped io.Writer, to tell write errors apart from read errors in
+// io.Copy.
+type errorRecordingWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (w *errorRecordingWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// isTimeout indicates whether err is a timeout
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
 // getLazyConn gets the lazyConn corresponding to the given id and addr, or
 // creates a new one and saves it to connMap.
 func (p *Proxy) getLazyConn(id string, addr string, req *http.Request, resp http.ResponseWriter) (l *lazyConn, isNew bool, err error) {
 	p.connMapMutex.RLock()
 	l = p.connMap[id]
+	evicted := p.wasEvicted(id)
 	p.connMapMutex.RUnlock()
+	reestablish := req.Header.Get(X_ENPROXY_REESTABLISH) == "true"
 	if l != nil {
+		if reestablish {
+			log.Debugf("Client re-established tunnel %v to %v on a new connection", id, addr)
+		}
+		return l, false, nil
+	}
+	if evicted {
+		respondEvicted(resp, id)
+		return nil, false, fmt.Errorf("Evicted tunnel %v", id)
+	}
+	if req.Header.Get(X_ENPROXY_RESUME) == "true" {
+		// Client is trying to resume a tunnel that we no longer have, don't
+		// silently replace it with a new one
+		respond(http.StatusGone, resp, fmt.Sprintf("Unable to resume unknown tunnel %v", id))
+		return nil, false, fmt.Errorf("Unknown tunnel %v", id)
+	}
+	if reestablish {
+		// Client is re-establishing a tunnel that it established with us or
+		// another proxy, which we don't have (anymore)
+		if !p.RedialLostTunnels {
+			respond(http.StatusGone, resp, fmt.Sprintf("Unable to re-establish unknown tunnel %v", id))
+			return nil, false, fmt.Errorf("Unknown tunnel %v", id)
+		}
+		log.Debugf("Redialing %v for lost tunnel %v", addr, id)
+		l, _, err = p.newOutgoingConn(id, addr, req, resp)
+		if err != nil {
+			return nil, false, err
+		}
+		// The client established the tunnel long ago, so this isn't the
+		// tunnel's first request
+		l.establish()
 		return l, false, nil
 	}
 	return p.newOutgoingConn(id, addr, req, resp)
@@ -368,19 +945,86 @@ func (p *Proxy) newOutgoingConn(id string, addr string, req *http.Request, resp
 			return nil, false, fmt.Errorf("Not allowed: %v", err)
 		}
 	}
-	l = p.newLazyConn(id, addr)
+	dialAddr := addr
+	if p.Resolver != nil {
+		dialAddr, err = p.Resolver(addr)
+		if err != nil {
+			respond(http.StatusNotFound, resp, fmt.Sprintf("Unable to resolve destination %v: %v", addr, err))
+			return nil, false, fmt.Errorf("Unable to resolve %v: %v", addr, err)
+		}
+	}
+	var limits RateLimits
+	if p.TunnelRateLimits != nil {
+		limits = p.TunnelRateLimits(req, addr)
+	}
 	p.connMapMutex.Lock()
+	if existing := p.connMap[id]; existing != nil {
+		// Another request for the same tunnel got here first
+		p.connMapMutex.Unlock()
+		return existing, false, nil
+	}
+	if limit := p.destinationLimit(addr); limit > 0 && p.destCounts[addr] >= limit {
+		p.connMapMutex.Unlock()
+		respond(http.StatusServiceUnavailable, resp, fmt.Sprintf("Too many tunnels to %v", addr))
+		return nil, false, fmt.Errorf("Too many tunnels to %v", addr)
+	}
+	victim, err := p.makeRoomForTunnel()
+	if err != nil {
+		p.connMapMutex.Unlock()
+		respond(http.StatusServiceUnavailable, resp, err.Error())
+		return nil, false, err
+	}
+	l = p.newLazyConn(id, addr)
+	l.dialAddr = dialAddr
+	l.clientAddr = clientIpFor(req)
+	l.serverName = req.Header.Get(X_ENPROXY_SNI)
+	if p.ProxyProtocol != 0 {
+		l.clientSource = clientSourceFor(req)
+	}
+	l.upstreamBucket = newTokenBucket(limits.Upstream)
+	l.downstreamBucket = newTokenBucket(limits.Downstream)
+	l.maxReconnects, _ = strconv.Atoi(req.Header.Get(X_ENPROXY_MAX_RECONNECTS))
+	if l.maxReconnects > p.MaxUpstreamReconnects {
+		l.maxReconnects = p.MaxUpstreamReconnects
+	}
+	if p.EstablishTimeout > 0 {
+		l.establishTimer = time.AfterFunc(p.EstablishTimeout, l.dropIfUnestablished)
+	}
 	p.connMap[id] = l
+	p.destCounts[addr]++
+	if p.MaxTunnels > 0 {
+		l.lruElement = p.lru.PushFront(l)
+	}
 	p.connMapMutex.Unlock()
+	if victim != nil {
+		victim.evict()
+	}
 	return l, true, nil
 }
 
+// removeLazyConn removes the given lazyConn from connMap. It must be called
+// with connMapMutex held.
+func (p *Proxy) removeLazyConn(l *lazyConn) {
+	if p.connMap[l.id] != l {
+		return
+	}
+	delete(p.connMap, l.id)
+	if l.lruElement != nil {
+		p.lru.Remove(l.lruElement)
+		l.lruElement = nil
+	}
+	p.destCounts[l.addr]--
+	if p.destCounts[l.addr] <= 0 {
+		delete(p.destCounts, l.addr)
+	}
+}
+
 func clientIpFor(req *http.Request) string {
 	clientIp := req.Header.Get("X-Forwarded-For")
 	if clientIp == "" {
 		clientIp, _, err := net.SplitHostPort(req.RemoteAddr)
 		if err != nil {
-			log.Debugf("Unable to split RemoteAddr %v: %v", err)
+			log.Debugf("Unable to split RemoteAddr %v: %v", req.RemoteAddr, err)
 			return ""
 		}
 		return clientIp
@@ -391,7 +1035,13 @@ func clientIpFor(req *http.Request) string {
 }
 
 func respond(status int, resp http.ResponseWriter, msg string) {
-	log.Errorf(msg)
+	log.Error(msg)
+	writeResponse(status, resp, msg)
+}
+
+// writeResponse responds with the given status and msg as the body, without
+// logging msg.
+func writeResponse(status int, resp http.ResponseWriter, msg string) {
 	resp.WriteHeader(status)
 	if _, err := resp.Write([]byte(msg)); err != nil {
 		log.Debugf("Unable to write response: %v", err)
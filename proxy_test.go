@@ -1,9 +1,29 @@
 package enproxy
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
 )
 
 func TestCustomHeaders(t *testing.T) {
@@ -37,3 +57,1296 @@ func TestCustomHeaders(t *testing.T) {
 		t.Fatalf("Unexpected country: %v", country)
 	}
 }
+
+func TestListener(t *testing.T) {
+	proxy := &Proxy{}
+	l := NewListener(proxy)
+	proxy.Start()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	acceptedAddr := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Errorf("Unable to accept: %v", err)
+			return
+		}
+		acceptedAddr <- conn.LocalAddr().String()
+		// Echo
+		if _, err := io.Copy(conn, conn); err != nil {
+			log.Debugf("Unable to echo: %v", err)
+		}
+		if err := conn.Close(); err != nil {
+			log.Debugf("Unable to close accepted conn: %v", err)
+		}
+	}()
+
+	conn, err := Dial("service.example:22", testConfig(server.Listener.Addr().String()))
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	defer func() {
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	}()
+
+	msg := []byte("Hello tunnel")
+	_, err = conn.Write(msg)
+	assert.NoError(t, err, "Writing to tunnel should succeed")
+	b := make([]byte, len(msg))
+	_, err = io.ReadFull(conn, b)
+	assert.NoError(t, err, "Reading from tunnel should succeed")
+	assert.Equal(t, string(msg), string(b), "Should have received echo")
+	assert.Equal(t, "service.example:22", <-acceptedAddr, "Accepted conn should report destination address")
+
+	assert.NoError(t, l.Close(), "Closing listener should succeed")
+	_, err = l.Accept()
+	assert.Equal(t, ErrListenerClosed, err, "Accept on closed listener should fail")
+}
+
+func TestHealthPath(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	proxy := &Proxy{HealthPath: "/healthz", IdleTimeout: 500 * time.Millisecond}
+	proxy.Start()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	getHealth := func() *Health {
+		resp, err := http.Get(server.URL + "/healthz")
+		if err != nil {
+			t.Fatalf("Unable to get health: %v", err)
+		}
+		defer func() {
+			if err := resp.Body.Close(); err != nil {
+				log.Debugf("Unable to close response body: %v", err)
+			}
+		}()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		health := &Health{}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(health), "Health should be valid JSON")
+		return health
+	}
+
+	health := getHealth()
+	assert.Equal(t, 0, health.ActiveTunnels, "Health check shouldn't open a tunnel")
+	assert.True(t, health.Uptime > 0, "Uptime should be reported")
+
+	conn, err := Dial(destAddr, testConfig(server.Listener.Addr().String()))
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	defer func() {
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	}()
+	_, err = conn.Write([]byte("Hello"))
+	assert.NoError(t, err, "Writing should succeed")
+	_, err = io.ReadFull(conn, make([]byte, 5))
+	assert.NoError(t, err, "Reading should succeed")
+
+	assert.Equal(t, 1, getHealth().ActiveTunnels, "Health should count open tunnel")
+}
+
+func TestCORS(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	proxy := &Proxy{
+		IdleTimeout: 500 * time.Millisecond,
+		CORS: &CORS{
+			AllowedOrigins: []string{"https://app.example.com"},
+			AllowedHeaders: []string{"X-Front"},
+			MaxAge:         10 * time.Minute,
+		},
+	}
+	proxy.Start()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	preflight := func(origin string, id string) *http.Response {
+		req, err := http.NewRequest(http.MethodOptions, server.URL+"/", nil)
+		if err != nil {
+			t.Fatalf("Unable to create request: %v", err)
+		}
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		if id != "" {
+			req.Header.Set(X_ENPROXY_ID, id)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Unable to send preflight request: %v", err)
+		}
+		if err := resp.Body.Close(); err != nil {
+			log.Debugf("Unable to close response body: %v", err)
+		}
+		return resp
+	}
+
+	resp := preflight("https://app.example.com", "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode, "Preflight from allowed origin should be answered")
+	assert.Equal(t, "https://app.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, resp.Header.Get("Access-Control-Allow-Methods"), http.MethodPost)
+	allowedHeaders := resp.Header.Get("Access-Control-Allow-Headers")
+	assert.Contains(t, allowedHeaders, X_ENPROXY_ID, "Enproxy headers should be allowed")
+	assert.Contains(t, allowedHeaders, "X-Front", "Configured headers should be allowed")
+	assert.Equal(t, "600", resp.Header.Get("Access-Control-Max-Age"))
+	assert.Equal(t, 0, proxy.Health().ActiveTunnels, "Preflight shouldn't open a tunnel")
+
+	resp = preflight("https://evil.example.com", "")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "Preflight from other origin should be refused")
+	assert.Empty(t, resp.Header.Get("Access-Control-Allow-Origin"))
+
+	resp = preflight("https://app.example.com", "abc")
+	assert.NotEqual(t, http.StatusNoContent, resp.StatusCode, "OPTIONS requests with an id should be treated as tunnel requests")
+
+	// Tunnel requests from the browser get to read the enproxy headers
+	firstResponse := make(chan *http.Response, 1)
+	config := testConfig(server.Listener.Addr().String())
+	config.OnRequest = func(req *http.Request) {
+		req.Header.Set("Origin", "https://app.example.com")
+	}
+	config.OnFirstResponse = func(resp *http.Response) {
+		firstResponse <- resp
+	}
+	conn, err := Dial(destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	defer func() {
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	}()
+	_, err = conn.Write([]byte("Hello"))
+	assert.NoError(t, err, "Writing should succeed")
+	_, err = io.ReadFull(conn, make([]byte, 5))
+	assert.NoError(t, err, "Reading should succeed")
+	resp = <-firstResponse
+	assert.Equal(t, "https://app.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, resp.Header.Get("Access-Control-Expose-Headers"), X_ENPROXY_EOF)
+}
+
+func TestOnTunnelClosed(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	records := make(chan *AccessLogRecord, 1)
+	proxy := &Proxy{
+		IdleTimeout: 300 * time.Millisecond,
+		OnTunnelClosed: func(record *AccessLogRecord) {
+			records <- record
+		},
+	}
+	proxy.Start()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	start := time.Now()
+	conn, err := Dial(destAddr, testConfig(server.Listener.Addr().String()))
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	_, err = conn.Write([]byte("Hello"))
+	assert.NoError(t, err, "Writing should succeed")
+	_, err = io.ReadFull(conn, make([]byte, 5))
+	assert.NoError(t, err, "Reading should succeed")
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+
+	select {
+	case record := <-records:
+		assert.Equal(t, destAddr, record.Destination)
+		assert.Equal(t, "127.0.0.1", record.ClientAddr)
+		assert.NotEmpty(t, record.ID)
+		assert.EqualValues(t, 5, record.BytesUp)
+		assert.EqualValues(t, 5, record.BytesDown)
+		assert.Equal(t, TunnelClosedIdle, record.CloseReason)
+		assert.WithinDuration(t, start, record.Time, time.Second)
+		assert.True(t, record.Duration >= 300*time.Millisecond, "Duration should include idle time, was %v", record.Duration)
+		line := record.String()
+		assert.True(t, strings.HasPrefix(line, "127.0.0.1 - - ["), "Unexpected log line: %v", line)
+		assert.Contains(t, line, "\"TUNNEL "+destAddr+"\" 5 5 ")
+		assert.True(t, strings.HasSuffix(line, "s idle"), "Unexpected log line: %v", line)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Tunnel should have been closed")
+	}
+}
+
+func TestEstablishTimeout(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	records := make(chan *AccessLogRecord, 2)
+	proxy := &Proxy{
+		IdleTimeout:      500 * time.Millisecond,
+		EstablishTimeout: 200 * time.Millisecond,
+		OnTunnelClosed: func(record *AccessLogRecord) {
+			records <- record
+		},
+	}
+	proxy.Start()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	// Client that never finishes its first request
+	slow, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Unable to dial proxy: %v", err)
+	}
+	defer func() {
+		if err := slow.Close(); err != nil {
+			log.Debugf("Unable to close slow conn: %v", err)
+		}
+	}()
+	_, err = fmt.Fprintf(slow, "POST /slowid/%v/write/ HTTP/1.1\r\nHost: proxy\r\nContent-Length: 100\r\n\r\nHello", destAddr)
+	assert.NoError(t, err, "Writing partial request should succeed")
+	assert.NoError(t, slow.SetReadDeadline(time.Now().Add(5*time.Second)))
+	resp, err := http.ReadResponse(bufio.NewReader(slow), nil)
+	if assert.NoError(t, err, "Should have gotten a response") {
+		assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	}
+	select {
+	case record := <-records:
+		assert.Equal(t, "slowid", record.ID)
+		assert.Equal(t, TunnelClosedUnestablished, record.CloseReason)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Unestablished tunnel should have been dropped")
+	}
+	assert.Empty(t, proxy.DestinationCounts(), "Dropped tunnel shouldn't be counted")
+
+	// Established tunnels outlive the EstablishTimeout
+	conn, err := Dial(destAddr, testConfig(server.Listener.Addr().String()))
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	defer func() {
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	}()
+	_, err = conn.Write([]byte("Hello"))
+	assert.NoError(t, err, "Writing should succeed")
+	_, err = io.ReadFull(conn, make([]byte, 5))
+	assert.NoError(t, err, "Reading should succeed")
+	time.Sleep(300 * time.Millisecond)
+	_, err = conn.Write([]byte("World"))
+	assert.NoError(t, err, "Writing after EstablishTimeout should succeed")
+	b := make([]byte, 5)
+	_, err = io.ReadFull(conn, b)
+	assert.NoError(t, err, "Reading after EstablishTimeout should succeed")
+	assert.Equal(t, "World", string(b))
+}
+
+func TestReadHeaderTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	defer func() {
+		if err := l.Close(); err != nil {
+			log.Debugf("Unable to close listener: %v", err)
+		}
+	}()
+	proxy := &Proxy{ReadHeaderTimeout: 200 * time.Millisecond}
+	go func() {
+		if err := proxy.Serve(l); err != nil {
+			log.Debugf("Proxy stopped serving: %v", err)
+		}
+	}()
+
+	slow, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Unable to dial proxy: %v", err)
+	}
+	defer func() {
+		if err := slow.Close(); err != nil {
+			log.Debugf("Unable to close slow conn: %v", err)
+		}
+	}()
+	_, err = slow.Write([]byte("POST /slowid/"))
+	assert.NoError(t, err, "Writing partial headers should succeed")
+	start := time.Now()
+	assert.NoError(t, slow.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = ioutil.ReadAll(slow)
+	assert.NoError(t, err, "Proxy should have closed the connection")
+	assert.True(t, time.Now().Sub(start) < 2*time.Second, "Proxy should have closed the connection within ReadHeaderTimeout")
+}
+
+func TestResolver(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	proxy := &Proxy{
+		IdleTimeout: 500 * time.Millisecond,
+		Resolver: func(dest string) (string, error) {
+			if dest == "echo-service:1" {
+				return destAddr, nil
+			}
+			return "", fmt.Errorf("Unknown service")
+		},
+	}
+	proxy.Start()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+	config := testConfig(server.Listener.Addr().String())
+	config.WaitForUpstream = true
+
+	conn, err := Dial("echo-service:1", config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	defer func() {
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	}()
+	_, err = conn.Write([]byte("Hello"))
+	assert.NoError(t, err, "Writing should succeed")
+	b := make([]byte, 5)
+	_, err = io.ReadFull(conn, b)
+	assert.NoError(t, err, "Reading should succeed")
+	assert.Equal(t, "Hello", string(b), "Should have reached resolved destination")
+	assert.Equal(t, 1, proxy.DestinationCounts()["echo-service:1"], "Tunnel should be counted under the requested name")
+
+	_, err = Dial(destAddr, config)
+	if assert.Error(t, err, "Dialing unknown destination should fail") {
+		assert.Contains(t, err.Error(), "404 Not Found")
+		assert.Contains(t, err.Error(), "Unknown service")
+	}
+}
+
+// TestDialUpstream makes sure that the Proxy cancels dials of the destination
+// server when the client goes away, without failing the tunnel.
+func TestDialUpstream(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	dialCanceled := make(chan error, 1)
+	hang := int32(1)
+	proxy := &Proxy{
+		IdleTimeout: 500 * time.Millisecond,
+		DialUpstream: func(ctx context.Context, addr string) (net.Conn, error) {
+			if atomic.LoadInt32(&hang) == 1 {
+				// Very slow destination server
+				<-ctx.Done()
+				dialCanceled <- ctx.Err()
+				return nil, ctx.Err()
+			}
+			return (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+		},
+	}
+	proxy.Start()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	connect := func(ctx context.Context) (*http.Response, error) {
+		req, err := http.NewRequest("POST", server.URL+"/abc/"+destAddr+"/"+OP_CONNECT+"/", nil)
+		if err != nil {
+			t.Fatalf("Unable to create request: %v", err)
+		}
+		return http.DefaultClient.Do(req.WithContext(ctx))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err := connect(ctx)
+	assert.Error(t, err, "Connecting should time out")
+	select {
+	case err := <-dialCanceled:
+		assert.Equal(t, context.Canceled, err, "Dial should have been canceled")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Dial should have been canceled once the client went away")
+	}
+
+	// The tunnel can still dial once the destination server answers
+	atomic.StoreInt32(&hang, 0)
+	resp, err := connect(context.Background())
+	if assert.NoError(t, err, "Connecting again should succeed") {
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "Tunnel should have connected")
+		if err := resp.Body.Close(); err != nil {
+			log.Debugf("Unable to close response body: %v", err)
+		}
+	}
+}
+
+func TestDestAddrValidation(t *testing.T) {
+	for addr, expected := range map[string]string{
+		"Example.COM:443":           "example.com:443",
+		"example.com.:0080":         "example.com:80",
+		"[2001:DB8::1]:22":          "[2001:db8::1]:22",
+		"127.000.0.1:80":            "",
+		"10.0.0.1:80":               "10.0.0.1:80",
+		"my_service.internal:8080":  "my_service.internal:8080",
+		"example.com":               "",
+		"example.com:":              "",
+		"example.com:https":         "",
+		"example.com:+80":           "",
+		"example.com:0":             "",
+		"example.com:65536":         "",
+		":80":                       "",
+		"-example.com:80":           "",
+		"exa mple.com:80":           "",
+		"example.com:80\r\nHost: x": "",
+		"example..com:80":           "",
+		"ex%41mple.com:80":          "",
+	} {
+		normalized, err := normalizeDestAddr(addr)
+		if expected == "" {
+			assert.Error(t, err, "%q should be rejected", addr)
+		} else if assert.NoError(t, err, "%q should be accepted", addr) {
+			assert.Equal(t, expected, normalized, "%q should be normalized", addr)
+		}
+	}
+
+	destAddr := startEchoServer(t)
+	proxy := &Proxy{IdleTimeout: 500 * time.Millisecond}
+	proxy.Start()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	for _, path := range []string{
+		"/id-1/example.com/write/",
+		"/id-2/example.com:99999/write/",
+		"/id-3/example.com:80%0D%0AX-Injected:%201/write/",
+	} {
+		resp, err := http.Post("http://"+server.Listener.Addr().String()+path, "application/octet-stream", strings.NewReader("Hello"))
+		if assert.NoError(t, err, "Request should succeed") {
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "Bad destination in %v should be rejected", path)
+			assert.NoError(t, resp.Body.Close(), "Closing response body should succeed")
+		}
+	}
+	assert.Empty(t, proxy.DestinationCounts(), "No tunnels should have been opened to bad destinations")
+
+	// Destinations are normalized before being dialed and counted
+	_, port, _ := net.SplitHostPort(destAddr)
+	conn, err := Dial("LOCALHOST:0"+port, testConfig(server.Listener.Addr().String()))
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	_, err = conn.Write([]byte("Hello"))
+	assert.NoError(t, err, "Writing should succeed")
+	_, err = io.ReadFull(conn, make([]byte, 5))
+	assert.NoError(t, err, "Reading should succeed")
+	assert.Equal(t, 1, proxy.DestinationCounts()["localhost:"+port], "Tunnel should be counted under normalized destination")
+	assert.NoError(t, conn.Close(), "Closing conn should succeed")
+}
+
+func TestWriteOrdering(t *testing.T) {
+	proxy := &Proxy{IdleTimeout: 500 * time.Millisecond, MaxReorderBytes: 10}
+	l := NewListener(proxy)
+	proxy.Start()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Errorf("Unable to accept: %v", err)
+			return
+		}
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			t.Errorf("Unable to read: %v", err)
+		}
+		received <- b
+		if err := conn.Close(); err != nil {
+			log.Debugf("Unable to close accepted conn: %v", err)
+		}
+	}()
+
+	write := func(seq string, body string) int {
+		req, err := http.NewRequest("POST", server.URL+"/seqid/service.example:22/write/", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Unable to create request: %v", err)
+		}
+		req.Header.Set(X_ENPROXY_SEQ, seq)
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err, "Request should succeed") {
+			return 0
+		}
+		assert.NoError(t, resp.Body.Close(), "Closing response body should succeed")
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, write("1", "A"))
+	// Ahead of its turn, buffered
+	assert.Equal(t, http.StatusOK, write("3", "C"))
+	// Exceeds MaxReorderBytes
+	assert.Equal(t, http.StatusServiceUnavailable, write("4", "DDDDDDDDDDDD"))
+	// Resent, discarded
+	assert.Equal(t, http.StatusOK, write("1", "A"))
+	assert.Equal(t, http.StatusOK, write("3", "C"))
+	// Completes the sequence, so that C is written too
+	assert.Equal(t, http.StatusOK, write("2", "B"))
+	assert.Equal(t, http.StatusOK, write("4", "D"))
+	assert.Equal(t, http.StatusBadRequest, write("0", "X"))
+
+	select {
+	case b := <-received:
+		assert.Equal(t, "ABCD", string(b), "Destination should have received bodies in order and once")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Destination didn't receive data")
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	// Destination that reports the PROXY protocol header and then echoes
+	headers := make(chan []byte, 1)
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	defer func() {
+		if err := l.Close(); err != nil {
+			log.Debugf("Unable to close listener: %v", err)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() {
+					if err := conn.Close(); err != nil {
+						log.Debugf("Unable to close connection: %v", err)
+					}
+				}()
+				br := bufio.NewReader(conn)
+				var header []byte
+				if first, err := br.Peek(1); err != nil {
+					return
+				} else if first[0] == 'P' {
+					line, err := br.ReadBytes('\n')
+					if err != nil {
+						return
+					}
+					header = line
+				} else {
+					header = make([]byte, 16)
+					if _, err := io.ReadFull(br, header); err != nil {
+						return
+					}
+					addrs := make([]byte, binary.BigEndian.Uint16(header[14:]))
+					if _, err := io.ReadFull(br, addrs); err != nil {
+						return
+					}
+					header = append(header, addrs...)
+				}
+				headers <- header
+				if _, err := io.Copy(conn, br); err != nil {
+					log.Debugf("Unable to echo: %v", err)
+				}
+			}()
+		}
+	}()
+	destAddr := l.Addr().String()
+	destPort := l.Addr().(*net.TCPAddr).Port
+
+	echo := func(config *Config) {
+		conn, err := Dial(destAddr, config)
+		if err != nil {
+			t.Fatalf("Unable to dial: %v", err)
+		}
+		defer func() {
+			assert.NoError(t, conn.Close(), "Closing conn should succeed")
+		}()
+		_, err = conn.Write([]byte("Hello"))
+		assert.NoError(t, err, "Writing should succeed")
+		b := make([]byte, 5)
+		_, err = io.ReadFull(conn, b)
+		assert.NoError(t, err, "Reading should succeed")
+		assert.Equal(t, "Hello", string(b), "Data after header should be echoed")
+	}
+
+	for _, version := range []int{ProxyProtocolV1, ProxyProtocolV2} {
+		proxy := &Proxy{IdleTimeout: 500 * time.Millisecond, ProxyProtocol: version}
+		proxy.Start()
+		server := httptest.NewServer(proxy)
+		config := testConfig(server.Listener.Addr().String())
+		config.OnRequest = func(req *http.Request) {
+			req.Header.Set("X-Forwarded-For", "7.7.7.7, 10.0.0.1")
+		}
+		echo(config)
+		header := <-headers
+		if version == ProxyProtocolV1 {
+			assert.Equal(t, fmt.Sprintf("PROXY TCP4 7.7.7.7 127.0.0.1 0 %d\r\n", destPort), string(header))
+		} else {
+			expected := append([]byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c"), 7, 7, 7, 7, 127, 0, 0, 1, 0, 0, byte(destPort>>8), byte(destPort))
+			assert.Equal(t, expected, header)
+		}
+		server.Close()
+	}
+
+	// Without X-Forwarded-For, the client's address and port are used
+	proxy := &Proxy{IdleTimeout: 500 * time.Millisecond, ProxyProtocol: ProxyProtocolV1}
+	proxy.Start()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+	echo(testConfig(server.Listener.Addr().String()))
+	header := string(<-headers)
+	expected := regexp.MustCompile(fmt.Sprintf("^PROXY TCP4 127.0.0.1 127.0.0.1 [1-9][0-9]* %d\r\n$", destPort))
+	assert.True(t, expected.MatchString(header), "Unexpected header: %v", header)
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	// TLS destination that reports the server names that clients ask for and
+	// then echoes, with a certificate for 127.0.0.1 and example.com
+	certServer := httptest.NewTLSServer(http.NotFoundHandler())
+	defer certServer.Close()
+	serverNames := make(chan string, 10)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: certServer.TLS.Certificates,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverNames <- hello.ServerName
+			return nil, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := io.Copy(conn, conn); err != nil {
+					log.Debugf("Unable to echo: %v", err)
+				}
+			}()
+		}
+	}()
+	destAddr := l.Addr().String()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(certServer.Certificate())
+	proxy := &Proxy{IdleTimeout: 500 * time.Millisecond, UpstreamTLS: &tls.Config{RootCAs: roots}}
+	proxy.Start()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	echo := func(serverName string) error {
+		config := testConfig(server.Listener.Addr().String())
+		config.UpstreamServerName = serverName
+		config.WaitForUpstream = true
+		conn, err := Dial(destAddr, config)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, err = conn.Write([]byte("Hello"))
+		assert.NoError(t, err, "Writing should succeed")
+		b := make([]byte, 5)
+		_, err = io.ReadFull(conn, b)
+		assert.NoError(t, err, "Reading should succeed")
+		assert.Equal(t, "Hello", string(b), "Data should be echoed over TLS")
+		return nil
+	}
+
+	// By default, the IP of the destination address is verified, which isn't
+	// sent as SNI
+	assert.NoError(t, echo(""), "Dialing destination by IP should succeed")
+	assert.Equal(t, "", <-serverNames)
+
+	// The client can ask for the name on the certificate
+	assert.NoError(t, echo("example.com"), "Dialing with server name should succeed")
+	assert.Equal(t, "example.com", <-serverNames)
+
+	// A name that the certificate doesn't have fails the tunnel
+	err = echo("wrong.example.org")
+	if assert.Error(t, err, "Dialing with wrong server name should fail") {
+		assert.Contains(t, err.Error(), "Unable to establish TLS")
+	}
+	assert.Equal(t, "wrong.example.org", <-serverNames)
+}
+
+func TestMaxResponseChunkBytes(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	proxy := &Proxy{IdleTimeout: 2 * time.Second, MaxResponseChunkBytes: 10}
+	proxy.Start()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	for _, maxResponseBytes := range []int{0, 4} {
+		scheduler := &recordingPollScheduler{}
+		config := testConfig(server.Listener.Addr().String())
+		config.PollScheduler = scheduler
+		config.MaxResponseBytes = maxResponseBytes
+		conn, err := Dial(destAddr, config)
+		if err != nil {
+			t.Fatalf("Unable to dial: %v", err)
+		}
+		msg := []byte(strings.Repeat("0123456789", 5))
+		_, err = conn.Write(msg)
+		assert.NoError(t, err, "Writing should succeed")
+		b := make([]byte, len(msg))
+		_, err = io.ReadFull(conn, b)
+		assert.NoError(t, err, "Reading should succeed")
+		assert.Equal(t, string(msg), string(b))
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+
+		limit := 10
+		if maxResponseBytes > 0 {
+			limit = maxResponseBytes
+		}
+		scheduler.mutex.Lock()
+		assert.True(t, len(scheduler.stats) >= len(msg)/limit-1, "Should have polled for each chunk")
+		for _, stats := range scheduler.stats {
+			assert.True(t, stats.BytesReceived <= limit, "Responses should be at most %d bytes, not %d", limit, stats.BytesReceived)
+		}
+		scheduler.mutex.Unlock()
+	}
+}
+
+func TestTunnelRateLimits(t *testing.T) {
+	data := patternedData(30000)
+	echoAddr := startEchoServer(t)
+	dataAddr := startDataServer(t, data)
+
+	proxy := &Proxy{
+		// Longer than a limited write takes
+		IdleTimeout: 2 * time.Second,
+		TunnelRateLimits: func(req *http.Request, destAddr string) RateLimits {
+			if req.Header.Get("X-Plan") != "basic" {
+				return RateLimits{}
+			}
+			if destAddr == echoAddr {
+				return RateLimits{Upstream: 20000}
+			}
+			return RateLimits{Downstream: 20000}
+		},
+	}
+	proxy.Start()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+	config := testConfig(server.Listener.Addr().String())
+	config.OnRequest = func(req *http.Request) {
+		req.Header.Set("X-Plan", "basic")
+	}
+
+	for _, destAddr := range []string{echoAddr, dataAddr} {
+		conn, err := Dial(destAddr, config)
+		if err != nil {
+			t.Fatalf("Unable to dial: %v", err)
+		}
+		start := time.Now()
+		if destAddr == echoAddr {
+			_, err = conn.Write(data)
+			assert.NoError(t, err, "Writing should succeed")
+		}
+		b := make([]byte, len(data))
+		_, err = io.ReadFull(conn, b)
+		assert.NoError(t, err, "Reading should succeed")
+		assert.True(t, bytes.Equal(data, b), "Unexpected data from %v", destAddr)
+		// The first 20000 bytes pass right away, the rest takes half a second
+		elapsed := time.Now().Sub(start)
+		assert.True(t, elapsed >= 400*time.Millisecond, "Transfer to %v should have been limited, took %v", destAddr, elapsed)
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	}
+}
+
+func TestDestinationLimits(t *testing.T) {
+	limitedAddr := startEchoServer(t)
+	otherAddr := startEchoServer(t)
+
+	proxy := &Proxy{
+		IdleTimeout: 500 * time.Millisecond,
+		DestinationLimits: []DestinationLimit{
+			{Pattern: limitedAddr, MaxTunnels: 1},
+		},
+	}
+	proxy.Start()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+	config := testConfig(server.Listener.Addr().String())
+	config.WaitForUpstream = true
+
+	conn, err := Dial(limitedAddr, config)
+	if !assert.NoError(t, err, "First tunnel to limited destination should be allowed") {
+		return
+	}
+	defer func() {
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	}()
+
+	_, err = Dial(limitedAddr, config)
+	if assert.Error(t, err, "Second tunnel to limited destination should be rejected") {
+		assert.Contains(t, err.Error(), "503 Service Unavailable")
+	}
+
+	other, err := Dial(otherAddr, config)
+	if assert.NoError(t, err, "Tunnel to other destination should be allowed") {
+		assert.NoError(t, other.Close(), "Closing conn should succeed")
+	}
+
+	counts := proxy.DestinationCounts()
+	assert.Equal(t, 1, counts[limitedAddr], "Should count tunnel to limited destination")
+	assert.Equal(t, 1, counts[otherAddr], "Should count tunnel to other destination")
+}
+
+func TestMaxTunnels(t *testing.T) {
+	destAddrs := []string{startEchoServer(t), startEchoServer(t), startEchoServer(t)}
+
+	records := make(chan *AccessLogRecord, 10)
+	proxy := &Proxy{
+		IdleTimeout: 2 * time.Second,
+		MaxTunnels:  2,
+		OnTunnelClosed: func(record *AccessLogRecord) {
+			records <- record
+		},
+	}
+	proxy.Start()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+	config := testConfig(server.Listener.Addr().String())
+	config.WaitForUpstream = true
+
+	echo := func(conn net.Conn) error {
+		if _, err := conn.Write([]byte("Hello")); err != nil {
+			return err
+		}
+		_, err := io.ReadFull(conn, make([]byte, 5))
+		return err
+	}
+
+	conns := make([]net.Conn, 0, len(destAddrs))
+	for _, destAddr := range destAddrs[:2] {
+		conn, err := Dial(destAddr, config)
+		if !assert.NoError(t, err, "Tunnels up to MaxTunnels should be allowed") {
+			return
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	// Make the second tunnel the least recently active one
+	assert.NoError(t, echo(conns[1]), "Echoing on second tunnel should succeed")
+	assert.NoError(t, echo(conns[0]), "Echoing on first tunnel should succeed")
+
+	conn, err := Dial(destAddrs[2], config)
+	if !assert.NoError(t, err, "New tunnel should evict an old one") {
+		return
+	}
+	defer conn.Close()
+	select {
+	case record := <-records:
+		assert.Equal(t, destAddrs[1], record.Destination, "Least recently active tunnel should have been evicted")
+		assert.Equal(t, TunnelClosedEvicted, record.CloseReason)
+	case <-time.After(1 * time.Second):
+		t.Fatal("Evicted tunnel should have been closed")
+	}
+	assert.EqualValues(t, 1, proxy.Evictions(), "Should have counted eviction")
+	assert.EqualValues(t, 1, proxy.Health().EvictedTunnels, "Health should report eviction")
+	assert.Equal(t, 2, proxy.Health().ActiveTunnels, "Should be at MaxTunnels")
+
+	assert.NoError(t, echo(conn), "Echoing on new tunnel should succeed")
+	assert.NoError(t, echo(conns[0]), "Echoing on first tunnel should still succeed")
+	err = echo(conns[1])
+	assert.True(t, errors.Is(err, ErrTunnelNotFound), "Evicted tunnel should fail with ErrTunnelNotFound, not %v", err)
+
+	// Without eviction, new tunnels are rejected instead
+	proxy.TunnelEviction = RejectNewTunnels
+	_, err = Dial(destAddrs[1], config)
+	if assert.Error(t, err, "Tunnel beyond MaxTunnels should be rejected") {
+		assert.Contains(t, err.Error(), "503 Service Unavailable")
+	}
+	assert.EqualValues(t, 1, proxy.Evictions(), "Rejecting shouldn't evict")
+}
+
+func TestMaxRequestBodyBytes(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	records := make(chan *AccessLogRecord, 10)
+	proxy := &Proxy{
+		IdleTimeout:         500 * time.Millisecond,
+		MaxRequestBodyBytes: 1000,
+		OnTunnelClosed: func(record *AccessLogRecord) {
+			select {
+			case records <- record:
+			default:
+			}
+		},
+	}
+	proxy.Start()
+	maxBodyBytes := int64(0)
+	var maxBodyBytesMutex sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/"+OP_WRITE+"/") {
+			body, _ := ioutil.ReadAll(req.Body)
+			maxBodyBytesMutex.Lock()
+			if int64(len(body)) > maxBodyBytes {
+				maxBodyBytes = int64(len(body))
+			}
+			maxBodyBytesMutex.Unlock()
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		proxy.ServeHTTP(resp, req)
+	}))
+	defer server.Close()
+
+	// Conns that know the limit keep their requests within it
+	data := bytes.Repeat([]byte("0123456789"), 500)
+	for _, buffered := range []bool{false, true} {
+		config := testConfig(server.Listener.Addr().String())
+		config.WaitForUpstream = true
+		config.BufferRequests = buffered
+		conn, err := Dial(destAddr, config)
+		if err != nil {
+			t.Fatalf("Unable to dial: %v", err)
+		}
+		_, err = conn.Write(data)
+		assert.NoError(t, err, "Writing more than the limit should succeed (buffered: %v)", buffered)
+		received := make([]byte, len(data))
+		_, err = io.ReadFull(conn, received)
+		assert.NoError(t, err, "Reading should succeed (buffered: %v)", buffered)
+		assert.Equal(t, data, received, "Should have received all data back (buffered: %v)", buffered)
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	}
+	maxBodyBytesMutex.Lock()
+	assert.True(t, maxBodyBytes > 0 && maxBodyBytes <= 1000, "Request bodies should stay within the limit, biggest was %d bytes", maxBodyBytes)
+	maxBodyBytesMutex.Unlock()
+
+	// The limit is on the data, so base64 bodies that carry exactly as much
+	// as the limit are fine even though they're bigger on the wire
+	for _, buffered := range []bool{false, true} {
+		config := testConfig(server.Listener.Addr().String())
+		config.WaitForUpstream = true
+		config.BufferRequests = buffered
+		config.BodyEncoding = BodyEncodingBase64
+		conn, err := Dial(destAddr, config)
+		if err != nil {
+			t.Fatalf("Unable to dial: %v", err)
+		}
+		for _, b := range [][]byte{data[:1000], data} {
+			_, err = conn.Write(b)
+			assert.NoError(t, err, "Writing base64 should succeed (buffered: %v)", buffered)
+			received := make([]byte, len(b))
+			_, err = io.ReadFull(conn, received)
+			assert.NoError(t, err, "Reading base64 should succeed (buffered: %v)", buffered)
+			assert.Equal(t, b, received, "Should have received all base64 data back (buffered: %v)", buffered)
+		}
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	}
+
+	// Requests beyond the limit are rejected and close their tunnel
+	url := "http://" + server.Listener.Addr().String() + "/big/" + destAddr + "/" + OP_WRITE + "/"
+	resp, err := http.Post(url, "application/octet-stream", bytes.NewReader(data))
+	if assert.NoError(t, err, "Request should succeed") {
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode, "Request beyond limit should be rejected")
+		assert.Equal(t, "1000", resp.Header.Get(X_ENPROXY_MAX_BODY_BYTES), "Response should announce the limit")
+		assert.NoError(t, resp.Body.Close(), "Closing response body should succeed")
+	}
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case record := <-records:
+			if record.ID != "big" {
+				continue
+			}
+			assert.Equal(t, TunnelClosedRequestTooLarge, record.CloseReason)
+			assert.EqualValues(t, 1000, record.BytesUp, "Data up to the limit should have been sent upstream")
+		case <-timeout:
+			t.Fatal("Tunnel with too large request should have been closed")
+		}
+		break
+	}
+}
+
+func TestUpstreamReconnect(t *testing.T) {
+	// Destination that resets the first connection once it has received
+	// something and echoes on all later connections
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	defer func() {
+		if err := l.Close(); err != nil {
+			log.Debugf("Unable to close listener: %v", err)
+		}
+	}()
+	go func() {
+		first := true
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if first {
+				first = false
+				go func() {
+					if _, err := conn.Read(make([]byte, 5)); err != nil {
+						log.Debugf("Unable to read: %v", err)
+					}
+					if err := conn.(*net.TCPConn).SetLinger(0); err != nil {
+						log.Debugf("Unable to set linger: %v", err)
+					}
+					if err := conn.Close(); err != nil {
+						log.Debugf("Unable to close connection: %v", err)
+					}
+				}()
+				continue
+			}
+			go func() {
+				if _, err := io.Copy(conn, conn); err != nil {
+					log.Debugf("Unable to echo: %v", err)
+				}
+				if err := conn.Close(); err != nil {
+					log.Debugf("Unable to close connection: %v", err)
+				}
+			}()
+		}
+	}()
+
+	proxy := &Proxy{IdleTimeout: 500 * time.Millisecond, MaxUpstreamReconnects: 1}
+	proxy.Start()
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	config := testConfig(server.Listener.Addr().String())
+	config.MaxUpstreamReconnects = 5
+	conn, err := Dial(l.Addr().String(), config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	defer func() {
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	}()
+
+	_, err = conn.Write([]byte("Reset"))
+	assert.NoError(t, err, "Writing should succeed")
+	// Give the destination time to reset the connection
+	time.Sleep(250 * time.Millisecond)
+
+	_, err = conn.Write([]byte("Hello"))
+	assert.NoError(t, err, "Writing after reset should succeed")
+	b := make([]byte, 5)
+	_, err = io.ReadFull(conn, b)
+	assert.NoError(t, err, "Reading after reset should succeed")
+	assert.Equal(t, "Hello", string(b), "Should have gotten echo from new connection")
+}
+
+func TestPathTemplate(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	var paths []string
+	var pathsMutex sync.Mutex
+	proxy := &Proxy{IdleTimeout: 500 * time.Millisecond, PathTemplate: "connect/{addr}/{id}/{op}"}
+	proxy.Start()
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		pathsMutex.Lock()
+		paths = append(paths, req.URL.Path)
+		pathsMutex.Unlock()
+		proxy.ServeHTTP(resp, req)
+	}))
+	defer server.Close()
+
+	config := testConfig(server.Listener.Addr().String())
+	config.PathTemplate = "connect/{addr}/{id}/{op}"
+	config.NewRequest = func(host, path, method string, body io.Reader) (*http.Request, error) {
+		// Prefix used for routing
+		return http.NewRequest(method, server.URL+"/routed/"+path, body)
+	}
+	conn, err := Dial(destAddr, config)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	defer func() {
+		assert.NoError(t, conn.Close(), "Closing conn should succeed")
+	}()
+
+	_, err = conn.Write([]byte("Hello"))
+	assert.NoError(t, err, "Writing should succeed")
+	b := make([]byte, 5)
+	_, err = io.ReadFull(conn, b)
+	assert.NoError(t, err, "Reading should succeed")
+	assert.Equal(t, "Hello", string(b), "Should have gotten echo")
+
+	pathsMutex.Lock()
+	defer pathsMutex.Unlock()
+	for _, path := range paths {
+		assert.True(t, strings.HasPrefix(path, "/routed/connect/"+destAddr+"/"), "Unexpected path %v", path)
+	}
+
+	_, err = compilePathTemplate("connect/{addr}/{op}")
+	assert.Error(t, err, "Template without {id} should be rejected")
+}
+
+func TestCoalescingConn(t *testing.T) {
+	rc := &recordingConn{}
+	maxDelay := 50 * time.Millisecond
+	conn := newCoalescingConn(rc, 100, maxDelay)
+
+	// Small writes are held until maxDelay has passed
+	for i := 0; i < 5; i++ {
+		n, err := conn.Write([]byte("0123456789"))
+		assert.NoError(t, err, "Buffered write should succeed")
+		assert.Equal(t, 10, n, "Buffered write should report all bytes written")
+	}
+	assert.Equal(t, 0, len(rc.getWrites()), "Small writes shouldn't have been flushed yet")
+	time.Sleep(maxDelay * 2)
+	if assert.Equal(t, 1, len(rc.getWrites()), "Small writes should have been flushed together after delay") {
+		assert.Equal(t, 50, len(rc.getWrites()[0]))
+	}
+
+	// Filling the buffer flushes right away
+	_, err := conn.Write(bytes.Repeat([]byte("a"), 60))
+	assert.NoError(t, err)
+	_, err = conn.Write(bytes.Repeat([]byte("b"), 40))
+	assert.NoError(t, err)
+	if assert.Equal(t, 2, len(rc.getWrites()), "Full buffer should have been flushed immediately") {
+		assert.Equal(t, 100, len(rc.getWrites()[1]))
+	}
+
+	// Big writes flush what's buffered and then go straight through
+	_, err = conn.Write([]byte("small"))
+	assert.NoError(t, err)
+	_, err = conn.Write(bytes.Repeat([]byte("c"), 200))
+	assert.NoError(t, err)
+	writes := rc.getWrites()
+	if assert.Equal(t, 4, len(writes), "Big write should have gone straight through") {
+		assert.Equal(t, "small", string(writes[2]))
+		assert.Equal(t, 200, len(writes[3]))
+	}
+
+	// Close flushes what's buffered
+	_, err = conn.Write([]byte("last"))
+	assert.NoError(t, err)
+	assert.NoError(t, conn.Close())
+	writes = rc.getWrites()
+	if assert.Equal(t, 5, len(writes), "Close should have flushed buffered data") {
+		assert.Equal(t, "last", string(writes[4]))
+	}
+}
+
+// recordingConn is a net.Conn that records the writes made to it
+type recordingConn struct {
+	net.Conn
+	writes [][]byte
+	mutex  sync.Mutex
+}
+
+func (rc *recordingConn) Write(b []byte) (int, error) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	rc.writes = append(rc.writes, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func (rc *recordingConn) Close() error {
+	return nil
+}
+
+func (rc *recordingConn) getWrites() [][]byte {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	return rc.writes
+}
+
+func FuzzServerRequest(f *testing.F) {
+	for _, seed := range []struct {
+		path    string
+		id      string
+		addr    string
+		op      string
+		seq     string
+		resume  string
+		maxResp string
+		body    []byte
+	}{
+		{"/id/example.com:80/write/", "", "", "", "1", "", "", []byte("Hello")},
+		{"/id/example.com:80/read/", "", "", "", "", "", "10", nil},
+		{"/id/example.com:80/connect/", "", "", "", "", "", "", nil},
+		{"/id/example.com:80/websocket/", "", "", "", "", "", "", nil},
+		{"/id/example.com:80/unknown/", "", "", "", "", "", "", nil},
+		{"/", "id", "example.com:80", OP_WRITE, "", "", "", []byte("Hello")},
+		{"/", "", "example.com:80", OP_WRITE, "", "", "", nil},
+		{"/", "id", "", OP_READ, "", "", "", nil},
+		{"//example.com:80/write/", "", "", "", "", "", "", nil},
+		{"/id//write/", "", "", "", "", "", "", nil},
+		{"/id/example.com/write/", "", "", "", "", "", "", nil},
+		{"/id/example.com:99999/write/", "", "", "", "", "", "", nil},
+		{"/id/example.com:-1/write/", "", "", "", "", "", "", nil},
+		{"/id/[::1/write/", "", "", "", "", "", "", nil},
+		{"/id/exa mple.com:80/write/", "", "", "", "", "", "", nil},
+		{"/", "id", "example.com:80\r\nX-Injected: 1", OP_WRITE, "", "", "", nil},
+		{"/id/example.com:80/write/", "", "", "", "0", "", "", nil},
+		{"/id/example.com:80/write/", "", "", "", "-5", "", "", nil},
+		{"/id/example.com:80/write/", "", "", "", "99999999999999999999", "", "", nil},
+		{"/id/example.com:80/write/", "", "", "", "3", "true", "", []byte("Hello")},
+		{"/id/example.com:80/read/", "", "", "", "", "true", "-1", nil},
+	} {
+		f.Add(seed.path, seed.id, seed.addr, seed.op, seed.seq, seed.resume, seed.maxResp, seed.body)
+	}
+
+	proxy := &Proxy{
+		IdleTimeout: 100 * time.Millisecond,
+		// Destinations discard what they receive, send a little data and hang
+		// up, so that requests finish quickly
+		Dial: func(addr string) (net.Conn, error) {
+			conn, dest := net.Pipe()
+			go func() {
+				if _, err := io.Copy(ioutil.Discard, dest); err != nil {
+					log.Debugf("Unable to discard: %v", err)
+				}
+			}()
+			go func() {
+				if err := dest.SetWriteDeadline(time.Now().Add(time.Second)); err != nil {
+					log.Debugf("Unable to set write deadline: %v", err)
+				}
+				if _, err := dest.Write([]byte("Hello")); err != nil {
+					log.Debugf("Unable to write: %v", err)
+				}
+				if err := dest.Close(); err != nil {
+					log.Debugf("Unable to close: %v", err)
+				}
+			}()
+			return conn, nil
+		},
+	}
+	proxy.Start()
+
+	f.Fuzz(func(t *testing.T, path string, id string, addr string, op string, seq string, resume string, maxResp string, body []byte) {
+		req := &http.Request{
+			Method:     "POST",
+			URL:        &url.URL{Path: path},
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     make(http.Header),
+			Body:       ioutil.NopCloser(bytes.NewReader(body)),
+			Host:       "proxy",
+			RemoteAddr: "127.0.0.1:12345",
+		}
+		for key, value := range map[string]string{
+			X_ENPROXY_ID:                 id,
+			X_ENPROXY_DEST_ADDR:          addr,
+			X_ENPROXY_OP:                 op,
+			X_ENPROXY_SEQ:                seq,
+			X_ENPROXY_RESUME:             resume,
+			X_ENPROXY_MAX_RESPONSE_BYTES: maxResp,
+		} {
+			if value != "" {
+				req.Header.Set(key, value)
+			}
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		req = req.WithContext(ctx)
+
+		resp := httptest.NewRecorder()
+		done := make(chan interface{}, 1)
+		go func() {
+			defer func() {
+				done <- recover()
+			}()
+			proxy.ServeHTTP(resp, req)
+		}()
+		select {
+		case recovered := <-done:
+			if recovered != nil {
+				t.Fatalf("Handler panicked: %v", recovered)
+			}
+		case <-time.After(15 * time.Second):
+			t.Fatal("Handler didn't finish")
+		}
+		if resp.Code < 100 || resp.Code > 599 {
+			t.Fatalf("Invalid response status %d", resp.Code)
+		}
+	})
+}
@@ -0,0 +1,103 @@
+package enproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// ProxyProtocolV1: the human-readable version 1 of the PROXY protocol
+	ProxyProtocolV1 = 1
+
+	// ProxyProtocolV2: the binary version 2 of the PROXY protocol
+	ProxyProtocolV2 = 2
+)
+
+var (
+	proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// proxyProtocolHeader builds a PROXY protocol header of the given version
+// telling the destination server that the connection from src to dst is being
+// proxied. src or dst may be nil if they're unknown, in which case the header
+// doesn't carry addresses.
+//
+// See http://www.haproxy.org/download/1.8/doc/proxy-protocol.txt.
+func proxyProtocolHeader(version int, src *net.TCPAddr, dst *net.TCPAddr) ([]byte, error) {
+	known := src != nil && dst != nil
+	ipv4 := known && src.IP.To4() != nil && dst.IP.To4() != nil
+	switch version {
+	case ProxyProtocolV1:
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		family := "TCP6"
+		srcIP, dstIP := src.IP.To16(), dst.IP.To16()
+		if ipv4 {
+			family = "TCP4"
+			srcIP, dstIP = src.IP.To4(), dst.IP.To4()
+		}
+		return []byte(fmt.Sprintf("PROXY %v %v %v %d %d\r\n", family, srcIP, dstIP, src.Port, dst.Port)), nil
+	case ProxyProtocolV2:
+		var header bytes.Buffer
+		header.Write(proxyProtocolV2Signature)
+		if !known {
+			// LOCAL command, receiver uses the connection's own addresses
+			header.Write([]byte{0x20, 0x00, 0x00, 0x00})
+			return header.Bytes(), nil
+		}
+		var addrs []byte
+		if ipv4 {
+			// PROXY command, TCP over IPv4
+			header.Write([]byte{0x21, 0x11})
+			addrs = append(append(addrs, src.IP.To4()...), dst.IP.To4()...)
+		} else {
+			// PROXY command, TCP over IPv6
+			header.Write([]byte{0x21, 0x21})
+			addrs = append(append(addrs, src.IP.To16()...), dst.IP.To16()...)
+		}
+		ports := make([]byte, 4)
+		binary.BigEndian.PutUint16(ports, uint16(src.Port))
+		binary.BigEndian.PutUint16(ports[2:], uint16(dst.Port))
+		addrs = append(addrs, ports...)
+		length := make([]byte, 2)
+		binary.BigEndian.PutUint16(length, uint16(len(addrs)))
+		header.Write(length)
+		header.Write(addrs)
+		return header.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("Unsupported PROXY protocol version %d", version)
+	}
+}
+
+// sendProxyProtocolHeader writes the PROXY protocol header for the tunnel to
+// the new connection to the destination server.
+func (l *lazyConn) sendProxyProtocolHeader(conn net.Conn) error {
+	dst, _ := conn.RemoteAddr().(*net.TCPAddr)
+	header, err := proxyProtocolHeader(l.p.ProxyProtocol, l.clientSource, dst)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(header)
+	return err
+}
+
+// clientSourceFor returns the address of the client that sent req, like
+// clientIpFor. The port is only known if the request wasn't forwarded.
+func clientSourceFor(req *http.Request) *net.TCPAddr {
+	ip := net.ParseIP(clientIpFor(req))
+	if ip == nil {
+		return nil
+	}
+	addr := &net.TCPAddr{IP: ip}
+	if req.Header.Get("X-Forwarded-For") == "" {
+		if _, port, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			addr.Port, _ = strconv.Atoi(port)
+		}
+	}
+	return addr
+}
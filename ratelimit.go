@@ -0,0 +1,68 @@
+package enproxy
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// retryAfterOf returns how long the proxy asked us to wait if resp is a 429 or
+// 503 carrying a Retry-After, either as delta-seconds or as an HTTP-date.
+func retryAfterOf(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	return parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+}
+
+// parseRetryAfter parses the value of a Retry-After header relative to now.
+// Dates in the past yield a wait of 0.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	wait := t.Sub(now)
+	if wait < 0 {
+		wait = 0
+	}
+	return wait, true
+}
+
+// rateLimit holds off further requests for the given duration. Waits longer
+// than MaxRetryAfter aren't recorded, since the request that got them fails
+// and it's up to the caller to decide what to do about that.
+func (c *conn) rateLimit(retryAfter time.Duration) {
+	if retryAfter > c.getConfig().MaxRetryAfter {
+		return
+	}
+	atomic.StoreInt64(&c.rateLimitedUntil, time.Now().Add(retryAfter).UnixNano())
+}
+
+// waitForRateLimit waits until the proxy's last Retry-After has passed,
+// returning net.ErrClosed if the conn is closed in the meantime.
+func (c *conn) waitForRateLimit() error {
+	wait := time.Until(time.Unix(0, atomic.LoadInt64(&c.rateLimitedUntil)))
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-c.closedCh:
+		return net.ErrClosed
+	}
+}
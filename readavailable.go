@@ -0,0 +1,79 @@
+package enproxy
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+// ReadAvailable() implements the function from Conn
+func (c *conn) ReadAvailable(max int) ([]byte, error) {
+	if !atomic.CompareAndSwapInt32(&c.reading, 0, 1) {
+		return nil, ErrConcurrentRead
+	}
+	defer atomic.StoreInt32(&c.reading, 0)
+	if err := c.getAsyncErr(); err != nil {
+		return nil, err
+	}
+	if c.readClosed() {
+		return nil, io.EOF
+	}
+	if max <= 0 {
+		return nil, nil
+	}
+	b := make([]byte, max)
+
+	// First what Read buffered (see ReadBufferBytes)
+	c.readBufMutex.Lock()
+	defer c.readBufMutex.Unlock()
+	n := copy(b, c.readPending)
+	c.readPending = c.readPending[n:]
+	atomic.StoreInt64(&c.pendingReadBytes, int64(len(c.readPending)))
+	if len(c.readPending) > 0 {
+		return b[:n], nil
+	}
+	if c.readErr != nil {
+		err := c.readErr
+		c.readErr = nil
+		return b[:n], err
+	}
+
+	// Then what reads that outlived their deadline left
+	c.deadlineReadMutex.Lock()
+	defer c.deadlineReadMutex.Unlock()
+	m := copy(b[n:], c.deadlineReadLeft)
+	n += m
+	c.deadlineReadLeft = c.deadlineReadLeft[m:]
+	atomic.StoreInt64(&c.deadlineReadBytes, int64(len(c.deadlineReadLeft)))
+	if len(c.deadlineReadLeft) > 0 {
+		return b[:n], nil
+	}
+	if c.deadlineReadErr != nil {
+		err := c.deadlineReadErr
+		c.deadlineReadErr = nil
+		return b[:n], err
+	}
+	if c.deadlineReadCh != nil || c.ws != nil || atomic.LoadInt32(&c.readsStarted) == 0 {
+		// Whatever comes next means waiting
+		return b[:n], nil
+	}
+
+	// Then what processReads gets without waiting
+	atomic.StoreInt32(&c.readingAvailable, 1)
+	defer atomic.StoreInt32(&c.readingAvailable, 0)
+	if !c.submitRead(b[n:]) {
+		return b[:n], net.ErrClosed
+	}
+	defer decrement(&blockedOnRead)
+	select {
+	case res, ok := <-c.readResponsesCh:
+		if !ok {
+			return b[:n], io.EOF
+		}
+		return b[:n+res.n], c.interruptedErr(res.err)
+	case err := <-c.asyncErrCh:
+		return b[:n], err
+	case <-c.readClosedCh:
+		return b[:n], io.EOF
+	}
+}
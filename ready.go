@@ -0,0 +1,32 @@
+package enproxy
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// markReady records the outcome of establishing the tunnel for WaitReady,
+// unless it has already been recorded, along with how long establishing took.
+func (c *conn) markReady(err error) {
+	c.readyOnce.Do(func() {
+		c.readyErr = err
+		latency := time.Now().Sub(c.dialStartedAt)
+		if err == nil {
+			atomic.StoreInt64(&c.establishTime, int64(latency))
+		}
+		c.getConfig().Trace.tunnelEstablished(latency, err)
+		c.emit(Event{Type: TunnelOpened, Err: err, Latency: latency})
+		close(c.readyCh)
+	})
+}
+
+// WaitReady() implements the function from Conn
+func (c *conn) WaitReady(ctx context.Context) error {
+	select {
+	case <-c.readyCh:
+		return c.readyErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
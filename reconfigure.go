@@ -0,0 +1,93 @@
+package enproxy
+
+import (
+	"bytes"
+	"errors"
+	"unsafe"
+)
+
+// getConfig returns the current configuration of this conn
+func (c *conn) getConfig() *Config {
+	c.configMutex.RLock()
+	defer c.configMutex.RUnlock()
+	return c.config
+}
+
+// Reconfigure() implements the function from Conn
+func (c *conn) Reconfigure(config *Config) error {
+	if config == nil {
+		return errors.New("Unable to reconfigure with nil Config")
+	}
+	config = config.Clone()
+	config.initDefaults()
+
+	c.configMutex.Lock()
+	defer c.configMutex.Unlock()
+	if field := fixedFieldChanged(c.config, config); field != "" {
+		return &ConfigChangeError{Field: field}
+	}
+	c.config = config
+	return nil
+}
+
+// fixedFieldChanged returns the name of the first field that can't be changed
+// by Reconfigure (see Conn.Reconfigure) that differs between old and updated,
+// or "" if there's none. These fields are either only used while starting a
+// Conn, size its buffers or goroutines, or have to match what the proxy was
+// told when the tunnel was set up.
+func fixedFieldChanged(old *Config, updated *Config) string {
+	switch {
+	case !sameFunc(unsafe.Pointer(&old.DialProxy), unsafe.Pointer(&updated.DialProxy)):
+		return "DialProxy"
+	case !sameFunc(unsafe.Pointer(&old.NewRequest), unsafe.Pointer(&updated.NewRequest)):
+		return "NewRequest"
+	case old.Frontends != updated.Frontends:
+		return "Frontends"
+	case old.DialRetries != updated.DialRetries:
+		return "DialRetries"
+	case old.DialRetryBackoff != updated.DialRetryBackoff:
+		return "DialRetryBackoff"
+	case old.PathTemplate != updated.PathTemplate:
+		return "PathTemplate"
+	case old.MaxIdleTime != updated.MaxIdleTime:
+		return "MaxIdleTime"
+	case old.ProgressTimeout != updated.ProgressTimeout:
+		return "ProgressTimeout"
+	case old.HeartbeatInterval != updated.HeartbeatInterval:
+		return "HeartbeatInterval"
+	case old.IdleTimeout != updated.IdleTimeout:
+		return "IdleTimeout"
+	case old.MaxInFlightRequests != updated.MaxInFlightRequests:
+		return "MaxInFlightRequests"
+	case old.WaitForUpstream != updated.WaitForUpstream:
+		return "WaitForUpstream"
+	case old.UpstreamServerName != updated.UpstreamServerName:
+		return "UpstreamServerName"
+	case old.ProbeKeepAlives != updated.ProbeKeepAlives:
+		return "ProbeKeepAlives"
+	case old.WebSocket != updated.WebSocket:
+		return "WebSocket"
+	case old.UseCookies != updated.UseCookies:
+		return "UseCookies"
+	case old.BufferRequests != updated.BufferRequests:
+		return "BufferRequests"
+	case old.MaxBufferedWriteBytes != updated.MaxBufferedWriteBytes:
+		return "MaxBufferedWriteBytes"
+	case old.MaxBufferedReadBytes != updated.MaxBufferedReadBytes:
+		return "MaxBufferedReadBytes"
+	case old.ReadBufferBytes != updated.ReadBufferBytes:
+		return "ReadBufferBytes"
+	case !bytes.Equal(old.CompressionDict, updated.CompressionDict):
+		return "CompressionDict"
+	}
+	return ""
+}
+
+// sameFunc indicates whether the function variables that a and b point to
+// hold the same function value (or are both nil). A function value is a
+// pointer to its closure, so copies of it are the same while closures of the
+// same function literal aren't, even though they share the code pointer that
+// reflect gives us.
+func sameFunc(a unsafe.Pointer, b unsafe.Pointer) bool {
+	return *(*unsafe.Pointer)(a) == *(*unsafe.Pointer)(b)
+}
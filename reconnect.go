@@ -0,0 +1,161 @@
+package enproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultReconnectInitial = 100 * time.Millisecond
+	defaultReconnectMax     = 5 * time.Second
+)
+
+// ReconnectBackoff configures how a Conn retries polls (read requests) that
+// fail because the connection to the proxy broke, e.g. when a mobile network
+// drops the connection or a CDN closes an idle keepalive connection. Instead of
+// failing the Read, the Conn dials the proxy again and polls again for the same
+// tunnel, waiting longer after each consecutive failure.
+//
+// Retrying is only lossless if the proxy still has all data that it hasn't
+// delivered, which requires it to buffer data per tunnel id until the client
+// has received it. The enproxy Proxy keeps the data that it sent in a response
+// until the client's next poll says how much of it arrived, and sends the rest
+// again. With proxies that don't, a poll whose response broke after some of
+// its data arrived isn't retried, since the rest would be lost: the Read fails
+// instead.
+type ReconnectBackoff struct {
+	// MaxTotal: how long to keep retrying after a failure before giving up
+	// and failing the Read. Zero disables retries.
+	MaxTotal time.Duration
+
+	// Initial: how long to wait before the first retry, defaults to 100
+	// milliseconds
+	Initial time.Duration
+
+	// Max: the longest wait between retries, defaults to 5 seconds. Waits
+	// double after each consecutive failure.
+	Max time.Duration
+}
+
+// pollRetrier keeps track of consecutive failed polls
+type pollRetrier struct {
+	backoff *ReconnectBackoff
+	// failingSince: when the first of the consecutive failures happened, zero
+	// if the last poll succeeded
+	failingSince time.Time
+	wait         time.Duration
+}
+
+// succeeded resets the backoff after a successful poll, returning how long
+// polls had been failing, or 0 if the previous poll succeeded too
+func (r *pollRetrier) succeeded() time.Duration {
+	if r.failingSince.IsZero() {
+		return 0
+	}
+	failing := time.Now().Sub(r.failingSince)
+	r.failingSince = time.Time{}
+	r.wait = 0
+	return failing
+}
+
+// retry decides whether to retry after the given poll failure, waiting until
+// it's time to retry. It returns false if err isn't due to a broken
+// connection, if retrying for longer would exceed MaxTotal or if closedCh
+// closes while waiting.
+func (r *pollRetrier) retry(err error, closedCh chan struct{}) bool {
+	if r.backoff.MaxTotal <= 0 || !isBrokenConnection(err) {
+		return false
+	}
+	now := time.Now()
+	if r.failingSince.IsZero() {
+		r.failingSince = now
+		r.wait = r.backoff.Initial
+		if r.wait <= 0 {
+			r.wait = defaultReconnectInitial
+		}
+	} else {
+		r.wait *= 2
+		max := r.backoff.Max
+		if max <= 0 {
+			max = defaultReconnectMax
+		}
+		if r.wait > max {
+			r.wait = max
+		}
+	}
+	if now.Add(r.wait).Sub(r.failingSince) > r.backoff.MaxTotal {
+		return false
+	}
+	log.Debugf("Poll failed with %v, retrying in %v", err, r.wait)
+	timer := time.NewTimer(r.wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-closedCh:
+		return false
+	}
+}
+
+// isBrokenConnection indicates whether err is due to a broken connection to
+// the proxy, as opposed to e.g. the proxy rejecting a request.
+func isBrokenConnection(err error) bool {
+	var netErr net.Error
+	var framingErr *FramingError
+	return errors.As(err, &netErr) ||
+		errors.As(err, &framingErr) ||
+		errors.Is(err, ErrBodyReadTimeout) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// resumeResponse prepares resp, the response to a poll, for being read after
+// received bytes of the tunnel's data arrived, by skipping any data at its
+// start that already arrived. It returns whether the proxy keeps the data of
+// resp until the next poll confirms that it arrived, so that a poll whose
+// response broke can be retried even after some of its data arrived (see
+// X_ENPROXY_OFFSET).
+func resumeResponse(resp *http.Response, received int64) (bool, error) {
+	value := resp.Header.Get(X_ENPROXY_OFFSET)
+	if value == "" {
+		return false, nil
+	}
+	offset, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || offset < 0 {
+		return false, fmt.Errorf("Invalid offset %q in header %s", value, X_ENPROXY_OFFSET)
+	}
+	if offset > received {
+		return false, fmt.Errorf("Response starts at byte %d of the tunnel's data, but only %d bytes arrived", offset, received)
+	}
+	if offset < received {
+		resp.Body = &resentBody{resp.Body, received - offset}
+	}
+	return true, nil
+}
+
+// resentBody is a response body that starts with skip bytes that already
+// arrived in an earlier response, which it discards.
+type resentBody struct {
+	io.ReadCloser
+	skip int64
+}
+
+func (b *resentBody) Read(p []byte) (int, error) {
+	for b.skip > 0 {
+		discard := p
+		if int64(len(discard)) > b.skip {
+			discard = discard[:b.skip]
+		}
+		n, err := b.ReadCloser.Read(discard)
+		b.skip -= int64(n)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return b.ReadCloser.Read(p)
+}
@@ -0,0 +1,31 @@
+package enproxy
+
+import (
+	"net/http"
+)
+
+// initEstablishment records the headers with which this conn's requests
+// establish its tunnel on the proxy, which are sent until the first response
+// and replayed by reEstablish.
+func (c *conn) initEstablishment() {
+	c.establishment = make(http.Header)
+	setVersionHeaders(c.establishment)
+	if c.config.UpstreamServerName != "" {
+		c.establishment.Set(X_ENPROXY_SNI, c.config.UpstreamServerName)
+	}
+}
+
+// reEstablish replays the establishment of this conn's tunnel on a request
+// sent on a new connection to the proxy, so that a proxy that doesn't know the
+// tunnel can tell it from a new one (see Config.ReplayEstablishment).
+func (c *conn) reEstablish(header http.Header) {
+	copyHeaders(header, c.establishment)
+	header.Set(X_ENPROXY_REESTABLISH, "true")
+}
+
+// copyHeaders sets the headers in from on to
+func copyHeaders(to http.Header, from http.Header) {
+	for key, values := range from {
+		to[key] = append([]string(nil), values...)
+	}
+}
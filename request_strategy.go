@@ -3,12 +3,59 @@ package enproxy
 import (
 	"bytes"
 	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
 )
 
 // request is an outgoing request to the upstream proxy
 type request struct {
 	body   io.ReadCloser
 	length int
+
+	// seq: the request's position among the Conn's write requests, starting
+	// at 1. The proxy uses it to write request bodies to the destination
+	// server in order and exactly once, even if requests are resent or arrive
+	// out of order.
+	seq int64
+
+	// eof: whether this request tells the proxy that we're done writing
+	// (see Conn.CloseWrite)
+	eof bool
+}
+
+// rewind rewinds the body of this request so that it can be sent again,
+// returning false if that's not possible.
+func (r *request) rewind() bool {
+	if r == nil {
+		// Requests without a body can always be resent
+		return true
+	}
+	if c, ok := r.body.(*closer); ok {
+		if seeker, ok := c.Reader.(io.Seeker); ok {
+			_, err := seeker.Seek(0, io.SeekStart)
+			return err == nil
+		}
+	}
+	return false
+}
+
+// recordMaxBodyBytes remembers the limit on request bodies that the proxy
+// announced in a response, if any (see Proxy.MaxRequestBodyBytes).
+func (c *conn) recordMaxBodyBytes(header http.Header) {
+	if limit, err := strconv.ParseInt(header.Get(X_ENPROXY_MAX_BODY_BYTES), 10, 64); err == nil && limit > 0 {
+		atomic.StoreInt64(&c.proxyMaxBodyBytes, limit)
+	}
+}
+
+// maxBodyBytes returns the most bytes that a request body may carry according
+// to max (unlimited if 0) and the proxy's limit.
+func (c *conn) maxBodyBytes(max int) int {
+	limit := int(atomic.LoadInt64(&c.proxyMaxBodyBytes))
+	if limit > 0 && (max <= 0 || limit < max) {
+		return limit
+	}
+	return max
 }
 
 // requestStrategy encapsulates a strategy for making requests upstream (either
@@ -17,6 +64,10 @@ type requestStrategy interface {
 	write(b []byte) (int, error)
 
 	finishBody() error
+
+	// closeWrite finishes the current body and then tells the proxy that
+	// we're done writing, waiting for it to take note
+	closeWrite() error
 }
 
 // bufferingRequestStrategy is an implementation of requestStrategy that buffers
@@ -32,18 +83,32 @@ type bufferingRequestStrategy struct {
 type streamingRequestStrategy struct {
 	c      *conn
 	writer *io.PipeWriter
+	// bodyBytes: how much data has been written to writer
+	bodyBytes int
+	// finished: closed once the most recent streamed request has finished
+	finished chan struct{}
+	// pending: with PreferContentLength, the first write of a request body,
+	// held back to see whether it's the only one
+	pending []byte
 }
 
 // Writes the given buffer to the upstream proxy encapsulated in an HTTP
-// request. If b is bigger than bodySize (65K), then this will result in
-// multiple POST requests.
+// request. If b is bigger than MaxBufferedWriteBytes (by default 65K), then
+// this will result in multiple POST requests.
 func (brs *bufferingRequestStrategy) write(b []byte) (int, error) {
 	// Consume writes as long as they keep coming in
 	bytesWritten := 0
+	maxBodySize := brs.c.maxBodyBytes(brs.c.getConfig().MaxBufferedWriteBytes)
+
+	if brs.currentBody == nil {
+		// Initialize the body even for empty writes so that finishBody sends
+		// a request
+		brs.initBody()
+	}
 
 	// Copy from b into outbound body
 	for {
-		bytesRemaining := bodySize - brs.currentBytesWritten
+		bytesRemaining := maxBodySize - brs.currentBytesWritten
 		bytesToCopy := len(b)
 		if bytesToCopy == 0 {
 			break
@@ -57,6 +122,7 @@ func (brs *bufferingRequestStrategy) write(b []byte) (int, error) {
 				copy(dst, b)
 				brs.currentBytesWritten = brs.currentBytesWritten + bytesToCopy
 				bytesWritten = bytesWritten + bytesToCopy
+				atomic.AddInt64(&brs.c.bufferedWriteBytes, int64(bytesToCopy))
 				break
 			} else {
 				// Copy as much as we can from the buffer to the destination
@@ -65,6 +131,7 @@ func (brs *bufferingRequestStrategy) write(b []byte) (int, error) {
 				b = b[bytesRemaining:]
 				brs.currentBytesWritten = brs.currentBytesWritten + bytesRemaining
 				bytesWritten = bytesWritten + bytesRemaining
+				atomic.AddInt64(&brs.c.bufferedWriteBytes, int64(bytesRemaining))
 				// Write the body
 				err := brs.finishBody()
 				if err != nil {
@@ -74,7 +141,7 @@ func (brs *bufferingRequestStrategy) write(b []byte) (int, error) {
 		}
 	}
 
-	if bodySize == brs.currentBytesWritten {
+	if maxBodySize == brs.currentBytesWritten {
 		// We've filled the body, write it
 		err := brs.finishBody()
 		if err != nil {
@@ -88,6 +155,50 @@ func (brs *bufferingRequestStrategy) write(b []byte) (int, error) {
 // Writes the given buffer to the upstream proxy encapsulated in an HTTP
 // request.
 func (srs *streamingRequestStrategy) write(b []byte) (int, error) {
+	if srs.c.getConfig().PreferContentLength && srs.writer == nil {
+		if srs.pending == nil && len(b) <= srs.c.maxBodyBytes(srs.c.getConfig().MaxBufferedWriteBytes) {
+			// Hold on to the write in case the body ends up being just this
+			srs.pending = append(make([]byte, 0, len(b)), b...)
+			atomic.AddInt64(&srs.c.bufferedWriteBytes, int64(len(b)))
+			return len(b), nil
+		}
+		if srs.pending != nil {
+			// More writes are coming in, stream the body after all
+			pending := srs.pending
+			srs.pending = nil
+			atomic.AddInt64(&srs.c.bufferedWriteBytes, -int64(len(pending)))
+			if _, err := srs.streamingWrite(pending); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return srs.streamingWrite(b)
+}
+
+// streamingWrite writes b to streamed request bodies, finishing them before
+// they exceed the proxy's limit.
+func (srs *streamingRequestStrategy) streamingWrite(b []byte) (int, error) {
+	written := 0
+	for limit := srs.c.maxBodyBytes(0); limit > 0 && srs.bodyBytes+len(b) > limit; {
+		if room := limit - srs.bodyBytes; room > 0 {
+			n, err := srs.writeToBody(b[:room])
+			written += n
+			if err != nil {
+				return written, err
+			}
+			b = b[room:]
+		}
+		if err := srs.finishBody(); err != nil {
+			return written, err
+		}
+	}
+	n, err := srs.writeToBody(b)
+	return written + n, err
+}
+
+// writeToBody writes b to the current streamed request body, starting a new
+// request if necessary.
+func (srs *streamingRequestStrategy) writeToBody(b []byte) (int, error) {
 	if srs.writer == nil {
 		// Lazily initialize our next request to the proxy
 		// Construct a pipe for piping data to proxy
@@ -104,11 +215,21 @@ func (srs *streamingRequestStrategy) write(b []byte) (int, error) {
 			return 0, io.EOF
 		}
 		decrement(&writingSubmittingRequest)
+		// Requests finish in the order in which they were submitted, so
+		// wait for the previous request's turn to receive from
+		// requestFinishedCh to pass
+		previousFinished := srs.finished
+		finished := make(chan struct{})
+		srs.finished = finished
 		go func() {
+			defer close(finished)
+			if previousFinished != nil {
+				<-previousFinished
+			}
 			// Drain the requestFinishedCh
 			err := <-srs.c.requestFinishedCh
 			if err := writer.Close(); err != nil {
-				log.Debugf("Unable to close writer: %v", err)
+				srs.c.logger().Debugf("Unable to close writer: %v", err)
 			}
 			if err != nil && err != io.EOF {
 				srs.c.fail(err)
@@ -118,11 +239,13 @@ func (srs *streamingRequestStrategy) write(b []byte) (int, error) {
 
 	increment(&writingDoingWrite)
 	defer decrement(&writingDoingWrite)
-	return srs.writer.Write(b)
+	n, err := srs.writer.Write(b)
+	srs.bodyBytes += n
+	return n, err
 }
 
 func (brs *bufferingRequestStrategy) initBody() {
-	brs.currentBody = make([]byte, bodySize)
+	brs.currentBody = make([]byte, brs.c.getConfig().MaxBufferedWriteBytes)
 	brs.currentBytesWritten = 0
 }
 
@@ -139,14 +262,17 @@ func (brs *bufferingRequestStrategy) finishBody() error {
 		body:   &closer{bytes.NewReader(body)},
 		length: brs.currentBytesWritten, // forces identity encoding
 	})
+	var err error
 	if success {
-		err := <-brs.c.requestFinishedCh
-		if err != nil {
-			return err
-		}
+		err = <-brs.c.requestFinishedCh
 	}
+	// Once the request has finished, its body is no longer buffered
+	atomic.AddInt64(&brs.c.bufferedWriteBytes, -int64(brs.currentBytesWritten))
 	brs.currentBody = nil
 	brs.currentBytesWritten = 0
+	if err != nil {
+		return err
+	}
 	if !success {
 		return io.EOF
 	}
@@ -155,15 +281,64 @@ func (brs *bufferingRequestStrategy) finishBody() error {
 }
 
 func (srs *streamingRequestStrategy) finishBody() error {
+	if srs.pending != nil {
+		return srs.sendPending()
+	}
 	if srs.writer == nil {
 		return nil
 	}
 
 	if err := srs.writer.Close(); err != nil {
-		log.Debugf("Unable to close writer: %v", err)
+		srs.c.logger().Debugf("Unable to close writer: %v", err)
 	}
 	srs.writer = nil
+	srs.bodyBytes = 0
 	decrement(&writePipeOpen)
 
 	return nil
 }
+
+// sendPending sends the pending write as a request body with a Content-Length
+// and waits for the request to finish.
+func (srs *streamingRequestStrategy) sendPending() error {
+	pending := srs.pending
+	srs.pending = nil
+	if srs.finished != nil {
+		// Don't take the finish of a streamed request for ours
+		<-srs.finished
+	}
+	success := srs.c.submitRequest(&request{
+		body:   &closer{bytes.NewReader(pending)},
+		length: len(pending), // forces identity encoding
+	})
+	var err error
+	if success {
+		err = <-srs.c.requestFinishedCh
+	}
+	atomic.AddInt64(&srs.c.bufferedWriteBytes, -int64(len(pending)))
+	if err != nil {
+		return err
+	}
+	if !success {
+		return io.EOF
+	}
+	return nil
+}
+
+func (brs *bufferingRequestStrategy) closeWrite() error {
+	if err := brs.finishBody(); err != nil {
+		return err
+	}
+	return brs.c.sendWriteEOF()
+}
+
+func (srs *streamingRequestStrategy) closeWrite() error {
+	if err := srs.finishBody(); err != nil {
+		return err
+	}
+	if srs.finished != nil {
+		// Don't take the finish of a streamed request for ours
+		<-srs.finished
+	}
+	return srs.c.sendWriteEOF()
+}
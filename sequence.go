@@ -0,0 +1,217 @@
+package enproxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	errReorderBufferFull = errors.New("Too many bytes of write requests arrived out of order")
+)
+
+// seqOf returns the sequence number of the write request req, if it has one.
+// Requests from clients that don't number their write requests are written to
+// the destination server in the order in which they arrive.
+func seqOf(req *http.Request) (int64, bool, error) {
+	value := req.Header.Get(X_ENPROXY_SEQ)
+	if value == "" {
+		return 0, false, nil
+	}
+	seq, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seq < 1 {
+		return 0, false, fmt.Errorf("Invalid sequence number %q in header %s", value, X_ENPROXY_SEQ)
+	}
+	return seq, true, nil
+}
+
+// copyInOrder copies body, the body of the write request with sequence number
+// seq, to connOut in sequence order. Bodies of requests that we've already
+// written (i.e. resent requests) are discarded. Bodies of requests that arrive
+// before their turn are buffered, up to the Proxy's MaxReorderBytes, and
+// written once the requests before them have been written. If eof is set, the
+// client is done writing once this body has been written. Like
+// copyToUpstream, this returns the connection to the destination server, which
+// changes when reconnecting.
+func (p *Proxy) copyInOrder(lc *lazyConn, connOut net.Conn, seq int64, body io.Reader, eof bool) (int64, net.Conn, error) {
+	lc.seqMutex.Lock()
+	defer lc.seqMutex.Unlock()
+
+	if lc.nextSeq == 0 {
+		// First write on this tunnel. Since clients wait for the response to
+		// each write request before sending the next one, this is the first
+		// request that the client has sent for the tunnel, unless we dropped
+		// an earlier tunnel with the same id (e.g. because it idled), in which
+		// case we start over like we do without sequence numbers.
+		lc.nextSeq = seq
+	}
+
+	_, pending := lc.pendingBodies[seq]
+	if seq < lc.nextSeq || pending {
+		log.Debugf("Discarding duplicate write request %d for %v", seq, lc.addr)
+		_, err := io.Copy(ioutil.Discard, body)
+		return 0, connOut, err
+	}
+
+	if seq > lc.nextSeq {
+		available := p.MaxReorderBytes - lc.pendingBytes
+		b, err := ioutil.ReadAll(io.LimitReader(body, int64(available)+1))
+		if err != nil {
+			return 0, connOut, err
+		}
+		if len(b) > available {
+			return 0, connOut, errReorderBufferFull
+		}
+		if lc.pendingBodies == nil {
+			lc.pendingBodies = make(map[int64][]byte)
+		}
+		lc.pendingBodies[seq] = b
+		lc.pendingBytes += len(b)
+		if eof {
+			lc.eofSeq = seq
+		}
+		return 0, connOut, nil
+	}
+
+	n, connOut, err := p.copyToUpstream(lc, connOut, body)
+	if err != nil && err != io.EOF {
+		return n, connOut, err
+	}
+	if eof {
+		lc.closeWrite()
+	}
+	lc.nextSeq++
+	for {
+		b, found := lc.pendingBodies[lc.nextSeq]
+		if !found {
+			return n, connOut, nil
+		}
+		delete(lc.pendingBodies, lc.nextSeq)
+		lc.pendingBytes -= len(b)
+		var m int64
+		m, connOut, err = p.copyToUpstream(lc, connOut, bytes.NewReader(b))
+		n += m
+		if err != nil {
+			return n, connOut, err
+		}
+		if lc.nextSeq == lc.eofSeq {
+			lc.closeWrite()
+		}
+		lc.nextSeq++
+	}
+}
+
+// responseReorderer puts the responses to a Conn's polls in the order in which
+// the Proxy numbered them (see X_ENPROXY_SEQ), like copyInOrder does for write
+// requests. Proxies that don't number their responses have them read in the
+// order in which they arrive (see Config.MaxReorderBytes).
+type responseReorderer struct {
+	c *conn
+
+	// nextSeq is the sequence number of the next response to read, 0 until
+	// the first numbered one arrives
+	nextSeq      int64
+	pending      map[int64]heldResponse
+	pendingBytes int
+	// waitingSince: when the first of the pending responses arrived
+	waitingSince time.Time
+}
+
+// order returns resp if it's its turn to be read. Otherwise it returns nil,
+// having discarded resp if it's a duplicate or held it for take if it arrived
+// ahead of its turn, whose body it reads in full.
+func (r *responseReorderer) order(resp *http.Response) (*http.Response, error) {
+	value := resp.Header.Get(X_ENPROXY_SEQ)
+	if value == "" {
+		return resp, nil
+	}
+	seq, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seq < 1 {
+		return nil, fmt.Errorf("Invalid sequence number %q in header %s", value, X_ENPROXY_SEQ)
+	}
+
+	if r.nextSeq == 0 || seq == 1 {
+		// First response of the tunnel, which starts over if the proxy lost
+		// it (see Config.ReplayEstablishment)
+		r.nextSeq = seq
+		r.pending = nil
+		r.pendingBytes = 0
+	}
+
+	_, pending := r.pending[seq]
+	if seq < r.nextSeq || pending {
+		r.c.logger().Debugf("Discarding duplicate response %d for %v", seq, r.c.addr)
+		if err := resp.Body.Close(); err != nil {
+			r.c.logger().Debugf("Unable to close response body: %v", err)
+		}
+		return nil, nil
+	}
+
+	if seq == r.nextSeq {
+		r.nextSeq++
+		return resp, nil
+	}
+
+	config := r.c.getConfig()
+	maxBytes := config.MaxReorderBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxReorderBytes
+	}
+	timeout := config.ReorderTimeout
+	if timeout <= 0 {
+		timeout = defaultReorderTimeout
+	}
+	available := maxBytes - r.pendingBytes
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, int64(available)+1))
+	if closeErr := resp.Body.Close(); closeErr != nil {
+		r.c.logger().Debugf("Unable to close response body: %v", closeErr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > available {
+		return nil, fmt.Errorf("%w: %d, more than %d bytes arrived after it", ErrResponseLost, r.nextSeq, maxBytes)
+	}
+	if len(r.pending) == 0 {
+		r.waitingSince = time.Now()
+	} else if time.Now().Sub(r.waitingSince) > timeout {
+		return nil, fmt.Errorf("%w: %d, still missing after %v", ErrResponseLost, r.nextSeq, timeout)
+	}
+	if r.pending == nil {
+		r.pending = make(map[int64]heldResponse)
+	}
+	r.pending[seq] = heldResponse{resp, b}
+	r.pendingBytes += len(b)
+	return nil, nil
+}
+
+// take returns the next response to read if it was held by order, or nil.
+func (r *responseReorderer) take() *http.Response {
+	held, found := r.pending[r.nextSeq]
+	if !found {
+		return nil
+	}
+	delete(r.pending, r.nextSeq)
+	r.pendingBytes -= len(held.body)
+	r.nextSeq++
+	if len(r.pending) > 0 {
+		// The rest wait for the next one that's missing
+		r.waitingSince = time.Now()
+	}
+	// The trailers were read along with the body
+	resp := *held.resp
+	resp.Body = ioutil.NopCloser(bytes.NewReader(held.body))
+	return &resp
+}
+
+// heldResponse: a response held by responseReorderer, with its body
+type heldResponse struct {
+	resp *http.Response
+	body []byte
+}
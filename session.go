@@ -0,0 +1,90 @@
+package enproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+)
+
+// SessionState is the minimal state of a Conn's tunnel needed to resume it,
+// for example after the client process restarts. It can be persisted using
+// MarshalBinary and restored using UnmarshalBinary.
+type SessionState struct {
+	// ID: the tunnel's id, which the Proxy uses to find the tunnel's
+	// connection to the destination server
+	ID string `json:"id"`
+
+	// Addr: the host:port of the destination server
+	Addr string `json:"addr"`
+
+	// BytesWritten: total bytes written to the tunnel so far
+	BytesWritten int64 `json:"bytesWritten"`
+
+	// BytesRead: total bytes read from the tunnel so far
+	BytesRead int64 `json:"bytesRead"`
+
+	// WriteSeq: the sequence number of the last write request sent for the
+	// tunnel, from which the resumed Conn continues numbering
+	WriteSeq int64 `json:"writeSeq,omitempty"`
+}
+
+// MarshalBinary implements the encoding.BinaryMarshaler interface
+func (s *SessionState) MarshalBinary() ([]byte, error) {
+	return json.Marshal(s)
+}
+
+// UnmarshalBinary implements the encoding.BinaryUnmarshaler interface
+func (s *SessionState) UnmarshalBinary(data []byte) error {
+	if err := json.Unmarshal(data, s); err != nil {
+		return fmt.Errorf("Unable to unmarshal session state: %v", err)
+	}
+	if s.ID == "" || s.Addr == "" {
+		return fmt.Errorf("Session state is missing id or addr")
+	}
+	return nil
+}
+
+// SessionState() implements the function from Conn
+func (c *conn) SessionState() *SessionState {
+	return &SessionState{
+		ID:           c.id,
+		Addr:         c.addr,
+		BytesWritten: atomic.LoadInt64(&c.bytesWritten),
+		BytesRead:    atomic.LoadInt64(&c.bytesRead),
+		WriteSeq:     atomic.LoadInt64(&c.writeSeq),
+	}
+}
+
+// File() implements the function from Conn
+func (c *conn) File() (*os.File, error) {
+	return nil, ErrNotSupported
+}
+
+// ResumeConn creates a Conn that continues the tunnel described by state,
+// polling the proxy using the same id as the Conn from which state was taken.
+// That Conn must no longer be in use.
+//
+// Resuming only works while the Proxy still holds the tunnel's connection to
+// the destination server, which it does until the connection has been idle for
+// the Proxy's IdleTimeout. If the Proxy no longer has the tunnel, it refuses to
+// start a new one and the first Read or Write on the returned Conn fails.
+//
+// Resumption continues the connection to the destination server, it doesn't
+// make delivery reliable: data that was in flight between the proxy and the
+// old Conn at the time that it stopped is lost.
+func ResumeConn(state *SessionState, config *Config) (net.Conn, error) {
+	c := &conn{
+		id:                  state.ID,
+		addr:                state.Addr,
+		config:              config,
+		resumed:             true,
+		bytesWritten:        state.BytesWritten,
+		bytesRead:           state.BytesRead,
+		writeSeq:            state.WriteSeq,
+		initialBytesWritten: state.BytesWritten,
+		initialBytesRead:    state.BytesRead,
+	}
+	return c.start()
+}
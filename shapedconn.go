@@ -0,0 +1,109 @@
+package enproxy
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// RateLimits are the bandwidth limits for a tunnel, in bytes per second. Zero
+// means no limit.
+type RateLimits struct {
+	// Upstream: limit on data from the client to the destination server
+	Upstream int
+
+	// Downstream: limit on data from the destination server to the client
+	Downstream int
+}
+
+// tokenBucket limits throughput to rate bytes per second, allowing bursts of up
+// to one second's worth of data.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+	mutex  sync.Mutex
+}
+
+func newTokenBucket(rate int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// maxBytes limits n to the size of the largest burst
+func (b *tokenBucket) maxBytes(n int) int {
+	if n > int(b.rate) {
+		return int(b.rate)
+	}
+	return n
+}
+
+// take takes n tokens, returning how long to wait until they've been earned
+func (b *tokenBucket) take(n int) time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// wait waits until n bytes may pass
+func (b *tokenBucket) wait(n int) {
+	if wait := b.take(n); wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// shapedConn is a net.Conn whose writes and reads are limited by token
+// buckets. Either bucket may be nil for no limit.
+type shapedConn struct {
+	net.Conn
+	writeBucket *tokenBucket
+	readBucket  *tokenBucket
+}
+
+// Write() implements the function from net.Conn
+func (c *shapedConn) Write(b []byte) (int, error) {
+	if c.writeBucket == nil {
+		return c.Conn.Write(b)
+	}
+	written := 0
+	for written < len(b) {
+		chunk := b[written:]
+		chunk = chunk[:c.writeBucket.maxBytes(len(chunk))]
+		c.writeBucket.wait(len(chunk))
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Read() implements the function from net.Conn. Data that was read is held
+// back until the tokens it used have been earned.
+func (c *shapedConn) Read(b []byte) (int, error) {
+	if c.readBucket == nil {
+		return c.Conn.Read(b)
+	}
+	n, err := c.Conn.Read(b[:c.readBucket.maxBytes(len(b))])
+	if n > 0 {
+		c.readBucket.wait(n)
+	}
+	return n, err
+}
@@ -0,0 +1,260 @@
+package enproxy
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// bufferingThreshold: read responses whose headers take at least this long
+	// to arrive are checked for having been buffered by an intermediary. The
+	// Proxy sends headers right away, so this only happens when an
+	// intermediary holds back the response or when the network is very slow.
+	bufferingThreshold = 250 * time.Millisecond
+
+	// defaultBufferedMaxResponseBytes: the MaxResponseBytes used while
+	// responses are being buffered, if MaxResponseBytes isn't configured
+	defaultBufferedMaxResponseBytes = 65536
+
+	// rttSmoothing: each poll's round-trip time makes up 1/rttSmoothing of
+	// the moving average returned by RTT, like the smoothed RTT of TCP
+	rttSmoothing = 8
+)
+
+// Stats are statistics about a Conn
+type Stats struct {
+	// TimeToFirstByte: how long it took to receive the response headers for
+	// the most recent request to the proxy
+	TimeToFirstByte time.Duration
+
+	// BufferedResponses: number of read responses that arrived all at once
+	// after a delay, indicating that an intermediary buffered them
+	BufferedResponses int64
+
+	// StreamedResponses: number of read responses that took a while but were
+	// streamed, indicating that intermediaries don't buffer responses
+	StreamedResponses int64
+
+	// BufferingDetected: whether the most recent delayed response was
+	// buffered. While this is true, the proxy is asked to keep responses
+	// smaller (see Config.MaxResponseBytes) so that data isn't held back for
+	// long.
+	BufferingDetected bool
+
+	// ReadsFromBuffer: number of Reads that were served from data that had
+	// already arrived or from a response that was already open, without a new
+	// request to the proxy
+	ReadsFromBuffer int64
+
+	// ReadsRequiringPoll: number of Reads that had to wait for a new request
+	// to the proxy. Together with ReadsFromBuffer, this shows how much of a
+	// workload's read latency comes from polling.
+	ReadsRequiringPoll int64
+
+	// Requests: number of requests sent to the proxy, including polls (see
+	// Config.MaxRequests)
+	Requests int64
+
+	// WriteRequests and ReadRequests: number of requests that carried
+	// written data to the proxy and that polled the proxy for data to read
+	WriteRequests int64
+	ReadRequests  int64
+
+	// BytesPerRequest: how many bytes were written and read per request to
+	// the proxy. A low value means that most requests carry little or no data,
+	// which suggests tuning the polling (see PollScheduler) of this workload.
+	// BytesPerWriteRequest and BytesPerReadRequest break this down by
+	// direction. All are 0 until there has been a request of the kind.
+	BytesPerRequest      float64
+	BytesPerWriteRequest float64
+	BytesPerReadRequest  float64
+
+	// WritesBlocked: number of Writes that had to wait because the Conn was
+	// still busy sending earlier data to the proxy, and WriteBlockedTime: the
+	// total time they waited. If these grow, the tunnel rather than the
+	// application is the bottleneck for writes. Together with BufferedBytes,
+	// this shows where written data is held up.
+	WritesBlocked    int64
+	WriteBlockedTime time.Duration
+
+	// WebSocket: whether the Conn's data is carried by a WebSocket instead of
+	// requests (see Config.WebSocket)
+	WebSocket bool
+
+	// KeepAlivesDisabled: whether each request to the proxy goes on a new
+	// connection, because of Config.DisableKeepAlives or because
+	// Config.ProbeKeepAlives found that the proxy needs it
+	KeepAlivesDisabled bool
+
+	// ProxyVersion: the protocol version that the proxy announced (see
+	// PROTOCOL_VERSION), 0 until the first response from the proxy and for
+	// proxies from before versioning
+	ProxyVersion int
+
+	// Tag: the Conn's tag (see Config.Tag)
+	Tag string
+
+	// EstablishTime: how long it took from when the Conn started dialing the
+	// proxy until its tunnel was established, i.e. until the proxy had
+	// connected to the destination server, including any retries and
+	// fallbacks along the way. ProxyDialTime is the part of it that it took
+	// to get the first connection to the proxy (e.g. a slow front-end), the
+	// rest is mostly up to the proxy connecting to the destination server.
+	// EstablishTime is 0 until the tunnel has been established. Neither
+	// includes time spent waiting for Dialer.MaxConcurrentDials.
+	EstablishTime time.Duration
+	ProxyDialTime time.Duration
+
+	// DroppedEvents: number of events that couldn't be sent to
+	// Config.Events because the channel was full
+	DroppedEvents int64
+
+	// PollInterval and IdleInterval: the Conn's current poll and write idle
+	// intervals (see Conn.CurrentPollInterval and Conn.CurrentIdleInterval)
+	PollInterval time.Duration
+	IdleInterval time.Duration
+}
+
+// Stats() implements the function from Conn
+func (c *conn) Stats() Stats {
+	bytesWritten := atomic.LoadInt64(&c.bytesWritten) - c.initialBytesWritten
+	bytesRead := atomic.LoadInt64(&c.bytesRead) - c.initialBytesRead
+	requests := atomic.LoadInt64(&c.requests)
+	writeRequests := atomic.LoadInt64(&c.writeRequests)
+	readRequests := atomic.LoadInt64(&c.readRequests)
+	return Stats{
+		TimeToFirstByte:      time.Duration(atomic.LoadInt64(&c.timeToFirstByte)),
+		BufferedResponses:    atomic.LoadInt64(&c.bufferedResponses),
+		StreamedResponses:    atomic.LoadInt64(&c.streamedResponses),
+		BufferingDetected:    atomic.LoadInt32(&c.bufferingDetected) == 1,
+		ReadsFromBuffer:      atomic.LoadInt64(&c.readsFromBuffer),
+		ReadsRequiringPoll:   atomic.LoadInt64(&c.readsRequiringPoll),
+		Requests:             requests,
+		WriteRequests:        writeRequests,
+		ReadRequests:         readRequests,
+		BytesPerRequest:      perRequest(bytesWritten+bytesRead, requests),
+		BytesPerWriteRequest: perRequest(bytesWritten, writeRequests),
+		BytesPerReadRequest:  perRequest(bytesRead, readRequests),
+		WritesBlocked:        atomic.LoadInt64(&c.writesBlocked),
+		WriteBlockedTime:     time.Duration(atomic.LoadInt64(&c.writeBlockedTime)),
+		WebSocket:            c.ws != nil,
+		KeepAlivesDisabled:   c.keepAlivesDisabled(),
+		ProxyVersion:         int(atomic.LoadInt32(&c.proxyVersion)),
+		Tag:                  c.getConfig().Tag,
+		EstablishTime:        time.Duration(atomic.LoadInt64(&c.establishTime)),
+		ProxyDialTime:        c.proxyDialTime,
+		DroppedEvents:        atomic.LoadInt64(&c.droppedEvents),
+		PollInterval:         c.CurrentPollInterval(),
+		IdleInterval:         c.CurrentIdleInterval(),
+	}
+}
+
+// perRequest returns bytes divided by requests, or 0 if there were no requests
+func perRequest(bytes int64, requests int64) float64 {
+	if requests == 0 {
+		return 0
+	}
+	return float64(bytes) / float64(requests)
+}
+
+// countRequest counts a request for op that's about to be sent to the proxy
+// and records when it was sent for KeepAliveInterval. If that
+// would exceed MaxRequests, the request isn't counted and the conn fails with
+// ErrRequestQuotaExceeded instead.
+func (c *conn) countRequest(op string) error {
+	requests := atomic.AddInt64(&c.requests, 1)
+	if c.getConfig().MaxRequests > 0 && requests > int64(c.getConfig().MaxRequests) {
+		atomic.AddInt64(&c.requests, -1)
+		c.fail(ErrRequestQuotaExceeded)
+		return ErrRequestQuotaExceeded
+	}
+	switch op {
+	case OP_WRITE:
+		atomic.AddInt64(&c.writeRequests, 1)
+	case OP_READ:
+		atomic.AddInt64(&c.readRequests, 1)
+		c.emit(Event{Type: PollIssued})
+	}
+	atomic.StoreInt64(&c.lastRequest, time.Now().UnixNano())
+	return nil
+}
+
+// recordResponse records the time to first byte of the given response and, for
+// read responses, whether it appears to have been buffered by an intermediary.
+func (c *conn) recordResponse(op string, resp *http.Response, timeToFirstByte time.Duration) {
+	atomic.StoreInt64(&c.timeToFirstByte, int64(timeToFirstByte))
+	if op != OP_READ {
+		return
+	}
+	atomic.StoreInt64(&c.readTimeToFirstByte, int64(timeToFirstByte))
+	c.recordRTT(timeToFirstByte)
+	if timeToFirstByte < bufferingThreshold {
+		return
+	}
+	// The Proxy streams read responses, so delayed responses with a known
+	// length were assembled by someone else.
+	if resp.ContentLength > 0 {
+		atomic.AddInt64(&c.bufferedResponses, 1)
+		atomic.StoreInt32(&c.bufferingDetected, 1)
+	} else if resp.ContentLength < 0 {
+		atomic.AddInt64(&c.streamedResponses, 1)
+		atomic.StoreInt32(&c.bufferingDetected, 0)
+	}
+}
+
+// recordRTT adds the round-trip time of a poll to the moving average
+func (c *conn) recordRTT(rtt time.Duration) {
+	for {
+		old := atomic.LoadInt64(&c.rtt)
+		updated := int64(rtt)
+		if old > 0 {
+			updated = old + (int64(rtt)-old)/rttSmoothing
+		}
+		if atomic.CompareAndSwapInt64(&c.rtt, old, updated) {
+			return
+		}
+	}
+}
+
+// RTT() implements the function from Conn
+func (c *conn) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.rtt))
+}
+
+// CurrentPollInterval() implements the function from Conn
+func (c *conn) CurrentPollInterval() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.pollInterval))
+}
+
+// CurrentIdleInterval() implements the function from Conn
+func (c *conn) CurrentIdleInterval() time.Duration {
+	if c.ws != nil {
+		return 0
+	}
+	return c.getConfig().FlushTimeout
+}
+
+// maxResponseBytes returns the maximum response size to request from the
+// proxy, or 0 for no limit.
+func (c *conn) maxResponseBytes() int {
+	if atomic.LoadInt32(&c.bufferingDetected) == 1 && c.getConfig().MaxResponseBytes == 0 {
+		return defaultBufferedMaxResponseBytes
+	}
+	return c.getConfig().MaxResponseBytes
+}
+
+// receiveWindow returns the window to advertise to the proxy based on
+// ReceiveWindow, or 0 if there's no window.
+func (c *conn) receiveWindow() int {
+	if c.getConfig().ReceiveWindow <= 0 {
+		return 0
+	}
+	_, unread := c.BufferedBytes()
+	window := c.getConfig().ReceiveWindow - unread
+	if window < 1 {
+		// Always let the proxy make some progress
+		window = 1
+	}
+	return window
+}
@@ -0,0 +1,57 @@
+package enproxy
+
+import (
+	"fmt"
+
+	"github.com/getlantern/golog"
+)
+
+// taggedLogger is a golog.Logger that starts messages with a Conn's tag (see
+// Config.Tag)
+type taggedLogger struct {
+	golog.Logger
+	prefix string
+}
+
+func (l *taggedLogger) Debug(arg interface{}) {
+	l.Logger.Debug(l.prefix + fmt.Sprint(arg))
+}
+
+func (l *taggedLogger) Debugf(msg string, args ...interface{}) {
+	l.Logger.Debugf(l.prefix+msg, args...)
+}
+
+func (l *taggedLogger) Error(arg interface{}) {
+	l.Logger.Error(l.prefix + fmt.Sprint(arg))
+}
+
+func (l *taggedLogger) Errorf(msg string, args ...interface{}) {
+	l.Logger.Errorf(l.prefix+msg, args...)
+}
+
+func (l *taggedLogger) Trace(arg interface{}) {
+	l.Logger.Trace(l.prefix + fmt.Sprint(arg))
+}
+
+func (l *taggedLogger) Tracef(msg string, args ...interface{}) {
+	l.Logger.Tracef(l.prefix+msg, args...)
+}
+
+// logger returns the logger for messages about this conn, which start with its
+// tag if it has one.
+func (c *conn) logger() golog.Logger {
+	tag := c.getConfig().Tag
+	if tag == "" {
+		return log
+	}
+	return &taggedLogger{log, "[" + tag + "] "}
+}
+
+// SetTag() implements the function from Conn
+func (c *conn) SetTag(tag string) {
+	c.configMutex.Lock()
+	defer c.configMutex.Unlock()
+	config := c.config.Clone()
+	config.Tag = tag
+	c.config = config
+}
@@ -0,0 +1,95 @@
+package enproxy
+
+import (
+	"time"
+)
+
+// ClientTrace is a set of hooks that get called at various stages of the
+// requests that a Conn makes to the proxy, similar to httptrace.ClientTrace.
+// Any of the hooks may be nil. Hooks are called synchronously from the
+// goroutines that process the Conn's requests, so they should return quickly.
+// Since writes and reads use separate requests, hooks may be called
+// concurrently.
+//
+// Resolving the proxy's address and connecting to it both happen inside
+// Config.DialProxy, so they're covered by DialProxyStart and DialProxyDone.
+type ClientTrace struct {
+	// DialProxyStart is called before dialing a new connection to the proxy
+	DialProxyStart func()
+
+	// DialProxyDone is called once dialing the proxy has finished, with the
+	// error if dialing failed.
+	DialProxyDone func(err error)
+
+	// GotProxyConn is called once a connection to the proxy has been obtained
+	// for a request. reused indicates whether the connection was taken from a
+	// Dialer's idle pool instead of being dialed.
+	GotProxyConn func(reused bool)
+
+	// WroteRequest is called once the request for the given op (OP_WRITE,
+	// OP_READ or OP_CONNECT), including its body, has been written to the
+	// proxy, with the error if writing failed.
+	WroteRequest func(op string, err error)
+
+	// GotFirstResponseByte is called once the first byte of the response to
+	// the request for the given op has arrived.
+	GotFirstResponseByte func(op string)
+
+	// GotResponse is called once the headers of the response to the request
+	// for the given op have been read, with the error if reading them failed.
+	GotResponse func(op string, statusCode int, err error)
+
+	// TunnelEstablished is called once per Conn when its tunnel has been
+	// established, i.e. the proxy has connected to the destination server, or
+	// establishing it failed (with the error). latency is the time since the
+	// Conn started dialing the proxy (see Stats.EstablishTime).
+	TunnelEstablished func(latency time.Duration, err error)
+}
+
+func (t *ClientTrace) dialProxyStart() {
+	if t != nil && t.DialProxyStart != nil {
+		t.DialProxyStart()
+	}
+}
+
+func (t *ClientTrace) dialProxyDone(err error) {
+	if t != nil && t.DialProxyDone != nil {
+		t.DialProxyDone(err)
+	}
+}
+
+func (t *ClientTrace) gotProxyConn(reused bool) {
+	if t != nil && t.GotProxyConn != nil {
+		t.GotProxyConn(reused)
+	}
+}
+
+func (t *ClientTrace) wroteRequest(op string, err error) {
+	if t != nil && t.WroteRequest != nil {
+		t.WroteRequest(op, err)
+	}
+}
+
+// tracesFirstResponseByte indicates whether the first byte of responses
+// needs to be waited for separately.
+func (t *ClientTrace) tracesFirstResponseByte() bool {
+	return t != nil && t.GotFirstResponseByte != nil
+}
+
+func (t *ClientTrace) gotFirstResponseByte(op string) {
+	if t != nil && t.GotFirstResponseByte != nil {
+		t.GotFirstResponseByte(op)
+	}
+}
+
+func (t *ClientTrace) gotResponse(op string, statusCode int, err error) {
+	if t != nil && t.GotResponse != nil {
+		t.GotResponse(op, statusCode, err)
+	}
+}
+
+func (t *ClientTrace) tunnelEstablished(latency time.Duration, err error) {
+	if t != nil && t.TunnelEstablished != nil {
+		t.TunnelEstablished(latency, err)
+	}
+}
@@ -0,0 +1,91 @@
+package enproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+var (
+	errTunnelEvicted = errors.New("Tunnel evicted to make room for new tunnels")
+)
+
+// TunnelEvictionPolicy determines what a Proxy does with a new tunnel when it
+// already has MaxTunnels tunnels open.
+type TunnelEvictionPolicy int
+
+const (
+	// EvictLeastRecentlyActive: close the tunnel that has gone the longest
+	// without a request from its client to make room for the new one. This is
+	// the default.
+	EvictLeastRecentlyActive TunnelEvictionPolicy = iota
+
+	// RejectNewTunnels: keep the open tunnels and reject the new one with a
+	// 503
+	RejectNewTunnels
+)
+
+// touch marks the given tunnel as the most recently active one, for
+// EvictLeastRecentlyActive.
+func (p *Proxy) touch(l *lazyConn) {
+	if p.MaxTunnels <= 0 {
+		return
+	}
+	p.connMapMutex.Lock()
+	if l.lruElement != nil {
+		p.lru.MoveToFront(l.lruElement)
+	}
+	p.connMapMutex.Unlock()
+}
+
+// makeRoomForTunnel makes sure that there's room for one more tunnel according
+// to MaxTunnels, returning the tunnel that was removed from connMap for that, if
+// any, which the caller has to close with evict once it has released
+// connMapMutex. If the policy doesn't allow making room, it returns an error.
+// It must be called with connMapMutex held.
+func (p *Proxy) makeRoomForTunnel() (*lazyConn, error) {
+	if p.MaxTunnels <= 0 || len(p.connMap) < p.MaxTunnels {
+		return nil, nil
+	}
+	if p.TunnelEviction == RejectNewTunnels {
+		return nil, fmt.Errorf("Too many tunnels (%d)", len(p.connMap))
+	}
+	victim := p.lru.Back().Value.(*lazyConn)
+	p.removeLazyConn(victim)
+	// Remember that we evicted the tunnel, so that its client learns that we no
+	// longer have it instead of silently getting a new tunnel
+	p.evictedIDs[victim.id] = true
+	p.evictedOrder = append(p.evictedOrder, victim.id)
+	if len(p.evictedOrder) > p.MaxTunnels {
+		delete(p.evictedIDs, p.evictedOrder[0])
+		p.evictedOrder = p.evictedOrder[1:]
+	}
+	atomic.AddInt64(&p.evictions, 1)
+	return victim, nil
+}
+
+// wasEvicted indicates whether we recently evicted the tunnel with the given
+// id. It must be called with connMapMutex held (for reading at least).
+func (p *Proxy) wasEvicted(id string) bool {
+	return p.evictedIDs[id]
+}
+
+// evict closes a tunnel that was removed from connMap by makeRoomForTunnel.
+// Requests that are still to come for it fail with a 410.
+func (l *lazyConn) evict() {
+	log.Debugf("Evicting tunnel %v to %v", l.id, l.addr)
+	l.drop(errTunnelEvicted)
+}
+
+// respondEvicted tells the client of an evicted tunnel that we no longer have
+// it.
+func respondEvicted(resp http.ResponseWriter, id string) {
+	respond(http.StatusGone, resp, fmt.Sprintf("Tunnel %v was evicted", id))
+}
+
+// Evictions returns the number of tunnels that this Proxy has evicted to make
+// room for new ones (see MaxTunnels).
+func (p *Proxy) Evictions() int64 {
+	return atomic.LoadInt64(&p.evictions)
+}
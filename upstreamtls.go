@@ -0,0 +1,47 @@
+package enproxy
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+var (
+	// upstreamHandshakeTimeout: how long the Proxy waits for the TLS
+	// handshake with a destination server (see Proxy.UpstreamTLS)
+	upstreamHandshakeTimeout = 10 * time.Second
+)
+
+// handshakeTLS establishes TLS on conn, the connection to this tunnel's
+// destination server, using the Proxy's UpstreamTLS.
+func (l *lazyConn) handshakeTLS(conn net.Conn) (*tls.Conn, error) {
+	config := l.p.UpstreamTLS.Clone()
+	config.ServerName = l.upstreamServerName()
+	tlsConn := tls.Client(conn, config)
+	if err := conn.SetDeadline(time.Now().Add(upstreamHandshakeTimeout)); err != nil {
+		log.Debugf("Unable to set handshake deadline: %v", err)
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		log.Debugf("Unable to clear handshake deadline: %v", err)
+	}
+	return tlsConn, nil
+}
+
+// upstreamServerName returns the server name for the TLS handshake with this
+// tunnel's destination server.
+func (l *lazyConn) upstreamServerName() string {
+	if l.serverName != "" {
+		return l.serverName
+	}
+	if l.p.UpstreamTLS.ServerName != "" {
+		return l.p.UpstreamTLS.ServerName
+	}
+	host, _, err := net.SplitHostPort(l.addr)
+	if err != nil {
+		return l.addr
+	}
+	return host
+}
@@ -0,0 +1,438 @@
+package enproxy
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// websocketGUID: the GUID from RFC 6455 used to compute
+	// Sec-WebSocket-Accept
+	websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+
+	// wsMaxControlPayload: control frames can't carry more than this
+	wsMaxControlPayload = 125
+)
+
+var (
+	errWebSocketProtocol = errors.New("WebSocket protocol violation")
+
+	// wsCloseNormal: payload of the close frames we send (status 1000)
+	wsCloseNormal = []byte{0x03, 0xE8}
+)
+
+// webSocket is a minimal RFC 6455 WebSocket that carries a tunnel's data in
+// both directions as a stream of binary frames. Message boundaries have no
+// meaning, so data frames of any type are simply concatenated. Pings are
+// answered and a close frame ends the stream.
+//
+// Reads must not be called concurrently, Writes may be called concurrently
+// with Reads and each other.
+type webSocket struct {
+	net.Conn
+	reader io.Reader
+	// client: whether this is the client end, which masks the frames it
+	// sends
+	client bool
+
+	writeMutex sync.Mutex
+	// closeSent: whether a close frame was sent, after which no more frames
+	// may be sent
+	closeSent bool
+	closeOnce sync.Once
+
+	// State of the data frame being read
+	remaining int64
+	masked    bool
+	mask      [4]byte
+	maskPos   int
+	readErr   error
+}
+
+// newWebSocket creates a webSocket on conn, reading through reader, which
+// must hand off any bytes that were read from conn but not consumed yet.
+func newWebSocket(conn net.Conn, reader io.Reader, client bool) *webSocket {
+	return &webSocket{Conn: conn, reader: reader, client: client}
+}
+
+// websocketAccept returns the Sec-WebSocket-Accept for the given
+// Sec-WebSocket-Key
+func websocketAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func (ws *webSocket) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if err := ws.writeFrame(wsOpBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// writeFrame writes payload as a single frame with the given opcode
+func (ws *webSocket) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 2, 14+len(payload))
+	frame[0] = 0x80 | opcode
+	switch length := len(payload); {
+	case length < 126:
+		frame[1] = byte(length)
+	case length <= 0xFFFF:
+		frame[1] = 126
+		frame = binary.BigEndian.AppendUint16(frame, uint16(length))
+	default:
+		frame[1] = 127
+		frame = binary.BigEndian.AppendUint64(frame, uint64(length))
+	}
+	if ws.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return fmt.Errorf("Unable to generate WebSocket mask: %v", err)
+		}
+		frame[1] |= 0x80
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := range payload {
+			frame[start+i] ^= mask[i%4]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	ws.writeMutex.Lock()
+	defer ws.writeMutex.Unlock()
+	if ws.closeSent {
+		if opcode == wsOpClose {
+			return nil
+		}
+		return net.ErrClosed
+	}
+	ws.closeSent = opcode == wsOpClose
+	_, err := ws.Conn.Write(frame)
+	return err
+}
+
+func (ws *webSocket) Read(b []byte) (int, error) {
+	for ws.remaining == 0 {
+		if ws.readErr != nil {
+			return 0, ws.readErr
+		}
+		ws.readErr = ws.nextFrame()
+	}
+	if int64(len(b)) > ws.remaining {
+		b = b[:ws.remaining]
+	}
+	n, err := ws.reader.Read(b)
+	ws.unmask(b[:n])
+	ws.remaining -= int64(n)
+	if err == io.EOF {
+		// The connection ended in the middle of a frame
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// nextFrame reads the header of the next frame. Control frames are handled
+// right away, for data frames it's up to Read to read the payload. Once the
+// peer closes the WebSocket, nextFrame returns io.EOF.
+func (ws *webSocket) nextFrame() error {
+	var header [8]byte
+	if _, err := io.ReadFull(ws.reader, header[:2]); err != nil {
+		if err == io.EOF {
+			// The peer went away without closing the WebSocket
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	opcode := header[0] & 0x0F
+	ws.masked = header[1]&0x80 != 0
+	length := int64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		if _, err := io.ReadFull(ws.reader, header[:2]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint16(header[:2]))
+	case 127:
+		if _, err := io.ReadFull(ws.reader, header[:8]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint64(header[:8]))
+		if length < 0 {
+			return errWebSocketProtocol
+		}
+	}
+	if ws.masked {
+		if _, err := io.ReadFull(ws.reader, ws.mask[:]); err != nil {
+			return err
+		}
+		ws.maskPos = 0
+	}
+
+	switch opcode {
+	case wsOpContinuation, wsOpText, wsOpBinary:
+		ws.remaining = length
+		return nil
+	case wsOpClose, wsOpPing, wsOpPong:
+		if length > wsMaxControlPayload {
+			return errWebSocketProtocol
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(ws.reader, payload); err != nil {
+			return err
+		}
+		ws.unmask(payload)
+		switch opcode {
+		case wsOpClose:
+			// Acknowledge the close, the peer closes the connection
+			if err := ws.writeFrame(wsOpClose, wsCloseNormal); err != nil {
+				log.Debugf("Unable to acknowledge WebSocket close: %v", err)
+			}
+			return io.EOF
+		case wsOpPing:
+			return ws.writeFrame(wsOpPong, payload)
+		}
+		return nil
+	default:
+		return errWebSocketProtocol
+	}
+}
+
+// unmask unmasks b, the next bytes of the current frame's payload
+func (ws *webSocket) unmask(b []byte) {
+	if !ws.masked {
+		return
+	}
+	for i := range b {
+		b[i] ^= ws.mask[ws.maskPos]
+		ws.maskPos = (ws.maskPos + 1) % 4
+	}
+}
+
+// Close sends a close frame and closes the underlying connection
+func (ws *webSocket) Close() error {
+	var err error
+	ws.closeOnce.Do(func() {
+		if err := ws.writeFrame(wsOpClose, wsCloseNormal); err != nil {
+			log.Debugf("Unable to send WebSocket close: %v", err)
+		}
+		err = ws.Conn.Close()
+	})
+	return err
+}
+
+// upgradeToWebSocket asks the proxy to carry this conn's tunnel over a
+// WebSocket on proxyConn, which also connects to the destination server. If
+// the proxy doesn't switch protocols, it returns the reason. proxyConn can then
+// still be used for polling if it's usable.
+func (c *conn) upgradeToWebSocket(proxyConn *connInfo) (*webSocket, error) {
+	var key [16]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return nil, fmt.Errorf("Unable to generate WebSocket key: %v", err)
+	}
+	encodedKey := base64.StdEncoding.EncodeToString(key[:])
+
+	path := expandPathTemplate(c.getConfig().PathTemplate, c.id, c.addr, OP_WEBSOCKET)
+	req, err := c.newRequestFunc()("", path, "GET", nil)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to construct WebSocket upgrade to %s: %s", c.addr, err)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", encodedKey)
+	setVersionHeaders(req.Header)
+	if c.getConfig().OnRequest != nil {
+		c.getConfig().OnRequest(req)
+	}
+	if err := c.countRequest(OP_WEBSOCKET); err != nil {
+		return nil, err
+	}
+	if err := req.Write(proxyConn.conn); err != nil {
+		proxyConn.markClosed()
+		return nil, fmt.Errorf("Error sending WebSocket upgrade to %s: %w", c.addr, err)
+	}
+	if c.getConfig().ResponseHeaderTimeout > 0 {
+		if err := proxyConn.conn.SetReadDeadline(time.Now().Add(c.getConfig().ResponseHeaderTimeout)); err != nil {
+			c.logger().Debugf("Unable to set read deadline: %v", err)
+		}
+	}
+	resp, err := http.ReadResponse(proxyConn.bufReader, req)
+	if err != nil {
+		proxyConn.markClosed()
+		return nil, fmt.Errorf("Error reading response to WebSocket upgrade: %w", err)
+	}
+	if c.getConfig().ResponseHeaderTimeout > 0 {
+		if err := proxyConn.conn.SetReadDeadline(time.Time{}); err != nil {
+			c.logger().Debugf("Unable to clear read deadline: %v", err)
+		}
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// Leave the connection clean for polling
+		if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+			proxyConn.markClosed()
+		}
+		if err := resp.Body.Close(); err != nil {
+			c.logger().Debugf("Unable to close response body: %v", err)
+		}
+		if resp.Close {
+			proxyConn.markClosed()
+		}
+		return nil, fmt.Errorf("Proxy responded to WebSocket upgrade with %v", resp.Status)
+	}
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") || resp.Header.Get("Sec-WebSocket-Accept") != websocketAccept(encodedKey) {
+		proxyConn.markClosed()
+		return nil, fmt.Errorf("Proxy responded to WebSocket upgrade with invalid handshake")
+	}
+	c.recordProxyVersion(resp.Header)
+
+	return newWebSocket(proxyConn.conn, proxyConn.detach(), true), nil
+}
+
+// handleWebSocket upgrades the client's connection to a WebSocket and pipes
+// data between it and the destination server until either side closes.
+func (p *Proxy) handleWebSocket(resp http.ResponseWriter, req *http.Request, lc *lazyConn, connOut net.Conn) {
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") || key == "" {
+		respond(http.StatusBadRequest, resp, "Request is not a WebSocket upgrade")
+		return
+	}
+	hijacker, ok := resp.(http.Hijacker)
+	if !ok {
+		respond(http.StatusInternalServerError, resp, "Unable to upgrade to WebSocket: connection can't be hijacked")
+		return
+	}
+	p.establish(resp, lc)
+	clientConn, bufrw, err := hijacker.Hijack()
+	if err != nil {
+		log.Errorf("Unable to hijack connection for WebSocket: %v", err)
+		return
+	}
+	// Clear any deadlines set by the http.Server
+	if err := clientConn.SetDeadline(time.Time{}); err != nil {
+		log.Debugf("Unable to clear deadline: %v", err)
+	}
+	_, err = bufrw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n")
+	if err == nil && req.Header.Get(X_ENPROXY_VERSION) != "" {
+		header := make(http.Header)
+		setVersionHeaders(header)
+		err = header.Write(bufrw)
+	}
+	if err == nil {
+		_, err = bufrw.WriteString("\r\n")
+	}
+	if err == nil {
+		err = bufrw.Flush()
+	}
+	if err != nil {
+		log.Errorf("Unable to complete WebSocket upgrade: %v", err)
+		if err := clientConn.Close(); err != nil {
+			log.Debugf("Unable to close connection: %v", err)
+		}
+		return
+	}
+	ws := newWebSocket(clientConn, bufrw.Reader, false)
+	// Previous polls may have left a read deadline
+	if err := connOut.SetReadDeadline(time.Time{}); err != nil {
+		log.Debugf("Unable to clear read deadline: %v", err)
+	}
+
+	clientIp := clientIpFor(req)
+	downstreamDone := make(chan bool)
+	go func() {
+		defer close(downstreamDone)
+		b := make([]byte, p.ReadBufferSize)
+		for {
+			n, readErr := connOut.Read(b)
+			if n > 0 {
+				if clientIp != "" && p.OnBytesSent != nil {
+					p.OnBytesSent(clientIp, lc.addr, req, int64(n))
+				}
+				lc.addBytesDown(int64(n))
+				if _, err := ws.Write(b[:n]); err != nil {
+					log.Debugf("Unable to write to WebSocket: %v", err)
+					break
+				}
+			}
+			if readErr == io.EOF {
+				lc.mutex.Lock()
+				lc.hitEOF = true
+				lc.mutex.Unlock()
+				break
+			} else if readErr != nil {
+				if !errors.Is(readErr, net.ErrClosed) {
+					lc.setFailed()
+					log.Errorf("Unexpected error reading from upstream: %s", readErr)
+				}
+				break
+			}
+		}
+		// Let the client know that the tunnel is done
+		if err := ws.Close(); err != nil {
+			log.Debugf("Unable to close WebSocket: %v", err)
+		}
+	}()
+
+	b := make([]byte, p.ReadBufferSize)
+	for {
+		n, readErr := ws.Read(b)
+		if n > 0 {
+			if _, err := connOut.Write(b[:n]); err != nil {
+				lc.setFailed()
+				log.Errorf("Unable to write to upstream: %v", err)
+				break
+			}
+			lc.addBytesUp(int64(n))
+			if p.OnBytesReceived != nil && clientIp != "" {
+				p.OnBytesReceived(clientIp, lc.addr, req, int64(n))
+			}
+		}
+		if readErr == io.EOF {
+			lc.mutex.Lock()
+			lc.clientClosed = true
+			lc.mutex.Unlock()
+			break
+		} else if readErr != nil {
+			log.Debugf("Unable to read from WebSocket: %v", readErr)
+			break
+		}
+	}
+
+	p.connMapMutex.Lock()
+	p.removeLazyConn(lc)
+	p.connMapMutex.Unlock()
+	if err := connOut.Close(); err != nil {
+		log.Debugf("Unable to close out connection: %v", err)
+	}
+	if err := ws.Close(); err != nil {
+		log.Debugf("Unable to close WebSocket: %v", err)
+	}
+	<-downstreamDone
+	p.tunnelClosed(lc)
+}